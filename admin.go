@@ -0,0 +1,38 @@
+package main
+
+import (
+  "crypto/subtle"
+  "flag"
+  "net/http"
+  "strings"
+)
+
+var adminToken = flag.String("admin-token", "",
+  "bearer token granting access to /admin endpoints (none if empty)")
+
+/* Returns true if `request` carries the admin bearer token. */
+func hasAdminToken(request *http.Request) bool {
+  if *adminToken == "" { return false }
+
+  authorization := request.Header.Get("Authorization")
+  token := strings.TrimPrefix(authorization, "Bearer ")
+
+  return token != authorization &&
+    subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+/* Returns true if `request` may use admin endpoints, either by carrying the
+ * admin bearer token or an API key with the admin role. Otherwise, writes an
+ * error to `writer` and returns false. */
+func requireAdmin(writer http.ResponseWriter, request *http.Request) bool {
+  return requireRole(writer, request, ROLE_ADMIN)
+}
+
+/* Returns true if `request` may use admin endpoints, like requireAdmin, but
+ * without writing an error. */
+func isAdmin(request *http.Request) bool {
+  if hasAdminToken(request) { return true }
+
+  registeredKey, ok := apiKeys[requestAPIKey(request)]
+  return ok && registeredKey.hasRole(ROLE_ADMIN)
+}
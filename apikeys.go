@@ -0,0 +1,141 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "io/ioutil"
+  "net/http"
+)
+
+var apiKeysPath = flag.String("api-keys", "",
+  "JSON file mapping API keys to the tenants that own them")
+
+// tenant names for requests without a key and with an unregistered key
+const (
+  TENANT_ANONYMOUS = "anonymous"
+  TENANT_UNKNOWN = "unknown"
+)
+
+// roles an API key may hold; admin implies every other role
+const (
+  ROLE_CONVERT = "convert"
+  ROLE_READ_STATUS = "read-status"
+  ROLE_ADMIN = "admin"
+  ROLE_WORKER = "worker"
+)
+
+/* A registered API key. The key itself is secret; its name is safe to log
+ * and to use as a metrics label. `Roles` lists what the key may do, and
+ * `Weight` is the tenant's initial share of each stage's slots. */
+type apiKey struct {
+  Name string `json:"name"`
+  Roles []string `json:"roles"`
+  Weight float64 `json:"weight,omitempty"`
+}
+
+// registered API keys, keyed by the secret key
+var apiKeys = map[string]apiKey{}
+
+/* Loads the API keys in the JSON file at `path`, which maps each key to an
+ * object with the owning tenant's `name` and its `roles`. */
+func loadAPIKeys(path string) (map[string]apiKey, error) {
+  keys := map[string]apiKey{}
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+
+  err = json.Unmarshal(data, &keys)
+  if err != nil { return nil, err }
+
+  for _, key := range keys {
+    if key.Weight < 0 {
+      return nil, errors.New("Negative weight for API key '" + key.Name +
+        "'.\n")
+    }
+
+    for _, role := range key.Roles {
+      if role != ROLE_CONVERT && role != ROLE_READ_STATUS &&
+          role != ROLE_ADMIN && role != ROLE_WORKER {
+        return nil, errors.New("Unknown role '" + role + "' for API key '" +
+          key.Name + "'.\n")
+      }
+    }
+  }
+
+  return keys, nil
+}
+
+/* Returns true if `key` holds `role`, directly or by being an admin. */
+func (key apiKey) hasRole(role string) bool {
+  for _, keyRole := range key.Roles {
+    if keyRole == role || keyRole == ROLE_ADMIN { return true }
+  }
+  return false
+}
+
+/* Returns the API key accompanying `request`, from the X-API-Key header or,
+ * for browsers, the password of HTTP Basic authentication. */
+func requestAPIKey(request *http.Request) string {
+  key := request.Header.Get("X-API-Key")
+  if key != "" { return key }
+
+  _, password, ok := request.BasicAuth()
+  if ok { return password }
+  return ""
+}
+
+/* Returns true if `request` may act with `role`. Otherwise, writes an error
+ * to `writer` and returns false.
+ *
+ * Once API keys are configured, every request must carry a registered key
+ * holding the role. Without configured keys, conversions and status are
+ * open to all. In both cases, the admin role is also granted by the
+ * -admin-token bearer token. */
+func requireRole(writer http.ResponseWriter, request *http.Request,
+    role string) bool {
+  if role == ROLE_ADMIN && hasAdminToken(request) { return true }
+
+  if len(apiKeys) == 0 && role != ROLE_ADMIN { return true }
+
+  // browsers send Basic credentials along with cross-site form posts, so
+  // those must also carry a header that only scripts on our page can set
+  _, _, isBasic := request.BasicAuth()
+  if isBasic && request.Header.Get("X-API-Key") == "" &&
+      request.Method != "GET" && request.Method != "HEAD" &&
+      request.Header.Get("X-Requested-With") == "" {
+    http.Error(writer, "Browser requests must set X-Requested-With.\n",
+      http.StatusForbidden)
+    return false
+  }
+
+  registeredKey, ok := apiKeys[requestAPIKey(request)]
+
+  if !ok {
+    // lets browsers prompt for a key, sent as the Basic password
+    writer.Header().Set("WWW-Authenticate", "Basic realm=\"evangelist\"")
+    http.Error(writer, "Must specify a valid API key in the X-API-Key " +
+      "header.\n", http.StatusUnauthorized)
+    return false
+  }
+
+  if !registeredKey.hasRole(role) {
+    http.Error(writer, "This API key lacks the '" + role + "' role.\n",
+      http.StatusForbidden)
+    return false
+  }
+
+  return true
+}
+
+/* Returns the name of the tenant whose API key accompanies `request`. Since
+ * tenant names label metrics, the result is always a registered name,
+ * TENANT_ANONYMOUS, or TENANT_UNKNOWN. */
+func tenantName(request *http.Request) string {
+  key := requestAPIKey(request)
+  if key == "" { return TENANT_ANONYMOUS }
+
+  registeredKey, ok := apiKeys[key]
+  if !ok { return TENANT_UNKNOWN }
+  return registeredKey.Name
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "net/http"
+  "net/url"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var asyncWorkers = flag.Int("async-workers", 4,
+  "number of asynchronous conversions run at once")
+
+// most asynchronous conversions that may be waiting at once
+const MAX_QUEUED_ASYNC_JOBS = 1000
+
+/* An asynchronous conversion, tracked as `job`. `request` and `startTime`
+ * describe the original request for the audit log. */
+type asyncTask struct {
+  job *job
+  bucket *s3.Bucket
+  params conversionParams
+  request *http.Request
+  startTime time.Time
+}
+
+// asynchronous conversions waiting for a worker
+var asyncQueue = make(chan asyncTask, MAX_QUEUED_ASYNC_JOBS)
+
+/* Returns true if the `async` key of `form` asks for an asynchronous
+ * conversion. */
+func parseAsync(form url.Values) (bool, error) {
+  async, err := optionalFormValue(form, "async")
+  if err != nil { return false, err }
+
+  if async != "" && async != "true" && async != "false" {
+    return false, errors.New("The 'async' key must be 'true' or 'false'.\n")
+  }
+  return async == "true", nil
+}
+
+/* Queues `task` for a worker, or returns an error if the queue is full. */
+func queueAsyncJob(task asyncTask) error {
+  task.job.setConversion(task.bucket, task.params)
+  select {
+  case asyncQueue <- task:
+    prefetches.add(task.job, task.bucket, task.params)
+    spoolAsyncJob(task)
+    return nil
+  default:
+    return errors.New("Too many conversions are queued; try again later.\n")
+  }
+}
+
+/* Runs queued asynchronous conversions one at a time, retrying those that
+ * fail transiently. Several of these run at once. None are started while
+ * the server is in maintenance mode. */
+func processAsyncJobs() {
+  for task := range asyncQueue {
+    maintenance.wait()
+
+    // once shutting down, queued conversions are failed, not started; any
+    // spooled copy is left for the next run
+    if !backgroundWork.start() {
+      task.job.finish(errShuttingDown)
+      continue
+    }
+
+    numPages, err := runConversion(task.job, task.bucket, task.params)
+
+    retryTask := task
+    if scheduleRetry(task.job, err, func() { asyncQueue <- retryTask }) {
+      backgroundWork.end()
+      continue
+    }
+
+    task.job.finish(err)
+    unspoolAsyncJob(task.job.id)
+    sendCallback(task.params.CallbackURL, task.job)
+    recordInDataLake(task.job, task.params)
+    cleanupScratch(task.job.id)
+    auditConversion(task.request, task.job.id, numPages, task.startTime, err)
+    backgroundWork.end()
+
+    if err != nil {
+      task.job.logger().Error("Conversion failed", errorAttr(err))
+    } else {
+      task.job.logger().Info("Conversion finished", "pages", numPages)
+    }
+  }
+}
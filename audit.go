@@ -0,0 +1,249 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var auditLogPath = flag.String("audit-log", "",
+  "append a JSON line per conversion to this file (disabled if empty)")
+var auditLogMaxBytes = flag.Int64("audit-log-max-bytes", 100 * 1024 * 1024,
+  "rotate the audit log once it grows beyond this many bytes")
+var auditLogMaxFiles = flag.Int("audit-log-max-files", 10,
+  "number of rotated audit logs to keep locally")
+var auditLogS3Prefix = flag.String("audit-log-s3-prefix", "",
+  "if set, ship rotated audit logs to S3 under this prefix")
+
+// the server's audit log; nil if auditing is disabled
+var audit *auditLog = nil
+
+/* A single entry in the audit log. One is written for every conversion,
+ * whether it succeeded or not, and for every other `Action`, like a change
+ * of configuration. */
+type auditRecord struct {
+  Time string `json:"time"`
+  Action string `json:"action,omitempty"`
+  JobID string `json:"jobId"`
+  RequestID string `json:"requestId"`
+  Tenant string `json:"tenant"`
+  Client string `json:"client"`
+  Scheme string `json:"scheme"`
+  ClientCertificate string `json:"clientCertificate,omitempty"`
+  Source string `json:"source"`
+  Outputs []string `json:"outputs"`
+  Parameters map[string][]string `json:"parameters"`
+  NumPages int `json:"numPages"`
+  DurationMS int64 `json:"durationMs"`
+  Result string `json:"result"`
+  Error string `json:"error,omitempty"`
+}
+
+/* An append-only, size-rotated log of JSON audit records. Rotated files are
+ * named `path`.1 (newest) through `path`.N (oldest). If `bucket` is non-nil,
+ * rotated files are instead uploaded to S3 under `s3Prefix` and removed
+ * locally. */
+type auditLog struct {
+  mutex sync.Mutex
+  path string
+  maxBytes int64
+  maxFiles int
+  bucket *s3.Bucket
+  s3Prefix string
+  file *os.File
+  size int64
+}
+
+/* Opens (or creates) the audit log at `path` for appending. */
+func openAuditLog(path string, maxBytes int64, maxFiles int,
+    bucket *s3.Bucket, s3Prefix string) (*auditLog, error) {
+  log := &auditLog{path: path, maxBytes: maxBytes, maxFiles: maxFiles,
+    bucket: bucket, s3Prefix: s3Prefix}
+
+  err := log.open()
+  if err != nil { return nil, err }
+  return log, nil
+}
+
+/* Opens the file at `log.path` for appending, recording its current size. */
+func (log *auditLog) open() error {
+  file, err := os.OpenFile(log.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE,
+    0600)
+  if err != nil { return err }
+
+  fileInfo, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return err
+  }
+
+  log.file = file
+  log.size = fileInfo.Size()
+  return nil
+}
+
+/* Appends `record` to the log, rotating first if the log is too large. */
+func (log *auditLog) write(record auditRecord) error {
+  line, err := json.Marshal(record)
+  if err != nil { return err }
+  line = append(line, '\n')
+
+  log.mutex.Lock()
+  defer log.mutex.Unlock()
+
+  if log.size > 0 && log.size + int64(len(line)) > log.maxBytes {
+    err = log.rotate()
+    if err != nil { return err }
+  }
+
+  numBytes, err := log.file.Write(line)
+  log.size += int64(numBytes)
+  return err
+}
+
+/* Closes the current log file, shifts older files down by one, and starts a
+ * fresh log. Must be called with `log.mutex` held. */
+func (log *auditLog) rotate() error {
+  err := log.file.Close()
+  if err != nil { return err }
+
+  if log.bucket != nil {
+    // ship the full log to S3 rather than keeping it on local disk
+    err = log.upload()
+    if err != nil { return err }
+    return log.open()
+  }
+
+  // drop the oldest file and shift the rest: path.N-1 -> path.N, etc.
+  os.Remove(fmt.Sprintf("%s.%d", log.path, log.maxFiles))
+  for i := log.maxFiles - 1; i >= 1; i = i - 1 {
+    os.Rename(fmt.Sprintf("%s.%d", log.path, i),
+      fmt.Sprintf("%s.%d", log.path, i + 1))
+  }
+
+  if log.maxFiles > 0 {
+    err = os.Rename(log.path, log.path + ".1")
+  } else {
+    err = os.Remove(log.path)
+  }
+
+  if err != nil { return err }
+  return log.open()
+}
+
+/* Uploads the closed log file at `log.path` to S3 under a timestamped key,
+ * then removes it locally. */
+func (log *auditLog) upload() error {
+  file, err := os.Open(log.path)
+  if err != nil { return err }
+  defer file.Close()
+
+  fileInfo, err := file.Stat()
+  if err != nil { return err }
+
+  remotePath := fmt.Sprintf("%s%s.%s", log.s3Prefix, filepath.Base(log.path),
+    time.Now().UTC().Format("20060102T150405Z"))
+  contentType, err := detectFileContentType(file, remotePath)
+  if err != nil { return err }
+
+  err = log.bucket.PutReader(remotePath, file, fileInfo.Size(), contentType,
+    s3.Private)
+  if err != nil { return err }
+
+  return os.Remove(log.path)
+}
+
+// form keys whose values must never reach the audit log
+var SECRET_FORM_KEYS = []string{"sourceKey"}
+
+/* Returns a copy of `form` with the values of secret keys redacted. */
+func redactSecrets(form map[string][]string) map[string][]string {
+  redacted := map[string][]string{}
+  for key, values := range form {
+    redacted[key] = values
+  }
+
+  for _, key := range SECRET_FORM_KEYS {
+    if _, ok := redacted[key]; ok {
+      redacted[key] = []string{"[redacted]"}
+    }
+  }
+  return redacted
+}
+
+/* Records the outcome of the conversion described by `request` in the audit
+ * log. Does nothing if auditing is disabled. */
+func auditConversion(request *http.Request, jobID string, numPages int,
+    startTime time.Time, err error) {
+  if audit == nil { return }
+
+  record := auditRecord{
+    Time: startTime.UTC().Format(time.RFC3339),
+    JobID: jobID,
+    RequestID: requestID(request),
+    Tenant: tenantName(request),
+    Client: clientIP(request),
+    Scheme: clientScheme(request),
+    ClientCertificate: clientCertificateName(request),
+    Source: requestSource(request),
+    Outputs: []string{request.Form.Get("s3JPEGPath"),
+      request.Form.Get("s3SmallJPEGPath"), request.Form.Get("s3LargeJPEGPath")},
+    Parameters: redactSecrets(request.Form),
+    NumPages: numPages,
+    DurationMS: int64(time.Since(startTime) / time.Millisecond),
+    Result: "success",
+  }
+
+  if err != nil {
+    record.Result = "failure"
+    record.Error = err.Error()
+  }
+
+  writeErr := audit.write(record)
+  if writeErr != nil {
+    logger.Error("Couldn't write audit record", "job", jobID,
+      errorAttr(writeErr))
+  }
+}
+
+/* Writes an audit record of an attempt by `request` to change settings
+ * through /admin/config, which failed if `err` is non-nil. */
+func auditConfigChange(request *http.Request, err error) {
+  auditAdminChange(request, "config", err)
+}
+
+/* Writes an audit record of an attempt by `request` to make the admin
+ * change `action`, which failed if `err` is non-nil. */
+func auditAdminChange(request *http.Request, action string, err error) {
+  if audit == nil { return }
+
+  record := auditRecord{
+    Time: time.Now().UTC().Format(time.RFC3339),
+    Action: action,
+    RequestID: requestID(request),
+    Tenant: tenantName(request),
+    Client: clientIP(request),
+    Scheme: clientScheme(request),
+    ClientCertificate: clientCertificateName(request),
+    Outputs: []string{},
+    Parameters: request.PostForm,
+    Result: "success",
+  }
+
+  if err != nil {
+    record.Result = "failure"
+    record.Error = err.Error()
+  }
+
+  writeErr := audit.write(record)
+  if writeErr != nil {
+    logger.Error("Couldn't write audit record", "request", requestID(request),
+      errorAttr(writeErr))
+  }
+}
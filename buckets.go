@@ -0,0 +1,97 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "net/url"
+  "strings"
+  "launchpad.net/goamz/aws"
+  "launchpad.net/goamz/s3"
+)
+
+var allowedBucketsFlag = flag.String("allowed-buckets", "",
+  "comma-separated bucket:region pairs requests may convert in with " +
+  "'s3Bucket' and 's3Region', besides the server's own bucket")
+
+// buckets requests may choose, including the server's own, mapped to their
+// regions
+var allowedBuckets = map[string]string{}
+
+/* Parses -allowed-buckets, adding the server's own bucket `bucketName` in
+ * `regionName`. */
+func setupAllowedBuckets(bucketName string, regionName string) error {
+  allowedBuckets[bucketName] = regionName
+  if *allowedBucketsFlag == "" { return nil }
+
+  for _, pair := range strings.Split(*allowedBucketsFlag, ",") {
+    fields := strings.Split(strings.TrimSpace(pair), ":")
+    if len(fields) != 2 || fields[0] == "" {
+      return errors.New("-allowed-buckets must list bucket:region pairs.\n")
+    }
+
+    if _, ok := aws.Regions[fields[1]]; !ok {
+      return errors.New(fmt.Sprintf("Unknown region '%s' in " +
+        "-allowed-buckets.\n", fields[1]))
+    }
+    allowedBuckets[fields[0]] = fields[1]
+  }
+  return nil
+}
+
+/* Parses the optional `s3Bucket` and `s3Region` keys of `form` into
+ * `params`, to convert in a bucket other than the server's own. The bucket
+ * must be allowed by -allowed-buckets, which also gives its region, so
+ * `s3Region` is only checked against it. */
+func parseBucketParams(form url.Values, params *conversionParams) error {
+  bucketName, err := optionalFormValue(form, "s3Bucket")
+  if err != nil { return err }
+
+  regionName, err := optionalFormValue(form, "s3Region")
+  if err != nil { return err }
+
+  if bucketName == "" {
+    if regionName != "" {
+      return errors.New("The 's3Region' key requires 's3Bucket'.\n")
+    }
+    return nil
+  }
+
+  allowedRegion, ok := allowedBuckets[bucketName]
+  if !ok {
+    return errors.New(fmt.Sprintf("The bucket '%s' isn't allowed.\n",
+      bucketName))
+  }
+
+  if regionName != "" && regionName != allowedRegion {
+    return errors.New(fmt.Sprintf("The bucket '%s' is in '%s', not " +
+      "'%s'.\n", bucketName, allowedRegion, regionName))
+  }
+
+  params.S3Bucket = bucketName
+  params.S3Region = allowedRegion
+  return nil
+}
+
+/* Returns an S3 connection to the bucket `params` convert in: the one they
+ * chose, or the server's own `bucketName` in `regionName`. */
+func connectToParamsBucket(params conversionParams, bucketName string,
+    regionName string) (*s3.Bucket, error) {
+  if params.S3Bucket != "" {
+    bucketName = params.S3Bucket
+    regionName = params.S3Region
+  }
+  return connectToS3(bucketName, aws.Regions[regionName])
+}
+
+/* Returns an S3 connection to the bucket chosen in the `s3Bucket` and
+ * `s3Region` keys of `form`, or the server's own `bucketName` in
+ * `regionName`. */
+func connectToRequestBucket(form url.Values, bucketName string,
+    regionName string) (*s3.Bucket, error) {
+  params := conversionParams{}
+  err := parseBucketParams(form, &params)
+  if err != nil { return nil, err }
+
+  return connectToParamsBucket(params, bucketName, regionName)
+}
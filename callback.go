@@ -0,0 +1,136 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var callbackSecret = flag.String("callback-secret", "",
+  "secret used to sign completion callbacks with HMAC-SHA256 (callbacks " +
+  "are refused if empty)")
+var callbackHosts = flag.String("callback-hosts", "",
+  "comma-separated hosts callbacks may be sent to (any if empty)")
+
+// how many times, and how patiently, we try to deliver a callback
+const (
+  CALLBACK_ATTEMPTS = 5
+  CALLBACK_TIMEOUT = 10 * time.Second
+  CALLBACK_FIRST_RETRY_DELAY = time.Second
+)
+
+// redirects aren't followed, since only the first URL's host is checked
+// against -callback-hosts; a redirect is just an unsuccessful response
+var callbackClient = &http.Client{Timeout: CALLBACK_TIMEOUT,
+  CheckRedirect: func(request *http.Request, via []*http.Request) error {
+    return http.ErrUseLastResponse
+  }}
+
+/* Returns the URL in the `callbackURL` key of `form`, or "" if absent. It
+ * must be an absolute http or https URL on a host allowed by
+ * -callback-hosts, and -callback-secret must be set to sign callbacks. */
+func parseCallbackURL(form url.Values) (string, error) {
+  callbackURL, err := optionalFormValue(form, "callbackURL")
+  if err != nil || callbackURL == "" { return "", err }
+
+  // endpoints couldn't tell our callbacks from forgeries otherwise
+  if *callbackSecret == "" {
+    return "", errors.New("Callbacks aren't enabled on this server; it " +
+      "must be started with -callback-secret.\n")
+  }
+
+  parsedURL, err := url.Parse(callbackURL)
+  if err != nil || (parsedURL.Scheme != "http" &&
+      parsedURL.Scheme != "https") || parsedURL.Host == "" {
+    return "", errors.New("The 'callbackURL' key must be an http or https " +
+      "URL.\n")
+  }
+
+  if *callbackHosts == "" { return callbackURL, nil }
+
+  for _, host := range strings.Split(*callbackHosts, ",") {
+    if strings.TrimSpace(host) == parsedURL.Hostname() {
+      return callbackURL, nil
+    }
+  }
+  return "", errors.New("Callbacks to " + parsedURL.Hostname() +
+    " aren't allowed.\n")
+}
+
+/* Returns the signature of a callback sent at `timestamp` with `body`: the
+ * hex HMAC-SHA256 of "{timestamp}.{body}" under -callback-secret. */
+func signCallback(timestamp string, body []byte) string {
+  mac := hmac.New(sha256.New, []byte(*callbackSecret))
+  mac.Write([]byte(timestamp + "."))
+  mac.Write(body)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* POSTs `body` to `callbackURL` once, returning an error unless the
+ * endpoint responds with a 2xx status. `requestID` is passed along in the
+ * X-Request-ID header. */
+func postCallback(callbackURL string, body []byte, requestID string) error {
+  request, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+  if err != nil { return err }
+
+  timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+  request.Header.Set("Content-Type", "application/json")
+  request.Header.Set(TIMESTAMP_HEADER, timestamp)
+  if requestID != "" {
+    request.Header.Set(REQUEST_ID_HEADER, requestID)
+  }
+  request.Header.Set(SIGNATURE_HEADER,
+    "sha256=" + signCallback(timestamp, body))
+
+  response, err := callbackClient.Do(request)
+  if err != nil { return err }
+  response.Body.Close()
+
+  if response.StatusCode < 200 || response.StatusCode >= 300 {
+    return errors.New(fmt.Sprintf("callback responded %d",
+      response.StatusCode))
+  }
+  return nil
+}
+
+/* Notifies `callbackURL`, if any, that `job` has finished by POSTing its
+ * final status as JSON, in the background. Delivery is retried with
+ * exponential backoff. */
+func sendCallback(callbackURL string, job *job) {
+  if callbackURL == "" { return }
+
+  // e.g. a spooled conversion restored by a server without the secret
+  if *callbackSecret == "" {
+    job.logger().Warn("Dropped unsigned callback; -callback-secret is unset")
+    return
+  }
+
+  body, err := json.Marshal(job.status())
+  if err != nil {
+    job.logger().Error("Couldn't encode callback", errorAttr(err))
+    return
+  }
+
+  go func() {
+    delay := CALLBACK_FIRST_RETRY_DELAY
+    for attempt := 1; attempt <= CALLBACK_ATTEMPTS; attempt = attempt + 1 {
+      err := postCallback(callbackURL, body, job.requestID)
+      if err == nil { return }
+
+      job.logger().Warn("Callback failed", "url", callbackURL,
+        "attempt", attempt, errorAttr(err))
+      time.Sleep(delay)
+      delay *= 2
+    }
+  }()
+}
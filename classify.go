@@ -0,0 +1,179 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var classifyURL = flag.String("classify-url", "",
+  "inference endpoint each page is POSTed to when a request passes " +
+  "classify=true (disabled if empty)")
+var classifyPayload = flag.String("classify-payload", CLASSIFY_KEY,
+  "what's POSTed to the inference endpoint: key (the page's S3 key, as " +
+  "JSON) or image (the page's JPEG)")
+var classifyTimeout = flag.Duration("classify-timeout", 30 * time.Second,
+  "how long to wait for the inference endpoint to label a page")
+
+// what can be sent to the inference endpoint
+const (
+  CLASSIFY_KEY = "key"
+  CLASSIFY_IMAGE = "image"
+)
+
+// most bytes of an inference endpoint's response we read
+const MAX_CLASSIFY_RESPONSE_BYTES = 64 * 1024
+
+/* What's POSTed to the inference endpoint with -classify-payload key. */
+type classifyRequest struct {
+  JobID string `json:"jobId"`
+  RequestID string `json:"requestId,omitempty"`
+  PageNum int `json:"pageNum"`
+  Bucket string `json:"bucket"`
+  Key string `json:"key"`
+}
+
+/* What the inference endpoint responds with. */
+type classifyResponse struct {
+  Labels []string `json:"labels"`
+}
+
+/* Returns an error if -classify-payload is invalid. */
+func validateClassifyPayload() error {
+  if *classifyPayload != CLASSIFY_KEY && *classifyPayload != CLASSIFY_IMAGE {
+    return errors.New("-classify-payload must be key or image.\n")
+  }
+  return nil
+}
+
+/* Returns whether the `classify` key of `form` asks for each page to be
+ * labeled by the inference endpoint. Encrypted renditions can't be, since
+ * the endpoint would need the plaintext. */
+func parseClassify(form url.Values, params conversionParams) (bool, error) {
+  classify, err := optionalFormValue(form, "classify")
+  if err != nil { return false, err }
+
+  if classify != "" && classify != "true" && classify != "false" {
+    return false, errors.New("The 'classify' key must be 'true' or " +
+      "'false'.\n")
+  }
+  if classify != "true" { return false, nil }
+
+  if *classifyURL == "" {
+    return false, errors.New("Classification isn't enabled on this " +
+      "server.\n")
+  }
+  if params.OutputPublicKey != "" {
+    return false, errors.New("Encrypted output can't be classified.\n")
+  }
+  return true, nil
+}
+
+/* POSTs `body`, of type `contentType`, to the inference endpoint on behalf
+ * of `job`, returning the labels it responds with. */
+func postClassification(job *job, pageNum int, body []byte,
+    contentType string) ([]string, error) {
+  request, err := http.NewRequest("POST", *classifyURL,
+    bytes.NewReader(body))
+  if err != nil { return nil, err }
+
+  request.Header.Set("Content-Type", contentType)
+  request.Header.Set("X-Evangelist-Job-ID", job.id)
+  request.Header.Set("X-Evangelist-Page", strconv.Itoa(pageNum))
+  if job.requestID != "" {
+    request.Header.Set(REQUEST_ID_HEADER, job.requestID)
+  }
+
+  client := &http.Client{Timeout: *classifyTimeout}
+  response, err := client.Do(request)
+  if err != nil { return nil, err }
+  defer response.Body.Close()
+
+  if response.StatusCode < 200 || response.StatusCode >= 300 {
+    return nil, errors.New(fmt.Sprintf("inference endpoint responded %d",
+      response.StatusCode))
+  }
+
+  responseBody, err := ioutil.ReadAll(io.LimitReader(response.Body,
+    MAX_CLASSIFY_RESPONSE_BYTES))
+  if err != nil { return nil, err }
+
+  decoded := classifyResponse{}
+  err = json.Unmarshal(responseBody, &decoded)
+  if err != nil { return nil, err }
+
+  if decoded.Labels == nil {
+    return []string{}, nil
+  }
+  return decoded.Labels, nil
+}
+
+/* Has the inference endpoint label page `pageNum`, whose normal JPEG is
+ * saved locally at `jpegPath` and uploaded to `bucket`, and records the
+ * labels in `job`, if `params` asks for classification. Classification is
+ * advisory: failures are logged and leave the page unlabeled rather than
+ * failing the conversion. */
+func classifyPage(job *job, bucket *s3.Bucket, params conversionParams,
+    jpegPath string, pageNum int) {
+  // re-renders may outlive the endpoint their original request used
+  if !params.Classify || *classifyURL == "" { return }
+
+  var body []byte
+  var err error
+  contentType := "application/json"
+  if *classifyPayload == CLASSIFY_IMAGE {
+    contentType = "image/jpeg"
+    body, err = ioutil.ReadFile(fmt.Sprintf(jpegPath, pageNum))
+  } else {
+    body, err = json.Marshal(classifyRequest{
+      JobID: job.id,
+      RequestID: job.requestID,
+      PageNum: pageNum,
+      Bucket: bucket.Name,
+      Key: fmt.Sprintf(params.S3JPEGPath, pageNum),
+    })
+  }
+
+  if err == nil {
+    var labels []string
+    labels, err = postClassification(job, pageNum, body, contentType)
+    if err == nil {
+      job.setPageLabels(pageNum, labels)
+      return
+    }
+  }
+
+  job.logger().Warn("Couldn't classify page", "page", pageNum,
+    errorAttr(err))
+  job.recordEvent("page unclassified", pageNum, err.Error())
+}
+
+/* Records the labels the inference endpoint gave page `pageNum`. */
+func (job *job) setPageLabels(pageNum int, labels []string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.pageLabels[pageNum] = labels
+}
+
+/* Returns the labels of each classified page, or nil if none were. */
+func (job *job) labelsByPage() map[int][]string {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  if len(job.pageLabels) == 0 { return nil }
+
+  labels := map[int][]string{}
+  for pageNum, pageLabels := range job.pageLabels {
+    labels[pageNum] = pageLabels
+  }
+  return labels
+}
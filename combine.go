@@ -0,0 +1,413 @@
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// most images that can be combined into one PDF
+const MAX_COMBINED_IMAGES = 1000
+
+// widest margin around each image, in points (two inches)
+const MAX_COMBINE_MARGIN = 144
+
+// page size that fits each image at the `density` it was scanned at
+const PAGE_SIZE_FIT = "fit"
+
+// page sizes images can be combined onto, in portrait, in points
+var COMBINE_PAGE_SIZES = map[string][2]float64{
+  "letter": {612, 792},
+  "legal": {612, 1008},
+  "a4": {595.28, 841.89},
+  "a3": {841.89, 1190.55},
+}
+
+/* A POST to /combine: the images in S3 to combine, in order, and how to lay
+ * them out. `params` holds the bucket, source encryption, and upload
+ * options, which apply to every image and the PDF. */
+type combineOptions struct {
+  params conversionParams
+  imagePaths []string
+  combinedPath string
+  pageSize string
+  margin int
+  density int
+}
+
+/* Response of POST /combine. */
+type combineResponse struct {
+  JobID string `json:"jobId"`
+  Key string `json:"key"`
+  NumPages int `json:"numPages"`
+  Images []string `json:"images"`
+}
+
+/* Where an image goes on its page: the page's size, and the lower left
+ * corner and size of the image on it, all in points. */
+type imagePlacement struct {
+  pageWidth float64
+  pageHeight float64
+  x float64
+  y float64
+  width float64
+  height float64
+}
+
+/* Returns the keys of the images to combine in `form`: either every
+ * `s3ImagePath` key, in order, or `s3ImagePathTemplate` with '%d' replaced
+ * by each number from 1 to `numImages`. */
+func parseImagePaths(form url.Values) ([]string, error) {
+  template, err := optionalFormValue(form, "s3ImagePathTemplate")
+  if err != nil { return nil, err }
+
+  numImages, err := optionalBoundedInt(form, "numImages", 1,
+    MAX_COMBINED_IMAGES)
+  if err != nil { return nil, err }
+
+  if template == "" {
+    if numImages != 0 {
+      return nil, errors.New("The 'numImages' key requires " +
+        "'s3ImagePathTemplate'.\n")
+    }
+
+    imagePaths := form["s3ImagePath"]
+    if len(imagePaths) == 0 || len(imagePaths) > MAX_COMBINED_IMAGES {
+      return nil, errors.New(fmt.Sprintf("Must specify 1 to %d images in " +
+        "'s3ImagePath' keys, or a template in 's3ImagePathTemplate'.\n",
+        MAX_COMBINED_IMAGES))
+    }
+    for _, imagePath := range imagePaths {
+      if imagePath == "" {
+        return nil, errors.New("The 's3ImagePath' keys can't be empty.\n")
+      }
+    }
+    return imagePaths, nil
+  }
+
+  if len(form["s3ImagePath"]) > 0 {
+    return nil, errors.New("The 's3ImagePath' and 's3ImagePathTemplate' " +
+      "keys can't be combined.\n")
+  }
+  if !strings.Contains(template, "%d") || numImages == 0 {
+    return nil, errors.New("The 's3ImagePathTemplate' key must contain %d, " +
+      "and requires 'numImages'.\n")
+  }
+
+  imagePaths := []string{}
+  for i := 1; i <= numImages; i = i + 1 {
+    imagePaths = append(imagePaths, fmt.Sprintf(template, i))
+  }
+  return imagePaths, nil
+}
+
+/* Parses a POST to /combine: the images in `s3ImagePath` keys or
+ * `s3ImagePathTemplate`, the output path in `s3CombinedPath`, the layout in
+ * `pageSize`, `margin`, and `density`, and the optional bucket, source
+ * encryption, and upload option keys a conversion takes. */
+func parseCombineParams(form url.Values) (combineOptions, error) {
+  options := combineOptions{}
+
+  err := parseBucketParams(form, &options.params)
+  if err != nil { return options, err }
+
+  err = parseSourceEncryptionParams(form, &options.params)
+  if err != nil { return options, err }
+
+  err = parseUploadOptions(form, &options.params)
+  if err != nil { return options, err }
+
+  options.imagePaths, err = parseImagePaths(form)
+  if err != nil { return options, err }
+
+  options.combinedPath, err = requireFormValue(form, "s3CombinedPath",
+    "a PDF path")
+  if err != nil { return options, err }
+
+  options.pageSize, err = optionalFormValue(form, "pageSize")
+  if err != nil { return options, err }
+  if options.pageSize == "" { options.pageSize = PAGE_SIZE_FIT }
+
+  _, ok := COMBINE_PAGE_SIZES[options.pageSize]
+  if !ok && options.pageSize != PAGE_SIZE_FIT {
+    return options, errors.New("The 'pageSize' key must be 'fit', " +
+      "'letter', 'legal', 'a4', or 'a3'.\n")
+  }
+
+  options.margin, err = optionalBoundedInt(form, "margin", 0,
+    MAX_COMBINE_MARGIN)
+  if err != nil { return options, err }
+
+  options.density, err = optionalBoundedInt(form, "density", MIN_DENSITY,
+    MAX_DENSITY)
+  if err != nil { return options, err }
+  if options.density == 0 { options.density = DEFAULT_DENSITY }
+  return options, nil
+}
+
+/* Returns where `pageImage` goes on its page with `options`. On "fit" pages,
+ * it's shown at its size at `density`, surrounded by the margin. On pages
+ * of a fixed size, which are turned to landscape for landscape images, it's
+ * scaled to fill the space within the margins and centered. */
+func placeImage(pageImage pdfImage,
+    options combineOptions) imagePlacement {
+  margin := float64(options.margin)
+  width := float64(pageImage.width) * PDF_POINTS_PER_INCH /
+    float64(options.density)
+  height := float64(pageImage.height) * PDF_POINTS_PER_INCH /
+    float64(options.density)
+
+  if options.pageSize == PAGE_SIZE_FIT {
+    return imagePlacement{pageWidth: width + 2 * margin,
+      pageHeight: height + 2 * margin, x: margin, y: margin, width: width,
+      height: height}
+  }
+
+  size := COMBINE_PAGE_SIZES[options.pageSize]
+  pageWidth, pageHeight := size[0], size[1]
+  if pageImage.width > pageImage.height {
+    pageWidth, pageHeight = pageHeight, pageWidth
+  }
+
+  scale := (pageWidth - 2 * margin) / width
+  if heightScale := (pageHeight - 2 * margin) / height; heightScale < scale {
+    scale = heightScale
+  }
+  width, height = width * scale, height * scale
+  return imagePlacement{pageWidth: pageWidth, pageHeight: pageHeight,
+    x: (pageWidth - width) / 2, y: (pageHeight - height) / 2, width: width,
+    height: height}
+}
+
+/* Returns the JPEG or PNG at `imagePath`, whose format is `format`, ready to
+ * be placed in a PDF. Upright grayscale and RGB JPEGs are embedded as they
+ * are; other images, including JPEGs whose EXIF orientation turns them, as
+ * phones' often does, are decoded within the decode budget, turned upright,
+ * flattened onto white, and compressed losslessly. `pageNum` is the page it
+ * becomes. */
+func loadPDFImage(imagePath string, format string,
+    pageNum int) (pdfImage, error) {
+  file, err := os.Open(imagePath)
+  if err != nil { return pdfImage{}, err }
+  defer file.Close()
+
+  config, _, err := image.DecodeConfig(file)
+  if err != nil { return pdfImage{}, err }
+
+  orientation := EXIF_ORIENTATION_UPRIGHT
+  var data []byte
+  if format == SOURCE_JPEG {
+    data, err = ioutil.ReadFile(imagePath)
+    if err != nil { return pdfImage{}, err }
+    orientation = jpegOrientation(data)
+  }
+
+  if format == SOURCE_JPEG && orientation == EXIF_ORIENTATION_UPRIGHT &&
+      (config.ColorModel == color.GrayModel ||
+      config.ColorModel == color.YCbCrModel) {
+    colorSpace := "DeviceRGB"
+    if config.ColorModel == color.GrayModel { colorSpace = "DeviceGray" }
+    return pdfImage{width: config.Width, height: config.Height,
+      colorSpace: colorSpace, filter: "DCTDecode", data: data}, nil
+  }
+
+  // CMYK JPEGs are decoded too, since PDF viewers disagree about inversion
+  megapixels, err := reserveDecodeMegapixels(dimensions{config.Width,
+    config.Height}, pageNum)
+  if err != nil { return pdfImage{}, err }
+  defer decodeBudget.release(megapixels)
+
+  _, err = file.Seek(0, 0)
+  if err != nil { return pdfImage{}, err }
+  decoded, _, err := image.Decode(file)
+  if err != nil { return pdfImage{}, err }
+  if orientation != EXIF_ORIENTATION_UPRIGHT {
+    decoded = orientImage(decoded, orientation)
+  }
+
+  gray := config.ColorModel == color.GrayModel ||
+    config.ColorModel == color.Gray16Model
+  flattened := flattenOntoWhite(decoded, gray)
+
+  // PDF images are packed samples, without the alpha channel
+  samples := []byte{}
+  colorSpace := "DeviceGray"
+  switch flattened := flattened.(type) {
+  case *image.Gray:
+    samples = flattened.Pix
+  case *image.RGBA:
+    colorSpace = "DeviceRGB"
+    samples = make([]byte, 0, len(flattened.Pix) / 4 * 3)
+    for i := 0; i < len(flattened.Pix); i = i + 4 {
+      samples = append(samples, flattened.Pix[i:i + 3]...)
+    }
+  }
+
+  var compressed bytes.Buffer
+  writer := zlib.NewWriter(&compressed)
+  _, err = writer.Write(samples)
+  if err != nil { return pdfImage{}, err }
+  err = writer.Close()
+  if err != nil { return pdfImage{}, err }
+
+  bounds := flattened.Bounds()
+  return pdfImage{width: bounds.Dx(), height: bounds.Dy(),
+    colorSpace: colorSpace, filter: "FlateDecode",
+    data: compressed.Bytes()}, nil
+}
+
+/* Adds a page to `pdf` for each page of the image `job` fetched to
+ * `imagePath`: one for a JPEG or PNG, or one per frame of a TIFF, which is
+ * first converted to PNG by ImageMagick. `pageNum` is the page the image
+ * starts on. Returns the number of pages added. */
+func addImagePages(job *job, pdf *pdfWriter, imagePath string,
+    options combineOptions, pageNum int) (int, error) {
+  format, err := detectSourceFormat(imagePath)
+  if err != nil { return 0, err }
+  if !isRasterFormat(format) {
+    return 0, errors.New("Only TIFF, JPEG, and PNG images can be " +
+      "combined.\n")
+  }
+
+  numFrames := 1
+  if format == SOURCE_TIFF {
+    if !hasExternalResizer() {
+      return 0, errors.New("TIFF images can't be combined without " +
+        "ImageMagick.\n")
+    }
+    numFrames, err = getTIFFNumPages(imagePath)
+    if err != nil { return 0, err }
+  }
+
+  for frame := 0; frame < numFrames; frame = frame + 1 {
+    framePath, frameFormat := imagePath, format
+    if format == SOURCE_TIFF {
+      framePath = scratchPath(job.id + "-combine-frame.png")
+      frameFormat = SOURCE_PNG
+      err = runTool(toolCommand("convert", fmt.Sprintf("tiff:%s[%d]",
+        imagePath, frame), "-auto-orient", "png:" + framePath))
+      if err != nil { return frame, err }
+    }
+
+    pageImage, err := loadPDFImage(framePath, frameFormat, pageNum + frame)
+    if err != nil { return frame, err }
+
+    placement := placeImage(pageImage, options)
+    err = pdf.addImagePage(pageImage, placement.pageWidth, placement.pageHeight,
+      placement.x, placement.y, placement.width, placement.height)
+    if err != nil { return frame, err }
+  }
+  return numFrames, nil
+}
+
+/* Fetches each image `options` lists as `job`, in order, combines them into
+ * a PDF with a page per image (or TIFF frame), and uploads it to the
+ * `combinedPath`. Images are fetched and scanned like a conversion's
+ * source, one at a time, so only one is ever in scratch. */
+func runCombine(job *job, bucket *s3.Bucket,
+    options combineOptions) (combineResponse, error) {
+  response := combineResponse{JobID: job.id, Key: options.combinedPath,
+    Images: []string{}}
+  job.setNumPages(len(options.imagePaths))
+
+  pdfPath := scratchPath(job.id + "-combined.pdf")
+  pdf, err := createPDF(pdfPath)
+  if err != nil { return response, err }
+
+  for _, imagePath := range options.imagePaths {
+    params := options.params
+    params.S3PDFPath = imagePath
+    sourcePath, err := fetchPDF(job, bucket, params)
+    if err != nil {
+      pdf.abandon()
+      return response, err
+    }
+
+    numPages, err := addImagePages(job, pdf, sourcePath, options,
+      response.NumPages + 1)
+    response.NumPages += numPages
+    if err != nil {
+      pdf.abandon()
+      return response, errors.New(fmt.Sprintf("Couldn't combine %s: %s\n",
+        imagePath, strings.TrimSpace(err.Error())))
+    }
+
+    job.recordEvent("combined", response.NumPages, imagePath)
+    response.Images = append(response.Images, imagePath)
+  }
+
+  err = pdf.close()
+  if err != nil { return response, err }
+
+  err = uploadFileToS3(job, bucket, options.params, pdfPath,
+    options.combinedPath, 0)
+  return response, err
+}
+
+/* Handles POST /combine, the inverse of a conversion: it combines the
+ * images in S3 listed in `s3ImagePath` keys, or numbered by
+ * `s3ImagePathTemplate` and `numImages`, into a PDF with a page per image,
+ * and uploads it to `s3CombinedPath`, e.g. once a user has annotated a
+ * document's page images. `pageSize` and `margin` lay out the pages. The
+ * images are fetched like a conversion's source, as a job whose ID is in
+ * the X-Job-ID header. */
+func serveCombine(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  options, err := parseCombineParams(request.Form)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+  startTime := time.Now()
+
+  bucket, err := connectToParamsBucket(options.params, bucketName,
+    regionName)
+  var response combineResponse
+  if err == nil {
+    response, err = runCombine(job, bucket, options)
+  }
+  job.finish(err)
+  cleanupScratch(jobID)
+  auditConversion(request, jobID, response.NumPages, startTime, err)
+
+  if isS3NotFound(err) {
+    http.Error(writer, fmt.Sprintf("There's no image at %s.\n",
+      options.imagePaths[len(response.Images)]), http.StatusNotFound)
+    return
+  }
+  if errorCode(err) == ERROR_CODE_INFECTED {
+    writer.Header().Set("X-Error-Code", ERROR_CODE_INFECTED)
+    http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  job.logger().Info("Combine finished", "images", len(response.Images),
+    "pages", response.NumPages)
+  writeJSON(writer, http.StatusOK, response)
+}
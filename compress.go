@@ -0,0 +1,129 @@
+package main
+
+import (
+  "compress/gzip"
+  "compress/zlib"
+  "io"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+/* Wraps a ResponseWriter, compressing the body with `encoding` if the
+ * handler's response turns out to be JSON. The decision is made on the first
+ * call to WriteHeader or Write, once the handler has set its headers. */
+type compressingWriter struct {
+  http.ResponseWriter
+  encoding string
+  compressor io.WriteCloser
+  decided bool
+}
+
+/* Decides whether to compress the response, and sends the status line. */
+func (writer *compressingWriter) WriteHeader(status int) {
+  if !writer.decided {
+    writer.decided = true
+    header := writer.Header()
+    isJSON := strings.HasPrefix(header.Get("Content-Type"), "application/json")
+
+    if isJSON && header.Get("Content-Encoding") == "" {
+      header.Set("Content-Encoding", writer.encoding)
+      header.Del("Content-Length")
+
+      if writer.encoding == "gzip" {
+        writer.compressor = gzip.NewWriter(writer.ResponseWriter)
+      } else {
+        // HTTP's deflate is zlib-wrapped, not raw DEFLATE
+        writer.compressor = zlib.NewWriter(writer.ResponseWriter)
+      }
+    }
+  }
+
+  writer.ResponseWriter.WriteHeader(status)
+}
+
+/* Writes `bytes` to the response, compressing them if needed. */
+func (writer *compressingWriter) Write(bytes []byte) (int, error) {
+  if !writer.decided {
+    writer.WriteHeader(http.StatusOK)
+  }
+
+  if writer.compressor != nil {
+    return writer.compressor.Write(bytes)
+  }
+  return writer.ResponseWriter.Write(bytes)
+}
+
+/* Flushes any compressed data buffered so far to the client. */
+func (writer *compressingWriter) Flush() {
+  if flusher, ok := writer.compressor.(interface{ Flush() error }); ok {
+    flusher.Flush()
+  }
+
+  if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+/* Returns the wrapped ResponseWriter, so http.ResponseController can reach
+ * it, e.g. to hijack WebSocket connections. */
+func (writer *compressingWriter) Unwrap() http.ResponseWriter {
+  return writer.ResponseWriter
+}
+
+/* Returns the preferred encoding ("gzip" or "deflate") the client accepts
+ * according to `acceptEncoding`, or "" if it accepts neither. */
+func negotiateEncoding(acceptEncoding string) string {
+  best := ""
+  bestQuality := 0.0
+
+  for _, part := range strings.Split(acceptEncoding, ",") {
+    fields := strings.Split(part, ";")
+    coding := strings.ToLower(strings.TrimSpace(fields[0]))
+    quality := 1.0
+
+    for _, param := range fields[1:] {
+      param = strings.TrimSpace(param)
+      if strings.HasPrefix(param, "q=") {
+        parsed, err := strconv.ParseFloat(param[2:], 64)
+        if err == nil { quality = parsed }
+      }
+    }
+
+    // prefer gzip over deflate when the client weighs them equally
+    if coding != "gzip" && coding != "deflate" { continue }
+    if quality > bestQuality || (quality == bestQuality && coding == "gzip") {
+      best = coding
+      bestQuality = quality
+    }
+  }
+
+  if bestQuality <= 0 { return "" }
+  return best
+}
+
+/* Wraps `handler` so that JSON responses are gzip- or deflate-compressed when
+ * the client asks for it via Accept-Encoding. Other responses pass through
+ * untouched. */
+func compressJSON(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(writer http.ResponseWriter,
+      request *http.Request) {
+    writer.Header().Add("Vary", "Accept-Encoding")
+
+    encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"))
+    if encoding == "" {
+      handler.ServeHTTP(writer, request)
+      return
+    }
+
+    compressingWriter := &compressingWriter{ResponseWriter: writer,
+      encoding: encoding}
+    defer func() {
+      if compressingWriter.compressor != nil {
+        compressingWriter.compressor.Close()
+      }
+    }()
+
+    handler.ServeHTTP(compressingWriter, request)
+  })
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// largest count a setting may be given at runtime, to catch typos
+const MAX_TUNED_COUNT = 1024
+
+// guards the settings /admin/config may change while the server runs; they
+// must be read with tunedInt or tunedDuration once it's serving
+var configMutex sync.RWMutex
+
+// the least severe level logged, changeable at runtime
+var logLevelVar = &slog.LevelVar{}
+
+/* A setting /admin/config may change, named after its flag: `get` formats
+ * its current value, and `parse` validates a new one, returning a function
+ * that applies it. Both are called with configMutex held. */
+type tunableSetting struct {
+  get func() string
+  parse func(value string) (func(), error)
+}
+
+/* Returns a setting for the count in `value`, from 1 to MAX_TUNED_COUNT.
+ * `changed`, if non-nil, is called with each new count once it's set. */
+func countSetting(name string, value *int,
+    changed func(int)) tunableSetting {
+  return tunableSetting{
+    get: func() string { return strconv.Itoa(*value) },
+    parse: func(text string) (func(), error) {
+      count, err := strconv.Atoi(text)
+      if err != nil || count < 1 || count > MAX_TUNED_COUNT {
+        return nil, errors.New(fmt.Sprintf("'%s' must be a whole number " +
+          "from 1 to %d.\n", name, MAX_TUNED_COUNT))
+      }
+      return func() {
+        *value = count
+        if changed != nil { changed(count) }
+      }, nil
+    },
+  }
+}
+
+/* Returns a setting for the positive duration in `value`. */
+func durationSetting(name string, value *time.Duration) tunableSetting {
+  return tunableSetting{
+    get: func() string { return value.String() },
+    parse: func(text string) (func(), error) {
+      duration, err := time.ParseDuration(text)
+      if err != nil || duration <= 0 {
+        return nil, errors.New(fmt.Sprintf("'%s' must be a positive " +
+          "duration, e.g. '1h'.\n", name))
+      }
+      return func() { *value = duration }, nil
+    },
+  }
+}
+
+// settings that are safe to change while the server runs; others, like
+// paths and credentials, are only read at startup
+var TUNABLE_SETTINGS = map[string]tunableSetting{
+  "log-level": {
+    get: func() string {
+      return strings.ToLower(logLevelVar.Level().String())
+    },
+    parse: func(text string) (func(), error) {
+      var level slog.Level
+      err := level.UnmarshalText([]byte(text))
+      if err != nil {
+        return nil, errors.New("'log-level' must be debug, info, warn, or " +
+          "error.\n")
+      }
+      return func() { logLevelVar.Set(level) }, nil
+    },
+  },
+  "convert-workers": countSetting("convert-workers", convertWorkers, nil),
+  "upload-workers": countSetting("upload-workers", uploadWorkers, nil),
+  "download-slots": countSetting("download-slots", downloadSlots,
+    func(slots int) { downloadPool.scheduler.setSlots(slots) }),
+  "render-slots": countSetting("render-slots", renderSlots,
+    func(slots int) { renderPool.scheduler.setSlots(slots) }),
+  "resize-slots": countSetting("resize-slots", resizeSlots,
+    func(slots int) { resizePool.scheduler.setSlots(slots) }),
+  "upload-slots": countSetting("upload-slots", uploadSlots,
+    func(slots int) { uploadPool.scheduler.setSlots(slots) }),
+  "max-processes": countSetting("max-processes", maxProcesses,
+    func(limit int) { processSlots.setLimit(limit) }),
+  "job-max-attempts": countSetting("job-max-attempts", jobMaxAttempts, nil),
+  "s3-max-attempts": countSetting("s3-max-attempts", s3MaxAttempts, nil),
+  "job-retention": durationSetting("job-retention", jobRetention),
+}
+
+/* Returns the current value of the tunable count `value`. */
+func tunedInt(value *int) int {
+  configMutex.RLock()
+  defer configMutex.RUnlock()
+  return *value
+}
+
+/* Returns the current value of the tunable duration `value`. */
+func tunedDuration(value *time.Duration) time.Duration {
+  configMutex.RLock()
+  defer configMutex.RUnlock()
+  return *value
+}
+
+/* Returns the current value of every tunable setting. */
+func currentConfig() map[string]string {
+  configMutex.RLock()
+  defer configMutex.RUnlock()
+
+  config := map[string]string{}
+  for name, setting := range TUNABLE_SETTINGS {
+    config[name] = setting.get()
+  }
+  return config
+}
+
+/* Sets each setting named in `form` to its value there. Every value is
+ * validated before any is applied, so a bad one changes nothing. Returns
+ * the previous value of each setting changed. */
+func updateConfig(form map[string][]string) (map[string]string, error) {
+  if len(form) == 0 {
+    return nil, errors.New("Must specify at least one setting to change.\n")
+  }
+
+  names := []string{}
+  for name := range form {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  configMutex.Lock()
+  defer configMutex.Unlock()
+
+  previous := map[string]string{}
+  applies := []func(){}
+  for _, name := range names {
+    setting, ok := TUNABLE_SETTINGS[name]
+    if !ok {
+      return nil, errors.New(fmt.Sprintf("'%s' isn't a setting that can be " +
+        "changed at runtime.\n", name))
+    }
+    if len(form[name]) != 1 {
+      return nil, errors.New(fmt.Sprintf("Must specify exactly one value " +
+        "for '%s'.\n", name))
+    }
+
+    apply, err := setting.parse(form[name][0])
+    if err != nil { return nil, err }
+
+    previous[name] = setting.get()
+    applies = append(applies, apply)
+  }
+
+  for _, apply := range applies {
+    apply()
+  }
+  return previous, nil
+}
+
+/* Handles /admin/config, which lets operators tune a running server. GET
+ * reports the current value of each setting in TUNABLE_SETTINGS, named
+ * after its flag. PATCH changes the settings given as form keys, e.g.
+ * `render-slots=16&log-level=debug`, all or none, and responds like GET.
+ * Changes are logged and audited, and last until the server restarts. */
+func serveConfig(writer http.ResponseWriter, request *http.Request) {
+  if !requireAdmin(writer, request) { return }
+
+  switch request.Method {
+  case "GET":
+    writeJSON(writer, http.StatusOK, currentConfig())
+
+  case "PATCH":
+    err := request.ParseForm()
+    if handleError(err, writer) { return }
+
+    previous, err := updateConfig(request.PostForm)
+    auditConfigChange(request, err)
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    config := currentConfig()
+    for name, value := range previous {
+      logger.Info("Changed setting", "request", requestID(request),
+        "setting", name, "from", value, "to", config[name])
+    }
+    writeJSON(writer, http.StatusOK, config)
+
+  default:
+    http.Error(writer, "Only GET and PATCH requests are supported.\n",
+      http.StatusMethodNotAllowed)
+  }
+}
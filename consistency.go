@@ -0,0 +1,329 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "launchpad.net/goamz/s3"
+)
+
+// most pages a consistency check given templates rather than a manifest
+// will look for
+const MAX_CHECK_PAGES = 10000
+
+// most objects listed while looking for a document's renditions
+const MAX_CHECK_LISTED_KEYS = 100000
+
+// what can be wrong with a rendition
+const (
+  PROBLEM_MISSING = "missing"
+  PROBLEM_EMPTY = "empty"
+  PROBLEM_CHECKSUM = "checksum mismatch"
+)
+
+/* A rendition a converted document should have in S3. `md5` is its hex
+ * digest, if known. */
+type expectedObject struct {
+  pageNum int
+  tier string
+  key string
+  md5 string
+}
+
+/* Something wrong with one of a document's renditions. */
+type objectProblem struct {
+  PageNum int `json:"pageNum"`
+  Tier string `json:"tier"`
+  Key string `json:"key"`
+  Problem string `json:"problem"`
+}
+
+/* The outcome of checking a converted document's renditions in S3.
+ * `DamagedPages` lists the pages with any problem, for repair. */
+type consistencyReport struct {
+  ManifestKey string `json:"manifestKey,omitempty"`
+  NumPages int `json:"numPages"`
+  Checked int `json:"checked"`
+  Consistent bool `json:"consistent"`
+  Problems []objectProblem `json:"problems"`
+  DamagedPages []int `json:"damagedPages"`
+}
+
+/* Records the hex MD5 digest of the object uploaded to `key`. */
+func (job *job) recordChecksum(key string, digest string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.checksums[key] = digest
+}
+
+/* Returns the digests of the objects the job uploaded, keyed by S3 key. */
+func (job *job) uploadedChecksums() map[string]string {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  checksums := map[string]string{}
+  for key, digest := range job.checksums {
+    checksums[key] = digest
+  }
+  return checksums
+}
+
+/* Returns the hex form of the base64 MD5 `digest`, as S3 reports it in the
+ * ETags of objects uploaded in one part. */
+func md5ETag(digest string) string {
+  decoded, err := base64.StdEncoding.DecodeString(digest)
+  if err != nil { return "" }
+  return hex.EncodeToString(decoded)
+}
+
+/* Returns the renditions of pages `pageNums` that a conversion with
+ * `params` writes, with their digests from `checksums`, keyed by S3 key. */
+func expectedObjects(params conversionParams, pageNums []int,
+    checksums map[string]string) []expectedObject {
+  paths := s3PathsByTier(params)
+  tiers := []string{}
+  for tier, path := range paths {
+    if path != "" {
+      tiers = append(tiers, tier)
+    }
+  }
+  sort.Strings(tiers)
+
+  expected := []expectedObject{}
+  for _, pageNum := range pageNums {
+    for _, tier := range tiers {
+      key := fmt.Sprintf(paths[tier], pageNum)
+      expected = append(expected, expectedObject{pageNum, tier, key,
+        checksums[key]})
+    }
+  }
+  return expected
+}
+
+/* Returns the objects in `bucket` under each of `prefixes`, keyed by S3
+ * key. */
+func listObjects(bucket *s3.Bucket, prefixes []string) (map[string]s3.Key,
+    error) {
+  objects := map[string]s3.Key{}
+
+  for _, prefix := range prefixes {
+    marker := ""
+    for {
+      var list *s3.ListResp
+      err := withS3Retries(logger, S3_OP_LIST, func() error {
+        var err error
+        list, err = bucket.List(prefix, "", marker, MAX_LIST_KEYS)
+        return err
+      })
+      if err != nil { return nil, err }
+
+      for _, key := range list.Contents {
+        objects[key.Key] = key
+      }
+      if len(objects) > MAX_CHECK_LISTED_KEYS {
+        return nil, errors.New("Too many objects share the renditions' " +
+          "prefix to check them.\n")
+      }
+
+      if !list.IsTruncated || len(list.Contents) == 0 { break }
+      marker = list.Contents[len(list.Contents) - 1].Key
+    }
+  }
+  return objects, nil
+}
+
+/* Returns the distinct prefixes of the key templates in `params`, up to
+ * where they substitute the page number, so they can be listed together. */
+func listPrefixes(params conversionParams) []string {
+  prefixes := []string{}
+  seen := map[string]bool{}
+
+  for _, path := range s3PathsByTier(params) {
+    if path == "" { continue }
+
+    prefix := path[:strings.Index(path, "%d")]
+    if !seen[prefix] {
+      seen[prefix] = true
+      prefixes = append(prefixes, prefix)
+    }
+  }
+
+  // a prefix contains any other prefix that starts with it
+  sort.Strings(prefixes)
+  distinct := []string{}
+  for _, prefix := range prefixes {
+    if len(distinct) > 0 &&
+        strings.HasPrefix(prefix, distinct[len(distinct) - 1]) {
+      continue
+    }
+    distinct = append(distinct, prefix)
+  }
+  return distinct
+}
+
+/* Checks that each of `expected` exists in `bucket` among `objects`, isn't
+ * empty, and has its expected digest, if known. */
+func checkObjects(expected []expectedObject,
+    objects map[string]s3.Key) consistencyReport {
+  report := consistencyReport{Problems: []objectProblem{},
+    DamagedPages: []int{}}
+  damaged := map[int]bool{}
+
+  for _, object := range expected {
+    report.Checked += 1
+
+    problem := ""
+    listed, ok := objects[object.key]
+    if !ok {
+      problem = PROBLEM_MISSING
+    } else if listed.Size == 0 {
+      problem = PROBLEM_EMPTY
+    } else if object.md5 != "" &&
+        strings.Trim(listed.ETag, "\"") != object.md5 {
+      problem = PROBLEM_CHECKSUM
+    }
+    if problem == "" { continue }
+
+    report.Problems = append(report.Problems, objectProblem{object.pageNum,
+      object.tier, object.key, problem})
+    if !damaged[object.pageNum] {
+      damaged[object.pageNum] = true
+      report.DamagedPages = append(report.DamagedPages, object.pageNum)
+    }
+  }
+
+  sort.Ints(report.DamagedPages)
+  report.Consistent = len(report.Problems) == 0
+  return report
+}
+
+/* Returns the conversion parameters, pages, and digests of the document
+ * described by `form`: either the manifest at `s3ManifestPath`, or the key
+ * templates `s3JPEGPath`, `s3SmallJPEGPath`, `s3LargeJPEGPath`, and
+ * `s3DarkJPEGPath` (any of which may be omitted) with `numPages` and
+ * optionally `pages`. Without a manifest, digests are unknown. */
+func parseCheckTarget(bucket *s3.Bucket, form url.Values) (conversionParams,
+    []int, map[string]string, error) {
+  manifestPath, err := optionalFormValue(form, "s3ManifestPath")
+  if err != nil { return conversionParams{}, nil, nil, err }
+
+  if manifestPath != "" {
+    manifest, err := readManifest(bucket, manifestPath)
+    if err != nil { return conversionParams{}, nil, nil, err }
+    manifest.Params.S3ManifestPath = manifestPath
+
+    pageNums := manifest.RenderedPages
+    if pageNums == nil {
+      pageNums = samplePages(manifest.NumPages, 0)
+    }
+    return manifest.Params, pageNums, manifest.Checksums, nil
+  }
+
+  params := conversionParams{}
+  keys := []string{"s3JPEGPath", "s3SmallJPEGPath", "s3LargeJPEGPath",
+    "s3DarkJPEGPath"}
+  paths := []*string{&params.S3JPEGPath, &params.S3SmallJPEGPath,
+    &params.S3LargeJPEGPath, &params.S3DarkJPEGPath}
+
+  given := false
+  for i, key := range keys {
+    if _, ok := form[key]; !ok { continue }
+
+    *paths[i], err = requirePathTemplate(form, key, "a JPEG path")
+    if err != nil { return params, nil, nil, err }
+    given = true
+  }
+  if !given {
+    return params, nil, nil, errors.New("Must specify a manifest in the " +
+      "'s3ManifestPath' key or JPEG paths with %d.\n")
+  }
+
+  pageNums, err := parseCheckPages(form)
+  return params, pageNums, nil, err
+}
+
+/* Returns the pages to check according to the `numPages` and optional
+ * `pages` keys of `form`. */
+func parseCheckPages(form url.Values) ([]int, error) {
+  numPagesStr, err := requireFormValue(form, "numPages", "a page count")
+  if err != nil { return nil, err }
+
+  numPages, err := strconv.Atoi(numPagesStr)
+  if err != nil || numPages < 1 || numPages > MAX_CHECK_PAGES {
+    return nil, errors.New(fmt.Sprintf("The 'numPages' key must be a " +
+      "whole number from 1 to %d.\n", MAX_CHECK_PAGES))
+  }
+
+  pages, err := parsePageRange(form)
+  if err != nil { return nil, err }
+
+  return selectPages(numPages, pages)
+}
+
+/* Checks the renditions of pages `pageNums` that a conversion with `params`
+ * wrote to `bucket`, verifying digests in `checksums` where known. */
+func checkRenditions(bucket *s3.Bucket, params conversionParams,
+    pageNums []int, checksums map[string]string) (consistencyReport, error) {
+  objects, err := listObjects(bucket, listPrefixes(params))
+  if err != nil { return consistencyReport{}, err }
+
+  report := checkObjects(expectedObjects(params, pageNums, checksums),
+    objects)
+  report.ManifestKey = params.S3ManifestPath
+  report.NumPages = len(pageNums)
+  return report, nil
+}
+
+/* Handles /check: verifies that every rendition of a converted document
+ * exists in S3, isn't empty, and matches the checksum in its manifest,
+ * reporting the pages that need repair. */
+func serveCheck(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if !requireRole(writer, request, ROLE_READ_STATUS) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  bucket, err := connectToRequestBucket(request.Form, bucketName, regionName)
+  if err != nil {
+    writeCheckError(writer, err)
+    return
+  }
+
+  params, pageNums, checksums, err := parseCheckTarget(bucket, request.Form)
+  if err != nil {
+    writeCheckError(writer, err)
+    return
+  }
+
+  report, err := checkRenditions(bucket, params, pageNums, checksums)
+  if err != nil {
+    writeCheckError(writer, err)
+    return
+  }
+
+  writeJSON(writer, http.StatusOK, report)
+}
+
+/* Responds to a consistency check or repair that failed with `err`: 404 if
+ * the manifest doesn't exist, 500 if S3 failed, and 400 otherwise, since
+ * the request was invalid. */
+func writeCheckError(writer http.ResponseWriter, err error) {
+  if isS3NotFound(err) {
+    http.Error(writer, "There's no manifest at that key.\n",
+      http.StatusNotFound)
+    return
+  }
+
+  if _, ok := err.(*s3.Error); ok || errorClass(err) != ERROR_CLASS_PERMANENT {
+    handleError(err, writer)
+    return
+  }
+  http.Error(writer, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+  "io"
+  "mime"
+  "net/http"
+  "path"
+  "strings"
+)
+
+// bytes http.DetectContentType looks at
+const SNIFF_BYTES = 512
+
+/* Returns the content type of an object to be stored at `key`, whose data
+ * begins with `head`. The data itself decides, since it can't lie about
+ * being a JPEG, PNG, WebP, or ZIP; text and unrecognized data fall back to
+ * the key's extension, so JSON manifests are labeled as such. */
+func detectContentType(key string, head []byte) string {
+  if len(head) > SNIFF_BYTES {
+    head = head[:SNIFF_BYTES]
+  }
+  sniffed := http.DetectContentType(head)
+
+  if sniffed == "application/octet-stream" ||
+      strings.HasPrefix(sniffed, "text/plain") {
+    byExtension := mime.TypeByExtension(path.Ext(key))
+    if byExtension != "" { return byExtension }
+  }
+  return sniffed
+}
+
+/* Returns the content type of the data in `file`, to be stored at `key`,
+ * leaving `file` positioned at its start. */
+func detectFileContentType(file io.ReadSeeker, key string) (string, error) {
+  head := make([]byte, SNIFF_BYTES)
+  n, err := io.ReadFull(file, head)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return "", err
+  }
+
+  _, err = file.Seek(0, 0)
+  if err != nil { return "", err }
+  return detectContentType(key, head[:n]), nil
+}
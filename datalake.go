@@ -0,0 +1,176 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "mime"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var dataLakePrefix = flag.String("datalake-prefix", "",
+  "S3 prefix under which a record of every finished conversion is written, " +
+  "partitioned by dt=YYYY-MM-DD (disabled if empty)")
+var dataLakeFormat = flag.String("datalake-format", DATALAKE_JSONL,
+  "format of data lake records: jsonl or parquet")
+
+// formats data lake records can be written in
+const (
+  DATALAKE_JSONL = "jsonl"
+  DATALAKE_PARQUET = "parquet"
+)
+
+// bucket data lake records are written to, or nil if disabled
+var dataLake *s3.Bucket = nil
+
+/* A flat record of a finished conversion, for analytics. Columns are
+ * snake_case, as Athena expects. */
+type dataLakeRecord struct {
+  JobID string `json:"job_id"`
+  RequestID string `json:"request_id"`
+  Tenant string `json:"tenant"`
+  State string `json:"state"`
+  Error string `json:"error"`
+  PipelineVersion int64 `json:"pipeline_version"`
+  Source string `json:"source"`
+  Layout string `json:"layout"`
+  OutputPrefix string `json:"output_prefix"`
+  ManifestPath string `json:"manifest_path"`
+  NumPages int64 `json:"num_pages"`
+  RenderedPages string `json:"rendered_pages"`
+  PagesConverted int64 `json:"pages_converted"`
+  PagesUploaded int64 `json:"pages_uploaded"`
+  BytesDownloaded int64 `json:"bytes_downloaded"`
+  BytesUploaded int64 `json:"bytes_uploaded"`
+  Attempts int64 `json:"attempts"`
+  CreatedAt int64 `json:"created_at"`
+  FinishedAt int64 `json:"finished_at"`
+  DurationMS int64 `json:"duration_ms"`
+  Params string `json:"params"`
+}
+
+/* Sets up writing data lake records to `bucket` according to
+ * -datalake-prefix and -datalake-format. */
+func setupDataLake(bucket *s3.Bucket) error {
+  if *dataLakeFormat != DATALAKE_JSONL &&
+      *dataLakeFormat != DATALAKE_PARQUET {
+    return errors.New("-datalake-format must be jsonl or parquet.\n")
+  }
+
+  if *dataLakePrefix == "" { return nil }
+
+  // so records are labeled correctly when uploaded
+  mime.AddExtensionType(".jsonl", "application/x-ndjson")
+  mime.AddExtensionType(".parquet", "application/vnd.apache.parquet")
+
+  dataLake = bucket
+  return nil
+}
+
+/* Returns the data lake record of `job`, which has finished converting with
+ * `params`. */
+func newDataLakeRecord(job *job, params conversionParams) dataLakeRecord {
+  // secrets and callback URLs aren't serialized
+  encodedParams, _ := json.Marshal(params)
+
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  record := dataLakeRecord{
+    JobID: job.id,
+    RequestID: job.requestID,
+    Tenant: job.tenant,
+    State: job.state,
+    PipelineVersion: PIPELINE_VERSION,
+    Source: params.S3PDFPath,
+    Layout: params.Layout,
+    OutputPrefix: job.outputPrefix,
+    ManifestPath: params.S3ManifestPath,
+    NumPages: int64(job.numPages),
+    RenderedPages: formatPageList(job.renderedPages),
+    PagesConverted: int64(job.pagesConverted),
+    PagesUploaded: int64(job.pagesUploaded),
+    BytesDownloaded: job.bytesDownloaded,
+    BytesUploaded: job.bytesUploaded,
+    Attempts: int64(job.attempts),
+    CreatedAt: job.createdAt.UnixNano() / int64(time.Millisecond),
+    FinishedAt: job.finishedAt.UnixNano() / int64(time.Millisecond),
+    DurationMS: int64(job.finishedAt.Sub(job.createdAt) / time.Millisecond),
+    Params: string(encodedParams),
+  }
+
+  if job.err != nil {
+    record.Error = job.err.Error()
+  }
+  return record
+}
+
+/* Returns `record` as a row of Parquet fields. */
+func (record dataLakeRecord) parquetRow() []parquetField {
+  return []parquetField{
+    {name: "job_id", kind: PARQUET_STRING, text: record.JobID},
+    {name: "request_id", kind: PARQUET_STRING, text: record.RequestID},
+    {name: "tenant", kind: PARQUET_STRING, text: record.Tenant},
+    {name: "state", kind: PARQUET_STRING, text: record.State},
+    {name: "error", kind: PARQUET_STRING, text: record.Error},
+    {name: "pipeline_version", kind: PARQUET_INT64,
+      number: record.PipelineVersion},
+    {name: "source", kind: PARQUET_STRING, text: record.Source},
+    {name: "layout", kind: PARQUET_STRING, text: record.Layout},
+    {name: "output_prefix", kind: PARQUET_STRING, text: record.OutputPrefix},
+    {name: "manifest_path", kind: PARQUET_STRING, text: record.ManifestPath},
+    {name: "num_pages", kind: PARQUET_INT64, number: record.NumPages},
+    {name: "rendered_pages", kind: PARQUET_STRING,
+      text: record.RenderedPages},
+    {name: "pages_converted", kind: PARQUET_INT64,
+      number: record.PagesConverted},
+    {name: "pages_uploaded", kind: PARQUET_INT64,
+      number: record.PagesUploaded},
+    {name: "bytes_downloaded", kind: PARQUET_INT64,
+      number: record.BytesDownloaded},
+    {name: "bytes_uploaded", kind: PARQUET_INT64,
+      number: record.BytesUploaded},
+    {name: "attempts", kind: PARQUET_INT64, number: record.Attempts},
+    {name: "created_at", kind: PARQUET_TIMESTAMP_MILLIS,
+      number: record.CreatedAt},
+    {name: "finished_at", kind: PARQUET_TIMESTAMP_MILLIS,
+      number: record.FinishedAt},
+    {name: "duration_ms", kind: PARQUET_INT64, number: record.DurationMS},
+    {name: "params", kind: PARQUET_STRING, text: record.Params},
+  }
+}
+
+/* Writes the data lake record of `job`, which has finished converting with
+ * `params`, in the background. Each record is its own object at
+ * {prefix}dt={date}/{jobID}.{format}, so partitions can be queried by
+ * date. Does nothing if the data lake is disabled. */
+func recordInDataLake(job *job, params conversionParams) {
+  if dataLake == nil { return }
+
+  record := newDataLakeRecord(job, params)
+  finishedAt := time.Unix(0, record.FinishedAt * int64(time.Millisecond))
+  key := fmt.Sprintf("%sdt=%s/%s.%s", *dataLakePrefix,
+    finishedAt.UTC().Format("2006-01-02"), record.JobID, *dataLakeFormat)
+
+  var body []byte
+  if *dataLakeFormat == DATALAKE_PARQUET {
+    body = encodeParquet([][]parquetField{record.parquetRow()})
+  } else {
+    line, err := json.Marshal(record)
+    if err != nil {
+      job.logger().Error("Couldn't encode data lake record", errorAttr(err))
+      return
+    }
+    body = append(line, '\n')
+  }
+
+  go func() {
+    err := dataLake.Put(key, body, detectContentType(key, body), s3.Private)
+    if err != nil {
+      job.logger().Error("Couldn't write data lake record", "key", key,
+        errorAttr(err))
+    }
+  }()
+}
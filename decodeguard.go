@@ -0,0 +1,90 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "sync"
+)
+
+var decodeMegapixelBudget = flag.Float64("decode-megapixel-budget", 250,
+  "megapixels of rendered pages that may be decoded for resizing at once " +
+  "across the process; larger pages are refused (0 disables the guard)")
+
+/* A page whose rendering has more pixels than may ever be decoded at once,
+ * e.g. a decompression bomb with a huge page size. */
+type imageTooLargeError struct {
+  pageNum int
+  size dimensions
+}
+
+func (err *imageTooLargeError) Error() string {
+  return fmt.Sprintf("Page %d renders at %dx%d pixels, more than the %g " +
+    "megapixels that may be decoded at once.\n", err.pageNum,
+    err.size.Width, err.size.Height, *decodeMegapixelBudget)
+}
+
+/* Bounds the megapixels of images being decoded at once, since ImageMagick
+ * holds every pixel of an image in memory while resizing it. */
+type megapixelBudget struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  inUse float64
+}
+
+var decodeBudget = newMegapixelBudget()
+
+/* Returns an empty budget. */
+func newMegapixelBudget() *megapixelBudget {
+  budget := &megapixelBudget{}
+  budget.cond = sync.NewCond(&budget.mutex)
+  return budget
+}
+
+/* Waits until `megapixels` fit within -decode-megapixel-budget alongside
+ * the images already being decoded, then reserves them. Every call must be
+ * followed by a call to `release`. */
+func (budget *megapixelBudget) acquire(megapixels float64) {
+  budget.mutex.Lock()
+  defer budget.mutex.Unlock()
+
+  for budget.inUse > 0 && budget.inUse + megapixels > *decodeMegapixelBudget {
+    budget.cond.Wait()
+  }
+  budget.inUse += megapixels
+}
+
+/* Frees the megapixels reserved by `acquire`. */
+func (budget *megapixelBudget) release(megapixels float64) {
+  budget.mutex.Lock()
+  defer budget.mutex.Unlock()
+
+  budget.inUse -= megapixels
+  budget.cond.Broadcast()
+}
+
+/* Probes the dimensions of page `pageNum`'s rendering at `jpegPath` without
+ * decoding it, and reserves its megapixels in the decode budget. Returns the
+ * megapixels reserved, which must be released once resizing is done, or an
+ * error if the page could never fit in the budget. */
+func reserveDecodeBudget(jpegPath string, pageNum int) (float64, error) {
+  if *decodeMegapixelBudget <= 0 { return 0, nil }
+
+  size, err := jpegDimensions(jpegPath)
+  if err != nil { return 0, err }
+  return reserveDecodeMegapixels(size, pageNum)
+}
+
+/* Reserves the megapixels of an image of page `pageNum` that's `size`, as
+ * reserveDecodeBudget does, for images whose dimensions are already known,
+ * e.g. from image.DecodeConfig. */
+func reserveDecodeMegapixels(size dimensions, pageNum int) (float64, error) {
+  if *decodeMegapixelBudget <= 0 { return 0, nil }
+
+  megapixels := float64(size.Width) * float64(size.Height) / 1e6
+  if megapixels > *decodeMegapixelBudget {
+    return 0, &imageTooLargeError{pageNum, size}
+  }
+
+  decodeBudget.acquire(megapixels)
+  return megapixels, nil
+}
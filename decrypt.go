@@ -0,0 +1,247 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "compress/flate"
+  "crypto/aes"
+  "crypto/cipher"
+  "encoding/base64"
+  "errors"
+  "hash/crc32"
+  "io"
+  "io/ioutil"
+  "net/url"
+  "path"
+  "strings"
+)
+
+// possible encodings of an encrypted source document
+const (
+  SOURCE_ZIP = "zip"
+  SOURCE_AES_256_GCM = "aes-256-gcm"
+)
+
+// largest encrypted source we'll hold in memory to decrypt
+const MAX_ENCRYPTED_SOURCE_BYTES = 512 * 1024 * 1024
+
+// size of the header preceding each traditionally encrypted ZIP entry
+const ZIP_CRYPTO_HEADER_BYTES = 12
+
+var crc32Table = crc32.MakeTable(crc32.IEEE)
+
+/* Parses the optional source encryption parameters in `form` into `params`:
+ * `sourceEncryption` ("zip" or "aes-256-gcm") and `sourceKey` (the ZIP
+ * password, or the base64 AES key). */
+func parseSourceEncryptionParams(form url.Values,
+    params *conversionParams) error {
+  var err error
+
+  params.SourceEncryption, err = optionalFormValue(form, "sourceEncryption")
+  if err != nil { return err }
+
+  params.SourceKey, err = optionalFormValue(form, "sourceKey")
+  if err != nil { return err }
+
+  switch params.SourceEncryption {
+  case "":
+    if params.SourceKey != "" {
+      return errors.New("The 'sourceKey' key requires 'sourceEncryption'.\n")
+    }
+  case SOURCE_ZIP:
+  case SOURCE_AES_256_GCM:
+    key, err := base64.StdEncoding.DecodeString(params.SourceKey)
+    if err != nil || len(key) != 32 {
+      return errors.New("The 'sourceKey' key must be a base64 256-bit key " +
+        "for aes-256-gcm sources.\n")
+    }
+  default:
+    return errors.New("The 'sourceEncryption' key must be 'zip' or " +
+      "'aes-256-gcm'.\n")
+  }
+
+  return nil
+}
+
+/* Decrypts a source encrypted with AES-256-GCM, laid out as a 12-byte nonce
+ * followed by the ciphertext and tag. */
+func decryptAESGCM(data []byte, encodedKey string) ([]byte, error) {
+  key, err := base64.StdEncoding.DecodeString(encodedKey)
+  if err != nil { return nil, err }
+
+  block, err := aes.NewCipher(key)
+  if err != nil { return nil, err }
+
+  gcm, err := cipher.NewGCM(block)
+  if err != nil { return nil, err }
+
+  if len(data) < gcm.NonceSize() {
+    return nil, errors.New("Encrypted source is too short.\n")
+  }
+
+  plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()],
+    data[gcm.NonceSize():], nil)
+  if err != nil {
+    return nil, errors.New("Couldn't decrypt source; wrong key?\n")
+  }
+  return plaintext, nil
+}
+
+/* The state of the traditional PKWARE ("ZipCrypto") stream cipher. */
+type zipCrypto struct {
+  keys [3]uint32
+}
+
+/* Returns the cipher state initialized with `password`. */
+func newZipCrypto(password string) *zipCrypto {
+  crypto := &zipCrypto{[3]uint32{0x12345678, 0x23456789, 0x34567890}}
+  for i := 0; i < len(password); i = i + 1 {
+    crypto.update(password[i])
+  }
+  return crypto
+}
+
+/* Updates a CRC-32 with a single byte. */
+func crc32Byte(crc uint32, b byte) uint32 {
+  return crc32Table[byte(crc) ^ b] ^ (crc >> 8)
+}
+
+/* Mixes plaintext byte `b` into the cipher state. */
+func (crypto *zipCrypto) update(b byte) {
+  crypto.keys[0] = crc32Byte(crypto.keys[0], b)
+  crypto.keys[1] = (crypto.keys[1] + (crypto.keys[0] & 0xff)) * 134775813 + 1
+  crypto.keys[2] = crc32Byte(crypto.keys[2], byte(crypto.keys[1] >> 24))
+}
+
+/* Decrypts `data` in place. */
+func (crypto *zipCrypto) decrypt(data []byte) {
+  for i, b := range data {
+    temp := crypto.keys[2] | 2
+    data[i] = b ^ byte((temp * (temp ^ 1)) >> 8)
+    crypto.update(data[i])
+  }
+}
+
+// returned when a ZIP entry decompresses to more than we'll hold in memory
+var errZipEntryTooLarge = errors.New("The PDF in the source archive is too " +
+  "large to extract.\n")
+
+/* Reads the decompressed contents of a ZIP entry from `reader`, failing
+ * rather than exhausting memory if it's a ZIP bomb. */
+func readZipEntryData(reader io.Reader) ([]byte, error) {
+  data, err := ioutil.ReadAll(io.LimitReader(reader,
+    MAX_ENCRYPTED_SOURCE_BYTES + 1))
+  if err != nil { return nil, err }
+
+  if len(data) > MAX_ENCRYPTED_SOURCE_BYTES { return nil, errZipEntryTooLarge }
+  return data, nil
+}
+
+/* Returns the contents of ZIP entry `file`, decrypting it with `password`
+ * if it's encrypted. Only traditional PKWARE encryption is supported. */
+func readZipEntry(file *zip.File, password string) ([]byte, error) {
+  // the declared size may lie, so reads are capped too
+  if file.UncompressedSize64 > MAX_ENCRYPTED_SOURCE_BYTES {
+    return nil, errZipEntryTooLarge
+  }
+
+  if file.Flags & 0x1 == 0 {
+    reader, err := file.Open()
+    if err != nil { return nil, err }
+    defer reader.Close()
+    return readZipEntryData(reader)
+  }
+
+  if password == "" {
+    return nil, errors.New("The source archive is encrypted; must specify " +
+      "its password in the 'sourceKey' key.\n")
+  }
+
+  rawReader, err := file.OpenRaw()
+  if err != nil { return nil, err }
+
+  data, err := ioutil.ReadAll(rawReader)
+  if err != nil { return nil, err }
+
+  if len(data) < ZIP_CRYPTO_HEADER_BYTES {
+    return nil, errors.New("Encrypted archive entry is too short.\n")
+  }
+
+  crypto := newZipCrypto(password)
+  crypto.decrypt(data)
+
+  // the header's last byte lets us reject a wrong password early
+  check := byte(file.CRC32 >> 24)
+  if file.Flags & 0x8 != 0 {
+    check = byte(file.ModifiedTime >> 8)
+  }
+  if data[ZIP_CRYPTO_HEADER_BYTES - 1] != check {
+    return nil, errors.New("Couldn't decrypt source archive; wrong " +
+      "password?\n")
+  }
+
+  compressed := bytes.NewReader(data[ZIP_CRYPTO_HEADER_BYTES:])
+  var plaintext []byte
+
+  switch file.Method {
+  case zip.Store:
+    plaintext, err = readZipEntryData(compressed)
+  case zip.Deflate:
+    plaintext, err = readZipEntryData(flate.NewReader(compressed))
+  default:
+    return nil, errors.New("Unsupported compression method in source " +
+      "archive.\n")
+  }
+  if err != nil { return nil, err }
+
+  if crc32.ChecksumIEEE(plaintext) != file.CRC32 {
+    return nil, errors.New("Couldn't decrypt source archive; wrong " +
+      "password?\n")
+  }
+  return plaintext, nil
+}
+
+/* Returns the first PDF in the ZIP archive `data`, decrypting it with
+ * `password` if needed. */
+func extractPDFFromZip(data []byte, password string) ([]byte, error) {
+  archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+  if err != nil { return nil, err }
+
+  for _, file := range archive.File {
+    if strings.ToLower(path.Ext(file.Name)) == ".pdf" {
+      return readZipEntry(file, password)
+    }
+  }
+
+  return nil, errors.New("The source archive contains no PDF.\n")
+}
+
+/* Wraps a reader, counting the bytes read through it. */
+type countingReader struct {
+  reader io.Reader
+  numBytes int64
+}
+
+func (counter *countingReader) Read(data []byte) (int, error) {
+  n, err := counter.reader.Read(data)
+  counter.numBytes += int64(n)
+  return n, err
+}
+
+/* Reads the encrypted source in `reader` into memory and returns the
+ * decrypted PDF, according to the encryption in `params`. */
+func decryptSource(reader io.Reader, params conversionParams) ([]byte,
+    error) {
+  limitedReader := io.LimitReader(reader, MAX_ENCRYPTED_SOURCE_BYTES + 1)
+  data, err := ioutil.ReadAll(limitedReader)
+  if err != nil { return nil, err }
+
+  if len(data) > MAX_ENCRYPTED_SOURCE_BYTES {
+    return nil, errors.New("Encrypted source is too large to decrypt.\n")
+  }
+
+  if params.SourceEncryption == SOURCE_AES_256_GCM {
+    return decryptAESGCM(data, params.SourceKey)
+  }
+  return extractPDFFromZip(data, params.SourceKey)
+}
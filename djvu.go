@@ -0,0 +1,47 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// name reported for pages rendered from DJVU sources
+const RENDERER_DJVU = "djvu"
+
+/* Renders pages of DJVU documents with DjVuLibre's ddjvu, which can't write
+ * JPEGs, so its PNM is re-encoded by ImageMagick, and converted to
+ * grayscale then if need be. DJVU sources can only be rendered this way, and
+ * PDFs never are. */
+type djvuRenderer struct{}
+
+func (djvuRenderer) renderPage(djvuPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  pnmPath := strings.TrimSuffix(outputPath, ".jpg") + ".pnm"
+  defer os.Remove(pnmPath)
+
+  cmd := toolCommand("ddjvu", "-format=pnm",
+    fmt.Sprintf("-page=%d", pageNum), fmt.Sprintf("-scale=%d", density),
+    djvuPath, pnmPath)
+  err := runTool(cmd)
+  if err != nil { return err }
+
+  args := []string{pnmPath}
+  if gray { args = append(args, "-colorspace", "Gray") }
+  args = append(args, "-quality", fmt.Sprintf("%d", quality), outputPath)
+  return runTool(toolCommand("convert", args...))
+}
+
+/* Returns the number of pages in the DJVU document at `djvuPath`. */
+func getDJVUNumPages(djvuPath string) (int, error) {
+  var output []byte
+  err := withProcessSlot(func() error {
+    var err error
+    output, err = toolCommand("djvused", "-e", "n", djvuPath).Output()
+    return err
+  })
+  if err != nil { return -1, err }
+
+  return strconv.Atoi(strings.TrimSpace(string(output)))
+}
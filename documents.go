@@ -0,0 +1,116 @@
+package main
+
+import (
+  "bytes"
+  "flag"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "regexp"
+  "strings"
+  "time"
+  "launchpad.net/goamz/aws"
+)
+
+var documentsPrefix = flag.String("documents-prefix", "",
+  "S3 output prefix of content-addressed documents served at /documents/ " +
+  "(disabled if empty)")
+var documentsRedirect = flag.Bool("documents-redirect", false,
+  "redirect /documents/ requests to S3 rather than proxying the images")
+
+// largest image we'll proxy from S3
+const MAX_DOCUMENT_IMAGE_BYTES = 64 * 1024 * 1024
+
+// a document is identified by its source hash and rendering hash, which
+// together form its directory under the content-addressed output prefix
+var documentIDPattern = regexp.MustCompile("^[0-9a-f]{64}/[0-9a-f]{16}$")
+
+// a page image is named by its page number and optional size tier
+var pageImagePattern = regexp.MustCompile(
+  "^[1-9][0-9]*(-small|-large|-dark)?\\.jpg$")
+
+/* Splits a request path like /documents/{id}/pages/{n}.jpg into the document
+ * ID and image name. Returns false if the path isn't of that form. */
+func parseDocumentPath(requestPath string) (string, string, bool) {
+  rest := strings.TrimPrefix(requestPath, "/documents/")
+  separator := strings.LastIndex(rest, "/pages/")
+  if separator < 0 { return "", "", false }
+
+  documentID := rest[:separator]
+  imageName := rest[separator + len("/pages/"):]
+
+  if !documentIDPattern.MatchString(documentID) ||
+      !pageImagePattern.MatchString(imageName) {
+    return "", "", false
+  }
+  return documentID, imageName, true
+}
+
+/* Handles GET /documents/{id}/pages/{n}.jpg, serving a page rendered with
+ * the content-addressed layout under -documents-prefix. `{id}` is the
+ * document's directory under the prefix ({sourceHash}/{renderingHash}), and
+ * `{n}` may be suffixed with -small, -large, or -dark to pick a tier.
+ *
+ * Since content-addressed images never change, they're served as immutable,
+ * and conditional requests are answered without asking S3. Range requests
+ * are supported. */
+func serveDocuments(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if *documentsPrefix == "" {
+    http.NotFound(writer, request)
+    return
+  }
+
+  if request.Method != "GET" && request.Method != "HEAD" {
+    http.Error(writer, "Only GET and HEAD requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  documentID, imageName, ok := parseDocumentPath(request.URL.Path)
+  if !ok {
+    http.NotFound(writer, request)
+    return
+  }
+
+  key := *documentsPrefix + documentID + "/" + imageName
+
+  // the key names immutable content, so it makes a strong validator
+  writer.Header().Set("ETag", "\"" +
+    strings.Replace(documentID, "/", "-", 1) + "-" + imageName + "\"")
+  writer.Header().Set("Cache-Control", IMMUTABLE_CACHE_CONTROL)
+
+  if request.Header.Get("If-None-Match") == writer.Header().Get("ETag") {
+    writer.WriteHeader(http.StatusNotModified)
+    return
+  }
+
+  bucket, err := connectToS3(bucketName, aws.Regions[regionName])
+  if handleError(err, writer) { return }
+
+  if *documentsRedirect {
+    http.Redirect(writer, request, bucket.URL(key), http.StatusFound)
+    return
+  }
+
+  response, err := bucket.GetResponse(key)
+  if isS3NotFound(err) {
+    http.NotFound(writer, request)
+    return
+  }
+  if handleError(err, writer) { return }
+  defer response.Body.Close()
+
+  image, err := ioutil.ReadAll(io.LimitReader(response.Body,
+    MAX_DOCUMENT_IMAGE_BYTES))
+  if handleError(err, writer) { return }
+
+  modTime, err := http.ParseTime(response.Header.Get("Last-Modified"))
+  if err != nil {
+    modTime = time.Time{}
+  }
+
+  writer.Header().Set("Content-Type", detectContentType(imageName, image))
+  http.ServeContent(writer, request, imageName, modTime,
+    bytes.NewReader(image))
+}
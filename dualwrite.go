@@ -0,0 +1,107 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "net/url"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var dualWriteUntil = flag.String("dual-write-until", "",
+  "RFC 3339 time after which requests' dualWrite is ignored, ending a key " +
+  "layout migration (no end if empty)")
+
+// parsed -dual-write-until, or zero if there's no end
+var dualWriteDeadline time.Time
+
+/* Parses -dual-write-until. */
+func setupDualWrite() error {
+  if *dualWriteUntil == "" { return nil }
+
+  deadline, err := time.Parse(time.RFC3339, *dualWriteUntil)
+  if err != nil {
+    return errors.New("-dual-write-until must be an RFC 3339 time, like " +
+      "2024-06-30T00:00:00Z.\n")
+  }
+  dualWriteDeadline = deadline
+  return nil
+}
+
+/* Parses the `dualWrite` key of `form` into `params`. If it's "true", the
+ * renditions are also written to the legacy path templates in
+ * `s3LegacyJPEGPath`, `s3LegacySmallJPEGPath`, `s3LegacyLargeJPEGPath`, and
+ * optionally `s3LegacyDarkJPEGPath`, so clients can move to a new key layout
+ * while the old one is still being read. */
+func parseDualWriteParams(form url.Values, params *conversionParams) error {
+  dualWrite, err := optionalFormValue(form, "dualWrite")
+  if err != nil { return err }
+
+  if dualWrite != "" && dualWrite != "true" && dualWrite != "false" {
+    return errors.New("The 'dualWrite' key must be 'true' or 'false'.\n")
+  }
+  if dualWrite != "true" { return nil }
+
+  if params.Layout != "" {
+    return errors.New("Dual writes require caller-provided path " +
+      "templates, not the 'layout' key.\n")
+  }
+
+  params.DualWrite = true
+  params.S3LegacyJPEGPath, err = requirePathTemplate(form,
+    "s3LegacyJPEGPath", "a legacy JPEG path")
+  if err != nil { return err }
+
+  params.S3LegacySmallJPEGPath, err = requirePathTemplate(form,
+    "s3LegacySmallJPEGPath", "a legacy small JPEG path")
+  if err != nil { return err }
+
+  params.S3LegacyLargeJPEGPath, err = requirePathTemplate(form,
+    "s3LegacyLargeJPEGPath", "a legacy large JPEG path")
+  if err != nil { return err }
+
+  params.S3LegacyDarkJPEGPath, err = optionalFormValue(form,
+    "s3LegacyDarkJPEGPath")
+  if err != nil { return err }
+
+  if params.S3LegacyDarkJPEGPath != "" &&
+      !strings.Contains(params.S3LegacyDarkJPEGPath, "%d") {
+    return errors.New("Must specify a JPEG path with %d in the " +
+      "'s3LegacyDarkJPEGPath' key.\n")
+  }
+  return nil
+}
+
+/* Returns true if renditions converted with `params` should be written to
+ * the legacy paths too: if the request asked for it and -dual-write-until
+ * hasn't passed. Checked at upload time, so queued jobs and re-renders stop
+ * dual-writing once the migration ends. */
+func isDualWriting(params conversionParams) bool {
+  return params.DualWrite &&
+    (dualWriteDeadline.IsZero() || time.Now().Before(dualWriteDeadline))
+}
+
+/* Uploads the renditions of page `pageNum` to the legacy path templates in
+ * `params`, as `uploadJPEGPagesToS3` does to the primary ones. */
+func uploadLegacyJPEGsToS3(job *job, bucket *s3.Bucket,
+    params conversionParams, jpegPath string, smallJPEGPath string,
+    largeJPEGPath string, darkJPEGPath string, pageNum int) error {
+  err := uploadJPEGToS3(job, bucket, params, jpegPath,
+    params.S3LegacyJPEGPath, pageNum)
+  if err != nil { return err }
+
+  err = uploadJPEGToS3(job, bucket, params, smallJPEGPath,
+    params.S3LegacySmallJPEGPath, pageNum)
+  if err != nil { return err }
+
+  err = uploadJPEGToS3(job, bucket, params, largeJPEGPath,
+    params.S3LegacyLargeJPEGPath, pageNum)
+  if err != nil { return err }
+
+  if darkJPEGPath != "" && params.S3LegacyDarkJPEGPath != "" {
+    err = uploadJPEGToS3(job, bucket, params, darkJPEGPath,
+      params.S3LegacyDarkJPEGPath, pageNum)
+  }
+  return err
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "mime"
+  "mime/multipart"
+  "net"
+  "net/http"
+  "net/mail"
+  "net/smtp"
+  "net/textproto"
+  "net/url"
+  "strings"
+  "time"
+  "launchpad.net/goamz/aws"
+  "launchpad.net/goamz/s3"
+)
+
+var emailRoutesPath = flag.String("email-routes", "",
+  "JSON file mapping addresses PDFs may be emailed to onto the template " +
+  "they're converted with (email disabled if empty)")
+var emailTopicARN = flag.String("email-topic-arn", "",
+  "ARN of the SNS topic SES publishes received emails to; /email/ses only " +
+  "accepts messages from it")
+var emailFrom = flag.String("email-from", "",
+  "address replies to emailed documents are sent from")
+var emailSMTP = flag.String("email-smtp", "",
+  "host:port of the SMTP server replies are sent through")
+var emailSMTPUsername = flag.String("email-smtp-username", "",
+  "username for the SMTP server, if it requires one")
+var emailSMTPPassword = flag.String("email-smtp-password", "",
+  "password for the SMTP server")
+
+// tenant conversions of emailed documents are attributed to
+const TENANT_EMAIL = "email"
+
+// largest SNS message accepted; SNS itself allows no more
+const MAX_SNS_MESSAGE_BYTES = 256 * 1024
+
+// largest email read from S3; SES itself receives no more
+const MAX_EMAIL_BYTES = 40 * 1024 * 1024
+
+// most documents converted from a single email
+const MAX_EMAIL_ATTACHMENTS = 10
+
+var emailsTotal = newCounterVec("evangelist_emails_total",
+  "Emails received, by outcome (converted, failed, empty, or rejected).",
+  "outcome")
+
+/* Where documents emailed to an address go. They're stored under
+ * `SourcePrefix` and converted with `Template`. If `Senders` is non-empty,
+ * only those addresses, or addresses at those "@domain"s, may email it. */
+type emailRoute struct {
+  Template string `json:"template"`
+  SourcePrefix string `json:"sourcePrefix"`
+  Senders []string `json:"senders"`
+}
+
+// routes by lowercased address, or empty if email is disabled
+var emailRoutes = map[string]emailRoute{}
+
+/* The verdict of one of SES's checks on a received email, e.g. "PASS". */
+type sesVerdict struct {
+  Status string `json:"status"`
+}
+
+/* The notification SES publishes for a received email that its receipt
+ * rule stored in S3. */
+type sesNotification struct {
+  NotificationType string `json:"notificationType"`
+  Mail struct {
+    MessageID string `json:"messageId"`
+    CommonHeaders struct {
+      From []string `json:"from"`
+      Subject string `json:"subject"`
+      MessageID string `json:"messageId"`
+    } `json:"commonHeaders"`
+  } `json:"mail"`
+  Receipt struct {
+    Recipients []string `json:"recipients"`
+    SpamVerdict sesVerdict `json:"spamVerdict"`
+    VirusVerdict sesVerdict `json:"virusVerdict"`
+    DMARCVerdict sesVerdict `json:"dmarcVerdict"`
+    Action struct {
+      Type string `json:"type"`
+      BucketName string `json:"bucketName"`
+      ObjectKey string `json:"objectKey"`
+    } `json:"action"`
+  } `json:"receipt"`
+}
+
+/* A document attached to an email. */
+type emailAttachment struct {
+  filename string
+  data []byte
+}
+
+/* A document from an email being converted as `job`, or why it couldn't
+ * be. */
+type emailConversion struct {
+  filename string
+  job *job
+  bucket *s3.Bucket
+  params conversionParams
+  err error
+}
+
+/* Loads -email-routes and checks the flags replies are sent with. */
+func loadEmailRoutes() error {
+  if *emailRoutesPath == "" { return nil }
+
+  data, err := ioutil.ReadFile(*emailRoutesPath)
+  if err != nil { return err }
+
+  routes := map[string]emailRoute{}
+  err = json.Unmarshal(data, &routes)
+  if err != nil { return err }
+
+  for address, route := range routes {
+    if route.Template == "" || route.SourcePrefix == "" {
+      return errors.New(fmt.Sprintf("The email route for '%s' needs a " +
+        "template and sourcePrefix.\n", address))
+    }
+    emailRoutes[strings.ToLower(address)] = route
+  }
+
+  if *emailTopicARN == "" || *emailFrom == "" || *emailSMTP == "" {
+    return errors.New("-email-routes requires -email-topic-arn, " +
+      "-email-from, and -email-smtp.\n")
+  }
+
+  _, _, err = net.SplitHostPort(*emailSMTP)
+  if err != nil {
+    return errors.New("-email-smtp must be a host:port.\n")
+  }
+  return nil
+}
+
+/* Returns true if `route` accepts email from `sender`. */
+func (route emailRoute) allows(sender string) bool {
+  if len(route.Senders) == 0 { return true }
+
+  sender = strings.ToLower(sender)
+  for _, allowed := range route.Senders {
+    allowed = strings.ToLower(allowed)
+    if sender == allowed || (strings.HasPrefix(allowed, "@") &&
+        strings.HasSuffix(sender, allowed)) {
+      return true
+    }
+  }
+  return false
+}
+
+/* Returns the route of the first of `recipients` that has one. */
+func findEmailRoute(recipients []string) (emailRoute, bool) {
+  for _, recipient := range recipients {
+    route, ok := emailRoutes[strings.ToLower(recipient)]
+    if ok { return route, true }
+  }
+  return emailRoute{}, false
+}
+
+/* Returns the decoded body of a MIME part with the given
+ * Content-Transfer-Encoding. Quoted-printable parts are decoded by the
+ * multipart reader already. */
+func decodeMIMEBody(body io.Reader, encoding string) ([]byte, error) {
+  if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+    // the decoder skips the line breaks base64 bodies are wrapped with
+    body = base64.NewDecoder(base64.StdEncoding, body)
+  }
+  return ioutil.ReadAll(body)
+}
+
+/* Appends the documents in the MIME entity with the given headers and
+ * `body` to `attachments`: every part that's a PDF, PostScript, EPS, DJVU,
+ * or TIFF file, or a JPEG or PNG attached rather than inline, however deeply
+ * it's nested in multiparts. */
+func collectAttachments(header textproto.MIMEHeader, body io.Reader,
+    attachments []emailAttachment) ([]emailAttachment, error) {
+  mediaType, mediaParams, err := mime.ParseMediaType(
+    header.Get("Content-Type"))
+  if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+    reader := multipart.NewReader(body, mediaParams["boundary"])
+    for {
+      part, err := reader.NextPart()
+      if err == io.EOF { return attachments, nil }
+      if err != nil { return attachments, err }
+
+      attachments, err = collectAttachments(part.Header, part, attachments)
+      if err != nil { return attachments, err }
+    }
+  }
+
+  data, err := decodeMIMEBody(body, header.Get("Content-Transfer-Encoding"))
+  if err != nil { return attachments, err }
+  format := sourceFormat(data)
+  if format == "" { return attachments, nil }
+
+  // the name is in Content-Disposition, or Content-Type in older mailers
+  filename := ""
+  disposition, dispositionParams, err := mime.ParseMediaType(
+    header.Get("Content-Disposition"))
+
+  // inline images are logos and signatures, not documents
+  if (format == SOURCE_JPEG || format == SOURCE_PNG) &&
+      (err != nil || disposition != "attachment") {
+    return attachments, nil
+  }
+  if err == nil {
+    filename = dispositionParams["filename"]
+  }
+  if filename == "" {
+    filename = mediaParams["name"]
+  }
+
+  return append(attachments, emailAttachment{sanitizeFilename(filename),
+    data}), nil
+}
+
+/* Returns the documents attached to the raw email `raw`. */
+func parseEmailAttachments(raw []byte) ([]emailAttachment, error) {
+  message, err := mail.ReadMessage(bytes.NewReader(raw))
+  if err != nil { return nil, err }
+  return collectAttachments(textproto.MIMEHeader(message.Header),
+    message.Body, nil)
+}
+
+/* Reads the email SES stored for `notification` from S3. Only buckets
+ * allowed by -allowed-buckets are read. */
+func fetchEmail(log *slog.Logger,
+    notification sesNotification) ([]byte, error) {
+  action := notification.Receipt.Action
+  regionName, ok := allowedBuckets[action.BucketName]
+  if action.Type != "S3" || !ok {
+    return nil, errors.New("Emails must be stored by SES in an allowed " +
+      "S3 bucket.\n")
+  }
+
+  bucket, err := connectToS3(action.BucketName, aws.Regions[regionName])
+  if err != nil { return nil, err }
+
+  var raw []byte
+  err = withS3Retries(log, S3_OP_DOWNLOAD, func() error {
+    var err error
+    raw, err = bucket.Get(action.ObjectKey)
+    return err
+  })
+  if err != nil { return nil, err }
+
+  if len(raw) > MAX_EMAIL_BYTES {
+    return nil, errors.New("The email is too large.\n")
+  }
+  return raw, nil
+}
+
+/* Stores `attachment` from the email with ID `messageID` under the source
+ * prefix of `route` and queues its conversion with the route's template.
+ * `request` is the SNS request that delivered the email. */
+func queueEmailConversion(request *http.Request, route emailRoute,
+    messageID string, index int, attachment emailAttachment,
+    bucketName string, regionName string) emailConversion {
+  conversion := emailConversion{filename: attachment.filename}
+  key := fmt.Sprintf("%s%s/%d-%s", route.SourcePrefix, messageID, index,
+    attachment.filename)
+
+  form := url.Values{"template": {route.Template}, "s3PDFPath": {key}}
+  template, err := applyTemplate(form, key)
+  if err != nil {
+    conversion.err = err
+    return conversion
+  }
+
+  conversion.params, conversion.err = parseConversionForm(form)
+  if conversion.err != nil { return conversion }
+  conversion.params.Template = template
+
+  conversion.bucket, conversion.err = connectToParamsBucket(
+    conversion.params, bucketName, regionName)
+  if conversion.err != nil { return conversion }
+
+  log := logger.With("request", requestID(request), "key", key)
+  conversion.err = withS3Retries(log, S3_OP_UPLOAD, func() error {
+    return conversion.bucket.Put(key, attachment.data,
+      detectContentType(key, attachment.data), s3.Private)
+  })
+  if conversion.err != nil { return conversion }
+
+  // the audit log sees the conversion as if its form had been posted
+  auditRequest := request.Clone(context.Background())
+  auditRequest.Form = form
+
+  job := newJob(newID(), TENANT_EMAIL, requestID(request))
+  conversion.err = queueAsyncJob(asyncTask{job, conversion.bucket,
+    conversion.params, auditRequest, time.Now()})
+  if conversion.err != nil {
+    job.finish(conversion.err)
+    return conversion
+  }
+
+  conversion.job = job
+  return conversion
+}
+
+/* Returns the plain-text summary of `conversion`, once finished, for the
+ * reply to the email it came from. */
+func describeEmailConversion(conversion emailConversion) string {
+  if conversion.err != nil {
+    return fmt.Sprintf("%s: couldn't convert: %s", conversion.filename,
+      strings.TrimSpace(conversion.err.Error()))
+  }
+
+  status := conversion.job.status()
+  if status.Result == nil {
+    return fmt.Sprintf("%s: conversion failed: %s", conversion.filename,
+      strings.TrimSpace(status.Error))
+  }
+
+  summary := fmt.Sprintf("%s: converted %d pages (job %s)",
+    conversion.filename, status.Result.NumPages, status.ID)
+  if status.Result.ManifestKey != "" {
+    summary += "\n  manifest: " + status.Result.ManifestKey
+  }
+
+  // link to the first page, presigned or public
+  links := status.Result.URLs[TIER_NORMAL]
+  if len(links) == 0 && renditionACL(conversion.params) == s3.PublicRead {
+    for _, key := range status.Result.Keys[TIER_NORMAL] {
+      links = append(links, conversion.bucket.URL(key))
+    }
+  }
+  if len(links) > 0 {
+    summary += "\n  first page: " + links[0]
+  }
+  return summary
+}
+
+/* Returns `header` for a mail header, encoded if it isn't ASCII. */
+func encodeMailHeader(header string) string {
+  return mime.QEncoding.Encode("utf-8", header)
+}
+
+/* Emails `to` the outcome of `conversions`, in reply to the email with the
+ * given Message-ID and subject. Each finished conversion's status is
+ * attached as JSON. */
+func sendEmailReply(to string, subject string, inReplyTo string,
+    conversions []emailConversion) error {
+  var body bytes.Buffer
+  writer := multipart.NewWriter(&body)
+
+  text, err := writer.CreatePart(map[string][]string{
+    "Content-Type": {"text/plain; charset=utf-8"}})
+  if err != nil { return err }
+
+  fmt.Fprintf(text, "Here's what happened to the documents you sent:\n\n")
+  if len(conversions) == 0 {
+    fmt.Fprintf(text, "No PDF, PostScript, EPS, DJVU, TIFF, JPEG, or PNG " +
+      "attachments were found.\n")
+  }
+  for _, conversion := range conversions {
+    fmt.Fprintf(text, "%s\n\n", describeEmailConversion(conversion))
+  }
+
+  for _, conversion := range conversions {
+    if conversion.job == nil { continue }
+
+    encoded, err := json.MarshalIndent(conversion.job.status(), "", "  ")
+    if err != nil { return err }
+
+    attachment, err := writer.CreatePart(map[string][]string{
+      "Content-Type": {"application/json"},
+      "Content-Disposition": {mime.FormatMediaType("attachment",
+        map[string]string{"filename": conversion.filename + ".json"})},
+    })
+    if err != nil { return err }
+    attachment.Write(encoded)
+  }
+
+  err = writer.Close()
+  if err != nil { return err }
+
+  if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+    subject = "Re: " + subject
+  }
+
+  var message bytes.Buffer
+  fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\n",
+    *emailFrom, to, encodeMailHeader(subject))
+  if inReplyTo != "" {
+    fmt.Fprintf(&message, "In-Reply-To: %s\r\nReferences: %s\r\n",
+      inReplyTo, inReplyTo)
+  }
+  fmt.Fprintf(&message, "Date: %s\r\nMIME-Version: 1.0\r\n" +
+    "Content-Type: multipart/mixed; boundary=%s\r\n\r\n",
+    time.Now().Format(time.RFC1123Z), writer.Boundary())
+  message.Write(body.Bytes())
+
+  var auth smtp.Auth = nil
+  if *emailSMTPUsername != "" {
+    host, _, _ := net.SplitHostPort(*emailSMTP)
+    auth = smtp.PlainAuth("", *emailSMTPUsername, *emailSMTPPassword, host)
+  }
+  return smtp.SendMail(*emailSMTP, auth, *emailFrom, []string{to},
+    message.Bytes())
+}
+
+/* Converts the documents attached to the email SES received for
+ * `notification`, which arrived in `request`, and replies to the sender
+ * once they're done. Emails SES flagged, or from senders their route
+ * doesn't allow, are dropped without a reply. Only senders that pass DMARC
+ * are trusted: to reach restricted routes, and to be replied to at all, so
+ * spoofed From headers aren't sent mail. */
+func handleInboundEmail(request *http.Request, notification sesNotification,
+    bucketName string, regionName string) {
+  headers := notification.Mail.CommonHeaders
+  log := logger.With("request", requestID(request),
+    "email", notification.Mail.MessageID)
+
+  route, ok := findEmailRoute(notification.Receipt.Recipients)
+  if !ok || len(headers.From) == 0 {
+    log.Warn("Dropped email to an unrouted address")
+    emailsTotal.add(1, "rejected")
+    return
+  }
+
+  sender, err := mail.ParseAddress(headers.From[0])
+  if err != nil {
+    log.Warn("Dropped email with an invalid sender", errorAttr(err))
+    emailsTotal.add(1, "rejected")
+    return
+  }
+
+  // SPF and DKIM alone can pass for domains other than the From header's
+  receipt := notification.Receipt
+  authenticated := receipt.DMARCVerdict.Status == "PASS"
+  if receipt.SpamVerdict.Status == "FAIL" ||
+      receipt.VirusVerdict.Status == "FAIL" || !route.allows(sender.Address) ||
+      (len(route.Senders) > 0 && !authenticated) {
+    log.Warn("Dropped unwanted email", "sender", sender.Address)
+    emailsTotal.add(1, "rejected")
+    return
+  }
+
+  log = log.With("sender", sender.Address)
+  raw, err := fetchEmail(log, notification)
+  if err != nil {
+    log.Error("Couldn't fetch email", errorAttr(err))
+    emailsTotal.add(1, "failed")
+    return
+  }
+
+  attachments, err := parseEmailAttachments(raw)
+  if err != nil {
+    log.Error("Couldn't parse email", errorAttr(err))
+    emailsTotal.add(1, "failed")
+    return
+  }
+  if len(attachments) > MAX_EMAIL_ATTACHMENTS {
+    attachments = attachments[:MAX_EMAIL_ATTACHMENTS]
+  }
+
+  conversions := []emailConversion{}
+  for i, attachment := range attachments {
+    conversion := queueEmailConversion(request, route,
+      notification.Mail.MessageID, i + 1, attachment, bucketName, regionName)
+    conversions = append(conversions, conversion)
+  }
+  log.Info("Converting emailed documents", "documents", len(conversions))
+
+  outcome := "converted"
+  if len(conversions) == 0 {
+    outcome = "empty"
+  }
+  for _, conversion := range conversions {
+    if conversion.job != nil {
+      <-conversion.job.done
+    }
+    if conversion.err != nil || conversion.job.status().Result == nil {
+      outcome = "failed"
+    }
+  }
+  emailsTotal.add(1, outcome)
+
+  if !authenticated {
+    log.Warn("Not replying to an unauthenticated sender")
+    return
+  }
+  err = sendEmailReply(sender.Address, headers.Subject, headers.MessageID,
+    conversions)
+  if err != nil {
+    log.Error("Couldn't reply to email", errorAttr(err))
+  }
+}
+
+/* Handles POST /email/ses, the SNS subscription SES publishes received
+ * emails to. Each verified notification is processed in the background, so
+ * SNS isn't kept waiting. */
+func serveSESNotifications(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if len(emailRoutes) == 0 {
+    http.Error(writer, "Email isn't enabled.\n", http.StatusNotFound)
+    return
+  }
+
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  var message snsMessage
+  body, err := ioutil.ReadAll(io.LimitReader(request.Body,
+    MAX_SNS_MESSAGE_BYTES))
+  if err == nil {
+    err = json.Unmarshal(body, &message)
+  }
+  if err != nil {
+    http.Error(writer, "Expected an SNS message.\n", http.StatusBadRequest)
+    return
+  }
+
+  err = verifySNSMessage(message, *emailTopicARN)
+  if err != nil {
+    logger.Warn("Rejected SNS message", "request", requestID(request),
+      errorAttr(err))
+    http.Error(writer, err.Error(), http.StatusForbidden)
+    return
+  }
+
+  switch message.Type {
+  case "SubscriptionConfirmation":
+    err = confirmSNSSubscription(message)
+    if handleError(err, writer) { return }
+    logger.Info("Confirmed SNS subscription", "topic", message.TopicArn)
+
+  case "Notification":
+    var notification sesNotification
+    err = json.Unmarshal([]byte(message.Message), &notification)
+    if err != nil || notification.NotificationType != "Received" {
+      http.Error(writer, "Expected an SES receipt notification.\n",
+        http.StatusBadRequest)
+      return
+    }
+    go handleInboundEmail(request.Clone(context.Background()), notification,
+      bucketName, regionName)
+  }
+
+  writer.WriteHeader(http.StatusOK)
+}
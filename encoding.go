@@ -0,0 +1,52 @@
+package main
+
+import (
+  "errors"
+  "os"
+)
+
+// possible JPEG encodings for a tier: baseline is understood by every
+// decoder, progressive renders incrementally, and arithmetic coding is
+// smallest but unsupported by many older decoders
+const (
+  JPEG_BASELINE = "baseline"
+  JPEG_PROGRESSIVE = "progressive"
+  JPEG_ARITHMETIC = "arithmetic"
+)
+
+/* Returns an error if `encoding` isn't a supported JPEG encoding. */
+func validateJPEGEncoding(encoding string, key string) error {
+  if encoding != JPEG_BASELINE && encoding != JPEG_PROGRESSIVE &&
+      encoding != JPEG_ARITHMETIC {
+    return errors.New("The '" + key + "' key must be one of 'baseline', " +
+      "'progressive', or 'arithmetic'.\n")
+  }
+
+  return nil
+}
+
+/* Re-encodes the JPEG at `jpegPath`, the rendition of size `tier`, with the
+ * given encoding and marks it as upright, embedding `metadata` if it isn't
+ * nil. Ghostscript and ImageMagick both write baseline JPEGs, so other
+ * encodings are applied losslessly with jpegtran. */
+func finishJPEG(jpegPath string, tier string, encoding string,
+    metadata *pageMetadata) error {
+  if encoding == JPEG_PROGRESSIVE || encoding == JPEG_ARITHMETIC {
+    transcodedPath := jpegPath + ".transcoded"
+    cmd := toolCommand("jpegtran", "-copy", "none", "-" + encoding,
+      "-outfile", transcodedPath, jpegPath)
+
+    err := runTool(cmd)
+    if err != nil {
+      os.Remove(transcodedPath)
+      return err
+    }
+
+    err = os.Rename(transcodedPath, jpegPath)
+    if err != nil { return err }
+  }
+
+  // pages are always rendered upright, so viewers mustn't rotate them
+  return setJPEGMetadata(jpegPath, EXIF_ORIENTATION_UPRIGHT,
+    metadata.forTier(tier, encoding))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/ecdh"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/url"
+  "os"
+)
+
+// scheme renditions are encrypted with: a sealed box built from X25519,
+// HKDF-SHA256, and AES-256-GCM
+const OUTPUT_ENCRYPTION_SCHEME = "x25519-hkdf-sha256-aes-256-gcm"
+
+// HKDF info binding derived keys to this scheme
+const OUTPUT_ENCRYPTION_INFO = "evangelist rendition v1"
+
+// content type of encrypted renditions
+const ENCRYPTED_CONTENT_TYPE = "application/octet-stream"
+
+// sizes of the parts of an encrypted rendition:
+// ephemeral public key || nonce || ciphertext || tag
+const (
+  X25519_KEY_BYTES = 32
+  GCM_NONCE_BYTES = 12
+)
+
+/* How a document's renditions were encrypted, as listed in its manifest.
+ * `KeyID` is the hex SHA-256 of the recipient's public key, truncated to 8
+ * bytes, so clients holding several keys know which one to use. */
+type outputEncryption struct {
+  Scheme string `json:"scheme"`
+  PublicKey string `json:"publicKey"`
+  KeyID string `json:"keyId"`
+}
+
+/* Parses the optional `outputPublicKey` key of `form`, the base64 X25519
+ * public key renditions are encrypted to, into `params`. */
+func parseOutputEncryptionParams(form url.Values,
+    params *conversionParams) error {
+  publicKey, err := optionalFormValue(form, "outputPublicKey")
+  if err != nil || publicKey == "" { return err }
+
+  _, err = decodeRecipientKey(publicKey)
+  if err != nil {
+    return errors.New("The 'outputPublicKey' key must be a base64 X25519 " +
+      "public key.\n")
+  }
+
+  params.OutputPublicKey = publicKey
+  return nil
+}
+
+/* Returns the X25519 public key encoded in base64 in `encoded`. */
+func decodeRecipientKey(encoded string) (*ecdh.PublicKey, error) {
+  key, err := base64.StdEncoding.DecodeString(encoded)
+  if err != nil {
+    key, err = base64.URLEncoding.DecodeString(encoded)
+  }
+  if err != nil { return nil, err }
+
+  return ecdh.X25519().NewPublicKey(key)
+}
+
+/* Returns the encryption metadata of renditions converted with `params`, or
+ * nil if they aren't encrypted. */
+func newOutputEncryption(params conversionParams) *outputEncryption {
+  if params.OutputPublicKey == "" { return nil }
+
+  recipient, err := decodeRecipientKey(params.OutputPublicKey)
+  if err != nil { return nil }
+
+  digest := sha256.Sum256(recipient.Bytes())
+  return &outputEncryption{
+    Scheme: OUTPUT_ENCRYPTION_SCHEME,
+    PublicKey: base64.StdEncoding.EncodeToString(recipient.Bytes()),
+    KeyID: hex.EncodeToString(digest[:8]),
+  }
+}
+
+/* A rendition to upload, held in memory once encrypted. */
+type sealedUpload struct {
+  *bytes.Reader
+}
+
+func (sealedUpload) Close() error { return nil }
+
+/* Opens the rendition at `path` for uploading, encrypting it first if
+ * `params` asks for encrypted output. Returns it with its size. */
+func openUpload(params conversionParams, path string) (io.ReadSeekCloser,
+    int64, error) {
+  if params.OutputPublicKey == "" {
+    file, err := os.Open(path)
+    if err != nil { return nil, 0, err }
+
+    fileInfo, err := file.Stat()
+    if err != nil {
+      file.Close()
+      return nil, 0, err
+    }
+    return file, fileInfo.Size(), nil
+  }
+
+  plaintext, err := ioutil.ReadFile(path)
+  if err != nil { return nil, 0, err }
+
+  sealed, err := sealRendition(plaintext, params.OutputPublicKey)
+  if err != nil { return nil, 0, err }
+
+  return sealedUpload{bytes.NewReader(sealed)}, int64(len(sealed)), nil
+}
+
+/* Returns the content type of the rendition in `file`, to be stored at
+ * `key`. Encrypted renditions are opaque, whatever their extension says. */
+func uploadContentType(params conversionParams, file io.ReadSeeker,
+    key string) (string, error) {
+  if params.OutputPublicKey != "" { return ENCRYPTED_CONTENT_TYPE, nil }
+  return detectFileContentType(file, key)
+}
+
+/* Returns the HKDF-SHA256 (RFC 5869) output of `length` bytes for input key
+ * material `secret`, `salt`, and `info`. */
+func hkdfSHA256(secret []byte, salt []byte, info []byte, length int) []byte {
+  extractor := hmac.New(sha256.New, salt)
+  extractor.Write(secret)
+  pseudorandomKey := extractor.Sum(nil)
+
+  output := []byte{}
+  block := []byte{}
+  for counter := byte(1); len(output) < length; counter = counter + 1 {
+    expander := hmac.New(sha256.New, pseudorandomKey)
+    expander.Write(block)
+    expander.Write(info)
+    expander.Write([]byte{counter})
+    block = expander.Sum(nil)
+    output = append(output, block...)
+  }
+  return output[:length]
+}
+
+/* Encrypts `plaintext` so only the holder of the private key matching the
+ * base64 X25519 `publicKey` can read it. A fresh ephemeral key pair is
+ * agreed with the recipient's key, and the shared secret is stretched with
+ * HKDF-SHA256 (salted with both public keys) into an AES-256-GCM key. The
+ * result is the ephemeral public key, the nonce, and the ciphertext and
+ * tag. */
+func sealRendition(plaintext []byte, publicKey string) ([]byte, error) {
+  recipient, err := decodeRecipientKey(publicKey)
+  if err != nil { return nil, err }
+
+  ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+  if err != nil { return nil, err }
+
+  secret, err := ephemeral.ECDH(recipient)
+  if err != nil { return nil, err }
+
+  salt := append(ephemeral.PublicKey().Bytes(), recipient.Bytes()...)
+  key := hkdfSHA256(secret, salt, []byte(OUTPUT_ENCRYPTION_INFO), 32)
+
+  block, err := aes.NewCipher(key)
+  if err != nil { return nil, err }
+
+  gcm, err := cipher.NewGCM(block)
+  if err != nil { return nil, err }
+
+  nonce := make([]byte, GCM_NONCE_BYTES)
+  _, err = rand.Read(nonce)
+  if err != nil { return nil, err }
+
+  sealed := append(ephemeral.PublicKey().Bytes(), nonce...)
+  return gcm.Seal(sealed, nonce, plaintext, nil), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "io/ioutil"
+  "os"
+)
+
+// JPEG markers we care about
+const (
+  JPEG_SOI = 0xd8
+  JPEG_APP1 = 0xe1
+  JPEG_SOS = 0xda
+)
+
+// EXIF orientation for an image whose pixels are already upright
+const EXIF_ORIENTATION_UPRIGHT = 1
+
+// EXIF (TIFF) tags we write
+const (
+  EXIF_TAG_DOCUMENT_NAME = 0x010d
+  EXIF_TAG_IMAGE_DESCRIPTION = 0x010e
+  EXIF_TAG_ORIENTATION = 0x0112
+  EXIF_TAG_PAGE_NUMBER = 0x0129
+  EXIF_TAG_SOFTWARE = 0x0131
+)
+
+// TIFF types of the EXIF values we write
+const (
+  EXIF_TYPE_ASCII = 2
+  EXIF_TYPE_SHORT = 3
+)
+
+// what APP1 segments holding EXIF and XMP begin with
+const (
+  EXIF_IDENTIFIER = "Exif\x00\x00"
+  XMP_IDENTIFIER = "http://ns.adobe.com/xap/1.0/\x00"
+)
+
+/* One entry of an EXIF IFD: a tag and its value, already encoded in big
+ * endian as `count` values of TIFF type `kind`. */
+type exifEntry struct {
+  tag uint16
+  kind uint16
+  count uint32
+  value []byte
+}
+
+/* Returns an entry for the ASCII tag `tag` holding `text`. */
+func exifASCII(tag uint16, text string) exifEntry {
+  value := append([]byte(text), 0)
+  return exifEntry{tag, EXIF_TYPE_ASCII, uint32(len(value)), value}
+}
+
+/* Returns an entry for the tag `tag` holding the SHORTs `values`. */
+func exifShorts(tag uint16, values ...uint16) exifEntry {
+  var value bytes.Buffer
+  binary.Write(&value, binary.BigEndian, values)
+  return exifEntry{tag, EXIF_TYPE_SHORT, uint32(len(values)), value.Bytes()}
+}
+
+/* Returns an APP1 segment holding a big-endian EXIF block with a single
+ * IFD, IFD0, of `entries`, which must be sorted by tag. Values longer than
+ * four bytes are stored after the IFD. */
+func exifSegment(entries []exifEntry) []byte {
+  var tiff bytes.Buffer
+  tiff.WriteString("MM")
+  binary.Write(&tiff, binary.BigEndian, uint16(42))  // TIFF magic
+  binary.Write(&tiff, binary.BigEndian, uint32(8))  // offset of IFD0
+
+  // entry count, 12 bytes per entry, and the next IFD's offset
+  dataOffset := 8 + 2 + 12 * len(entries) + 4
+  var data bytes.Buffer
+
+  binary.Write(&tiff, binary.BigEndian, uint16(len(entries)))
+  for _, entry := range entries {
+    binary.Write(&tiff, binary.BigEndian, entry.tag)
+    binary.Write(&tiff, binary.BigEndian, entry.kind)
+    binary.Write(&tiff, binary.BigEndian, entry.count)
+    if len(entry.value) <= 4 {
+      tiff.Write(entry.value)
+      tiff.Write(make([]byte, 4 - len(entry.value)))  // value padding
+    } else {
+      binary.Write(&tiff, binary.BigEndian,
+        uint32(dataOffset + data.Len()))
+      data.Write(entry.value)
+      // values start on word boundaries
+      if data.Len() % 2 == 1 { data.WriteByte(0) }
+    }
+  }
+  binary.Write(&tiff, binary.BigEndian, uint32(0))  // no next IFD
+  tiff.Write(data.Bytes())
+
+  return app1Segment(EXIF_IDENTIFIER, tiff.Bytes())
+}
+
+/* Returns an APP1 segment holding `payload` after `identifier`. */
+func app1Segment(identifier string, payload []byte) []byte {
+  var segment bytes.Buffer
+  segment.Write([]byte{0xff, JPEG_APP1})
+  binary.Write(&segment, binary.BigEndian,
+    uint16(2 + len(identifier) + len(payload)))
+  segment.WriteString(identifier)
+  segment.Write(payload)
+  return segment.Bytes()
+}
+
+/* Rewrites the JPEG at `jpegPath` so that its only EXIF block records the
+ * given orientation, along with where it came from if `metadata` isn't nil,
+ * which is also recorded as XMP. Any existing EXIF and XMP blocks are
+ * dropped, as they may describe the image before it was rotated. */
+func setJPEGMetadata(jpegPath string, orientation uint16,
+    metadata *pageMetadata) error {
+  data, err := ioutil.ReadFile(jpegPath)
+  if err != nil { return err }
+
+  if len(data) < 4 || data[0] != 0xff || data[1] != JPEG_SOI {
+    return errors.New("Not a JPEG: " + jpegPath + "\n")
+  }
+
+  var output bytes.Buffer
+  output.Write(data[:2])
+  entries := []exifEntry{
+    exifShorts(EXIF_TAG_ORIENTATION, orientation),
+  }
+  if metadata != nil {
+    entries = metadata.exifEntries(orientation)
+  }
+  output.Write(exifSegment(entries))
+
+  if metadata != nil {
+    xmp, err := metadata.xmpSegment()
+    if err != nil { return err }
+    output.Write(xmp)
+  }
+
+  // copy every marker segment up to the scan, except old EXIF and XMP
+  offset := 2
+  for offset + 4 <= len(data) && data[offset] == 0xff &&
+      data[offset + 1] != JPEG_SOS {
+    length := int(binary.BigEndian.Uint16(data[offset + 2:]))
+    end := offset + 2 + length
+    if length < 2 || end > len(data) {
+      return errors.New("Malformed JPEG: " + jpegPath + "\n")
+    }
+
+    payload := data[offset + 4:end]
+    isMetadata := data[offset + 1] == JPEG_APP1 &&
+      (bytes.HasPrefix(payload, []byte("Exif\x00")) ||
+      bytes.HasPrefix(payload, []byte(XMP_IDENTIFIER)))
+    if !isMetadata {
+      output.Write(data[offset:end])
+    }
+    offset = end
+  }
+
+  // the scan and everything after it are copied untouched
+  output.Write(data[offset:])
+
+  fileInfo, err := os.Stat(jpegPath)
+  if err != nil { return err }
+  return ioutil.WriteFile(jpegPath, output.Bytes(), fileInfo.Mode())
+}
+
+/* Returns the EXIF orientation the JPEG `data` is tagged with, from 1
+ * (upright) to 8, or EXIF_ORIENTATION_UPRIGHT if it has none. */
+func jpegOrientation(data []byte) int {
+  offset := 2
+  for offset + 4 <= len(data) && data[offset] == 0xff &&
+      data[offset + 1] != JPEG_SOS {
+    length := int(binary.BigEndian.Uint16(data[offset + 2:]))
+    end := offset + 2 + length
+    if length < 2 || end > len(data) { break }
+
+    payload := data[offset + 4:end]
+    if data[offset + 1] == JPEG_APP1 &&
+        bytes.HasPrefix(payload, []byte(EXIF_IDENTIFIER)) {
+      return exifOrientation(payload[len(EXIF_IDENTIFIER):])
+    }
+    offset = end
+  }
+  return EXIF_ORIENTATION_UPRIGHT
+}
+
+/* Returns the orientation recorded in the first IFD of the EXIF block
+ * `tiff`, or EXIF_ORIENTATION_UPRIGHT if it has none. */
+func exifOrientation(tiff []byte) int {
+  if len(tiff) < 8 { return EXIF_ORIENTATION_UPRIGHT }
+
+  var order binary.ByteOrder = binary.BigEndian
+  if bytes.HasPrefix(tiff, []byte("II")) {
+    order = binary.LittleEndian
+  } else if !bytes.HasPrefix(tiff, []byte("MM")) {
+    return EXIF_ORIENTATION_UPRIGHT
+  }
+
+  ifd := int64(order.Uint32(tiff[4:]))
+  if ifd + 2 > int64(len(tiff)) { return EXIF_ORIENTATION_UPRIGHT }
+  numEntries := int(order.Uint16(tiff[ifd:]))
+
+  for i := 0; i < numEntries; i = i + 1 {
+    entry := ifd + 2 + int64(i) * 12
+    if entry + 12 > int64(len(tiff)) { break }
+
+    if order.Uint16(tiff[entry:]) == EXIF_TAG_ORIENTATION &&
+        order.Uint16(tiff[entry + 2:]) == EXIF_TYPE_SHORT {
+      orientation := int(order.Uint16(tiff[entry + 8:]))
+      if orientation < 1 || orientation > 8 { break }
+      return orientation
+    }
+  }
+  return EXIF_ORIENTATION_UPRIGHT
+}
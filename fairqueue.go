@@ -0,0 +1,237 @@
+package main
+
+import (
+  "container/heap"
+  "errors"
+  "net/http"
+  "net/url"
+  "strconv"
+  "sync"
+)
+
+// weight of tenants that haven't been given one
+const DEFAULT_TENANT_WEIGHT = 1.0
+
+/* A page render waiting for a slot on behalf of `tenant`. Waiters are served
+ * in order of `start`, their virtual start time, then of arrival. */
+type fairWaiter struct {
+  tenant string
+  start float64
+  arrival uint64
+  ready chan struct{}
+}
+
+/* A min-heap of waiters, implementing heap.Interface. */
+type fairWaiterHeap []*fairWaiter
+
+func (waiters fairWaiterHeap) Len() int { return len(waiters) }
+
+func (waiters fairWaiterHeap) Less(i int, j int) bool {
+  if waiters[i].start != waiters[j].start {
+    return waiters[i].start < waiters[j].start
+  }
+  return waiters[i].arrival < waiters[j].arrival
+}
+
+func (waiters fairWaiterHeap) Swap(i int, j int) {
+  waiters[i], waiters[j] = waiters[j], waiters[i]
+}
+
+func (waiters *fairWaiterHeap) Push(waiter interface{}) {
+  *waiters = append(*waiters, waiter.(*fairWaiter))
+}
+
+func (waiters *fairWaiterHeap) Pop() interface{} {
+  old := *waiters
+  waiter := old[len(old) - 1]
+  *waiters = old[:len(old) - 1]
+  return waiter
+}
+
+/* Hands out a fixed number of slots for one stage, e.g. rendering, using
+ * start-time fair queuing: each tenant's renders are stamped with a virtual
+ * start time that advances by 1/weight per render, and the waiting render
+ * with the earliest stamp goes next. A tenant with a huge backlog thus gets
+ * its weighted share of slots rather than all of them, while an idle
+ * tenant's next render goes straight to the front. */
+type fairScheduler struct {
+  mutex sync.Mutex
+  slots int
+  freeSlots int
+  virtualTime float64
+  arrivals uint64
+  lastFinish map[string]float64
+  weights map[string]float64
+  waiters fairWaiterHeap
+}
+
+/* Returns a scheduler handing out `slots` slots. */
+func newFairScheduler(slots int) *fairScheduler {
+  return &fairScheduler{slots: slots, freeSlots: slots,
+    lastFinish: map[string]float64{}, weights: map[string]float64{}}
+}
+
+/* Returns the weight of `tenant`. Expects the mutex to be held. */
+func (scheduler *fairScheduler) weightLocked(tenant string) float64 {
+  weight, ok := scheduler.weights[tenant]
+  if !ok { return DEFAULT_TENANT_WEIGHT }
+  return weight
+}
+
+/* Blocks until `tenant` may render a page. Every acquire must be followed by
+ * a release. */
+func (scheduler *fairScheduler) acquire(tenant string) {
+  scheduler.mutex.Lock()
+
+  // a tenant can't bank credit while idle: start no earlier than now
+  start := scheduler.lastFinish[tenant]
+  if start < scheduler.virtualTime {
+    start = scheduler.virtualTime
+  }
+  scheduler.lastFinish[tenant] = start + 1 / scheduler.weightLocked(tenant)
+
+  if scheduler.freeSlots > 0 && len(scheduler.waiters) == 0 {
+    scheduler.freeSlots -= 1
+    scheduler.virtualTime = start
+    scheduler.mutex.Unlock()
+    return
+  }
+
+  waiter := &fairWaiter{tenant: tenant, start: start,
+    arrival: scheduler.arrivals, ready: make(chan struct{})}
+  scheduler.arrivals += 1
+  heap.Push(&scheduler.waiters, waiter)
+  scheduler.mutex.Unlock()
+
+  <-waiter.ready
+}
+
+/* Frees a slot, handing it straight to the next waiter, if any. */
+func (scheduler *fairScheduler) release() {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+
+  // after the slots are reduced, released slots are retired first
+  if len(scheduler.waiters) == 0 || scheduler.freeSlots < 0 {
+    scheduler.freeSlots += 1
+    return
+  }
+  scheduler.wakeNextLocked()
+}
+
+/* Hands a slot to the next waiter. Expects the mutex to be held. */
+func (scheduler *fairScheduler) wakeNextLocked() {
+  waiter := heap.Pop(&scheduler.waiters).(*fairWaiter)
+  scheduler.virtualTime = waiter.start
+  close(waiter.ready)
+}
+
+/* Changes the number of slots to `slots`. Added slots go straight to
+ * waiters; removed ones are retired as renders holding them finish. */
+func (scheduler *fairScheduler) setSlots(slots int) {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+
+  scheduler.freeSlots += slots - scheduler.slots
+  scheduler.slots = slots
+  for scheduler.freeSlots > 0 && len(scheduler.waiters) > 0 {
+    scheduler.freeSlots -= 1
+    scheduler.wakeNextLocked()
+  }
+}
+
+/* Returns the number of slots. */
+func (scheduler *fairScheduler) numSlots() int {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+  return scheduler.slots
+}
+
+/* Sets the weight of `tenant`, which takes effect from its next render. */
+func (scheduler *fairScheduler) setWeight(tenant string, weight float64) {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+  scheduler.weights[tenant] = weight
+}
+
+/* Resets the weight of `tenant` to the default. */
+func (scheduler *fairScheduler) resetWeight(tenant string) {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+  delete(scheduler.weights, tenant)
+}
+
+/* The current scheduling weights, as reported by GET /admin/weights. */
+type weightsResponse struct {
+  DefaultWeight float64 `json:"defaultWeight"`
+  Weights map[string]float64 `json:"weights"`
+  Waiting map[string]int `json:"waiting"`
+}
+
+/* Returns a snapshot of the scheduler's weights and waiting renders. */
+func (scheduler *fairScheduler) snapshot() weightsResponse {
+  scheduler.mutex.Lock()
+  defer scheduler.mutex.Unlock()
+
+  response := weightsResponse{DefaultWeight: DEFAULT_TENANT_WEIGHT,
+    Weights: map[string]float64{}, Waiting: map[string]int{}}
+  for tenant, weight := range scheduler.weights {
+    response.Weights[tenant] = weight
+  }
+  for _, waiter := range scheduler.waiters {
+    response.Waiting[waiter.tenant] += 1
+  }
+  return response
+}
+
+/* Handles /admin/weights. GET reports each tenant's weight and how many of
+ * its renders are waiting. POST sets the weight of tenant `tenant` in every
+ * stage to `weight`, a positive number, or back to the default if `weight`
+ * is "default". */
+func serveWeights(writer http.ResponseWriter, request *http.Request) {
+  if !requireAdmin(writer, request) { return }
+
+  switch request.Method {
+  case "GET":
+    writeJSON(writer, http.StatusOK, renderPool.scheduler.snapshot())
+
+  case "POST":
+    err := request.ParseForm()
+    if handleError(err, writer) { return }
+
+    err = updateWeight(request.Form)
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusBadRequest)
+      return
+    }
+    writeJSON(writer, http.StatusOK, renderPool.scheduler.snapshot())
+
+  default:
+    http.Error(writer, "Only GET and POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+  }
+}
+
+/* Sets the weight of the tenant in the `tenant` key of `form` to the one in
+ * the `weight` key. */
+func updateWeight(form url.Values) error {
+  tenant, err := requireFormValue(form, "tenant", "a tenant name")
+  if err != nil { return err }
+
+  weight, err := requireFormValue(form, "weight", "a weight")
+  if err != nil { return err }
+
+  if weight == "default" {
+    resetTenantWeight(tenant)
+    return nil
+  }
+
+  parsedWeight, err := strconv.ParseFloat(weight, 64)
+  if err != nil || !(parsedWeight > 0) || parsedWeight > 1e6 {
+    return errors.New("The 'weight' key must be a positive number or " +
+      "'default'.\n")
+  }
+
+  setTenantWeight(tenant, parsedWeight)
+  return nil
+}
@@ -0,0 +1,29 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+import (
+  "os"
+)
+
+// environment variable configuring injected faults in chaos builds
+const FAULTS_ENV = "EVANGELIST_FAULTS"
+
+// Without the chaos build tag, fault injection is compiled out entirely, so
+// production binaries can't be made to fail by their environment.
+
+/* Warns if faults are configured, since this build can't inject them. */
+func setupFaults() error {
+  if os.Getenv(FAULTS_ENV) != "" {
+    logger.Warn("Ignoring faults; build with -tags chaos to inject them",
+      "variable", FAULTS_ENV)
+  }
+  return nil
+}
+
+func injectS3PutFault(remotePath string) error { return nil }
+
+func injectRenderDelay(pageNum int) {}
+
+func injectPageCorruption(jpegPath string, pageNum int) error { return nil }
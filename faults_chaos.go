@@ -0,0 +1,119 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+  "errors"
+  "math/rand"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// environment variable configuring injected faults, e.g.
+// "s3-put=0.1,gs-delay=0.2:5s,corrupt-page=0.05"
+const FAULTS_ENV = "EVANGELIST_FAULTS"
+
+// faults that can be injected, each with the probability it's injected on
+// any given occasion
+const (
+  FAULT_S3_PUT = "s3-put"
+  FAULT_GS_DELAY = "gs-delay"
+  FAULT_CORRUPT_PAGE = "corrupt-page"
+)
+
+// bytes of a rendered page overwritten when it's corrupted, enough to
+// destroy its JPEG header
+const CORRUPTED_PAGE_BYTES = 64
+
+var faultProbabilities = map[string]float64{}
+var renderDelay time.Duration
+
+/* Parses the faults to inject from $EVANGELIST_FAULTS: a comma-separated
+ * list of fault=probability, where gs-delay also takes a duration, as in
+ * gs-delay=0.2:5s. */
+func setupFaults() error {
+  spec := os.Getenv(FAULTS_ENV)
+  if spec == "" { return nil }
+
+  for _, item := range strings.Split(spec, ",") {
+    parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+    if len(parts) != 2 {
+      return errors.New("Malformed fault '" + item + "' in " + FAULTS_ENV +
+        ".\n")
+    }
+
+    name, value := parts[0], parts[1]
+    if name == FAULT_GS_DELAY {
+      delay := strings.SplitN(value, ":", 2)
+      if len(delay) != 2 {
+        return errors.New("The gs-delay fault needs a duration, as in " +
+          "gs-delay=0.2:5s.\n")
+      }
+
+      var err error
+      renderDelay, err = time.ParseDuration(delay[1])
+      if err != nil { return err }
+      value = delay[0]
+    } else if name != FAULT_S3_PUT && name != FAULT_CORRUPT_PAGE {
+      return errors.New("Unknown fault '" + name + "' in " + FAULTS_ENV +
+        ".\n")
+    }
+
+    probability, err := strconv.ParseFloat(value, 64)
+    if err != nil || probability < 0 || probability > 1 {
+      return errors.New("The probability of fault '" + name + "' must be " +
+        "from 0 to 1.\n")
+    }
+    faultProbabilities[name] = probability
+  }
+
+  logger.Warn("Injecting faults", "faults", spec)
+  return nil
+}
+
+/* Returns true if fault `name` should be injected this time. */
+func shouldInjectFault(name string) bool {
+  return rand.Float64() < faultProbabilities[name]
+}
+
+/* Returns an S3 error, either throttling or a server error, if an upload to
+ * `remotePath` should fail. */
+func injectS3PutFault(remotePath string) error {
+  if !shouldInjectFault(FAULT_S3_PUT) { return nil }
+
+  logger.Warn("Injecting a failed upload", "key", remotePath)
+  if rand.Intn(2) == 0 {
+    return &s3.Error{StatusCode: http.StatusServiceUnavailable,
+      Code: "SlowDown", Message: "Injected fault."}
+  }
+  return &s3.Error{StatusCode: http.StatusInternalServerError,
+    Code: "InternalError", Message: "Injected fault."}
+}
+
+/* Sleeps before page `pageNum` is rendered, if it should be delayed. */
+func injectRenderDelay(pageNum int) {
+  if !shouldInjectFault(FAULT_GS_DELAY) { return }
+
+  logger.Warn("Injecting a render delay", "page", pageNum,
+    "delay", renderDelay.String())
+  time.Sleep(renderDelay)
+}
+
+/* Overwrites the start of the rendered page at `jpegPath` with zeros, if
+ * page `pageNum` should be corrupted, so processing it fails. */
+func injectPageCorruption(jpegPath string, pageNum int) error {
+  if !shouldInjectFault(FAULT_CORRUPT_PAGE) { return nil }
+
+  logger.Warn("Injecting corruption", "page", pageNum)
+  file, err := os.OpenFile(jpegPath, os.O_WRONLY, 0)
+  if err != nil { return err }
+  defer file.Close()
+
+  _, err = file.Write(make([]byte, CORRUPTED_PAGE_BYTES))
+  return err
+}
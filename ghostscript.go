@@ -0,0 +1,18 @@
+//go:build !gsapi
+// +build !gsapi
+
+package main
+
+// Without the gsapi build tag, Ghostscript is run as a separate gs process
+// for each page, so the binary builds and runs without libgs.
+
+/* Does nothing; this build has no in-process interpreter to set up. */
+func setupGhostscript() error { return nil }
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` by running
+ * gs, with `extraArgs` from ghostscriptArgs. */
+func renderWithGhostscript(pdfPath string, pageNum int, outputPath string,
+    density int, quality int, gray bool, extraArgs []string) error {
+  return runTool(ghostscriptCommand(pdfPath, pageNum, outputPath, density,
+    quality, gray, extraArgs))
+}
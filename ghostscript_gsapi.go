@@ -0,0 +1,196 @@
+//go:build gsapi
+// +build gsapi
+
+package main
+
+/*
+#cgo LDFLAGS: -lgs
+#include <stdlib.h>
+#include <ghostscript/iapi.h>
+*/
+import "C"
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+  "unsafe"
+)
+
+// pages an interpreter renders before it's replaced, so whatever it leaks
+// or caches from one document to the next can't accumulate forever
+const GHOSTSCRIPT_PAGES_PER_INTERPRETER = 500
+
+// from gsapi's iapi.h, which older headers don't all define
+const GS_ARG_ENCODING_UTF8 = 1
+
+// With the gsapi build tag, pages are rendered by Ghostscript interpreters
+// linked into the server through libgs, instead of by a gs process per page:
+// at our volume, spawning gs and having it load its resources costs a CPU
+// core by itself. Interpreters are kept between pages, one per page being
+// rendered at once, and pages they fail on are retried by running gs, just
+// as they would be without the tag.
+
+/* A Ghostscript instance, initialized with `device` and ready to run
+ * PostScript. It's only used by one page at a time. */
+type ghostscriptInterpreter struct {
+  instance unsafe.Pointer
+  device string
+  pages int
+}
+
+// interpreters that aren't rendering a page right now, by device, and the
+// lock on them
+var idleInterpreters = map[string][]*ghostscriptInterpreter{}
+var interpretersMutex sync.Mutex
+
+/* Returns an error describing Ghostscript's return `code` from `call`. */
+func ghostscriptError(call string, code C.int) error {
+  return errors.New(fmt.Sprintf("Ghostscript's %s failed with code %d.\n",
+    call, int(code)))
+}
+
+/* Logs which libgs the server is linked against, failing if it can't
+ * report its revision. */
+func setupGhostscript() error {
+  var revision C.gsapi_revision_t
+  code := C.gsapi_revision(&revision, C.int(unsafe.Sizeof(revision)))
+  if code != 0 { return ghostscriptError("gsapi_revision", code) }
+
+  logger.Info("Rendering with Ghostscript in-process",
+    "product", C.GoString(revision.product),
+    "revision", int64(revision.revision))
+  return nil
+}
+
+/* Returns a new interpreter set up to render JPEGs with `device`, allowed
+ * to read and write files only in -scratch-dir. */
+func newGhostscriptInterpreter(device string) (*ghostscriptInterpreter,
+    error) {
+  var instance unsafe.Pointer
+  code := C.gsapi_new_instance(&instance, nil)
+  if code < 0 { return nil, ghostscriptError("gsapi_new_instance", code) }
+
+  interpreter := &ghostscriptInterpreter{instance: instance, device: device}
+  code = C.gsapi_set_arg_encoding(instance, GS_ARG_ENCODING_UTF8)
+  if code < 0 {
+    interpreter.close()
+    return nil, ghostscriptError("gsapi_set_arg_encoding", code)
+  }
+
+  args := []string{"gs", "-q", "-dNOPAUSE", "-dSAFER", "-sDEVICE=" + device,
+    "--permit-file-all=" + strings.TrimSuffix(*scratchDir, "/") + "/"}
+  argv := make([]*C.char, len(args))
+  for i, arg := range args {
+    argv[i] = C.CString(arg)
+    defer C.free(unsafe.Pointer(argv[i]))
+  }
+
+  code = C.gsapi_init_with_args(instance, C.int(len(argv)), &argv[0])
+  if code < 0 {
+    interpreter.close()
+    return nil, ghostscriptError("gsapi_init_with_args", code)
+  }
+  return interpreter, nil
+}
+
+/* Shuts down and frees the interpreter. */
+func (interpreter *ghostscriptInterpreter) close() {
+  C.gsapi_exit(interpreter.instance)
+  C.gsapi_delete_instance(interpreter.instance)
+}
+
+/* Returns `text` as a PostScript string literal. */
+func postScriptString(text string) string {
+  escaper := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+  return "(" + escaper.Replace(text) + ")"
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` as the
+ * equivalent of ghostscriptCommand does. Afterwards the output file is
+ * pointed elsewhere, which closes the page's JPEG; the printer device only
+ * creates its file once a page is output, so nothing is written there. */
+func (interpreter *ghostscriptInterpreter) renderPage(pdfPath string,
+    pageNum int, outputPath string, density int, quality int) error {
+  program := fmt.Sprintf("<< /OutputFile %s /HWResolution [%d %d] " +
+    "/JPEGQ %d >> setpagedevice\n" +
+    "%s (r) file runpdfbegin %d pdfgetpage pdfshowpage runpdfend\n" +
+    "<< /OutputFile %s >> setpagedevice\n",
+    postScriptString(outputPath), density, density, quality,
+    postScriptString(pdfPath), pageNum,
+    postScriptString(scratchPath("gsapi-idle.jpg")))
+
+  source := C.CString(program)
+  defer C.free(unsafe.Pointer(source))
+
+  var exitCode C.int
+  code := C.gsapi_run_string(interpreter.instance, source, 0, &exitCode)
+  interpreter.pages = interpreter.pages + 1
+  if code < 0 { return ghostscriptError("gsapi_run_string", code) }
+  return nil
+}
+
+/* Returns an idle interpreter with `device`, starting one if there's
+ * none. */
+func takeGhostscriptInterpreter(device string) (*ghostscriptInterpreter,
+    error) {
+  interpretersMutex.Lock()
+  idle := idleInterpreters[device]
+  count := len(idle)
+  if count > 0 {
+    interpreter := idle[count - 1]
+    idleInterpreters[device] = idle[:count - 1]
+    interpretersMutex.Unlock()
+    return interpreter, nil
+  }
+  interpretersMutex.Unlock()
+
+  return newGhostscriptInterpreter(device)
+}
+
+/* Keeps `interpreter` for the next page, unless it's rendered its share of
+ * pages or there are already as many idle with its device as -render-slots
+ * allows. */
+func releaseGhostscriptInterpreter(interpreter *ghostscriptInterpreter) {
+  interpretersMutex.Lock()
+  idle := idleInterpreters[interpreter.device]
+  if interpreter.pages < GHOSTSCRIPT_PAGES_PER_INTERPRETER &&
+      len(idle) < tunedInt(renderSlots) {
+    idleInterpreters[interpreter.device] = append(idle, interpreter)
+    interpreter = nil
+  }
+  interpretersMutex.Unlock()
+
+  if interpreter != nil { interpreter.close() }
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` with an
+ * in-process interpreter. If one can't be started, or it fails on the page,
+ * the page is rendered by running gs instead, and a failed interpreter is
+ * discarded, since it may be left in any state. Pages with `extraArgs`,
+ * from ghostscriptArgs, are always rendered by running gs, since
+ * interpreters only take arguments when they start. */
+func renderWithGhostscript(pdfPath string, pageNum int, outputPath string,
+    density int, quality int, gray bool, extraArgs []string) error {
+  if len(extraArgs) > 0 {
+    return runTool(ghostscriptCommand(pdfPath, pageNum, outputPath, density,
+      quality, gray, extraArgs))
+  }
+
+  interpreter, err := takeGhostscriptInterpreter(ghostscriptDevice(gray))
+  if err == nil {
+    err = interpreter.renderPage(pdfPath, pageNum, outputPath, density,
+      quality)
+    if err == nil {
+      releaseGhostscriptInterpreter(interpreter)
+      return nil
+    }
+    interpreter.close()
+  }
+
+  logger.Warn("Rendering with gs instead of libgs", "page", pageNum,
+    errorAttr(err))
+  return runTool(ghostscriptCommand(pdfPath, pageNum, outputPath, density,
+    quality, gray, nil))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "net/url"
+  "regexp"
+  "strings"
+)
+
+var ghostscriptArgAllowlist = flag.String("ghostscript-arg-allowlist",
+  "-dUseCropBox,-dUseTrimBox,-dUseArtBox,-dUseBleedBox,-dPrinted," +
+  "-dPrinted=false,-dShowAnnots=false,-dShowAcroForm=false," +
+  "-dNOINTERPOLATE,-dTextAlphaBits=#,-dGraphicsAlphaBits=#",
+  "comma-separated Ghostscript flags clients may pass in 'ghostscriptArgs'; " +
+  "a '#' matches a whole number")
+
+// most extra Ghostscript flags a single request may pass
+const MAX_GHOSTSCRIPT_ARGS = 16
+
+// what a flag in -ghostscript-arg-allowlist may look like: a define, with at
+// most one '#' standing in for its number
+var ALLOWED_GHOSTSCRIPT_ARG_PATTERN = regexp.MustCompile(
+  "^-[ds][A-Za-z][A-Za-z0-9]*(=[A-Za-z0-9.]*#?[A-Za-z0-9.]*)?$")
+
+// defines that can't be allowed: they'd turn off -dSAFER, choose where or
+// how output is written, or fight the per-page rendering
+var UNSAFE_GHOSTSCRIPT_DEFINES = []string{"-dNOSAFER", "-dDELAYSAFER",
+  "-dWRITESYSTEMDICT", "-sDEVICE", "-sOutputFile", "-dFirstPage",
+  "-dLastPage", "-sPageList"}
+
+// patterns matching the flags in -ghostscript-arg-allowlist
+var allowedGhostscriptArgs = []*regexp.Regexp{}
+
+/* Parses -ghostscript-arg-allowlist, failing if an entry isn't a define
+ * like "-dUseCropBox" or "-dTextAlphaBits=#", or is one of
+ * UNSAFE_GHOSTSCRIPT_DEFINES. Values can't hold paths, since they're what
+ * an argument injection would be after. */
+func setupGhostscriptArgs() error {
+  for _, entry := range strings.Split(*ghostscriptArgAllowlist, ",") {
+    entry = strings.TrimSpace(entry)
+    if entry == "" { continue }
+
+    if !ALLOWED_GHOSTSCRIPT_ARG_PATTERN.MatchString(entry) {
+      return errors.New(fmt.Sprintf("'%s' in -ghostscript-arg-allowlist " +
+        "isn't a Ghostscript define like '-dUseCropBox' or " +
+        "'-dTextAlphaBits=#'.\n", entry))
+    }
+
+    name := strings.SplitN(entry, "=", 2)[0]
+    for _, define := range UNSAFE_GHOSTSCRIPT_DEFINES {
+      if strings.EqualFold(name, define) {
+        return errors.New(fmt.Sprintf("'%s' can't be allowed in " +
+          "-ghostscript-arg-allowlist.\n", entry))
+      }
+    }
+
+    pattern := "^" + strings.Replace(regexp.QuoteMeta(entry), "#", "[0-9]+",
+      1) + "$"
+    allowedGhostscriptArgs = append(allowedGhostscriptArgs,
+      regexp.MustCompile(pattern))
+  }
+  return nil
+}
+
+/* Returns true if `arg` matches a flag in -ghostscript-arg-allowlist. */
+func isAllowedGhostscriptArg(arg string) bool {
+  for _, pattern := range allowedGhostscriptArgs {
+    if pattern.MatchString(arg) { return true }
+  }
+  return false
+}
+
+/* Returns the extra Ghostscript flags in the `ghostscriptArgs` key of
+ * `form`, separated by spaces, each of which must be allowed by
+ * -ghostscript-arg-allowlist. Only Ghostscript understands them, so they
+ * can't be combined with another `renderer`. */
+func parseGhostscriptArgs(form url.Values, renderer string) ([]string,
+    error) {
+  value, err := optionalFormValue(form, "ghostscriptArgs")
+  if err != nil || value == "" { return nil, err }
+
+  args := strings.Fields(value)
+  if len(args) > MAX_GHOSTSCRIPT_ARGS {
+    return nil, errors.New(fmt.Sprintf("The 'ghostscriptArgs' key may " +
+      "have at most %d flags.\n", MAX_GHOSTSCRIPT_ARGS))
+  }
+
+  for _, arg := range args {
+    if !isAllowedGhostscriptArg(arg) {
+      return nil, errors.New(fmt.Sprintf("'%s' isn't an allowed Ghostscript " +
+        "flag; allowed flags are %s.\n", arg, *ghostscriptArgAllowlist))
+    }
+  }
+
+  if renderer != "" && renderer != RENDERER_GHOSTSCRIPT {
+    return nil, errors.New("The 'ghostscriptArgs' key requires the " +
+      "'ghostscript' renderer.\n")
+  }
+  return args, nil
+}
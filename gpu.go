@@ -0,0 +1,83 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+)
+
+var gpuRenderCommand = flag.String("gpu-render-command", "",
+  "command line of a GPU-capable rasterizer (e.g. a pdfium or NVJPEG " +
+  "build), with {pdf}, {page}, {density}, {quality}, and {output} " +
+  "placeholders; enables the 'gpu' renderer")
+var gpuMode = flag.String("gpu", "auto",
+  "whether to use the 'gpu' renderer: auto (if a GPU is present), on, or off")
+
+// name clients select the GPU renderer with
+const RENDERER_GPU = "gpu"
+
+// device nodes whose presence means there's a GPU we can render with
+var GPU_DEVICES = []string{"/dev/nvidia0", "/dev/dri/renderD128"}
+
+/* Renders with the external GPU-capable rasterizer in -gpu-render-command,
+ * which must write a JPEG to {output}. It renders in color, so grayscale
+ * pages are converted afterwards. */
+type gpuRenderer struct{}
+
+func (gpuRenderer) renderPage(pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  replacer := strings.NewReplacer("{pdf}", pdfPath,
+    "{page}", fmt.Sprintf("%d", pageNum),
+    "{density}", fmt.Sprintf("%d", density),
+    "{quality}", fmt.Sprintf("%d", quality),
+    "{output}", outputPath)
+
+  // split before substituting, so paths can't inject arguments
+  args := strings.Fields(*gpuRenderCommand)
+  for i, arg := range args {
+    args[i] = replacer.Replace(arg)
+  }
+
+  cmd := toolCommand(args[0], args[1:]...)
+  err := runTool(cmd)
+  if err != nil || !gray { return err }
+  return grayscaleJPEG(outputPath, quality)
+}
+
+/* Returns true if this machine appears to have a GPU. */
+func hasGPU() bool {
+  for _, device := range GPU_DEVICES {
+    _, err := os.Stat(device)
+    if err == nil { return true }
+  }
+  return false
+}
+
+/* Registers the GPU renderer according to -gpu and -gpu-render-command,
+ * putting it first in the fallback order so the CPU renderers only handle
+ * pages it fails on. */
+func setupGPURenderer() error {
+  if *gpuMode != "auto" && *gpuMode != "on" && *gpuMode != "off" {
+    return errors.New("-gpu must be auto, on, or off.\n")
+  }
+
+  if *gpuMode == "off" || (*gpuMode == "auto" && !hasGPU()) { return nil }
+
+  if strings.TrimSpace(*gpuRenderCommand) == "" {
+    if *gpuMode == "on" {
+      return errors.New("-gpu=on requires -gpu-render-command.\n")
+    }
+    return nil
+  }
+
+  renderers[RENDERER_GPU] = gpuRenderer{}
+  if !strings.Contains("," + *rendererFallback + ",",
+      "," + RENDERER_GPU + ",") {
+    *rendererFallback = RENDERER_GPU + "," + *rendererFallback
+  }
+
+  logger.Info("Rendering with the GPU first", "command", *gpuRenderCommand)
+  return nil
+}
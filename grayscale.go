@@ -0,0 +1,73 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/jpeg"
+  "net/url"
+  "os"
+)
+
+/* Returns true if the `grayscale` key of `form` asks for grayscale
+ * renditions, which suit black-and-white scans: a single-channel JPEG is
+ * smaller than a color one of the same page. */
+func parseGrayscale(form url.Values) (bool, error) {
+  grayscale, err := optionalFormValue(form, "grayscale")
+  if err != nil { return false, err }
+
+  if grayscale != "" && grayscale != "true" && grayscale != "false" {
+    return false, errors.New("The 'grayscale' key must be 'true' or " +
+      "'false'.\n")
+  }
+  return grayscale == "true", nil
+}
+
+/* Rewrites the JPEG at `jpegPath` in grayscale at JPEG quality `quality`,
+ * for renderers that can only write color. Falls back to converting in
+ * process if ImageMagick is missing. */
+func grayscaleJPEG(jpegPath string, quality int) error {
+  if !hasExternalResizer() {
+    return grayscaleJPEGInProcess(jpegPath, quality)
+  }
+
+  cmd := toolCommand("convert", jpegPath, "-colorspace", "Gray",
+    "-quality", fmt.Sprintf("%d", quality), jpegPath)
+  return runTool(cmd)
+}
+
+/* Does what grayscaleJPEG does, without ImageMagick. */
+func grayscaleJPEGInProcess(jpegPath string, quality int) error {
+  file, err := os.Open(jpegPath)
+  if err != nil { return err }
+  decoded, err := jpeg.Decode(file)
+  file.Close()
+  if err != nil { return err }
+
+  bounds := decoded.Bounds()
+  gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(gray, gray.Bounds(), decoded, bounds.Min, draw.Src)
+
+  output, err := os.Create(jpegPath)
+  if err != nil { return err }
+
+  err = jpeg.Encode(output, gray, &jpeg.Options{Quality: quality})
+  if err != nil {
+    output.Close()
+    return err
+  }
+  return output.Close()
+}
+
+/* Returns true if the JPEG at `path` is grayscale. */
+func isGrayscaleJPEG(path string) (bool, error) {
+  file, err := os.Open(path)
+  if err != nil { return false, err }
+  defer file.Close()
+
+  config, err := jpeg.DecodeConfig(file)
+  if err != nil { return false, err }
+  return config.ColorModel == color.GrayModel, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "net/url"
+  "time"
+)
+
+var handwritingDetector = flag.String("handwriting-detector", "",
+  "command run on each page's large JPEG when a request passes " +
+  "detectHandwriting=true, printing the page's handwritten regions as JSON " +
+  "(disabled if empty)")
+var handwritingTimeout = flag.Duration("handwriting-timeout", time.Minute,
+  "how long the handwriting detector may take on a single page")
+
+/* A handwritten region of a page. Coordinates are fractions of the page's
+ * width and height, measured from its top-left corner, so they apply to
+ * every size of rendition. */
+type handwritingRegion struct {
+  X float64 `json:"x"`
+  Y float64 `json:"y"`
+  Width float64 `json:"width"`
+  Height float64 `json:"height"`
+  Confidence float64 `json:"confidence,omitempty"`
+}
+
+/* What the handwriting detector prints. */
+type handwritingOutput struct {
+  Regions []handwritingRegion `json:"regions"`
+}
+
+/* Returns whether the `detectHandwriting` key of `form` asks for the
+ * handwritten regions of each page. */
+func parseDetectHandwriting(form url.Values) (bool, error) {
+  detect, err := optionalFormValue(form, "detectHandwriting")
+  if err != nil { return false, err }
+
+  if detect != "" && detect != "true" && detect != "false" {
+    return false, errors.New("The 'detectHandwriting' key must be 'true' " +
+      "or 'false'.\n")
+  }
+  if detect != "true" { return false, nil }
+
+  if *handwritingDetector == "" {
+    return false, errors.New("Handwriting detection isn't enabled on this " +
+      "server.\n")
+  }
+  return true, nil
+}
+
+/* Returns an error unless every coordinate of `region` lies within the
+ * page. */
+func validateHandwritingRegion(region handwritingRegion) error {
+  if region.X < 0 || region.Y < 0 || region.Width < 0 || region.Height < 0 ||
+      region.X + region.Width > 1 || region.Y + region.Height > 1 {
+    return errors.New(fmt.Sprintf("region %+v isn't within the page",
+      region))
+  }
+  return nil
+}
+
+/* Runs the handwriting detector on the JPEG at `jpegPath`, returning the
+ * regions it found. */
+func runHandwritingDetector(jpegPath string) ([]handwritingRegion, error) {
+  // the timeout starts once the detector does, not while it waits
+  var output []byte
+  err := withProcessSlot(func() error {
+    ctx, cancel := context.WithTimeout(context.Background(),
+      *handwritingTimeout)
+    defer cancel()
+
+    var err error
+    output, err = toolCommandContext(ctx, *handwritingDetector,
+      jpegPath).Output()
+    return err
+  })
+  if err != nil { return nil, err }
+
+  decoded := handwritingOutput{}
+  err = json.Unmarshal(output, &decoded)
+  if err != nil { return nil, err }
+
+  for _, region := range decoded.Regions {
+    err = validateHandwritingRegion(region)
+    if err != nil { return nil, err }
+  }
+
+  if decoded.Regions == nil {
+    return []handwritingRegion{}, nil
+  }
+  return decoded.Regions, nil
+}
+
+/* Finds the handwritten regions of page `pageNum`, whose large JPEG is
+ * saved locally at `largeJPEGPath`, and records them in `job`, if `params`
+ * asks for them. Like classification, detection is best-effort: failures
+ * are logged and leave the page without regions. */
+func detectHandwriting(job *job, params conversionParams,
+    largeJPEGPath string, pageNum int) {
+  // re-renders may outlive the detector their original request used
+  if !params.DetectHandwriting || *handwritingDetector == "" { return }
+
+  regions, err := runHandwritingDetector(fmt.Sprintf(largeJPEGPath, pageNum))
+  if err != nil {
+    job.logger().Warn("Couldn't detect handwriting", "page", pageNum,
+      errorAttr(err))
+    job.recordEvent("handwriting undetected", pageNum, err.Error())
+    return
+  }
+
+  job.setHandwritingRegions(pageNum, regions)
+}
+
+/* Records the handwritten regions found on page `pageNum`. */
+func (job *job) setHandwritingRegions(pageNum int,
+    regions []handwritingRegion) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.handwritingRegions[pageNum] = regions
+}
+
+/* Returns the handwritten regions of each page they were detected on, or
+ * nil if detection didn't run. */
+func (job *job) handwritingRegionsByPage() map[int][]handwritingRegion {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  if len(job.handwritingRegions) == 0 { return nil }
+
+  regions := map[int][]handwritingRegion{}
+  for pageNum, pageRegions := range job.handwritingRegions {
+    regions[pageNum] = pageRegions
+  }
+  return regions
+}
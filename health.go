@@ -0,0 +1,130 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sync"
+  "time"
+  "launchpad.net/goamz/aws"
+)
+
+// how long a successful S3 check is trusted, so frequent probes don't each
+// call S3
+const S3_CHECK_TTL = 30 * time.Second
+
+// external tools every conversion needs, by the name reported in checks
+var REQUIRED_TOOLS = map[string]string{
+  "ghostscript": "gs",
+}
+
+/* The response to /healthz and /readyz: "ok" or an error for each check,
+ * and "ok" overall only if every check passed. Overall, it's "degraded" if
+ * conversions still work, but with a fallback, and "failing" if not. */
+type healthResponse struct {
+  Status string `json:"status"`
+  Checks map[string]string `json:"checks"`
+}
+
+// when S3 credentials were last verified
+var s3CheckedAt time.Time
+var s3CheckMutex sync.Mutex
+
+/* Returns nil if the scratch directory is writable. */
+func checkScratchWritable() error {
+  file, err := ioutil.TempFile(*scratchDir, "healthz-")
+  if err != nil { return err }
+
+  path := file.Name()
+  file.Close()
+  return os.Remove(path)
+}
+
+/* Returns nil if the credentials in the environment can list
+ * `bucketName`. */
+func checkS3(bucketName string, regionName string) error {
+  s3CheckMutex.Lock()
+  defer s3CheckMutex.Unlock()
+
+  if time.Since(s3CheckedAt) < S3_CHECK_TTL { return nil }
+
+  bucket, err := connectToS3(bucketName, aws.Regions[regionName])
+  if err != nil { return err }
+
+  _, err = bucket.List("", "", "", 1)
+  if err != nil { return err }
+
+  s3CheckedAt = time.Now()
+  return nil
+}
+
+/* Runs the local checks: that the required tools can be run and the
+ * scratch directory is writable. Records each result in `response`. A
+ * missing ImageMagick only degrades conversions, as renditions are then
+ * resized in process. */
+func checkLocalHealth(response *healthResponse) {
+  for name, tool := range REQUIRED_TOOLS {
+    err := lookTool(tool)
+    recordCheck(response, name, err)
+  }
+
+  if hasExternalResizer() {
+    response.Checks["imagemagick"] = "ok"
+  } else {
+    response.Checks["imagemagick"] = RESIZER_DEGRADED
+    if response.Status == "ok" {
+      response.Status = "degraded"
+    }
+  }
+  recordCheck(response, "scratch", checkScratchWritable())
+}
+
+/* Records the result of check `name` in `response`. */
+func recordCheck(response *healthResponse, name string, err error) {
+  if err == nil {
+    response.Checks[name] = "ok"
+    return
+  }
+
+  response.Checks[name] = err.Error()
+  response.Status = "failing"
+}
+
+/* Writes `response` with 200 OK if every check passed or conversions are
+ * merely degraded, and 503 Service Unavailable otherwise. */
+func writeHealth(writer http.ResponseWriter, response healthResponse) {
+  status := http.StatusOK
+  if response.Status == "failing" {
+    status = http.StatusServiceUnavailable
+  }
+  writeJSON(writer, status, response)
+}
+
+/* Handles GET /healthz, a liveness probe: checks that conversions can run
+ * on this machine, but not that S3 is reachable, so an S3 outage doesn't
+ * get every replica restarted. */
+func serveHealthz(writer http.ResponseWriter, request *http.Request) {
+  response := healthResponse{Status: "ok", Checks: map[string]string{}}
+  checkLocalHealth(&response)
+  writeHealth(writer, response)
+}
+
+/* Handles GET /readyz, a readiness probe: runs the /healthz checks, and
+ * also checks that S3 credentials are valid, that clamd answers if sources
+ * are scanned, and that the server isn't shutting down. */
+func serveReadyz(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  response := healthResponse{Status: "ok", Checks: map[string]string{}}
+  checkLocalHealth(&response)
+  recordCheck(&response, "s3", checkS3(bucketName, regionName))
+
+  // sources can't be processed unscanned, so a lost clamd means not ready
+  if *clamdAddress != "" {
+    recordCheck(&response, "clamd", pingClamd())
+  }
+
+  if backgroundWork.isStopping() {
+    recordCheck(&response, "shutdown", errShuttingDown)
+  }
+  writeHealth(writer, response)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "flag"
+  "time"
+)
+
+var idScheme = flag.String("id-scheme", "uuidv7",
+  "identifier scheme for jobs and scratch files: uuidv7 or ulid")
+
+// Crockford's base32 alphabet, used to encode ULIDs
+const CROCKFORD_BASE32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+/* Returns an error if `scheme` isn't a supported identifier scheme. */
+func validateIDScheme(scheme string) error {
+  if scheme != "uuidv7" && scheme != "ulid" {
+    return errors.New("ID scheme must be one of 'uuidv7' or 'ulid'.\n")
+  }
+
+  return nil
+}
+
+/* Generates a new identifier using the configured scheme. Both schemes are
+ * time-ordered, so scratch files and logs sort by creation time. */
+func newID() string {
+  if *idScheme == "ulid" {
+    return newULID(time.Now())
+  }
+
+  return newUUIDv7(time.Now())
+}
+
+/* Fills 16 bytes with a 48-bit big-endian millisecond timestamp followed by
+ * random bits. This is the common layout of UUIDv7 and ULID. */
+func timestampedRandomBytes(now time.Time) [16]byte {
+  var bytes [16]byte
+  rand.Read(bytes[6:])
+
+  var timestamp [8]byte
+  binary.BigEndian.PutUint64(timestamp[:], uint64(now.UnixNano() / 1e6))
+  copy(bytes[:6], timestamp[2:])
+  return bytes
+}
+
+/* Returns a UUIDv7 (RFC 9562) for the given time in canonical 8-4-4-4-12 hex
+ * form. */
+func newUUIDv7(now time.Time) string {
+  bytes := timestampedRandomBytes(now)
+  bytes[6] = (bytes[6] & 0x0f) | 0x70  // version 7
+  bytes[8] = (bytes[8] & 0x3f) | 0x80  // RFC 4122 variant
+
+  encoded := hex.EncodeToString(bytes[:])
+  return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" +
+    encoded[16:20] + "-" + encoded[20:32]
+}
+
+/* Returns a ULID for the given time: 26 characters of Crockford base32. */
+func newULID(now time.Time) string {
+  bytes := timestampedRandomBytes(now)
+
+  // 128 bits are encoded as 26 characters of 5 bits, the first holding only 3
+  encoded := make([]byte, 26)
+  high := binary.BigEndian.Uint64(bytes[:8])
+  low := binary.BigEndian.Uint64(bytes[8:])
+
+  for i := 25; i >= 0; i = i - 1 {
+    encoded[i] = CROCKFORD_BASE32[low & 0x1f]
+    low = (low >> 5) | (high << 59)
+    high = high >> 5
+  }
+
+  return string(encoded)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/url"
+  "os"
+  "launchpad.net/goamz/s3"
+)
+
+/* Parses the `incremental` key of `form` into `params`. If "true", and the
+ * manifest at `s3ManifestPath` describes an earlier version of the same
+ * document whose pages are a byte-identical prefix of this one's, only the
+ * pages added since are rendered. Must come after the layout and page
+ * selection are parsed. */
+func parseIncremental(form url.Values, params *conversionParams) error {
+  incremental, err := optionalFormValue(form, "incremental")
+  if err != nil { return err }
+
+  if incremental != "" && incremental != "true" && incremental != "false" {
+    return errors.New("The 'incremental' key must be 'true' or 'false'.\n")
+  }
+  if incremental != "true" { return nil }
+
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    return errors.New("Content-addressed conversions can't be " +
+      "incremental, since a changed PDF gets new keys.\n")
+  }
+  if params.S3ManifestPath == "" {
+    return errors.New("The 'incremental' key requires 's3ManifestPath'.\n")
+  }
+  if isPartialConversion(*params) {
+    return errors.New("The 'incremental' key can't be combined with " +
+      "'pages' or 'sample'.\n")
+  }
+
+  params.Incremental = true
+  return nil
+}
+
+/* Returns the hash of each page of the PDF at `pdfPath`, which has
+ * `numPages` pages, for its manifest, or nil if the pages can't be hashed
+ * reliably. Only incremental conversions of PDF sources are hashed, since
+ * only later incremental conversions read the hashes, and distilled PDFs
+ * differ every time. */
+func hashPages(job *job, params conversionParams, pdfPath string,
+    numPages int) []string {
+  if !params.Incremental || params.SourceFormat != SOURCE_PDF { return nil }
+
+  fileInfo, err := os.Stat(pdfPath)
+  if err == nil && fileInfo.Size() > MAX_PAGE_COUNT_PARSE_BYTES {
+    err = errors.New("PDF is too large to parse in memory.\n")
+  }
+
+  var doc *pdfDocument
+  if err == nil { doc, err = openPDFDocument(pdfPath) }
+  var hashes []string
+  if err == nil {
+    hashes, err = doc.pageHashes()
+  }
+  if err == nil && len(hashes) != numPages {
+    err = errors.New(fmt.Sprintf("Found %d pages, but the PDF has %d.\n",
+      len(hashes), numPages))
+  }
+  if err != nil {
+    job.logger().Warn("Couldn't hash pages", errorAttr(err))
+    return nil
+  }
+  return hashes
+}
+
+/* Returns true if conversions with `a` and `b` write the same keys in the
+ * same bucket. */
+func sameOutputs(a conversionParams, b conversionParams) bool {
+  return a.S3Bucket == b.S3Bucket && a.S3JPEGPath == b.S3JPEGPath &&
+    a.S3SmallJPEGPath == b.S3SmallJPEGPath &&
+    a.S3LargeJPEGPath == b.S3LargeJPEGPath &&
+    a.S3DarkJPEGPath == b.S3DarkJPEGPath && a.S3TextPath == b.S3TextPath &&
+    a.S3HOCRPath == b.S3HOCRPath && a.S3OCRPath == b.S3OCRPath &&
+    sameSizes(a.Sizes, b.Sizes) &&
+    a.DualWrite == b.DualWrite &&
+    a.S3LegacyJPEGPath == b.S3LegacyJPEGPath &&
+    a.S3LegacySmallJPEGPath == b.S3LegacySmallJPEGPath &&
+    a.S3LegacyLargeJPEGPath == b.S3LegacyLargeJPEGPath &&
+    a.S3LegacyDarkJPEGPath == b.S3LegacyDarkJPEGPath
+}
+
+/* Returns the manifest of an earlier, complete conversion of the document
+ * `params` converts, whose pages are the first of `pageHashes`, or nil if
+ * every page must be rendered. */
+func findIncrementalBase(job *job, bucket *s3.Bucket,
+    params conversionParams, pageHashes []string) (*manifest, error) {
+  if !params.Incremental { return nil, nil }
+
+  reason := ""
+  base, err := readManifest(bucket, params.S3ManifestPath)
+  if isS3NotFound(err) {
+    reason = "no earlier manifest"
+  } else if err != nil {
+    return nil, err
+  } else if pageHashes == nil {
+    reason = "pages couldn't be hashed"
+  } else if base.PipelineVersion != PIPELINE_VERSION {
+    reason = "earlier render is from an older pipeline"
+  } else if len(base.RenderedPages) > 0 || len(base.PageHashes) == 0 {
+    reason = "earlier render is partial or unhashed"
+  } else if !sameOutputs(base.Params, params) ||
+      hashRenderingParams(base.Params) != hashRenderingParams(params) {
+    reason = "rendering parameters changed"
+  } else if len(base.PageHashes) > len(pageHashes) {
+    reason = "pages were removed"
+  } else {
+    for i, pageHash := range base.PageHashes {
+      if pageHashes[i] != pageHash {
+        reason = fmt.Sprintf("page %d changed", i + 1)
+        break
+      }
+    }
+  }
+
+  if reason != "" {
+    job.recordEvent("incremental", 0, "rendering every page: " + reason)
+    return nil, nil
+  }
+
+  job.recordEvent("incremental", 0, fmt.Sprintf("%d pages unchanged",
+    len(base.PageHashes)))
+  return &base, nil
+}
+
+/* Returns `updated`, the manifest of an incremental conversion that
+ * rendered the pages added since `base`, describing the whole document. */
+func mergeIncrementalManifest(base manifest, updated manifest) manifest {
+  merged := updated
+  merged.RenderedPages = nil
+  merged.PageLabels = map[int][]string{}
+  merged.HandwritingRegions = map[int][]handwritingRegion{}
+  merged.PageQuality = map[int]pageQuality{}
+  merged.Checksums = map[string]string{}
+
+  for _, source := range []manifest{base, updated} {
+    for pageNum, labels := range source.PageLabels {
+      merged.PageLabels[pageNum] = labels
+    }
+    for pageNum, regions := range source.HandwritingRegions {
+      merged.HandwritingRegions[pageNum] = regions
+    }
+    for pageNum, quality := range source.PageQuality {
+      merged.PageQuality[pageNum] = quality
+    }
+    for key, checksum := range source.Checksums {
+      merged.Checksums[key] = checksum
+    }
+  }
+  merged.UnreadablePages = unreadablePages(merged.PageQuality)
+  return merged
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "math"
+  "net/http"
+  "net/url"
+  "os"
+  "regexp"
+  "strconv"
+  "unicode/utf16"
+  "launchpad.net/goamz/s3"
+)
+
+// rough size of a rendered JPEG per pixel, for estimating output sizes;
+// scanned pages run larger, mostly blank ones smaller
+const ESTIMATED_JPEG_BYTES_PER_PIXEL = 0.15
+
+// PDF units per inch
+const PDF_POINTS_PER_INCH = 72.0
+
+// the PDF version in a PDF's header, e.g. "%PDF-1.7"
+var PDF_VERSION_PATTERN = regexp.MustCompile(`%PDF-(\d\.\d)`)
+
+/* What GET /info reports about a source document. The version,
+ * encryption, and metadata are only known for PDFs, and `Pages` only for
+ * documents whose page tree could be read. `EstimatedOutputBytes` is a
+ * rough guess at the total size of the normal, small, and large JPEGs a
+ * conversion at `Density` would upload. */
+type documentInfo struct {
+  JobID string `json:"jobId"`
+  Format string `json:"format"`
+  SourceBytes int64 `json:"sourceBytes"`
+  NumPages int `json:"numPages"`
+  Version string `json:"version,omitempty"`
+  Encrypted bool `json:"encrypted"`
+  Title string `json:"title,omitempty"`
+  Author string `json:"author,omitempty"`
+  Density int `json:"density"`
+  EstimatedOutputBytes int64 `json:"estimatedOutputBytes,omitempty"`
+  Pages []pageInfo `json:"pages,omitempty"`
+}
+
+/* A page's size in points, after its rotation, and the estimated pixel
+ * dimensions of each rendition. */
+type pageInfo struct {
+  PageNum int `json:"pageNum"`
+  Width float64 `json:"width"`
+  Height float64 `json:"height"`
+  Rotate int `json:"rotate,omitempty"`
+  Renditions map[string]dimensions `json:"renditions"`
+}
+
+/* Returns the text string `value` decoded: UTF-16 if it starts with a byte
+ * order mark, UTF-8 if it starts with one, and otherwise PDFDocEncoding,
+ * which matches Latin-1 for printable text. */
+func decodePDFText(value interface{}) string {
+  raw, ok := value.(pdfString)
+  if !ok { return "" }
+  text := raw.decoded()
+
+  if bytes.HasPrefix(text, []byte{0xfe, 0xff}) {
+    units := []uint16{}
+    for i := 2; i + 1 < len(text); i = i + 2 {
+      units = append(units, uint16(text[i]) << 8 | uint16(text[i + 1]))
+    }
+    return string(utf16.Decode(units))
+  }
+  if bytes.HasPrefix(text, []byte{0xef, 0xbb, 0xbf}) {
+    return string(text[3:])
+  }
+
+  runes := make([]rune, len(text))
+  for i, c := range text {
+    runes[i] = rune(c)
+  }
+  return string(runes)
+}
+
+/* Returns the number `value`, resolved, or false if it isn't one. */
+func (doc *pdfDocument) number(value interface{}) (float64, bool) {
+  number, err := strconv.ParseFloat(string(asPDFNumber(doc.resolve(value))),
+    64)
+  return number, err == nil
+}
+
+/* Returns the rectangle `value` as its left, bottom, right, and top, or
+ * false if it isn't one. */
+func (doc *pdfDocument) rectangle(value interface{}) ([4]float64, bool) {
+  var rect [4]float64
+  array, ok := doc.resolve(value).([]interface{})
+  if !ok || len(array) != 4 { return rect, false }
+
+  for i, coordinate := range array {
+    rect[i], ok = doc.number(coordinate)
+    if !ok { return rect, false }
+  }
+  return [4]float64{math.Min(rect[0], rect[2]), math.Min(rect[1], rect[3]),
+    math.Max(rect[0], rect[2]), math.Max(rect[1], rect[3])}, true
+}
+
+/* Returns the size of `page` in points, as it's displayed: its crop box,
+ * clipped to its media box, turned by its rotation. */
+func (doc *pdfDocument) pageSize(page pdfDict) (float64, float64, int,
+    error) {
+  box, ok := doc.rectangle(page["MediaBox"])
+  if !ok { return 0, 0, 0, errors.New("PDF page has no media box.\n") }
+
+  if crop, ok := doc.rectangle(page["CropBox"]); ok {
+    box = [4]float64{math.Max(box[0], crop[0]), math.Max(box[1], crop[1]),
+      math.Min(box[2], crop[2]), math.Min(box[3], crop[3])}
+  }
+
+  width, height := math.Max(0, box[2] - box[0]), math.Max(0, box[3] - box[1])
+  rotation, _ := doc.number(page["Rotate"])
+  rotate := ((int(rotation) % 360) + 360) % 360
+  if rotate == 90 || rotate == 270 {
+    width, height = height, width
+  }
+  return width, height, rotate, nil
+}
+
+/* Returns the estimated pixel dimensions of each rendition of a page
+ * `width` by `height` points rendered at `density` DPI. */
+func estimateRenditions(width float64, height float64,
+    density int) map[string]dimensions {
+  large := dimensions{
+    int(math.Max(1, math.Round(width / PDF_POINTS_PER_INCH *
+      float64(density)))),
+    int(math.Max(1, math.Round(height / PDF_POINTS_PER_INCH *
+      float64(density)))),
+  }
+
+  normal := dimensions{}
+  normal.Width, normal.Height = fitWithin(large.Width, large.Height,
+    NORMAL_MAX_DIMENSION, NORMAL_MAX_DIMENSION)
+  small := dimensions{}
+  small.Width, small.Height = fitWithin(normal.Width, normal.Height,
+    SMALL_MAX_DIMENSION, SMALL_MAX_DIMENSION)
+  return map[string]dimensions{TIER_LARGE: large, TIER_NORMAL: normal,
+    TIER_SMALL: small}
+}
+
+/* Fills in what the PDF at `pdfPath` says about itself: its version,
+ * encryption, and metadata, if `isPDF`, and the size of each page. Leaves
+ * out whatever its objects don't reveal. */
+func describePDF(info *documentInfo, pdfPath string, isPDF bool) {
+  doc, err := openPDFDocument(pdfPath)
+  if err != nil { return }
+
+  trailer := doc.trailer()
+  if isPDF {
+    if match := PDF_VERSION_PATTERN.FindSubmatch(
+        doc.data[:minInt(len(doc.data), SOURCE_HEADER_BYTES)]); match != nil {
+      info.Version = string(match[1])
+    }
+
+    // the catalog may declare a later version than the header
+    if version, ok := doc.root["Version"].(pdfName); ok &&
+        string(version) > info.Version {
+      info.Version = string(version)
+    }
+
+    info.Encrypted = trailer["Encrypt"] != nil
+
+    // an encrypted PDF's metadata is encrypted too
+    metadata, ok := doc.dict(trailer["Info"])
+    if ok && !info.Encrypted {
+      info.Title = decodePDFText(doc.resolve(metadata["Title"]))
+      info.Author = decodePDFText(doc.resolve(metadata["Author"]))
+    }
+  }
+
+  pages, err := doc.pages()
+  if err != nil || len(pages) != info.NumPages { return }
+
+  pageInfos := []pageInfo{}
+  estimate := 0.0
+  for i, page := range pages {
+    width, height, rotate, err := doc.pageSize(page)
+    if err != nil { return }
+
+    renditions := estimateRenditions(width, height, info.Density)
+    for _, rendition := range renditions {
+      estimate += float64(rendition.Width * rendition.Height) *
+        ESTIMATED_JPEG_BYTES_PER_PIXEL
+    }
+    pageInfos = append(pageInfos, pageInfo{PageNum: i + 1, Width: width,
+      Height: height, Rotate: rotate, Renditions: renditions})
+  }
+
+  info.Pages = pageInfos
+  info.EstimatedOutputBytes = int64(estimate)
+}
+
+/* Returns the smaller of `a` and `b`. */
+func minInt(a int, b int) int {
+  if a < b { return a }
+  return b
+}
+
+/* Fetches the source described by `params` as `job` and describes it,
+ * assuming it's rendered at `density` DPI. Nothing is rendered, though
+ * PostScript is distilled to count its pages. */
+func describeDocument(job *job, bucket *s3.Bucket, params conversionParams,
+    density int) (documentInfo, error) {
+  info := documentInfo{JobID: job.id, Density: density}
+
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return info, err }
+
+  fileInfo, err := os.Stat(sourcePath)
+  if err != nil { return info, err }
+  info.SourceBytes = fileInfo.Size()
+
+  info.Format, err = detectSourceFormat(sourcePath)
+  if err != nil { return info, err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return info, err }
+
+  info.NumPages, err = countPages(pdfPath, format)
+  if err != nil { return info, err }
+
+  if format == SOURCE_PDF {
+    describePDF(&info, pdfPath, info.Format == SOURCE_PDF)
+  }
+  return info, nil
+}
+
+/* Parses the source in the `s3PDFPath` key of `form`, with the optional
+ * bucket and source encryption keys that a conversion takes. */
+func parseInfoParams(form url.Values) (conversionParams, error) {
+  params := conversionParams{}
+
+  var err error
+  params.S3PDFPath, err = requireFormValue(form, "s3PDFPath", "a PDF")
+  if err != nil { return params, err }
+
+  err = parseBucketParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parseSourceEncryptionParams(form, &params)
+  return params, err
+}
+
+/* Handles GET and POST /info, which describes the source document in the
+ * `s3PDFPath` key without converting it: its format, size, page count, and
+ * for PDFs, its version, encryption, title, author, and each page's size,
+ * along with an estimate of the output a conversion at the `density` key
+ * (or the default) would upload. The source is fetched and scanned like a
+ * conversion's, as a job whose ID is in the X-Job-ID header. */
+func serveInfo(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "GET" && request.Method != "POST" {
+    http.Error(writer, "Only GET and POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  params, err := parseInfoParams(request.Form)
+  if err == nil {
+    params.Density, err = optionalBoundedInt(request.Form, "density",
+      MIN_DENSITY, MAX_DENSITY)
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+  defer cleanupScratch(jobID)
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  var info documentInfo
+  if err == nil {
+    info, err = describeDocument(job, bucket, params, renderDensity(params))
+  }
+  job.finish(err)
+
+  if isS3NotFound(err) {
+    http.Error(writer, "There's no source at that key.\n",
+      http.StatusNotFound)
+    return
+  }
+  if errorCode(err) == ERROR_CODE_INFECTED {
+    writer.Header().Set("X-Error-Code", ERROR_CODE_INFECTED)
+    http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  writeJSON(writer, http.StatusOK, info)
+}
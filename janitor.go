@@ -0,0 +1,112 @@
+package main
+
+import (
+  "flag"
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+var scratchMaxAge = flag.Duration("scratch-max-age", time.Hour,
+  "age after which scratch files of jobs that aren't running are swept " +
+  "(never if 0)")
+var scratchSweepInterval = flag.Duration("scratch-sweep-interval",
+  10 * time.Minute, "how often scratch files are swept")
+
+// lengths of job IDs in each scheme
+const (
+  UUIDV7_LENGTH = 36
+  ULID_LENGTH = 26
+)
+
+/* Returns the ID of the job that the scratch file `name` belongs to, or ""
+ * if it isn't a job's scratch file. IDs of either scheme are recognized,
+ * since -id-scheme may have changed since the file was written. */
+func scratchJobID(name string) string {
+  for _, length := range []int{UUIDV7_LENGTH, ULID_LENGTH} {
+    if len(name) < length { continue }
+
+    // IDs are followed by a suffix, like ".pdf" or "-3-small.jpg"
+    if len(name) > length && name[length] != '.' && name[length] != '-' {
+      continue
+    }
+
+    id := name[:length]
+    if isUUID(id) || isULID(id) { return id }
+  }
+  return ""
+}
+
+/* Returns true if `id` is a UUID in canonical 8-4-4-4-12 hex form. */
+func isUUID(id string) bool {
+  if len(id) != UUIDV7_LENGTH { return false }
+
+  for i := 0; i < len(id); i = i + 1 {
+    if i == 8 || i == 13 || i == 18 || i == 23 {
+      if id[i] != '-' { return false }
+    } else if !strings.ContainsRune("0123456789abcdef", rune(id[i])) {
+      return false
+    }
+  }
+  return true
+}
+
+/* Returns true if `id` is a ULID. */
+func isULID(id string) bool {
+  if len(id) != ULID_LENGTH { return false }
+
+  for i := 0; i < len(id); i = i + 1 {
+    if !strings.ContainsRune(CROCKFORD_BASE32, rune(id[i])) { return false }
+  }
+  return true
+}
+
+/* Removes the scratch files older than `maxAge` whose jobs aren't running,
+ * e.g. those left behind by a crash or by -keep-scratch. Files that aren't
+ * named after a job are never touched, since the scratch directory may be
+ * shared. Returns how many files were removed. */
+func sweepScratch(maxAge time.Duration) int {
+  entries, err := ioutil.ReadDir(*scratchDir)
+  if err != nil {
+    logger.Warn("Couldn't sweep scratch directory", "path", *scratchDir,
+      errorAttr(err))
+    return 0
+  }
+
+  running := map[string]bool{}
+  for _, job := range jobs.unfinished() {
+    running[job.id] = true
+  }
+
+  removed := 0
+  for _, entry := range entries {
+    jobID := scratchJobID(entry.Name())
+    if entry.IsDir() || jobID == "" || running[jobID] ||
+        time.Since(entry.ModTime()) < maxAge {
+      continue
+    }
+
+    path := filepath.Join(*scratchDir, entry.Name())
+    err = removeScratchFile(path)
+    if err != nil {
+      logger.Warn("Couldn't remove scratch file", "path", path,
+        errorAttr(err))
+      continue
+    }
+    removed += 1
+  }
+  return removed
+}
+
+/* Sweeps the scratch directory every -scratch-sweep-interval, starting
+ * now, so orphans from before a restart go too. Never returns. */
+func runScratchJanitor() {
+  for {
+    removed := sweepScratch(*scratchMaxAge)
+    if removed > 0 {
+      logger.Info("Swept orphaned scratch files", "files", removed)
+    }
+    time.Sleep(*scratchSweepInterval)
+  }
+}
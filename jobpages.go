@@ -0,0 +1,130 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strconv"
+)
+
+// pages listed by GET /jobs/{id}/pages when no `limit` is given, and the
+// most it will list at once
+const (
+  DEFAULT_PAGES_LIMIT = 100
+  MAX_PAGES_LIMIT = 1000
+)
+
+/* A page of a finished conversion, as listed by GET /jobs/{id}/pages: its
+ * details from the result, if it was rendered, and the S3 key (and
+ * presigned URL, if requested) of each size and text format. */
+type jobPage struct {
+  PageNum int `json:"pageNum"`
+  Renderer string `json:"renderer,omitempty"`
+  Labels []string `json:"labels,omitempty"`
+  HandwritingRegions []handwritingRegion `json:"handwritingRegions,omitempty"`
+  Quality *pageQuality `json:"quality,omitempty"`
+  Dimensions map[string]dimensions `json:"dimensions,omitempty"`
+  Keys map[string]string `json:"keys"`
+  URLs map[string]string `json:"urls,omitempty"`
+}
+
+/* Response of GET /jobs/{id}/pages. `Total` counts the pages the result
+ * lists; if there are more after these, `NextOffset` is where they start. */
+type jobPagesResponse struct {
+  JobID string `json:"jobId"`
+  NumPages int `json:"numPages"`
+  Total int `json:"total"`
+  Offset int `json:"offset"`
+  Limit int `json:"limit"`
+  NextOffset int `json:"nextOffset,omitempty"`
+  Pages []jobPage `json:"pages"`
+}
+
+/* Returns the `offset` and `limit` in `query`, defaulting to the first
+ * DEFAULT_PAGES_LIMIT pages. */
+func parsePageWindow(query url.Values) (int, int, error) {
+  offset := 0
+  limit := DEFAULT_PAGES_LIMIT
+  var err error
+
+  if query.Get("offset") != "" {
+    offset, err = strconv.Atoi(query.Get("offset"))
+    if err != nil || offset < 0 {
+      return 0, 0, errors.New("'offset' must be a whole number.\n")
+    }
+  }
+
+  if query.Get("limit") != "" {
+    limit, err = strconv.Atoi(query.Get("limit"))
+    if err != nil || limit < 1 || limit > MAX_PAGES_LIMIT {
+      return 0, 0, errors.New(fmt.Sprintf("'limit' must be a whole number " +
+        "from 1 to %d.\n", MAX_PAGES_LIMIT))
+    }
+  }
+  return offset, limit, nil
+}
+
+/* Returns the pages listed in `result`, in the order of its keys: those it
+ * rendered, or every page of the document. */
+func resultPageNums(result *conversionResult) []int {
+  if result.RenderedPages != nil { return result.RenderedPages }
+  return samplePages(result.NumPages, 0)
+}
+
+/* Returns true if the keys in a result's `name` are one per page, unlike
+ * the sprite sheet and its index. */
+func isPerPageKey(name string) bool {
+  return name != SPRITE_IMAGE && name != SPRITE_INDEX
+}
+
+/* Handles GET /jobs/{id}/pages?offset=&limit=, responding with a window of
+ * the pages in a finished job's result, so clients showing page 1 of a
+ * document with thousands needn't fetch every page's keys and details.
+ * Responds with 409 Conflict until the job has a result. */
+func getJobPages(writer http.ResponseWriter, request *http.Request,
+    job *job) {
+  offset, limit, err := parsePageWindow(request.URL.Query())
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  result := job.status().Result
+  if result == nil {
+    http.Error(writer, "The job has no result yet.\n", http.StatusConflict)
+    return
+  }
+
+  pageNums := resultPageNums(result)
+  response := jobPagesResponse{JobID: job.id, NumPages: result.NumPages,
+    Total: len(pageNums), Offset: offset, Limit: limit, Pages: []jobPage{}}
+
+  details := map[int]pageResult{}
+  for _, page := range result.Pages {
+    details[page.PageNum] = page
+  }
+
+  end := minInt(offset + limit, len(pageNums))
+  for i := offset; i < end; i = i + 1 {
+    detail := details[pageNums[i]]
+    page := jobPage{PageNum: pageNums[i], Renderer: detail.Renderer,
+      Labels: detail.Labels, HandwritingRegions: detail.HandwritingRegions,
+      Quality: detail.Quality, Dimensions: detail.Dimensions,
+      Keys: map[string]string{}}
+
+    for name, keys := range result.Keys {
+      if !isPerPageKey(name) { continue }
+      page.Keys[name] = keys[i]
+    }
+    for name, urls := range result.URLs {
+      if !isPerPageKey(name) { continue }
+      if page.URLs == nil { page.URLs = map[string]string{} }
+      page.URLs[name] = urls[i]
+    }
+    response.Pages = append(response.Pages, page)
+  }
+
+  if end < len(pageNums) { response.NextOffset = end }
+  writeJSON(writer, http.StatusOK, response)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+  "flag"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var jobRetention = flag.Duration("job-retention", time.Hour,
+  "how long finished jobs remain visible at /jobs/{id}")
+
+// longest a client may block waiting for a job via ?wait=
+const MAX_JOB_WAIT = 5 * time.Minute
+
+// most events kept per job; later ones are counted but dropped
+const MAX_JOB_EVENTS = 5000
+
+// possible job states, in lifecycle order
+const (
+  JOB_QUEUED = "queued"
+  JOB_RETRYING = "retrying"
+  JOB_CONVERTING = "converting"
+  JOB_UPLOADING = "uploading"
+  JOB_DONE = "done"
+  JOB_FAILED = "failed"
+)
+
+/* A single conversion, submitted by `tenant`, and its progress. All fields
+ * besides `id`, `tenant`, `throttle`, and `done` are protected by `mutex`.
+ * `bucket` and `params` describe the conversion once it's known, so it can
+ * be resubmitted, and `resubmittedAs` is the ID of the job that was.
+ * `throttle` paces the job's uploads. `done` is closed once the job
+ * finishes. */
+type job struct {
+  mutex sync.Mutex
+  id string
+  tenant string
+  requestID string
+  state string
+  attempts int
+  numPages int
+  renderedPages []int
+  pagesConverted int
+  pagesUploaded int
+  bytesDownloaded int64
+  bytesUploaded int64
+  lastPageConverted int
+  lastSmallJPEGPath string
+  pageRenderers map[int]string
+  pageLabels map[int][]string
+  handwritingRegions map[int][]handwritingRegion
+  pageQuality map[int]pageQuality
+  checksums map[string]string
+  events []jobEvent
+  droppedEvents int
+  outputPrefix string
+  bucket *s3.Bucket
+  params *conversionParams
+  resubmittedAs string
+  result *conversionResult
+  throttle *uploadThrottle
+  err error
+  createdAt time.Time
+  finishedAt time.Time
+  done chan struct{}
+}
+
+/* A point-in-time snapshot of a job, as reported by GET /jobs/{id}. */
+type jobStatus struct {
+  ID string `json:"id"`
+  RequestID string `json:"requestId,omitempty"`
+  State string `json:"state"`
+  Attempts int `json:"attempts"`
+  NumPages int `json:"numPages"`
+  RenderedPages []int `json:"renderedPages,omitempty"`
+  PagesConverted int `json:"pagesConverted"`
+  PagesUploaded int `json:"pagesUploaded"`
+  OutputPrefix string `json:"outputPrefix,omitempty"`
+  Labels map[string]string `json:"labels,omitempty"`
+  ResubmittedAs string `json:"resubmittedAs,omitempty"`
+  Result *conversionResult `json:"result,omitempty"`
+  Events []jobEvent `json:"events,omitempty"`
+  DroppedEvents int `json:"droppedEvents,omitempty"`
+  Error string `json:"error,omitempty"`
+  ErrorCode string `json:"errorCode,omitempty"`
+  CreatedAt string `json:"createdAt"`
+  FinishedAt string `json:"finishedAt,omitempty"`
+}
+
+/* Something that happened to a job, for post-mortem debugging. `PageNum` is
+ * set for page events and `Detail` elaborates, e.g. with an error. */
+type jobEvent struct {
+  Time string `json:"time"`
+  Event string `json:"event"`
+  PageNum int `json:"pageNum,omitempty"`
+  Detail string `json:"detail,omitempty"`
+}
+
+/* All jobs known to this server, keyed by ID. */
+type jobRegistry struct {
+  mutex sync.Mutex
+  jobs map[string]*job
+}
+
+var jobs = &jobRegistry{jobs: map[string]*job{}}
+
+/* Creates a queued job with the given ID on behalf of `tenant` and registers
+ * it. `requestID` identifies the request that created it. */
+func newJob(id string, tenant string, requestID string) *job {
+  job := &job{id: id, tenant: tenant, requestID: requestID,
+    state: JOB_QUEUED, attempts: 1,
+    pageRenderers: map[int]string{}, pageLabels: map[int][]string{},
+    handwritingRegions: map[int][]handwritingRegion{},
+    pageQuality: map[int]pageQuality{},
+    checksums: map[string]string{},
+    createdAt: time.Now(), done: make(chan struct{}),
+    throttle: newUploadThrottle(tunedInt(uploadWorkers))}
+  job.recordEvent(JOB_QUEUED, 0, "")
+  jobs.add(job)
+  return job
+}
+
+/* Registers `job`, forgetting finished jobs older than the retention period. */
+func (registry *jobRegistry) add(job *job) {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  retention := tunedDuration(jobRetention)
+  for id, existingJob := range registry.jobs {
+    existingJob.mutex.Lock()
+    expired := !existingJob.finishedAt.IsZero() &&
+      time.Since(existingJob.finishedAt) > retention
+    existingJob.mutex.Unlock()
+
+    if expired {
+      delete(registry.jobs, id)
+    }
+  }
+
+  registry.jobs[job.id] = job
+}
+
+/* Returns the jobs that haven't finished yet. */
+func (registry *jobRegistry) unfinished() []*job {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  unfinished := []*job{}
+  for _, job := range registry.jobs {
+    job.mutex.Lock()
+    if job.finishedAt.IsZero() {
+      unfinished = append(unfinished, job)
+    }
+    job.mutex.Unlock()
+  }
+  return unfinished
+}
+
+/* Returns the job with the given ID, or nil if there isn't one. */
+func (registry *jobRegistry) get(id string) *job {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+  return registry.jobs[id]
+}
+
+/* Records `event` in the job's history. Expects the mutex to be held. */
+func (job *job) recordEventLocked(event string, pageNum int, detail string) {
+  if len(job.events) >= MAX_JOB_EVENTS {
+    job.droppedEvents += 1
+    return
+  }
+
+  job.events = append(job.events, jobEvent{
+    Time: time.Now().UTC().Format(time.RFC3339Nano),
+    Event: event,
+    PageNum: pageNum,
+    Detail: detail,
+  })
+}
+
+/* Records `event` in the job's history. */
+func (job *job) recordEvent(event string, pageNum int, detail string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.recordEventLocked(event, pageNum, detail)
+}
+
+/* Moves the job to `state`. */
+func (job *job) setState(state string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.state = state
+  job.recordEventLocked(state, 0, "")
+}
+
+/* Queues another attempt at the job, discarding the progress of the
+ * previous one. */
+func (job *job) requeue() {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.attempts += 1
+  job.state = JOB_QUEUED
+  job.pagesConverted = 0
+  job.pagesUploaded = 0
+  job.lastPageConverted = 0
+  job.lastSmallJPEGPath = ""
+  job.pageRenderers = map[int]string{}
+  job.err = nil
+  job.recordEventLocked("requeued", 0, "")
+}
+
+/* Records that the job's latest attempt failed with `err` and that it's
+ * waiting to be retried. */
+func (job *job) retrying(err error) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.state = JOB_RETRYING
+  job.err = err
+  job.recordEventLocked(JOB_RETRYING, 0, err.Error())
+}
+
+/* Records the total number of pages the job will process. */
+func (job *job) setNumPages(numPages int) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.numPages = numPages
+}
+
+/* Records the pages the job will process, `pageNums`. If `partial`, they're
+ * a subset of the document and are reported as the rendered pages. */
+func (job *job) setPages(pageNums []int, partial bool) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.numPages = len(pageNums)
+  if partial {
+    job.renderedPages = pageNums
+  }
+}
+
+/* Records the S3 prefix the job's outputs are written under, when it's
+ * chosen by the server rather than the client. */
+func (job *job) setOutputPrefix(outputPrefix string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.outputPrefix = outputPrefix
+}
+
+/* Records that the job converts according to `params`, writing to
+ * `bucket`. The source's key, if any, isn't kept. */
+func (job *job) setConversion(bucket *s3.Bucket, params conversionParams) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  params.SourceKey = ""
+  job.bucket = bucket
+  job.params = &params
+}
+
+/* Returns the name of the bucket the job writes to, or "" if it isn't
+ * converting yet. */
+func (job *job) bucketName() string {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  if job.bucket == nil { return "" }
+  return job.bucket.Name
+}
+
+/* Returns the name of the renderer that converted page `pageNum`, or "" if
+ * it hasn't been converted. */
+func (job *job) pageRenderer(pageNum int) string {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  return job.pageRenderers[pageNum]
+}
+
+/* Records what the job produced once it has succeeded. */
+func (job *job) setResult(result conversionResult) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.result = &result
+}
+
+/* Records that page `pageNum` has been converted by renderer
+ * `rendererName`, with its small JPEG saved locally at `smallJPEGPath`. */
+func (job *job) pageConverted(pageNum int, smallJPEGPath string,
+    rendererName string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.pagesConverted += 1
+  job.pageRenderers[pageNum] = rendererName
+  job.recordEventLocked("page rendered", pageNum, rendererName)
+  job.lastPageConverted = pageNum
+  job.lastSmallJPEGPath = smallJPEGPath
+}
+
+/* Returns the number and local small JPEG path of the most recently
+ * converted page, or 0 and "" if no page has been converted yet. */
+func (job *job) latestPage() (int, string) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  return job.lastPageConverted, job.lastSmallJPEGPath
+}
+
+/* Records that `numBytes` of source document were downloaded. */
+func (job *job) addBytesDownloaded(numBytes int64) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.bytesDownloaded += numBytes
+}
+
+/* Records that `numBytes` of rendered images were uploaded. */
+func (job *job) addBytesUploaded(numBytes int64) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.bytesUploaded += numBytes
+}
+
+/* Records that page `pageNum` has been uploaded. */
+func (job *job) pageUploaded(pageNum int) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.pagesUploaded += 1
+  job.recordEventLocked("page uploaded", pageNum, "")
+}
+
+/* Marks the job as done, or failed if `err` is non-nil, and wakes up anyone
+ * waiting on it. */
+func (job *job) finish(err error) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  job.err = err
+  job.state = JOB_DONE
+  if err != nil {
+    job.state = JOB_FAILED
+  }
+
+  job.finishedAt = time.Now()
+  detail := ""
+  if err != nil {
+    detail = err.Error()
+  }
+  job.recordEventLocked(job.state, 0, detail)
+  close(job.done)
+
+  recordJobMetrics(job.tenant, job.pagesConverted, job.bytesDownloaded,
+    job.bytesUploaded, err)
+}
+
+/* Returns a copy of the job's events so far, and how many were dropped. */
+func (job *job) history() ([]jobEvent, int) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  events := make([]jobEvent, len(job.events))
+  copy(events, job.events)
+  return events, job.droppedEvents
+}
+
+/* Returns a snapshot of the job's current status. */
+func (job *job) status() jobStatus {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  status := jobStatus{
+    ID: job.id,
+    RequestID: job.requestID,
+    State: job.state,
+    Attempts: job.attempts,
+    NumPages: job.numPages,
+    RenderedPages: job.renderedPages,
+    PagesConverted: job.pagesConverted,
+    PagesUploaded: job.pagesUploaded,
+    OutputPrefix: job.outputPrefix,
+    ResubmittedAs: job.resubmittedAs,
+    Result: job.result,
+    CreatedAt: job.createdAt.UTC().Format(time.RFC3339),
+  }
+
+  if job.params != nil {
+    status.Labels = job.params.Labels
+  }
+
+  if job.err != nil {
+    status.Error = job.err.Error()
+    status.ErrorCode = errorCode(job.err)
+  }
+
+  if !job.finishedAt.IsZero() {
+    status.FinishedAt = job.finishedAt.UTC().Format(time.RFC3339)
+  }
+
+  return status
+}
+
+/* Parses the `wait` query parameter, either a Go duration ("30s") or a
+ * number of seconds ("30"). Returns 0 if it's absent or invalid. The wait is
+ * capped at MAX_JOB_WAIT. */
+func parseWait(wait string) time.Duration {
+  if wait == "" { return 0 }
+
+  duration, err := time.ParseDuration(wait)
+  if err != nil {
+    seconds, err := strconv.Atoi(wait)
+    if err != nil { return 0 }
+    duration = time.Duration(seconds) * time.Second
+  }
+
+  if duration > MAX_JOB_WAIT {
+    duration = MAX_JOB_WAIT
+  }
+  return duration
+}
+
+/* Handles everything under /jobs/: GET /jobs/{id},
+ * GET /jobs/{id}/preview, GET /jobs/{id}/pages, and POST /jobs/requeue.
+ * Like job search, only admins may see other tenants' jobs once API keys
+ * are configured. */
+func serveJobs(writer http.ResponseWriter, request *http.Request) {
+  if request.URL.Path == "/jobs/requeue" {
+    requeueJobs(writer, request)
+    return
+  }
+
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_READ_STATUS) { return }
+
+  path := strings.TrimPrefix(request.URL.Path, "/jobs/")
+  segments := strings.Split(path, "/")
+
+  job := jobs.get(segments[0])
+  // other tenants' jobs might as well not exist
+  if job != nil && len(apiKeys) > 0 && !isAdmin(request) &&
+      job.tenant != tenantName(request) {
+    job = nil
+  }
+  if job == nil {
+    http.Error(writer, "No such job.\n", http.StatusNotFound)
+    return
+  }
+
+  if len(segments) == 1 {
+    getJob(writer, request, job)
+  } else if len(segments) == 2 && segments[1] == "preview" {
+    getJobPreview(writer, request, job)
+  } else if len(segments) == 2 && segments[1] == "pages" {
+    getJobPages(writer, request, job)
+  } else {
+    http.NotFound(writer, request)
+  }
+}
+
+/* Handles GET /jobs/{id}/preview, responding with the small JPEG of the most
+ * recently converted page, so UIs can show real content while a conversion
+ * is in progress. The page number is in the X-Page-Number header. Responds
+ * with 204 No Content if no page has been converted yet. */
+func getJobPreview(writer http.ResponseWriter, request *http.Request,
+    job *job) {
+  pageNum, smallJPEGPath := job.latestPage()
+  if pageNum == 0 {
+    writer.WriteHeader(http.StatusNoContent)
+    return
+  }
+
+  // the preview changes as the job progresses, so it mustn't be cached
+  writer.Header().Set("Cache-Control", "no-store")
+  writer.Header().Set("Content-Type", "image/jpeg")
+  writer.Header().Set("X-Page-Number", strconv.Itoa(pageNum))
+  http.ServeFile(writer, request, smallJPEGPath)
+}
+
+/* Handles GET /jobs/{id}, responding with the job's status as JSON. With
+ * ?wait=30s, blocks until the job finishes or the wait elapses, whichever
+ * comes first, so clients needn't poll. */
+func getJob(writer http.ResponseWriter, request *http.Request, job *job) {
+  wait := parseWait(request.URL.Query().Get("wait"))
+  if wait > 0 {
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+
+    select {
+    case <-job.done:
+    case <-timer.C:
+    case <-request.Context().Done():
+      return
+    }
+  }
+
+  status := job.status()
+  if request.URL.Query().Get("verbose") == "1" {
+    status.Events, status.DroppedEvents = job.history()
+  }
+  writeJSON(writer, http.StatusOK, status)
+}
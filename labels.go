@@ -0,0 +1,252 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+)
+
+// most labels a conversion may carry
+const MAX_JOB_LABELS = 16
+
+// longest label value
+const MAX_LABEL_VALUE_LENGTH = 256
+
+var LABEL_NAME_PATTERN = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+/* Which jobs a search matches: those carrying every one of `labels`, in
+ * `state` if it's given, and submitted by `tenant` unless it's "". */
+type jobQuery struct {
+  labels map[string]string
+  state string
+  tenant string
+}
+
+/* What POST /jobs/requeue did with a job it matched: resubmitted it as
+ * `NewJobID`, or `Skipped` it for the given reason. */
+type requeuedJob struct {
+  JobID string `json:"jobId"`
+  NewJobID string `json:"newJobId,omitempty"`
+  Skipped string `json:"skipped,omitempty"`
+}
+
+/* Parses a label of the form "name:value". */
+func parseLabel(label string) (string, string, error) {
+  separator := strings.Index(label, ":")
+  if separator == -1 {
+    return "", "", errors.New(fmt.Sprintf("The label '%s' must be of the " +
+      "form 'name:value'.\n", label))
+  }
+
+  name, value := label[:separator], label[separator + 1:]
+  if !LABEL_NAME_PATTERN.MatchString(name) {
+    return "", "", errors.New(fmt.Sprintf("The label name '%s' must be 1-64 " +
+      "letters, digits, '.', '_', or '-'.\n", name))
+  }
+  if value == "" || len(value) > MAX_LABEL_VALUE_LENGTH {
+    return "", "", errors.New(fmt.Sprintf("The value of label '%s' must be " +
+      "1-%d bytes.\n", name, MAX_LABEL_VALUE_LENGTH))
+  }
+  return name, value, nil
+}
+
+/* Returns the labels given by the `label` keys of `form`, each "name:value",
+ * or nil if there are none. */
+func parseLabels(form url.Values) (map[string]string, error) {
+  if len(form["label"]) == 0 { return nil, nil }
+  if len(form["label"]) > MAX_JOB_LABELS {
+    return nil, errors.New(fmt.Sprintf("At most %d labels may be given.\n",
+      MAX_JOB_LABELS))
+  }
+
+  labels := map[string]string{}
+  for _, label := range form["label"] {
+    name, value, err := parseLabel(label)
+    if err != nil { return nil, err }
+
+    if _, ok := labels[name]; ok {
+      return nil, errors.New(fmt.Sprintf("The label '%s' is given more " +
+        "than once.\n", name))
+    }
+    labels[name] = value
+  }
+  return labels, nil
+}
+
+/* Parses the `label` and `status` query parameters of a search for jobs
+ * made by `request`. Only admins may see other tenants' jobs once API keys
+ * are configured. */
+func parseJobQuery(request *http.Request) (jobQuery, error) {
+  query := jobQuery{}
+  form := request.URL.Query()
+
+  var err error
+  query.labels, err = parseLabels(form)
+  if err != nil { return query, err }
+
+  query.state, err = optionalFormValue(form, "status")
+  if err != nil { return query, err }
+
+  switch query.state {
+  case "", JOB_QUEUED, JOB_RETRYING, JOB_CONVERTING, JOB_UPLOADING, JOB_DONE,
+      JOB_FAILED:
+  default:
+    return query, errors.New(fmt.Sprintf("Unknown job status '%s'.\n",
+      query.state))
+  }
+
+  if len(apiKeys) > 0 && !isAdmin(request) {
+    query.tenant = tenantName(request)
+  }
+  return query, nil
+}
+
+/* Returns true if the job matches `query`. */
+func (job *job) matches(query jobQuery) bool {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  if query.tenant != "" && job.tenant != query.tenant { return false }
+  if query.state != "" && job.state != query.state { return false }
+
+  for name, value := range query.labels {
+    if job.params == nil || job.params.Labels[name] != value { return false }
+  }
+  return true
+}
+
+/* Returns the jobs matching `query`, oldest first. */
+func (registry *jobRegistry) find(query jobQuery) []*job {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  found := []*job{}
+  for _, job := range registry.jobs {
+    if job.matches(query) {
+      found = append(found, job)
+    }
+  }
+
+  sort.Slice(found, func(i int, j int) bool {
+    return found[i].createdAt.Before(found[j].createdAt)
+  })
+  return found
+}
+
+/* Handles GET /jobs, responding with the status of each job matching the
+ * `label` (repeatable, each "name:value") and `status` query parameters.
+ * With no parameters, every job is listed. */
+func serveJobSearch(writer http.ResponseWriter, request *http.Request) {
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_READ_STATUS) { return }
+
+  query, err := parseJobQuery(request)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  statuses := []jobStatus{}
+  for _, job := range jobs.find(query) {
+    statuses = append(statuses, job.status())
+  }
+  writeJSON(writer, http.StatusOK, map[string][]jobStatus{"jobs": statuses})
+}
+
+/* Queues a new job, made by `request`, that converts what `job` did, and
+ * returns it. Returns an error explaining why if `job` can't be
+ * resubmitted. */
+func (job *job) resubmit(request *http.Request) (*job, error) {
+  id := newID()
+
+  // claimed before the new job is registered, as that locks every job
+  job.mutex.Lock()
+  var err error
+  if job.state != JOB_FAILED {
+    err = errors.New("it hasn't failed")
+  } else if job.resubmittedAs != "" {
+    err = errors.New("it was already resubmitted")
+  } else if job.params == nil {
+    err = errors.New("it failed before its conversion began")
+  } else if job.params.UploadedPDFPath != "" {
+    err = errors.New("its source wasn't in S3")
+  } else if job.params.SourceEncryption != "" {
+    err = errors.New("its source's key isn't kept")
+  } else {
+    job.resubmittedAs = id
+  }
+  bucket := job.bucket
+  params := job.params
+  job.mutex.Unlock()
+  if err != nil { return nil, err }
+
+  resubmitted := newJob(id, job.tenant, requestID(request))
+  resubmitted.recordEvent("resubmitted", 0, "from " + job.id)
+  err = queueAsyncJob(asyncTask{resubmitted, bucket, *params, request,
+    time.Now()})
+  if err != nil {
+    resubmitted.finish(err)
+
+    job.mutex.Lock()
+    job.resubmittedAs = ""
+    job.mutex.Unlock()
+    return nil, err
+  }
+
+  job.recordEvent("resubmitted", 0, id)
+  return resubmitted, nil
+}
+
+/* Handles POST /jobs/requeue, which resubmits every failed job matching the
+ * `label` query parameters, e.g. those of one exam, as new
+ * asynchronous jobs, responding with what became of each. Jobs whose
+ * source was uploaded with the request or is encrypted are skipped, since
+ * their sources aren't kept. */
+func requeueJobs(writer http.ResponseWriter, request *http.Request) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  query, err := parseJobQuery(request)
+  if err == nil && query.state == "" {
+    query.state = JOB_FAILED
+  } else if err == nil && query.state != JOB_FAILED {
+    err = errors.New("Only failed jobs can be requeued.\n")
+  } else if err == nil && len(query.labels) == 0 {
+    err = errors.New("Must specify the jobs to requeue in the 'label' " +
+      "key.\n")
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  requeued := []requeuedJob{}
+  for _, job := range jobs.find(query) {
+    resubmitted, err := job.resubmit(request)
+    if err != nil {
+      requeued = append(requeued, requeuedJob{JobID: job.id,
+        Skipped: strings.TrimSpace(err.Error())})
+      continue
+    }
+
+    requeued = append(requeued, requeuedJob{JobID: job.id,
+      NewJobID: resubmitted.id})
+    job.logger().Info("Resubmitted job", "newJob", resubmitted.id)
+  }
+  writeJSON(writer, http.StatusOK, map[string][]requeuedJob{"jobs": requeued})
+}
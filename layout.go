@@ -0,0 +1,190 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/url"
+  "os"
+)
+
+// output layout where keys are derived from the source PDF's contents and
+// the rendering parameters, rather than given by the client
+const LAYOUT_CONTENT_ADDRESSED = "content-addressed"
+
+// content-addressed outputs never change, so they may be cached forever
+const IMMUTABLE_CACHE_CONTROL = "public, max-age=31536000, immutable"
+
+/* The parameters that affect rendered output. Two conversions of the same
+ * PDF with equal rendering parameters produce the same JPEGs. */
+type renderingParams struct {
+  PipelineVersion int `json:"pipelineVersion"`
+  Dark bool `json:"dark"`
+  JPEGEncoding string `json:"jpegEncoding"`
+  SmallJPEGEncoding string `json:"smallJPEGEncoding"`
+  LargeJPEGEncoding string `json:"largeJPEGEncoding"`
+  DarkJPEGEncoding string `json:"darkJPEGEncoding"`
+  Sample int `json:"sample,omitempty"`
+  Pages string `json:"pages,omitempty"`
+  Renderer string `json:"renderer,omitempty"`
+  Strict bool `json:"strict,omitempty"`
+  GhostscriptArgs []string `json:"ghostscriptArgs,omitempty"`
+  Classify bool `json:"classify,omitempty"`
+  DetectHandwriting bool `json:"detectHandwriting,omitempty"`
+  ScoreQuality bool `json:"scoreQuality,omitempty"`
+  ExtractText bool `json:"extractText,omitempty"`
+  HOCR bool `json:"hocr,omitempty"`
+  OCRLanguages string `json:"ocrLanguages,omitempty"`
+  Sizes []sizeProfile `json:"sizes,omitempty"`
+  SpriteColumns int `json:"spriteColumns,omitempty"`
+  SpriteTileSize int `json:"spriteTileSize,omitempty"`
+  OutputPublicKey string `json:"outputPublicKey,omitempty"`
+  Presign bool `json:"presign,omitempty"`
+  ACL string `json:"acl,omitempty"`
+  CacheControl string `json:"cacheControl,omitempty"`
+  ContentDisposition string `json:"contentDisposition,omitempty"`
+  Density int `json:"density,omitempty"`
+  Quality int `json:"quality,omitempty"`
+  Grayscale bool `json:"grayscale,omitempty"`
+  Rotate string `json:"rotate,omitempty"`
+  WatermarkText string `json:"watermarkText,omitempty"`
+  S3WatermarkPath string `json:"s3WatermarkPath,omitempty"`
+  WatermarkPosition string `json:"watermarkPosition,omitempty"`
+  WatermarkOpacity int `json:"watermarkOpacity,omitempty"`
+  WatermarkScale int `json:"watermarkScale,omitempty"`
+}
+
+/* Parses the output parameters of a content-addressed conversion into
+ * `params`: an `s3OutputPrefix` and whether to produce a `dark` rendition. */
+func parseContentAddressedParams(form url.Values,
+    params *conversionParams) error {
+  var err error
+
+  params.S3OutputPrefix, err = requireFormValue(form, "s3OutputPrefix",
+    "an output prefix")
+  if err != nil { return err }
+
+  dark, err := optionalFormValue(form, "dark")
+  if err != nil { return err }
+
+  if dark != "" && dark != "true" && dark != "false" {
+    return errors.New("The 'dark' key must be 'true' or 'false'.\n")
+  }
+
+  params.Dark = dark == "true"
+  return nil
+}
+
+/* Returns the hex SHA-256 digest of the file at `path`. */
+func hashFile(path string) (string, error) {
+  file, err := os.Open(path)
+  if err != nil { return "", err }
+  defer file.Close()
+
+  hash := sha256.New()
+  _, err = io.Copy(hash, file)
+  if err != nil { return "", err }
+
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/* Returns a short hex digest of the parameters in `params` that affect the
+ * rendered output. */
+func hashRenderingParams(params conversionParams) string {
+  // sizes' paths are derived from the digest, so can't be part of it
+  var sizes []sizeProfile = nil
+  for _, profile := range params.Sizes {
+    profile.S3Path = ""
+    sizes = append(sizes, profile)
+  }
+
+  rendering := renderingParams{
+    PipelineVersion: PIPELINE_VERSION,
+    Dark: params.Dark,
+    JPEGEncoding: params.JPEGEncoding,
+    SmallJPEGEncoding: params.SmallJPEGEncoding,
+    LargeJPEGEncoding: params.LargeJPEGEncoding,
+    DarkJPEGEncoding: params.DarkJPEGEncoding,
+    Sample: params.Sample,
+    Pages: params.Pages,
+    Renderer: params.Renderer,
+    Strict: params.Strict,
+    GhostscriptArgs: params.GhostscriptArgs,
+    Classify: params.Classify,
+    DetectHandwriting: params.DetectHandwriting,
+    ScoreQuality: params.ScoreQuality,
+    ExtractText: params.ExtractText,
+    HOCR: params.HOCR,
+    OCRLanguages: params.OCRLanguages,
+    Sizes: sizes,
+    SpriteColumns: params.SpriteColumns,
+    SpriteTileSize: params.SpriteTileSize,
+    OutputPublicKey: params.OutputPublicKey,
+    Presign: params.Presign,
+    ACL: params.ACL,
+    CacheControl: params.CacheControl,
+    ContentDisposition: params.ContentDisposition,
+    Density: params.Density,
+    Quality: params.Quality,
+    Grayscale: params.Grayscale,
+    Rotate: params.Rotate,
+    WatermarkText: params.WatermarkText,
+    S3WatermarkPath: params.S3WatermarkPath,
+    WatermarkPosition: params.WatermarkPosition,
+    WatermarkOpacity: params.WatermarkOpacity,
+    WatermarkScale: params.WatermarkScale,
+  }
+
+  encoded, _ := json.Marshal(rendering)
+  digest := sha256.Sum256(encoded)
+  return hex.EncodeToString(digest[:8])
+}
+
+/* Fills in the output paths of a content-addressed conversion, given the
+ * source document fetched to `pdfPath`. Outputs go under
+ * {s3OutputPrefix}{sourceHash}/{paramsHash}/, alongside a manifest. */
+func resolveContentAddressedPaths(params conversionParams,
+    pdfPath string) (conversionParams, error) {
+  sourceHash, err := hashFile(pdfPath)
+  if err != nil { return params, err }
+
+  prefix := params.S3OutputPrefix + sourceHash + "/" +
+    hashRenderingParams(params) + "/"
+  params.S3ManifestPath = prefix + "manifest.json"
+  if len(params.Sizes) > 0 {
+    // copied, since the caller's params share the slice
+    sizes := []sizeProfile{}
+    for _, profile := range params.Sizes {
+      profile.S3Path = prefix + "%d-" + profile.Name + ".jpg"
+      sizes = append(sizes, profile)
+    }
+    params.Sizes = sizes
+  } else {
+    params.S3JPEGPath = prefix + "%d.jpg"
+    params.S3SmallJPEGPath = prefix + "%d-small.jpg"
+    params.S3LargeJPEGPath = prefix + "%d-large.jpg"
+  }
+
+  if params.Dark {
+    params.S3DarkJPEGPath = prefix + "%d-dark.jpg"
+  }
+  if params.ExtractText {
+    params.S3TextPath = prefix + "%d.txt"
+    params.S3OCRPath = prefix + "%d.ocr.json"
+  }
+  if params.HOCR {
+    params.S3HOCRPath = prefix + "%d.hocr"
+  }
+  if params.SpriteColumns != 0 {
+    params.S3SpritePath = prefix + "sprite.jpg"
+    params.S3SpriteIndexPath = prefix + "sprite.json"
+  }
+
+  // content-addressed renditions never change, unless told otherwise
+  if params.CacheControl == "" {
+    params.CacheControl = IMMUTABLE_CACHE_CONTROL
+  }
+  return params, nil
+}
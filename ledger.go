@@ -0,0 +1,499 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "launchpad.net/goamz/aws"
+  "launchpad.net/goamz/s3"
+)
+
+var ledgerTable = flag.String("ledger-table", "",
+  "DynamoDB table every finished conversion is recorded in, so other " +
+  "instances can reuse its outputs (disabled if empty)")
+var ledgerRegion = flag.String("ledger-region", "",
+  "region of the -ledger-table (the server's region if empty)")
+var ledgerEndpoint = flag.String("ledger-endpoint", "",
+  "URL of the DynamoDB API, e.g. for DynamoDB Local (the region's if empty)")
+
+// most attempts at a ledger request that keeps failing transiently
+const LEDGER_MAX_ATTEMPTS = 5
+
+// base delay before retrying a ledger request, doubled on each attempt
+const LEDGER_RETRY_DELAY = 100 * time.Millisecond
+
+// how long a ledger request may take
+const LEDGER_TIMEOUT = 10 * time.Second
+
+// most entries GET /ledger returns
+const MAX_LEDGER_ENTRIES = 100
+
+// types of DynamoDB error worth retrying, besides server-side ones
+var TRANSIENT_DYNAMODB_ERRORS = []string{"ThrottlingException",
+  "ProvisionedThroughputExceededException", "RequestLimitExceeded"}
+
+var ledgerOperationsTotal = newCounterVec("evangelist_ledger_operations_total",
+  "Ledger requests, by operation (record, lookup, or history) and outcome " +
+  "(success, hit, miss, or failed).", "operation", "outcome")
+
+/* Where the ledger is kept, or nil if it's disabled. */
+type ledgerConfig struct {
+  table string
+  region string
+  endpoint string
+}
+
+var ledger *ledgerConfig = nil
+
+var ledgerClient = &http.Client{Timeout: LEDGER_TIMEOUT}
+
+/* A finished conversion, as recorded in the ledger. Entries are keyed by
+ * `Source`, the bucket and key of the converted document, and sorted by
+ * `RecordedAt`, the time they were written followed by the job's ID, so a
+ * document's history reads back in order. */
+type ledgerEntry struct {
+  Source string `json:"source"`
+  RecordedAt string `json:"recordedAt"`
+  JobID string `json:"jobId"`
+  Tenant string `json:"tenant"`
+  SourceETag string `json:"sourceETag"`
+  ParamsHash string `json:"paramsHash"`
+  ManifestKey string `json:"manifestKey,omitempty"`
+  NumPages int `json:"numPages"`
+  PipelineVersion int `json:"pipelineVersion"`
+}
+
+/* An error DynamoDB responded with, e.g. a failed condition. */
+type dynamoDBError struct {
+  statusCode int
+  errorType string
+  message string
+}
+
+func (err *dynamoDBError) Error() string {
+  return fmt.Sprintf("DynamoDB responded %d %s: %s", err.statusCode,
+    err.errorType, err.message)
+}
+
+/* Sets up the ledger according to -ledger-table, -ledger-region, and
+ * -ledger-endpoint, in the server's `regionName` by default. */
+func setupLedger(regionName string) error {
+  if *ledgerTable == "" { return nil }
+
+  region := *ledgerRegion
+  if region == "" {
+    region = regionName
+  }
+  if _, ok := aws.Regions[region]; !ok && *ledgerEndpoint == "" {
+    return errors.New("-ledger-region must be a known region.\n")
+  }
+
+  endpoint := *ledgerEndpoint
+  if endpoint == "" {
+    endpoint = fmt.Sprintf("https://dynamodb.%s.amazonaws.com", region)
+  }
+  if _, err := url.Parse(endpoint); err != nil {
+    return errors.New("-ledger-endpoint must be a URL.\n")
+  }
+
+  ledger = &ledgerConfig{table: *ledgerTable, region: region,
+    endpoint: endpoint}
+  return nil
+}
+
+/* Returns the source key entries for the document at `key` in `bucket` are
+ * recorded under. */
+func ledgerSource(bucket *s3.Bucket, key string) string {
+  return bucket.Name + "/" + key
+}
+
+/* Returns the HMAC-SHA256 of `data` with `key`. */
+func hmacSHA256(key []byte, data string) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(data))
+  return mac.Sum(nil)
+}
+
+/* Signs `request`, whose body is `body`, with AWS Signature Version 4 for
+ * DynamoDB in `region`, using the credentials in the environment. goamz
+ * only signs its own services' requests. */
+func signDynamoDBRequest(request *http.Request, body []byte,
+    region string) error {
+  auth, err := aws.EnvAuth()
+  if err != nil { return err }
+
+  now := time.Now().UTC()
+  amzDate := now.Format("20060102T150405Z")
+  request.Header.Set("X-Amz-Date", amzDate)
+  if auth.Token != "" {
+    request.Header.Set("X-Amz-Security-Token", auth.Token)
+  }
+
+  // every header set so far is signed, sorted by lowercased name
+  names := []string{"host"}
+  headers := map[string]string{"host": request.URL.Host}
+  for name, values := range request.Header {
+    name = strings.ToLower(name)
+    names = append(names, name)
+    headers[name] = strings.TrimSpace(strings.Join(values, ","))
+  }
+  sort.Strings(names)
+
+  canonicalHeaders := ""
+  for _, name := range names {
+    canonicalHeaders += name + ":" + headers[name] + "\n"
+  }
+  signedHeaders := strings.Join(names, ";")
+
+  path := request.URL.EscapedPath()
+  if path == "" {
+    path = "/"
+  }
+  payloadHash := sha256.Sum256(body)
+  canonicalRequest := strings.Join([]string{request.Method, path,
+    request.URL.RawQuery, canonicalHeaders, signedHeaders,
+    hex.EncodeToString(payloadHash[:])}, "\n")
+
+  date := now.Format("20060102")
+  scope := date + "/" + region + "/dynamodb/aws4_request"
+  requestHash := sha256.Sum256([]byte(canonicalRequest))
+  stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope,
+    hex.EncodeToString(requestHash[:])}, "\n")
+
+  key := hmacSHA256([]byte("AWS4" + auth.SecretKey), date)
+  key = hmacSHA256(key, region)
+  key = hmacSHA256(key, "dynamodb")
+  key = hmacSHA256(key, "aws4_request")
+  signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+  request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 " +
+    "Credential=%s/%s, SignedHeaders=%s, Signature=%s", auth.AccessKey,
+    scope, signedHeaders, signature))
+  return nil
+}
+
+/* Returns true if `err` is a ledger failure that may well not happen again:
+ * a server-side error, DynamoDB throttling us, or a network problem. */
+func isTransientLedgerError(err error) bool {
+  if dynamoErr, ok := err.(*dynamoDBError); ok {
+    if dynamoErr.statusCode >= 500 { return true }
+    for _, errorType := range TRANSIENT_DYNAMODB_ERRORS {
+      if dynamoErr.errorType == errorType { return true }
+    }
+    return false
+  }
+  _, ok := err.(net.Error)
+  return ok
+}
+
+/* Calls the DynamoDB API `action` (e.g. "PutItem") with `input`, decoding
+ * its response into `output` unless it's nil. Transient failures are
+ * retried with backoff. */
+func callDynamoDB(action string, input interface{},
+    output interface{}) error {
+  body, err := json.Marshal(input)
+  if err != nil { return err }
+
+  delay := LEDGER_RETRY_DELAY
+  for attempt := 1; ; attempt = attempt + 1 {
+    err = callDynamoDBOnce(action, body, output)
+    if err == nil || !isTransientLedgerError(err) ||
+        attempt >= LEDGER_MAX_ATTEMPTS {
+      return err
+    }
+
+    logger.Warn("Retrying ledger request", "action", action, "attempt",
+      attempt, errorAttr(err))
+    time.Sleep(delay)
+    delay *= 2
+  }
+}
+
+/* Makes a single attempt at `callDynamoDB`, with the encoded `body`. */
+func callDynamoDBOnce(action string, body []byte,
+    output interface{}) error {
+  request, err := http.NewRequest("POST", ledger.endpoint,
+    bytes.NewReader(body))
+  if err != nil { return err }
+  request.Header.Set("Content-Type", "application/x-amz-json-1.0")
+  request.Header.Set("X-Amz-Target", "DynamoDB_20120810." + action)
+
+  err = signDynamoDBRequest(request, body, ledger.region)
+  if err != nil { return err }
+
+  response, err := ledgerClient.Do(request)
+  if err != nil { return err }
+  defer response.Body.Close()
+
+  responseBody, err := ioutil.ReadAll(response.Body)
+  if err != nil { return err }
+
+  if response.StatusCode != http.StatusOK {
+    // the type is namespaced, e.g. "com.amazonaws...#ThrottlingException"
+    failure := struct {
+      Type string `json:"__type"`
+      Message string `json:"message"`
+    }{}
+    json.Unmarshal(responseBody, &failure)
+    errorType := failure.Type[strings.LastIndex(failure.Type, "#") + 1:]
+    return &dynamoDBError{statusCode: response.StatusCode,
+      errorType: errorType, message: failure.Message}
+  }
+
+  if output == nil { return nil }
+  return json.Unmarshal(responseBody, output)
+}
+
+/* Returns `entry` as a DynamoDB item. */
+func (entry ledgerEntry) item() map[string]map[string]string {
+  item := map[string]map[string]string{
+    "source": {"S": entry.Source},
+    "recordedAt": {"S": entry.RecordedAt},
+    "jobId": {"S": entry.JobID},
+    "tenant": {"S": entry.Tenant},
+    "sourceETag": {"S": entry.SourceETag},
+    "paramsHash": {"S": entry.ParamsHash},
+    "numPages": {"N": strconv.Itoa(entry.NumPages)},
+    "pipelineVersion": {"N": strconv.Itoa(entry.PipelineVersion)},
+  }
+  if entry.ManifestKey != "" {
+    item["manifestKey"] = map[string]string{"S": entry.ManifestKey}
+  }
+  return item
+}
+
+/* Returns the entry a DynamoDB item records. */
+func ledgerEntryFromItem(item map[string]map[string]string) ledgerEntry {
+  entry := ledgerEntry{
+    Source: item["source"]["S"],
+    RecordedAt: item["recordedAt"]["S"],
+    JobID: item["jobId"]["S"],
+    Tenant: item["tenant"]["S"],
+    SourceETag: item["sourceETag"]["S"],
+    ParamsHash: item["paramsHash"]["S"],
+    ManifestKey: item["manifestKey"]["S"],
+  }
+  entry.NumPages, _ = strconv.Atoi(item["numPages"]["N"])
+  entry.PipelineVersion, _ = strconv.Atoi(item["pipelineVersion"]["N"])
+  return entry
+}
+
+/* Returns the ledger entries for `source`, newest first: at most `limit`
+ * of them, or only the newest whose `sourceETag` and `paramsHash` match
+ * `filter`'s if it's non-nil. */
+func queryLedger(source string, limit int,
+    filter *ledgerEntry) ([]ledgerEntry, error) {
+  input := map[string]interface{}{
+    "TableName": ledger.table,
+    "KeyConditionExpression": "#source = :source",
+    "ExpressionAttributeNames": map[string]string{"#source": "source"},
+    "ExpressionAttributeValues": map[string]map[string]string{
+      ":source": {"S": source},
+    },
+    "ScanIndexForward": false,
+  }
+  if filter != nil {
+    // filters apply after each page is read, so a limit would cut them off
+    input["FilterExpression"] = "sourceETag = :etag AND paramsHash = :hash"
+    values := input["ExpressionAttributeValues"].(map[string]map[string]string)
+    values[":etag"] = map[string]string{"S": filter.SourceETag}
+    values[":hash"] = map[string]string{"S": filter.ParamsHash}
+    limit = 1
+  } else {
+    input["Limit"] = limit
+  }
+
+  entries := []ledgerEntry{}
+  for {
+    output := struct {
+      Items []map[string]map[string]string
+      LastEvaluatedKey map[string]map[string]string
+    }{}
+    err := callDynamoDB("Query", input, &output)
+    if err != nil { return nil, err }
+
+    for _, item := range output.Items {
+      entries = append(entries, ledgerEntryFromItem(item))
+      if len(entries) >= limit { return entries, nil }
+    }
+
+    if output.LastEvaluatedKey == nil || filter == nil { return entries, nil }
+    input["ExclusiveStartKey"] = output.LastEvaluatedKey
+  }
+}
+
+/* Returns the params hash entries for conversions with `params` are
+ * recorded under: the hash of their rendering parameters, which also keys
+ * content-addressed outputs. Whether two conversions wrote the same keys is
+ * checked against their manifests. */
+func ledgerParamsHash(params conversionParams) string {
+  return hashRenderingParams(params)
+}
+
+/* Looks up the conversion `job` is about to carry out with `params` in the
+ * ledger. Returns the ETag of its source, which it's recorded under once it
+ * finishes, and the manifest of an earlier conversion of the same version
+ * of the source with the same parameters and outputs, if any, so this one
+ * can reuse it. Only S3 sources that aren't encrypted are recorded. The
+ * ledger is best-effort: failures are logged and count as misses. */
+func findInLedger(job *job, bucket *s3.Bucket,
+    params conversionParams) (string, *manifest) {
+  if ledger == nil || params.UploadedPDFPath != "" ||
+      params.SourceEncryption != "" {
+    return "", nil
+  }
+
+  head, err := fetchSourceHead(job, bucket, params, 1)
+  if err != nil || head.etag == "" {
+    // a missing source is reported once it's fetched
+    if err != nil && !isS3NotFound(err) {
+      job.logger().Warn("Couldn't read the source's ETag", errorAttr(err))
+    }
+    return "", nil
+  }
+
+  // content-addressed conversions find their own earlier outputs
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED ||
+      params.S3ManifestPath == "" || params.ManifestPart {
+    return head.etag, nil
+  }
+
+  filter := ledgerEntry{SourceETag: head.etag,
+    ParamsHash: ledgerParamsHash(params)}
+  entries, err := queryLedger(ledgerSource(bucket, params.S3PDFPath), 1,
+    &filter)
+  if err != nil {
+    ledgerOperationsTotal.add(1, "lookup", "failed")
+    job.logger().Warn("Couldn't look up conversion in ledger",
+      errorAttr(err))
+    return head.etag, nil
+  }
+
+  // the outputs must still be the ones that conversion wrote
+  for _, entry := range entries {
+    if entry.ManifestKey != params.S3ManifestPath ||
+        entry.PipelineVersion != PIPELINE_VERSION {
+      continue
+    }
+
+    existing, err := readManifest(bucket, entry.ManifestKey)
+    if err == nil && existing.JobID == entry.JobID &&
+        sameOutputs(existing.Params, params) {
+      ledgerOperationsTotal.add(1, "lookup", "hit")
+      job.recordEvent("reused", 0, "job " + entry.JobID)
+      return head.etag, &existing
+    }
+    if err != nil && !isS3NotFound(err) {
+      job.logger().Warn("Couldn't read manifest recorded in ledger",
+        "key", entry.ManifestKey, errorAttr(err))
+    }
+  }
+
+  ledgerOperationsTotal.add(1, "lookup", "miss")
+  return head.etag, nil
+}
+
+/* Records `job`, which finished converting `numPages` pages of the version
+ * of its source with ETag `sourceETag` with `params`, in the ledger.
+ * Entries are only ever added, never overwritten. Does nothing if the
+ * ledger is disabled or the source's ETag is unknown. */
+func recordInLedger(job *job, bucket *s3.Bucket, params conversionParams,
+    sourceETag string, numPages int) {
+  if ledger == nil || sourceETag == "" { return }
+
+  now := time.Now().UTC()
+  entry := ledgerEntry{
+    Source: ledgerSource(bucket, params.S3PDFPath),
+    RecordedAt: now.Format(time.RFC3339Nano) + "#" + job.id,
+    JobID: job.id,
+    Tenant: job.tenant,
+    SourceETag: sourceETag,
+    ParamsHash: ledgerParamsHash(params),
+    ManifestKey: writtenManifestKey(params, job.id),
+    NumPages: numPages,
+    PipelineVersion: PIPELINE_VERSION,
+  }
+
+  err := callDynamoDB("PutItem", map[string]interface{}{
+    "TableName": ledger.table,
+    "Item": entry.item(),
+    "ConditionExpression": "attribute_not_exists(#source)",
+    "ExpressionAttributeNames": map[string]string{"#source": "source"},
+  }, nil)
+  if err != nil {
+    ledgerOperationsTotal.add(1, "record", "failed")
+    job.logger().Error("Couldn't record conversion in ledger",
+      errorAttr(err))
+    return
+  }
+  ledgerOperationsTotal.add(1, "record", "success")
+}
+
+/* Handles GET /ledger, which responds with the ledger's entries for the
+ * document in `s3PDFPath`, in the bucket chosen by the `s3Bucket` and
+ * `s3Region` keys or the server's `bucketName`, newest first. `limit`
+ * bounds how many are returned. */
+func serveLedger(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_READ_STATUS) { return }
+
+  if ledger == nil {
+    http.Error(writer, "The ledger isn't enabled on this server.\n",
+      http.StatusNotFound)
+    return
+  }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  source, err := requireFormValue(request.Form, "s3PDFPath", "a PDF path")
+  var limit int
+  if err == nil {
+    limit, err = optionalBoundedInt(request.Form, "limit", 1,
+      MAX_LEDGER_ENTRIES)
+  }
+  var bucket *s3.Bucket
+  if err == nil {
+    bucket, err = connectToRequestBucket(request.Form, bucketName,
+      regionName)
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if limit == 0 {
+    limit = MAX_LEDGER_ENTRIES
+  }
+
+  entries, err := queryLedger(ledgerSource(bucket, source), limit, nil)
+  if err != nil {
+    ledgerOperationsTotal.add(1, "history", "failed")
+    logger.Error("Couldn't query ledger", errorAttr(err))
+    http.Error(writer, "Couldn't query the ledger.\n",
+      http.StatusBadGateway)
+    return
+  }
+  ledgerOperationsTotal.add(1, "history", "success")
+
+  writeJSON(writer, http.StatusOK, map[string][]ledgerEntry{
+    "entries": entries})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "log/slog"
+  "os"
+  "os/exec"
+  "strings"
+)
+
+var logLevel = flag.String("log-level", "info",
+  "least severe log level written: debug (which includes the output of gs, " +
+  "convert, and other tools), info, warn, or error")
+var logFormat = flag.String("log-format", LOG_FORMAT_LOGFMT,
+  "log format: logfmt or json")
+
+// formats logs can be written in
+const (
+  LOG_FORMAT_LOGFMT = "logfmt"
+  LOG_FORMAT_JSON = "json"
+)
+
+// structured, leveled logger for everything the server does; replaced by
+// setupLogging once the flags are parsed
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+/* Sets up `logger` according to -log-level and -log-format. */
+func setupLogging() error {
+  var level slog.Level
+  err := level.UnmarshalText([]byte(*logLevel))
+  if err != nil {
+    return errors.New("-log-level must be debug, info, warn, or error.\n")
+  }
+
+  logLevelVar.Set(level)
+  options := &slog.HandlerOptions{Level: logLevelVar}
+  switch *logFormat {
+  case LOG_FORMAT_LOGFMT:
+    logger = slog.New(slog.NewTextHandler(os.Stdout, options))
+  case LOG_FORMAT_JSON:
+    logger = slog.New(slog.NewJSONHandler(os.Stdout, options))
+  default:
+    return errors.New("-log-format must be logfmt or json.\n")
+  }
+  return nil
+}
+
+/* Returns `err` as a log attribute. Our error messages end in newlines for
+ * HTTP responses, which don't belong in logs. */
+func errorAttr(err error) slog.Attr {
+  return slog.String("error", strings.TrimSpace(err.Error()))
+}
+
+/* Logs `message` and `err` at the error level and exits, for problems that
+ * keep the server from starting. */
+func fatal(message string, err error) {
+  logger.Error(message, errorAttr(err))
+  os.Exit(1)
+}
+
+/* Returns a logger that tags records with the job's ID, tenant, and the ID
+ * of the request that created it. */
+func (job *job) logger() *slog.Logger {
+  return logger.With("job", job.id, "tenant", job.tenant,
+    "request", job.requestID)
+}
+
+/* Runs the external tool `cmd`. At the debug level, its output is logged,
+ * which is usually the quickest way to see why gs or convert misbehaved. */
+func runTool(cmd *exec.Cmd) error {
+  return withProcessSlot(func() error {
+    if !logger.Enabled(context.Background(), slog.LevelDebug) {
+      return cmd.Run()
+    }
+
+    output, err := cmd.CombinedOutput()
+    attrs := []any{"command", strings.Join(cmd.Args, " "),
+      "output", strings.TrimSpace(string(output))}
+    if err != nil {
+      attrs = append(attrs, errorAttr(err))
+    }
+    logger.Debug("Ran tool", attrs...)
+    return err
+  })
+}
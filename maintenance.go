@@ -0,0 +1,297 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+var maintenanceRetryAfter = flag.Duration("maintenance-retry-after",
+  5 * time.Minute, "how long clients turned away by maintenance mode are " +
+  "told to wait, unless the change that enabled it says otherwise")
+
+var asyncSpoolDir = flag.String("async-spool-dir", "",
+  "directory queued asynchronous conversions are saved to, so they survive " +
+  "a restart (kept only in memory if empty)")
+
+var errMaintenance = errors.New("The server is in maintenance mode; " +
+  "submit with async=true or try again later.\n")
+
+/* Whether the server is in maintenance mode, toggled through
+ * /admin/maintenance. While it is, synchronous conversions are turned away,
+ * and asynchronous ones are accepted but not started; `ended` is closed when
+ * it's turned off, releasing the workers waiting on it. */
+type maintenanceState struct {
+  mutex sync.Mutex
+  enabled bool
+  since time.Time
+  reason string
+  retryAfter time.Duration
+  ended chan struct{}
+}
+
+var maintenance = &maintenanceState{}
+
+/* Response of /admin/maintenance. */
+type maintenanceStatus struct {
+  Enabled bool `json:"enabled"`
+  Since string `json:"since,omitempty"`
+  Reason string `json:"reason,omitempty"`
+  RetryAfterSeconds int `json:"retryAfterSeconds,omitempty"`
+  QueuedJobs int `json:"queuedJobs"`
+}
+
+/* Turns maintenance mode on or off. `reason` and `retryAfter` describe it
+ * while it's on; a zero `retryAfter` means -maintenance-retry-after. Returns
+ * false if it was already in the requested state, which leaves it as is. */
+func (state *maintenanceState) set(enabled bool, reason string,
+    retryAfter time.Duration) bool {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+
+  if state.enabled == enabled { return false }
+  state.enabled = enabled
+
+  if enabled {
+    if retryAfter == 0 { retryAfter = *maintenanceRetryAfter }
+    state.since = time.Now()
+    state.reason = reason
+    state.retryAfter = retryAfter
+    state.ended = make(chan struct{})
+  } else {
+    close(state.ended)
+  }
+  return true
+}
+
+/* Reports whether maintenance mode is on, and if so, since when and why. */
+func (state *maintenanceState) status() maintenanceStatus {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+
+  status := maintenanceStatus{Enabled: state.enabled,
+    QueuedJobs: len(asyncQueue)}
+  if !state.enabled { return status }
+
+  status.Since = state.since.UTC().Format(time.RFC3339)
+  status.Reason = state.reason
+  status.RetryAfterSeconds = int(state.retryAfter / time.Second)
+  return status
+}
+
+/* Blocks until maintenance mode is off. */
+func (state *maintenanceState) wait() {
+  state.mutex.Lock()
+  enabled := state.enabled
+  ended := state.ended
+  state.mutex.Unlock()
+
+  if enabled { <-ended }
+}
+
+/* Responds 503 with a Retry-After header if maintenance mode is on, and
+ * returns true if it did. */
+func rejectDuringMaintenance(writer http.ResponseWriter) bool {
+  status := maintenance.status()
+  if !status.Enabled { return false }
+
+  writer.Header().Set("Retry-After",
+    strconv.Itoa(status.RetryAfterSeconds))
+  http.Error(writer, errMaintenance.Error(), http.StatusServiceUnavailable)
+  return true
+}
+
+/* Handles /admin/maintenance. GET reports whether maintenance mode is on.
+ * POST turns it on or off with the `enabled` key, "true" or "false"; when
+ * turning it on, `reason` says why, and `retryAfter`, a duration like "10m",
+ * overrides -maintenance-retry-after. Conversions already running finish
+ * either way. Changes are logged and audited, and last until the server
+ * restarts. */
+func serveMaintenance(writer http.ResponseWriter, request *http.Request) {
+  if !requireAdmin(writer, request) { return }
+
+  switch request.Method {
+  case "GET":
+    writeJSON(writer, http.StatusOK, maintenance.status())
+
+  case "POST":
+    err := request.ParseForm()
+    if handleError(err, writer) { return }
+
+    enabled, reason, retryAfter, err := parseMaintenanceParams(request.PostForm)
+    auditAdminChange(request, "maintenance", err)
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    if maintenance.set(enabled, reason, retryAfter) {
+      logger.Info("Changed maintenance mode", "request", requestID(request),
+        "enabled", enabled, "reason", reason)
+    }
+    writeJSON(writer, http.StatusOK, maintenance.status())
+
+  default:
+    http.Error(writer, "Only GET and POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+  }
+}
+
+/* Returns the state requested by the form of a POST to /admin/maintenance:
+ * whether it's enabled, why, and how long clients should wait. */
+func parseMaintenanceParams(form map[string][]string) (bool, string,
+    time.Duration, error) {
+  enabled, err := requireFormValue(form, "enabled", "'true' or 'false'")
+  if err != nil { return false, "", 0, err }
+  if enabled != "true" && enabled != "false" {
+    return false, "", 0, errors.New("The 'enabled' key must be 'true' or " +
+      "'false'.\n")
+  }
+
+  reason, err := optionalFormValue(form, "reason")
+  if err != nil { return false, "", 0, err }
+
+  retryAfterText, err := optionalFormValue(form, "retryAfter")
+  if err != nil { return false, "", 0, err }
+
+  var retryAfter time.Duration
+  if retryAfterText != "" {
+    retryAfter, err = time.ParseDuration(retryAfterText)
+    if err != nil || retryAfter < time.Second {
+      return false, "", 0, errors.New("The 'retryAfter' key must be a " +
+        "duration of at least a second, e.g. '10m'.\n")
+    }
+  }
+
+  return enabled == "true", reason, retryAfter, nil
+}
+
+/* An asynchronous conversion saved to -async-spool-dir while it waits, with
+ * what's needed to queue it again after a restart. */
+type spooledJob struct {
+  JobID string `json:"jobId"`
+  Tenant string `json:"tenant"`
+  RequestID string `json:"requestId"`
+  Params conversionParams `json:"params"`
+  CallbackURL string `json:"callbackURL,omitempty"`
+  Form map[string][]string `json:"form"`
+  StartTime time.Time `json:"startTime"`
+}
+
+/* Returns where the job with ID `jobID` is spooled. */
+func spoolPath(jobID string) string {
+  return path.Join(*asyncSpoolDir, jobID + ".json")
+}
+
+/* Saves `task` to -async-spool-dir, if set, so it's queued again should the
+ * server restart before it finishes. Conversions of uploaded PDFs or
+ * encrypted sources aren't saved, since neither the upload nor the source
+ * key outlives the process. */
+func spoolAsyncJob(task asyncTask) {
+  if *asyncSpoolDir == "" { return }
+  if task.params.UploadedPDFPath != "" || task.params.SourceKey != "" {
+    return
+  }
+
+  spooled := spooledJob{
+    JobID: task.job.id,
+    Tenant: task.job.tenant,
+    RequestID: task.job.requestID,
+    Params: task.params,
+    CallbackURL: task.params.CallbackURL,
+    Form: redactSecrets(task.request.Form),
+    StartTime: task.startTime,
+  }
+
+  data, err := json.Marshal(spooled)
+  if err == nil {
+    // written aside and renamed, so a crash never leaves it half-written
+    temporaryPath := spoolPath(task.job.id) + ".tmp"
+    err = ioutil.WriteFile(temporaryPath, data, 0600)
+    if err == nil { err = os.Rename(temporaryPath, spoolPath(task.job.id)) }
+  }
+  if err != nil {
+    task.job.logger().Error("Couldn't spool conversion", errorAttr(err))
+  }
+}
+
+/* Removes the spooled copy of the job with ID `jobID`, if any, once it's
+ * finished. */
+func unspoolAsyncJob(jobID string) {
+  if *asyncSpoolDir == "" { return }
+
+  err := os.Remove(spoolPath(jobID))
+  if err != nil && !os.IsNotExist(err) {
+    logger.Error("Couldn't remove spooled conversion", "job", jobID,
+      errorAttr(err))
+  }
+}
+
+/* Queues again every conversion left in -async-spool-dir by a previous run,
+ * under its original job ID. Those that can't be read or queued are logged
+ * and left in place. */
+func restoreSpooledJobs(bucketName string, regionName string) error {
+  if *asyncSpoolDir == "" { return nil }
+
+  err := os.MkdirAll(*asyncSpoolDir, 0700)
+  if err != nil { return err }
+
+  entries, err := ioutil.ReadDir(*asyncSpoolDir)
+  if err != nil { return err }
+
+  for _, entry := range entries {
+    if !strings.HasSuffix(entry.Name(), ".json") { continue }
+
+    err = restoreSpooledJob(path.Join(*asyncSpoolDir, entry.Name()),
+      bucketName, regionName)
+    if err != nil {
+      logger.Error("Couldn't restore spooled conversion", "file",
+        entry.Name(), errorAttr(err))
+    }
+  }
+  return nil
+}
+
+/* Queues the conversion spooled at `spooledPath`. */
+func restoreSpooledJob(spooledPath string, bucketName string,
+    regionName string) error {
+  data, err := ioutil.ReadFile(spooledPath)
+  if err != nil { return err }
+
+  var spooled spooledJob
+  err = json.Unmarshal(data, &spooled)
+  if err != nil { return err }
+  if spooled.JobID == "" {
+    return errors.New("The spooled conversion has no job ID.\n")
+  }
+
+  params := spooled.Params
+  params.CallbackURL = spooled.CallbackURL
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  if err != nil { return err }
+
+  // the original request is gone, so the audit log gets one that carries
+  // its form and request ID
+  auditRequest := &http.Request{
+    Header: http.Header{REQUEST_ID_HEADER: {spooled.RequestID}},
+    Form: spooled.Form}
+
+  job := newJob(spooled.JobID, spooled.Tenant, spooled.RequestID)
+  err = queueAsyncJob(asyncTask{job, bucket, params, auditRequest,
+    spooled.StartTime})
+  if err != nil {
+    job.finish(err)
+    return err
+  }
+
+  job.logger().Info("Restored spooled conversion")
+  return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "regexp"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var manifestChunkPages = flag.Int("manifest-chunk-pages", 1000,
+  "pages whose details are written to each chunk of a manifest for a longer " +
+  "document (0 keeps every manifest in one object)")
+
+// the end of the key of a manifest's chunk, e.g. ".pages-1-1000.json"
+var MANIFEST_CHUNK_PATTERN = regexp.MustCompile(`\.pages-\d+-\d+\.json$`)
+
+// version of the rendering pipeline; bump whenever a change to conversion
+// would produce better JPEGs, so existing documents can be re-rendered
+const PIPELINE_VERSION = 1
+
+/* A record of a finished conversion, written to S3 at `s3ManifestPath` when
+ * the client asks for one. It holds everything needed to redo the
+ * conversion later. */
+type manifest struct {
+  PipelineVersion int `json:"pipelineVersion"`
+  JobID string `json:"jobId"`
+  Params conversionParams `json:"params"`
+  NumPages int `json:"numPages"`
+  RenderedPages []int `json:"renderedPages,omitempty"`
+  PageLabels map[int][]string `json:"pageLabels,omitempty"`
+  HandwritingRegions map[int][]handwritingRegion `json:"handwritingRegions,omitempty"`
+  PageQuality map[int]pageQuality `json:"pageQuality,omitempty"`
+  // pages whose quality is flagged, kept whole so they're found without
+  // reading every chunk
+  UnreadablePages []int `json:"unreadablePages,omitempty"`
+  Encryption *outputEncryption `json:"encryption,omitempty"`
+  // hex MD5 of each uploaded rendition, keyed by S3 key
+  Checksums map[string]string `json:"checksums,omitempty"`
+  // hex SHA-256 of each page's content, for incremental conversions
+  PageHashes []string `json:"pageHashes,omitempty"`
+  // where the per-page details are, if they were split off into chunks
+  Chunks []manifestChunkRef `json:"chunks,omitempty"`
+  CreatedAt string `json:"createdAt"`
+}
+
+/* The per-page details of pages `FirstPage` to `LastPage` of a manifest
+ * that was split into chunks, written beside it. `PageHashes` starts with
+ * the hash of `FirstPage`, and `Checksums` holds those of the page's
+ * renditions and text. */
+type manifestChunk struct {
+  FirstPage int `json:"firstPage"`
+  LastPage int `json:"lastPage"`
+  PageLabels map[int][]string `json:"pageLabels,omitempty"`
+  HandwritingRegions map[int][]handwritingRegion `json:"handwritingRegions,omitempty"`
+  PageQuality map[int]pageQuality `json:"pageQuality,omitempty"`
+  Checksums map[string]string `json:"checksums,omitempty"`
+  PageHashes []string `json:"pageHashes,omitempty"`
+}
+
+/* Where a manifest's chunk of pages `FirstPage` to `LastPage` is. */
+type manifestChunkRef struct {
+  Key string `json:"key"`
+  FirstPage int `json:"firstPage"`
+  LastPage int `json:"lastPage"`
+}
+
+/* Returns a manifest for `job`, a conversion that just finished with the
+ * current pipeline. */
+func newManifest(job *job, params conversionParams, numPages int) manifest {
+  return manifest{
+    PipelineVersion: PIPELINE_VERSION,
+    JobID: job.id,
+    Params: params,
+    NumPages: numPages,
+    RenderedPages: job.status().RenderedPages,
+    PageLabels: job.labelsByPage(),
+    HandwritingRegions: job.handwritingRegionsByPage(),
+    PageQuality: job.pageQualityByPage(),
+    UnreadablePages: unreadablePages(job.pageQualityByPage()),
+    Encryption: newOutputEncryption(params),
+    Checksums: job.uploadedChecksums(),
+    CreatedAt: time.Now().UTC().Format(time.RFC3339),
+  }
+}
+
+/* Uploads `manifest` to its `s3ManifestPath` as private JSON, locked the
+ * same way as the JPEGs it describes, and signed if -manifest-signing-key
+ * is given. If the document has more than -manifest-chunk-pages pages, the
+ * per-page details are first written to chunks beside it, so clients can
+ * look up a few pages without downloading every page's. Transient failures
+ * are retried. */
+func writeManifest(bucket *s3.Bucket, manifest manifest) error {
+  manifest, chunks := splitManifest(manifest, *manifestChunkPages)
+
+  // chunks go first, so the manifest never refers to one that's missing
+  for i, chunk := range chunks {
+    err := putManifestObject(bucket, manifest.Params, manifest.Chunks[i].Key,
+      chunk)
+    if err != nil { return err }
+  }
+  return putManifestObject(bucket, manifest.Params,
+    manifest.Params.S3ManifestPath, manifest)
+}
+
+/* Uploads `value` as JSON to `key`, as part of the manifest of a
+ * conversion with `params`. Transient failures are retried. */
+func putManifestObject(bucket *s3.Bucket, params conversionParams,
+    key string, value interface{}) error {
+  body, err := json.MarshalIndent(value, "", "  ")
+  if err != nil { return err }
+
+  return withS3Retries(logger, S3_OP_WRITE_MANIFEST, func() error {
+    return putManifest(bucket, params, key, body)
+  })
+}
+
+/* Uploads the encoded manifest `body` to `key` for a conversion with
+ * `params`. */
+func putManifest(bucket *s3.Bucket, params conversionParams, key string,
+    body []byte) error {
+  headers := map[string][]string{
+    "Content-Type": {detectContentType(key, body)},
+  }
+  signed := addManifestSignature(headers, body)
+
+  if !usesObjectLock(params) && !signed {
+    return bucket.Put(key, body, detectContentType(key, body), s3.Private)
+  }
+
+  if usesObjectLock(params) {
+    md5, err := contentMD5(bytes.NewReader(body))
+    if err != nil { return err }
+
+    headers["Content-MD5"] = []string{md5}
+    addObjectLockHeaders(headers, params)
+  }
+  return bucket.PutHeader(key, body, headers, s3.Private)
+}
+
+/* Downloads and parses the manifest at `s3ManifestPath`, along with its
+ * chunks, if it has any, so it's whole again. Transient failures are
+ * retried. */
+func readManifest(bucket *s3.Bucket, s3ManifestPath string) (manifest,
+    error) {
+  manifest := manifest{}
+  err := readManifestObject(bucket, s3ManifestPath, &manifest)
+  if err != nil { return manifest, err }
+
+  for _, ref := range manifest.Chunks {
+    chunk := manifestChunk{}
+    err = readManifestObject(bucket, ref.Key, &chunk)
+    if err != nil { return manifest, err }
+    mergeManifestChunk(&manifest, chunk)
+  }
+  manifest.Chunks = nil
+  return manifest, nil
+}
+
+/* Downloads the JSON at `key` into `value`. Transient failures are
+ * retried. */
+func readManifestObject(bucket *s3.Bucket, key string,
+    value interface{}) error {
+  var body []byte
+  err := withS3Retries(logger, S3_OP_READ_MANIFEST, func() error {
+    var err error
+    body, err = bucket.Get(key)
+    return err
+  })
+  if err != nil { return err }
+
+  return json.Unmarshal(body, value)
+}
+
+/* Returns true if `key`, found by listing a prefix, may be a manifest of a
+ * whole document: a JSON object that isn't a chunk of one, nor a part. */
+func isTopLevelManifestKey(key string) bool {
+  return strings.HasSuffix(key, ".json") &&
+    !MANIFEST_CHUNK_PATTERN.MatchString(key) &&
+    !strings.Contains(key, ".parts/")
+}
+
+/* Returns the key of the chunk of the manifest at `s3ManifestPath` that
+ * holds pages `firstPage` to `lastPage`, e.g. "doc.pages-1-1000.json". */
+func manifestChunkKey(s3ManifestPath string, firstPage int,
+    lastPage int) string {
+  return replaceExtension(s3ManifestPath,
+    fmt.Sprintf(".pages-%d-%d.json", firstPage, lastPage))
+}
+
+/* Returns the page number of each per-page key the conversion with
+ * `params` writes for a `numPages`-page document. */
+func manifestPageKeys(params conversionParams,
+    numPages int) map[string]int {
+  templates := []string{}
+  for _, s3Path := range s3PathsByTier(params) {
+    templates = append(templates, s3Path)
+  }
+  for _, s3Path := range s3TextPathsByFormat(params) {
+    templates = append(templates, s3Path)
+  }
+  if params.DualWrite {
+    templates = append(templates, params.S3LegacyJPEGPath,
+      params.S3LegacySmallJPEGPath, params.S3LegacyLargeJPEGPath)
+    if params.S3LegacyDarkJPEGPath != "" {
+      templates = append(templates, params.S3LegacyDarkJPEGPath)
+    }
+  }
+
+  pageKeys := map[string]int{}
+  for pageNum := 1; pageNum <= numPages; pageNum = pageNum + 1 {
+    for _, template := range templates {
+      pageKeys[fmt.Sprintf(template, pageNum)] = pageNum
+    }
+  }
+  return pageKeys
+}
+
+/* Splits the per-page details of `whole` into chunks of `chunkPages` pages
+ * each, returning the manifest that refers to them and the chunks. If it has
+ * no more pages than that, or `chunkPages` is 0, it's returned unchanged.
+ * Checksums of keys that don't belong to a page, like the sprite sheet's,
+ * stay in the manifest. */
+func splitManifest(whole manifest, chunkPages int) (manifest,
+    []manifestChunk) {
+  if chunkPages <= 0 || whole.NumPages <= chunkPages { return whole, nil }
+
+  split := whole
+  split.PageLabels = nil
+  split.HandwritingRegions = nil
+  split.PageQuality = nil
+  split.PageHashes = nil
+  split.Checksums = map[string]string{}
+  split.Chunks = []manifestChunkRef{}
+
+  chunks := []manifestChunk{}
+  for first := 1; first <= whole.NumPages; first = first + chunkPages {
+    last := minInt(first + chunkPages - 1, whole.NumPages)
+    chunk := manifestChunk{FirstPage: first, LastPage: last,
+      PageLabels: map[int][]string{},
+      HandwritingRegions: map[int][]handwritingRegion{},
+      PageQuality: map[int]pageQuality{},
+      Checksums: map[string]string{}}
+
+    for pageNum := first; pageNum <= last; pageNum = pageNum + 1 {
+      if labels, ok := whole.PageLabels[pageNum]; ok {
+        chunk.PageLabels[pageNum] = labels
+      }
+      if regions, ok := whole.HandwritingRegions[pageNum]; ok {
+        chunk.HandwritingRegions[pageNum] = regions
+      }
+      if quality, ok := whole.PageQuality[pageNum]; ok {
+        chunk.PageQuality[pageNum] = quality
+      }
+    }
+    if len(whole.PageHashes) >= first {
+      chunk.PageHashes = whole.PageHashes[first - 1:minInt(last,
+        len(whole.PageHashes))]
+    }
+
+    chunks = append(chunks, chunk)
+    split.Chunks = append(split.Chunks, manifestChunkRef{
+      Key: manifestChunkKey(whole.Params.S3ManifestPath, first, last),
+      FirstPage: first, LastPage: last})
+  }
+
+  pageKeys := manifestPageKeys(whole.Params, whole.NumPages)
+  for key, checksum := range whole.Checksums {
+    pageNum, ok := pageKeys[key]
+    if ok {
+      chunks[(pageNum - 1) / chunkPages].Checksums[key] = checksum
+    } else {
+      split.Checksums[key] = checksum
+    }
+  }
+  return split, chunks
+}
+
+/* Adds the per-page details in `chunk` back to `manifest`. */
+func mergeManifestChunk(manifest *manifest, chunk manifestChunk) {
+  if manifest.PageLabels == nil {
+    manifest.PageLabels = map[int][]string{}
+  }
+  if manifest.HandwritingRegions == nil {
+    manifest.HandwritingRegions = map[int][]handwritingRegion{}
+  }
+  if manifest.PageQuality == nil {
+    manifest.PageQuality = map[int]pageQuality{}
+  }
+  if manifest.Checksums == nil {
+    manifest.Checksums = map[string]string{}
+  }
+
+  for pageNum, labels := range chunk.PageLabels {
+    manifest.PageLabels[pageNum] = labels
+  }
+  for pageNum, regions := range chunk.HandwritingRegions {
+    manifest.HandwritingRegions[pageNum] = regions
+  }
+  for pageNum, quality := range chunk.PageQuality {
+    manifest.PageQuality[pageNum] = quality
+  }
+  for key, checksum := range chunk.Checksums {
+    manifest.Checksums[key] = checksum
+  }
+
+  // chunks are read in order, so hashes line up as long as none is missing
+  if len(manifest.PageHashes) == chunk.FirstPage - 1 {
+    manifest.PageHashes = append(manifest.PageHashes, chunk.PageHashes...)
+  }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "sort"
+  "strings"
+  "launchpad.net/goamz/s3"
+)
+
+/* How a re-conversion changed the document its manifest describes, next to
+ * the manifest it replaced: the pages it gained and lost, and the rendered
+ * pages whose renditions' checksums changed, so consumers know which images
+ * to refresh in their caches. `UnchangedPages` counts the rest. */
+type manifestDiff struct {
+  PreviousJobID string `json:"previousJobId"`
+  AddedPages []int `json:"addedPages"`
+  RemovedPages []int `json:"removedPages"`
+  ChangedPages []int `json:"changedPages"`
+  UnchangedPages int `json:"unchangedPages"`
+}
+
+/* Returns the manifest a conversion with `params` is about to replace, or
+ * nil if there's none. `base`, the manifest an incremental conversion built
+ * on, is used if it was already read. The diff is best-effort, so a
+ * manifest that can't be read is logged and treated as missing. */
+func previousManifest(job *job, bucket *s3.Bucket, params conversionParams,
+    base *manifest) *manifest {
+  if params.S3ManifestPath == "" { return nil }
+  if base != nil { return base }
+
+  previous, err := readManifest(bucket, params.S3ManifestPath)
+  if isS3NotFound(err) { return nil }
+  if err != nil {
+    job.logger().Warn("Couldn't read previous manifest", errorAttr(err))
+    return nil
+  }
+  return &previous
+}
+
+/* Returns the checksums of each page's renditions and text in `manifest`,
+ * sorted and joined, so pages compare equal even if their keys moved. */
+func pageChecksums(manifest manifest) map[int]string {
+  checksums := map[int][]string{}
+  pageKeys := manifestPageKeys(manifest.Params, manifest.NumPages)
+  for key, pageNum := range pageKeys {
+    if checksum, ok := manifest.Checksums[key]; ok {
+      checksums[pageNum] = append(checksums[pageNum], checksum)
+    }
+  }
+
+  joined := map[int]string{}
+  for pageNum, pageChecksums := range checksums {
+    sort.Strings(pageChecksums)
+    joined[pageNum] = strings.Join(pageChecksums, ",")
+  }
+  return joined
+}
+
+/* Returns how `current`, the manifest of a conversion that rendered pages
+ * `pageNums`, differs from `previous`. Pages that weren't rendered are
+ * counted as unchanged. */
+func diffManifests(previous manifest, current manifest,
+    pageNums []int) manifestDiff {
+  diff := manifestDiff{PreviousJobID: previous.JobID, AddedPages: []int{},
+    RemovedPages: []int{}, ChangedPages: []int{}}
+
+  for pageNum := previous.NumPages + 1; pageNum <= current.NumPages;
+      pageNum = pageNum + 1 {
+    diff.AddedPages = append(diff.AddedPages, pageNum)
+  }
+  for pageNum := current.NumPages + 1; pageNum <= previous.NumPages;
+      pageNum = pageNum + 1 {
+    diff.RemovedPages = append(diff.RemovedPages, pageNum)
+  }
+
+  rendered := map[int]bool{}
+  for _, pageNum := range pageNums {
+    rendered[pageNum] = true
+  }
+
+  previousChecksums := pageChecksums(previous)
+  currentChecksums := pageChecksums(current)
+  common := minInt(previous.NumPages, current.NumPages)
+  for pageNum := 1; pageNum <= common; pageNum = pageNum + 1 {
+    checksum, ok := previousChecksums[pageNum]
+    if rendered[pageNum] &&
+        (!ok || checksum != currentChecksums[pageNum]) {
+      diff.ChangedPages = append(diff.ChangedPages, pageNum)
+    } else {
+      diff.UnchangedPages += 1
+    }
+  }
+  return diff
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "sort"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// returned when a manifest assembled has no parts
+var errNoManifestParts = errors.New("There are no parts of that " +
+  "manifest.\n")
+
+/* Response of POST /assemble. */
+type assemblyResponse struct {
+  JobID string `json:"jobId"`
+  ManifestKey string `json:"manifestKey"`
+  NumPages int `json:"numPages"`
+  Parts []string `json:"parts"`
+}
+
+/* An error explaining why a manifest's parts can't be assembled yet, e.g.
+ * because some pages haven't been converted. */
+type assemblyConflictError struct {
+  message string
+}
+
+func (err assemblyConflictError) Error() string {
+  return err.message
+}
+
+/* Parses the `manifestPart` key of `form` into `params`. If it's "true",
+ * the conversion only renders the pages in `pages`, and writes what it did
+ * to a part of the manifest at `s3ManifestPath` rather than to the manifest
+ * itself, so a client can spread a document's pages over many conversions
+ * and assemble their parts once they're done. */
+func parseManifestPart(form url.Values, params *conversionParams) error {
+  part, err := optionalFormValue(form, "manifestPart")
+  if err != nil { return err }
+
+  if part != "" && part != "true" && part != "false" {
+    return errors.New("The 'manifestPart' key must be 'true' or " +
+      "'false'.\n")
+  }
+  if part != "true" { return nil }
+
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    return errors.New("Content-addressed conversions can't write manifest " +
+      "parts, since their manifest's key isn't known in advance.\n")
+  }
+  if params.S3ManifestPath == "" {
+    return errors.New("The 'manifestPart' key requires 's3ManifestPath'.\n")
+  }
+  if params.Pages == "" || params.Sample > 0 {
+    return errors.New("The 'manifestPart' key requires 'pages', and can't " +
+      "be combined with 'sample'.\n")
+  }
+  if params.SpriteColumns != 0 {
+    return errors.New("The 'manifestPart' key can't be combined with " +
+      "'spriteColumns', since each part only has some pages.\n")
+  }
+
+  params.ManifestPart = true
+  return nil
+}
+
+/* Returns the prefix the parts of the manifest at `s3ManifestPath` are
+ * written under, e.g. "doc/manifest.parts/" for "doc/manifest.json". */
+func manifestPartsPrefix(s3ManifestPath string) string {
+  return replaceExtension(s3ManifestPath, ".parts/")
+}
+
+/* Returns the key of the part of the manifest at `s3ManifestPath` written
+ * by the job with ID `jobID`. */
+func manifestPartKey(s3ManifestPath string, jobID string) string {
+  return manifestPartsPrefix(s3ManifestPath) + jobID + ".json"
+}
+
+/* Returns the key the job with ID `jobID` writes its manifest to when
+ * converting with `params`, or "" if it doesn't write one. */
+func writtenManifestKey(params conversionParams, jobID string) string {
+  if params.ManifestPart {
+    return manifestPartKey(params.S3ManifestPath, jobID)
+  }
+  return params.S3ManifestPath
+}
+
+/* Uploads `part`, the manifest of a conversion that only rendered some
+ * pages, as a part of the manifest its params name. Parts aren't split
+ * into chunks, since each has just the pages it rendered. */
+func writeManifestPart(bucket *s3.Bucket, part manifest) error {
+  key := manifestPartKey(part.Params.S3ManifestPath, part.JobID)
+  return putManifestObject(bucket, part.Params, key, part)
+}
+
+/* Returns `params` without what may differ between the parts of one
+ * manifest: the pages each rendered. */
+func wholeDocumentParams(params conversionParams) conversionParams {
+  params.Pages = ""
+  params.ManifestPart = false
+  return params
+}
+
+/* Lists and reads every part of the manifest at `s3ManifestPath`, oldest
+ * first. */
+func readManifestParts(job *job, bucket *s3.Bucket,
+    s3ManifestPath string) ([]manifest, []string, error) {
+  prefix := manifestPartsPrefix(s3ManifestPath)
+  keys := []string{}
+  marker := ""
+  for {
+    var list *s3.ListResp
+    err := withS3Retries(job.logger(), S3_OP_LIST, func() error {
+      var err error
+      list, err = bucket.List(prefix, "", marker, MAX_LIST_KEYS)
+      return err
+    })
+    if err != nil { return nil, nil, err }
+
+    for _, key := range list.Contents {
+      if strings.HasSuffix(key.Key, ".json") {
+        keys = append(keys, key.Key)
+      }
+    }
+
+    if !list.IsTruncated || len(list.Contents) == 0 { break }
+    marker = list.Contents[len(list.Contents) - 1].Key
+  }
+
+  parts := []manifest{}
+  for _, key := range keys {
+    part, err := readManifest(bucket, key)
+    if err != nil { return nil, nil, err }
+    parts = append(parts, part)
+  }
+
+  // where parts overlap, e.g. after a chunk was retried, the latest wins
+  order := make([]int, len(parts))
+  for i := range order {
+    order[i] = i
+  }
+  sort.SliceStable(order, func(a int, b int) bool {
+    return parts[order[a]].CreatedAt < parts[order[b]].CreatedAt
+  })
+
+  sortedParts := []manifest{}
+  sortedKeys := []string{}
+  for _, i := range order {
+    sortedParts = append(sortedParts, parts[i])
+    sortedKeys = append(sortedKeys, keys[i])
+  }
+  return sortedParts, sortedKeys, nil
+}
+
+/* Returns the manifest of the whole document that `parts`, oldest first,
+ * each describe some pages of, as `job`. It's an error if the parts
+ * disagree about the document or how it was converted, or if they leave
+ * any page out. */
+func mergeManifestParts(job *job, parts []manifest) (manifest, error) {
+  first := parts[0]
+  params := wholeDocumentParams(first.Params)
+  merged := manifest{
+    PipelineVersion: first.PipelineVersion,
+    JobID: job.id,
+    Params: params,
+    NumPages: first.NumPages,
+    PageLabels: map[int][]string{},
+    HandwritingRegions: map[int][]handwritingRegion{},
+    PageQuality: map[int]pageQuality{},
+    Encryption: first.Encryption,
+    Checksums: map[string]string{},
+    CreatedAt: time.Now().UTC().Format(time.RFC3339),
+  }
+
+  rendered := map[int]bool{}
+  for _, part := range parts {
+    partParams := wholeDocumentParams(part.Params)
+    if part.PipelineVersion != merged.PipelineVersion ||
+        part.NumPages != merged.NumPages ||
+        !sameOutputs(partParams, params) ||
+        hashRenderingParams(partParams) != hashRenderingParams(params) {
+      return merged, assemblyConflictError{fmt.Sprintf("Part %s was " +
+        "converted differently from part %s.\n", part.JobID, first.JobID)}
+    }
+
+    for _, pageNum := range part.RenderedPages {
+      rendered[pageNum] = true
+    }
+    for pageNum, labels := range part.PageLabels {
+      merged.PageLabels[pageNum] = labels
+    }
+    for pageNum, regions := range part.HandwritingRegions {
+      merged.HandwritingRegions[pageNum] = regions
+    }
+    for pageNum, quality := range part.PageQuality {
+      merged.PageQuality[pageNum] = quality
+    }
+    for key, checksum := range part.Checksums {
+      merged.Checksums[key] = checksum
+    }
+  }
+
+  missing := []int{}
+  for pageNum := 1; pageNum <= merged.NumPages; pageNum = pageNum + 1 {
+    if !rendered[pageNum] {
+      missing = append(missing, pageNum)
+    }
+  }
+  if len(missing) > 0 {
+    return merged, assemblyConflictError{fmt.Sprintf("Pages %s haven't " +
+      "been converted yet.\n", formatPageList(missing))}
+  }
+
+  merged.UnreadablePages = unreadablePages(merged.PageQuality)
+  return merged, nil
+}
+
+/* Reads the parts of the manifest at `s3ManifestPath` as `job`, and writes
+ * the manifest they add up to in their place. Parts are kept, so assembly
+ * can be repeated, e.g. after a part is converted again. */
+func runAssembly(job *job, bucket *s3.Bucket,
+    s3ManifestPath string) (assemblyResponse, error) {
+  response := assemblyResponse{JobID: job.id, ManifestKey: s3ManifestPath}
+
+  parts, keys, err := readManifestParts(job, bucket, s3ManifestPath)
+  if err != nil { return response, err }
+  response.Parts = keys
+  if len(parts) == 0 { return response, errNoManifestParts }
+
+  merged, err := mergeManifestParts(job, parts)
+  if err != nil { return response, err }
+  response.NumPages = merged.NumPages
+  job.setNumPages(merged.NumPages)
+
+  err = writeManifest(bucket, merged)
+  if err != nil { return response, err }
+
+  job.recordEvent("assembled", 0, fmt.Sprintf("%d parts", len(parts)))
+  return response, nil
+}
+
+/* Handles POST /assemble, the last step of a client-driven conversion: once
+ * the client has converted every page of a document in conversions with
+ * `manifestPart=true`, perhaps on different servers, this writes the
+ * manifest at `s3ManifestPath` from their parts. It takes the same bucket
+ * keys as a conversion, and responds with the parts it read. A `409`
+ * explains which pages are still missing, or which parts disagree. */
+func serveAssembly(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  s3ManifestPath, err := requireFormValue(request.Form, "s3ManifestPath",
+    "a manifest path")
+  var bucket *s3.Bucket
+  if err == nil {
+    bucket, err = connectToRequestBucket(request.Form, bucketName,
+      regionName)
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+
+  response, err := runAssembly(job, bucket, s3ManifestPath)
+  job.finish(err)
+
+  if err == errNoManifestParts {
+    http.Error(writer, err.Error(), http.StatusNotFound)
+    return
+  }
+  if _, ok := err.(assemblyConflictError); ok {
+    http.Error(writer, err.Error(), http.StatusConflict)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  job.logger().Info("Manifest assembled", "parts", len(response.Parts))
+  writeJSON(writer, http.StatusOK, response)
+}
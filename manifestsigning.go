@@ -0,0 +1,104 @@
+package main
+
+import (
+  "crypto/ed25519"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/pem"
+  "errors"
+  "flag"
+  "io/ioutil"
+  "net/http"
+)
+
+var manifestSigningKeyPath = flag.String("manifest-signing-key", "",
+  "PEM (PKCS #8) Ed25519 private key manifests are signed with " +
+  "(unsigned if empty)")
+
+// S3 metadata a signed manifest carries: the base64 Ed25519 signature of
+// its body, and the ID of the key that made it
+const (
+  MANIFEST_SIGNATURE_HEADER = "x-amz-meta-evangelist-signature"
+  MANIFEST_KEY_ID_HEADER = "x-amz-meta-evangelist-key-id"
+)
+
+// the key manifests are signed with, or nil if they aren't
+var manifestSigningKey ed25519.PrivateKey
+
+/* The public half of the manifest signing key, as reported by
+ * GET /manifest-signing-key. `KeyID` is the hex SHA-256 of the public key,
+ * truncated to 8 bytes. */
+type manifestSigningKeyResponse struct {
+  Algorithm string `json:"algorithm"`
+  PublicKey string `json:"publicKey"`
+  KeyID string `json:"keyId"`
+}
+
+/* Loads the key at -manifest-signing-key, if given. */
+func setupManifestSigning() error {
+  if *manifestSigningKeyPath == "" { return nil }
+
+  encoded, err := ioutil.ReadFile(*manifestSigningKeyPath)
+  if err != nil { return err }
+
+  block, _ := pem.Decode(encoded)
+  if block == nil || block.Type != "PRIVATE KEY" {
+    return errors.New("-manifest-signing-key must hold a PEM PRIVATE KEY.\n")
+  }
+
+  key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil { return err }
+
+  signingKey, ok := key.(ed25519.PrivateKey)
+  if !ok {
+    return errors.New("-manifest-signing-key must be an Ed25519 key.\n")
+  }
+
+  manifestSigningKey = signingKey
+  logger.Info("Signing manifests", "keyId", manifestKeyID())
+  return nil
+}
+
+/* Returns the ID of the manifest signing key. */
+func manifestKeyID() string {
+  digest := sha256.Sum256(manifestSigningKey.Public().(ed25519.PublicKey))
+  return hex.EncodeToString(digest[:8])
+}
+
+/* Adds the signature of the manifest `body` to `headers`, if manifests are
+ * signed. Returns true if it did. */
+func addManifestSignature(headers map[string][]string, body []byte) bool {
+  if manifestSigningKey == nil { return false }
+
+  signature := ed25519.Sign(manifestSigningKey, body)
+  headers[MANIFEST_SIGNATURE_HEADER] =
+    []string{base64.StdEncoding.EncodeToString(signature)}
+  headers[MANIFEST_KEY_ID_HEADER] = []string{manifestKeyID()}
+  return true
+}
+
+/* Handles GET /manifest-signing-key, responding with the public key that
+ * manifests' signatures verify with, so downstream consumers can check
+ * them. It's public, so no role is required. */
+func serveManifestSigningKey(writer http.ResponseWriter,
+    request *http.Request) {
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if manifestSigningKey == nil {
+    http.Error(writer, "Manifests aren't signed.\n", http.StatusNotFound)
+    return
+  }
+
+  publicKey := manifestSigningKey.Public().(ed25519.PublicKey)
+  writeJSON(writer, http.StatusOK, manifestSigningKeyResponse{
+    Algorithm: "ed25519",
+    PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+    KeyID: manifestKeyID(),
+  })
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+)
+
+/* A metric family that can be written in the Prometheus text format. */
+type metric interface {
+  write(writer io.Writer)
+}
+
+/* A family of Prometheus counters sharing a name and label names, one
+ * counter per distinct combination of label values. */
+type counterVec struct {
+  mutex sync.Mutex
+  name string
+  help string
+  labelNames []string
+  values map[string]float64
+}
+
+/* Creates and registers a counter family. */
+func newCounterVec(name string, help string,
+    labelNames ...string) *counterVec {
+  counter := &counterVec{name: name, help: help, labelNames: labelNames,
+    values: map[string]float64{}}
+  allMetrics = append(allMetrics, counter)
+  return counter
+}
+
+/* Adds `value` to the counter with the given label values. */
+func (counter *counterVec) add(value float64, labelValues ...string) {
+  counter.mutex.Lock()
+  defer counter.mutex.Unlock()
+  counter.values[strings.Join(labelValues, "\x00")] += value
+}
+
+/* Escapes a label value for the Prometheus text format. */
+func escapeLabelValue(value string) string {
+  value = strings.Replace(value, "\\", "\\\\", -1)
+  value = strings.Replace(value, "\"", "\\\"", -1)
+  return strings.Replace(value, "\n", "\\n", -1)
+}
+
+/* Writes the samples in `values`, keyed by their label values joined with
+ * NULs, as metric family `name` of type `kind`. */
+func writeSamples(writer io.Writer, name string, help string, kind string,
+    labelNames []string, values map[string]float64) {
+  fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+  fmt.Fprintf(writer, "# TYPE %s %s\n", name, kind)
+
+  // sort for stable output
+  keys := []string{}
+  for key := range values {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    labels := []string{}
+    for i, labelValue := range strings.Split(key, "\x00") {
+      labels = append(labels, fmt.Sprintf("%s=\"%s\"", labelNames[i],
+        escapeLabelValue(labelValue)))
+    }
+
+    fmt.Fprintf(writer, "%s{%s} %g\n", name, strings.Join(labels, ","),
+      values[key])
+  }
+}
+
+/* Writes every counter in the family in the Prometheus text format. */
+func (counter *counterVec) write(writer io.Writer) {
+  counter.mutex.Lock()
+  defer counter.mutex.Unlock()
+  writeSamples(writer, counter.name, counter.help, "counter",
+    counter.labelNames, counter.values)
+}
+
+/* A family of Prometheus gauges with a single label, whose values are read
+ * by `collect` whenever metrics are scraped. */
+type gaugeFunc struct {
+  name string
+  help string
+  labelName string
+  collect func() map[string]float64
+}
+
+/* Creates and registers a gauge family. */
+func newGaugeFunc(name string, help string, labelName string,
+    collect func() map[string]float64) *gaugeFunc {
+  gauge := &gaugeFunc{name: name, help: help, labelName: labelName,
+    collect: collect}
+  allMetrics = append(allMetrics, gauge)
+  return gauge
+}
+
+/* Writes every gauge in the family in the Prometheus text format. */
+func (gauge *gaugeFunc) write(writer io.Writer) {
+  writeSamples(writer, gauge.name, gauge.help, "gauge",
+    []string{gauge.labelName}, gauge.collect())
+}
+
+// every registered metric, in registration order
+var allMetrics = []metric{}
+
+var jobsTotal = newCounterVec("evangelist_jobs_total",
+  "Jobs finished, by tenant and result (success or failure).",
+  "tenant", "result")
+var pagesTotal = newCounterVec("evangelist_pages_total",
+  "Pages converted, by tenant.", "tenant")
+var sourceBytesTotal = newCounterVec("evangelist_source_bytes_total",
+  "Bytes of source documents downloaded, by tenant.", "tenant")
+var outputBytesTotal = newCounterVec("evangelist_output_bytes_total",
+  "Bytes of rendered images uploaded, by tenant.", "tenant")
+
+/* Records the totals of a finished job in the metrics. */
+func recordJobMetrics(tenant string, pagesConverted int,
+    bytesDownloaded int64, bytesUploaded int64, err error) {
+  result := "success"
+  if err != nil {
+    result = "failure"
+  }
+
+  jobsTotal.add(1, tenant, result)
+  pagesTotal.add(float64(pagesConverted), tenant)
+  sourceBytesTotal.add(float64(bytesDownloaded), tenant)
+  outputBytesTotal.add(float64(bytesUploaded), tenant)
+}
+
+/* Handles GET /metrics, writing all metrics in the Prometheus text format. */
+func serveMetrics(writer http.ResponseWriter, request *http.Request) {
+  writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  for _, metric := range allMetrics {
+    metric.write(writer)
+  }
+}
@@ -0,0 +1,37 @@
+//go:build !fitz
+// +build !fitz
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "strings"
+)
+
+// Without the fitz build tag, MuPDF is run as a mutool process for each
+// page, so the binary builds and runs without MuPDF's libraries.
+
+/* Does nothing; this build has no in-process MuPDF to set up. */
+func setupMuPDF() error { return nil }
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` by running
+ * mutool, which can't write JPEGs, so its PNG is re-encoded by ImageMagick,
+ * which keeps a grayscale one grayscale. */
+func renderWithMuPDF(pdfPath string, pageNum int, outputPath string,
+    density int, quality int, gray bool) error {
+  pngPath := strings.TrimSuffix(outputPath, ".jpg") + ".png"
+  defer os.Remove(pngPath)
+
+  colorspace := "rgb"
+  if gray { colorspace = "gray" }
+  cmd := toolCommand("mutool", "draw", "-q", "-r",
+    fmt.Sprintf("%d", density), "-c", colorspace, "-o", pngPath, pdfPath,
+    fmt.Sprintf("%d", pageNum))
+  err := runTool(cmd)
+  if err != nil { return err }
+
+  cmd = toolCommand("convert", pngPath, "-quality",
+    fmt.Sprintf("%d", quality), outputPath)
+  return runTool(cmd)
+}
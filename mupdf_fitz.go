@@ -0,0 +1,45 @@
+//go:build fitz
+// +build fitz
+
+package main
+
+import (
+  "image/jpeg"
+  "os"
+  "github.com/gen2brain/go-fitz"
+)
+
+// With the fitz build tag, the mupdf renderer rasterizes pages with MuPDF
+// linked into the server through go-fitz, rather than by running mutool and
+// then ImageMagick for each page, so it needs neither binary.
+
+/* Logs that MuPDF renders in process. */
+func setupMuPDF() error {
+  logger.Info("Rendering with MuPDF in-process")
+  return nil
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` with
+ * MuPDF, encoding the JPEG in process. Each page opens the PDF afresh, so
+ * pages of the same document can be rendered at once. */
+func renderWithMuPDF(pdfPath string, pageNum int, outputPath string,
+    density int, quality int, gray bool) error {
+  document, err := fitz.New(pdfPath)
+  if err != nil { return err }
+  defer document.Close()
+
+  // go-fitz numbers pages from 0
+  rendered, err := document.ImageDPI(pageNum - 1, float64(density))
+  if err != nil { return err }
+
+  output, err := os.Create(outputPath)
+  if err != nil { return err }
+
+  err = jpeg.Encode(output, flattenOntoWhite(rendered, gray),
+    &jpeg.Options{Quality: quality})
+  if err != nil {
+    output.Close()
+    return err
+  }
+  return output.Close()
+}
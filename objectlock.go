@@ -0,0 +1,116 @@
+package main
+
+import (
+  "crypto/md5"
+  "encoding/base64"
+  "errors"
+  "io"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// S3 Object Lock retention modes
+const (
+  OBJECT_LOCK_GOVERNANCE = "GOVERNANCE"
+  OBJECT_LOCK_COMPLIANCE = "COMPLIANCE"
+)
+
+/* Parses the optional Object Lock parameters in `form` into `params`:
+ *
+ * - `objectLockMode`: "governance" or "compliance"
+ * - `objectLockRetainUntil`: an RFC 3339 time, or
+ * - `objectLockRetainDays`: a number of days from now
+ * - `objectLockLegalHold`: "true" to place a legal hold
+ *
+ * A mode requires a retention period, and vice versa. */
+func parseObjectLockParams(form url.Values, params *conversionParams) error {
+  mode, err := optionalFormValue(form, "objectLockMode")
+  if err != nil { return err }
+
+  retainUntil, err := optionalFormValue(form, "objectLockRetainUntil")
+  if err != nil { return err }
+
+  retainDays, err := optionalFormValue(form, "objectLockRetainDays")
+  if err != nil { return err }
+
+  legalHold, err := optionalFormValue(form, "objectLockLegalHold")
+  if err != nil { return err }
+
+  mode = strings.ToUpper(mode)
+  if mode != "" && mode != OBJECT_LOCK_GOVERNANCE &&
+      mode != OBJECT_LOCK_COMPLIANCE {
+    return errors.New("The 'objectLockMode' key must be 'governance' or " +
+      "'compliance'.\n")
+  }
+
+  if retainUntil != "" && retainDays != "" {
+    return errors.New("Must specify at most one of the " +
+      "'objectLockRetainUntil' and 'objectLockRetainDays' keys.\n")
+  }
+
+  if retainDays != "" {
+    days, err := strconv.Atoi(retainDays)
+    if err != nil || days < 1 {
+      return errors.New("The 'objectLockRetainDays' key must be a positive " +
+        "integer.\n")
+    }
+    retainUntil = time.Now().AddDate(0, 0, days).UTC().Format(time.RFC3339)
+  } else if retainUntil != "" {
+    until, err := time.Parse(time.RFC3339, retainUntil)
+    if err != nil || !until.After(time.Now()) {
+      return errors.New("The 'objectLockRetainUntil' key must be an RFC " +
+        "3339 time in the future.\n")
+    }
+    retainUntil = until.UTC().Format(time.RFC3339)
+  }
+
+  if (mode == "") != (retainUntil == "") {
+    return errors.New("An Object Lock mode requires a retention period, and " +
+      "vice versa.\n")
+  }
+
+  if legalHold != "" && legalHold != "true" && legalHold != "false" {
+    return errors.New("The 'objectLockLegalHold' key must be 'true' or " +
+      "'false'.\n")
+  }
+
+  params.ObjectLockMode = mode
+  params.ObjectLockRetainUntil = retainUntil
+  params.ObjectLockLegalHold = legalHold == "true"
+  return nil
+}
+
+/* Returns true if objects written for `params` are locked in any way. */
+func usesObjectLock(params conversionParams) bool {
+  return params.ObjectLockMode != "" || params.ObjectLockLegalHold
+}
+
+/* Adds the Object Lock headers requested by `params` to `headers`. */
+func addObjectLockHeaders(headers map[string][]string,
+    params conversionParams) {
+  if params.ObjectLockMode != "" {
+    headers["x-amz-object-lock-mode"] = []string{params.ObjectLockMode}
+    headers["x-amz-object-lock-retain-until-date"] =
+      []string{params.ObjectLockRetainUntil}
+  }
+
+  if params.ObjectLockLegalHold {
+    headers["x-amz-object-lock-legal-hold"] = []string{"ON"}
+  }
+}
+
+/* Returns the base64 MD5 digest of everything in `reader`, as needed for a
+ * Content-MD5 header, then rewinds it. S3 requires Content-MD5 on uploads to
+ * buckets with Object Lock retention. */
+func contentMD5(reader io.ReadSeeker) (string, error) {
+  hash := md5.New()
+  _, err := io.Copy(hash, reader)
+  if err != nil { return "", err }
+
+  _, err = reader.Seek(0, 0)
+  if err != nil { return "", err }
+
+  return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "encoding/xml"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var tesseract = flag.String("tesseract", "tesseract",
+  "Tesseract binary run on each page when a request passes extractText=true")
+var ocrTimeout = flag.Duration("ocr-timeout", 2 * time.Minute,
+  "how long Tesseract may take on a single page")
+
+// names of the text outputs in results, after Tesseract's config files
+const (
+  TEXT_PLAIN = "text"
+  TEXT_HOCR = "hocr"
+  TEXT_OCR_INFO = "ocr"
+)
+
+// a Tesseract language pack, e.g. "eng" or "chi_sim"
+var OCR_LANGUAGE_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// a word's confidence in the title of an hOCR word, e.g. "x_wconf 96"
+var HOCR_CONFIDENCE_PATTERN = regexp.MustCompile(`x_wconf (\d+)`)
+
+// language packs Tesseract has installed, listed once it's first asked for
+// one; nil if they couldn't be listed
+var installedOCRLanguages map[string]bool
+var listOCRLanguagesOnce sync.Once
+
+/* What Tesseract made of a page, uploaded beside its text: the language
+ * packs it was read with, the language most of its words were recognized
+ * in, and their mean confidence (0 to 100). */
+type ocrInfo struct {
+  PageNum int `json:"pageNum"`
+  Languages []string `json:"languages"`
+  Language string `json:"language,omitempty"`
+  Confidence float64 `json:"confidence"`
+  NumWords int `json:"numWords"`
+}
+
+/* Returns `jpegPath` with its extension replaced by `extension`, so text is
+ * stored alongside the JPEGs, e.g. "exam/%d.jpg" becomes "exam/%d.txt". */
+func replaceExtension(jpegPath string, extension string) string {
+  current := path.Ext(jpegPath)
+  if strings.Contains(current, "%d") || strings.Contains(current, "/") {
+    current = ""
+  }
+  return strings.TrimSuffix(jpegPath, current) + extension
+}
+
+/* Returns true if Tesseract has the language pack `language` installed, or
+ * if its packs can't be listed, leaving Tesseract to reject it. */
+func hasOCRLanguage(language string) bool {
+  listOCRLanguagesOnce.Do(func() {
+    output, err := toolCommand(*tesseract, "--list-langs").Output()
+    if err != nil {
+      logger.Warn("Couldn't list Tesseract's languages", errorAttr(err))
+      return
+    }
+
+    // the packs follow a header line, e.g. "List of available languages"
+    installedOCRLanguages = map[string]bool{}
+    for _, line := range strings.Split(string(output), "\n") {
+      line = strings.TrimSpace(line)
+      if OCR_LANGUAGE_PATTERN.MatchString(line) {
+        installedOCRLanguages[line] = true
+      }
+    }
+  })
+  return installedOCRLanguages == nil || installedOCRLanguages[language]
+}
+
+/* Parses the `ocrLanguages` key of `form`: the language packs to recognize
+ * text with, joined by '+' as Tesseract takes them (e.g. "eng+fra"), or ""
+ * for Tesseract's default. */
+func parseOCRLanguages(form url.Values) (string, error) {
+  languages, err := optionalFormValue(form, "ocrLanguages")
+  if err != nil || languages == "" { return languages, err }
+
+  for _, language := range strings.Split(languages, "+") {
+    if !OCR_LANGUAGE_PATTERN.MatchString(language) {
+      return "", errors.New("The 'ocrLanguages' key must list language " +
+        "packs joined by '+', e.g. 'eng+fra'.\n")
+    }
+    if !hasOCRLanguage(language) {
+      return "", errors.New(fmt.Sprintf("The '%s' OCR language isn't " +
+        "installed on this server.\n", language))
+    }
+  }
+  return languages, nil
+}
+
+/* Parses the `extractText`, `hocr`, and `ocrLanguages` keys of `form` into
+ * `params`. If `extractText` is "true", each page's text is recognized with
+ * Tesseract in the `ocrLanguages` given and uploaded to `s3TextPath`, what
+ * Tesseract made of it to `s3OCRPath`, and also hOCR to `s3HOCRPath` if
+ * `hocr` is "true". The paths default to the JPEG path with a .txt,
+ * .ocr.json, or .hocr extension. Must come after the layout is parsed. */
+func parseTextParams(form url.Values, params *conversionParams) error {
+  keys := []string{"extractText", "hocr"}
+  flags := []*bool{&params.ExtractText, &params.HOCR}
+  for i, key := range keys {
+    value, err := optionalFormValue(form, key)
+    if err != nil { return err }
+
+    if value != "" && value != "true" && value != "false" {
+      return errors.New(fmt.Sprintf("The '%s' key must be 'true' or " +
+        "'false'.\n", key))
+    }
+    *flags[i] = value == "true"
+  }
+
+  if params.HOCR && !params.ExtractText {
+    return errors.New("The 'hocr' key requires 'extractText'.\n")
+  }
+
+  languages, err := optionalFormValue(form, "ocrLanguages")
+  if err != nil { return err }
+  if languages != "" && !params.ExtractText {
+    return errors.New("The 'ocrLanguages' key requires 'extractText'.\n")
+  }
+  if !params.ExtractText { return nil }
+
+  if err := lookTool(*tesseract); err != nil {
+    return errors.New("Text extraction isn't available on this server.\n")
+  }
+
+  params.OCRLanguages, err = parseOCRLanguages(form)
+  if err != nil { return err }
+
+  // content-addressed paths are only resolved once the source is fetched
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED { return nil }
+
+  paths := []*string{&params.S3TextPath, &params.S3OCRPath,
+    &params.S3HOCRPath}
+  pathKeys := []string{"s3TextPath", "s3OCRPath", "s3HOCRPath"}
+  extensions := []string{".txt", ".ocr.json", ".hocr"}
+  for i, key := range pathKeys {
+    if key == "s3HOCRPath" && !params.HOCR { break }
+
+    value, err := optionalFormValue(form, key)
+    if err != nil { return err }
+
+    if value == "" {
+      value = replaceExtension(params.S3JPEGPath, extensions[i])
+    } else if !strings.Contains(value, "%d") {
+      return errors.New(fmt.Sprintf("Must specify a text path with %%d in " +
+        "the '%s' key.\n", key))
+    }
+    *paths[i] = value
+  }
+
+  if params.S3TextPath == params.S3HOCRPath ||
+      params.S3TextPath == params.S3OCRPath ||
+      params.S3OCRPath == params.S3HOCRPath {
+    return errors.New("The 's3TextPath', 's3OCRPath', and 's3HOCRPath' " +
+      "keys must differ.\n")
+  }
+  return nil
+}
+
+/* Returns the S3 key templates for each text output of `params`, or an
+ * empty map if text isn't extracted. */
+func s3TextPathsByFormat(params conversionParams) map[string]string {
+  paths := map[string]string{}
+  if params.S3TextPath != "" {
+    paths[TEXT_PLAIN] = params.S3TextPath
+  }
+  if params.S3HOCRPath != "" {
+    paths[TEXT_HOCR] = params.S3HOCRPath
+  }
+  if params.S3OCRPath != "" {
+    paths[TEXT_OCR_INFO] = params.S3OCRPath
+  }
+  return paths
+}
+
+/* Returns the local path templates Tesseract writes page text and hOCR to,
+ * and what it made of the page is written to, beside the page's JPEG at
+ * `jpegPath`. */
+func scratchTextPaths(jpegPath string) (string, string, string) {
+  base := strings.TrimSuffix(jpegPath, ".jpg")
+  return base + ".txt", base + ".hocr", base + ".ocr.json"
+}
+
+/* Returns what Tesseract made of page `pageNum` from the hOCR it wrote to
+ * `hocrPath`, read with language packs `languages`. Each word's language is
+ * the nearest `lang` attribute around it, and its confidence is in its
+ * title. */
+func readOCRInfo(hocrPath string, languages string,
+    pageNum int) (ocrInfo, error) {
+  info := ocrInfo{PageNum: pageNum, Languages: []string{}}
+  if languages != "" {
+    info.Languages = strings.Split(languages, "+")
+  }
+
+  file, err := os.Open(hocrPath)
+  if err != nil { return info, err }
+  defer file.Close()
+
+  decoder := xml.NewDecoder(file)
+  decoder.Strict = false
+  decoder.AutoClose = xml.HTMLAutoClose
+  decoder.Entity = xml.HTMLEntity
+
+  // the language of each open element, innermost last
+  langs := []string{""}
+  wordsByLanguage := map[string]int{}
+  totalConfidence := 0
+  for {
+    token, err := decoder.Token()
+    if err != nil { break }
+
+    switch element := token.(type) {
+    case xml.StartElement:
+      lang, class, title := langs[len(langs) - 1], "", ""
+      for _, attr := range element.Attr {
+        switch attr.Name.Local {
+        case "lang": lang = attr.Value
+        case "class": class = attr.Value
+        case "title": title = attr.Value
+        }
+      }
+      langs = append(langs, lang)
+
+      match := HOCR_CONFIDENCE_PATTERN.FindStringSubmatch(title)
+      if class != "ocrx_word" || match == nil { continue }
+      confidence, _ := strconv.Atoi(match[1])
+      totalConfidence += confidence
+      wordsByLanguage[lang] += 1
+      info.NumWords += 1
+    case xml.EndElement:
+      if len(langs) > 1 { langs = langs[:len(langs) - 1] }
+    }
+  }
+
+  if info.NumWords == 0 { return info, nil }
+  info.Confidence = roundTo(float64(totalConfidence) /
+    float64(info.NumWords), 1)
+  for lang, numWords := range wordsByLanguage {
+    if numWords > wordsByLanguage[info.Language] ||
+        (numWords == wordsByLanguage[info.Language] && lang < info.Language) {
+      info.Language = lang
+    }
+  }
+  return info, nil
+}
+
+/* Recognizes the text of page `pageNum`, whose JPEG is saved locally at
+ * `jpegPath`, if `params` asks for it. Unlike classification, the text is
+ * an output the client asked for, so failures fail the page. */
+func extractText(job *job, params conversionParams, jpegPath string,
+    pageNum int) error {
+  // re-renders may outlive the text paths their original request used
+  if params.S3TextPath == "" { return nil }
+
+  // hOCR is always written, since the words' languages and confidences
+  // are read from it, but only uploaded if it was asked for
+  localJPEGPath := fmt.Sprintf(jpegPath, pageNum)
+  args := []string{localJPEGPath, strings.TrimSuffix(localJPEGPath, ".jpg")}
+  if params.OCRLanguages != "" {
+    args = append(args, "-l", params.OCRLanguages)
+  }
+  args = append(args, "txt", "hocr")
+
+  // the timeout starts once Tesseract does, not while it waits
+  err := withProcessSlot(func() error {
+    ctx, cancel := context.WithTimeout(context.Background(), *ocrTimeout)
+    defer cancel()
+    return toolCommandContext(ctx, *tesseract, args...).Run()
+  })
+  if err != nil { return err }
+
+  _, hocrPath, infoPath := scratchTextPaths(jpegPath)
+  info, err := readOCRInfo(fmt.Sprintf(hocrPath, pageNum),
+    params.OCRLanguages, pageNum)
+  if err != nil { return err }
+
+  infoBytes, err := json.Marshal(info)
+  if err != nil { return err }
+  err = ioutil.WriteFile(fmt.Sprintf(infoPath, pageNum), infoBytes, 0600)
+  if err != nil { return err }
+
+  job.recordEvent("text extracted", pageNum, fmt.Sprintf("%s, %.1f%%",
+    info.Language, info.Confidence))
+  return nil
+}
+
+/* Uploads the text extracted from page `pageNum`, whose JPEG is saved
+ * locally at `jpegPath`, to the paths in `params`, if it was extracted. */
+func uploadPageText(job *job, bucket *s3.Bucket, params conversionParams,
+    jpegPath string, pageNum int) error {
+  if params.S3TextPath == "" { return nil }
+
+  textPath, hocrPath, infoPath := scratchTextPaths(jpegPath)
+  err := uploadJPEGToS3(job, bucket, params, textPath, params.S3TextPath,
+    pageNum)
+  if err != nil { return err }
+
+  // manifests from before OCR info was written don't have its path
+  if params.S3OCRPath != "" {
+    err = uploadJPEGToS3(job, bucket, params, infoPath, params.S3OCRPath,
+      pageNum)
+    if err != nil { return err }
+  }
+
+  if params.S3HOCRPath == "" { return nil }
+  return uploadJPEGToS3(job, bucket, params, hocrPath, params.S3HOCRPath,
+    pageNum)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// bytes read from the start of a source by /pagecount, enough to hold the
+// linearization dictionary of a linearized PDF
+const PAGE_COUNT_HEAD_BYTES = 1024
+
+// how long the URL /pagecount reads a source's first bytes from is valid
+const PAGE_COUNT_URL_EXPIRY = 5 * time.Minute
+
+// client /pagecount reads a source's first bytes with
+var pageCountClient = &http.Client{Timeout: time.Minute}
+
+// the total size in a Content-Range header, e.g. "bytes 0-1023/54321"
+var CONTENT_RANGE_PATTERN = regexp.MustCompile(`^bytes \d+-\d+/(\d+)$`)
+
+/* The first bytes of a source in S3, read by `fetchSourceHead`, along with
+ * the size and ETag of the whole object. */
+type sourceHead struct {
+  data []byte
+  size int64
+  etag string
+}
+
+/* Response of POST /pagecount. `Method` is how the pages were counted:
+ * PAGE_COUNT_LINEARIZED if only the first bytes of the source were read,
+ * or else how the whole source was counted once downloaded. */
+type pageCountResponse struct {
+  JobID string `json:"jobId"`
+  NumPages int `json:"numPages"`
+  Method string `json:"method"`
+}
+
+/* Returns the first `numBytes` bytes of the source described by `params`,
+ * read with a ranged request once `job`'s tenant gets a download slot.
+ * Transient failures are retried. */
+func fetchSourceHead(job *job, bucket *s3.Bucket, params conversionParams,
+    numBytes int) (sourceHead, error) {
+  head := sourceHead{}
+  err := downloadPool.run(job.tenant, func() error {
+    return withS3Retries(job.logger(), S3_OP_DOWNLOAD, func() error {
+      url := bucket.SignedURL(params.S3PDFPath,
+        time.Now().Add(PAGE_COUNT_URL_EXPIRY))
+      request, err := http.NewRequest("GET", url, nil)
+      if err != nil { return err }
+      request.Header.Set("Range", fmt.Sprintf("bytes=0-%d", numBytes - 1))
+
+      response, err := pageCountClient.Do(request)
+      if err != nil { return err }
+      defer response.Body.Close()
+
+      // S3 ignores ranges past the end of small objects, returning all of it
+      switch response.StatusCode {
+      case http.StatusPartialContent:
+        match := CONTENT_RANGE_PATTERN.FindStringSubmatch(
+          response.Header.Get("Content-Range"))
+        if match == nil {
+          return errors.New(fmt.Sprintf("S3 returned an unexpected " +
+            "Content-Range: %q\n", response.Header.Get("Content-Range")))
+        }
+        head.size, err = strconv.ParseInt(match[1], 10, 64)
+        if err != nil { return err }
+      case http.StatusOK:
+        head.size = response.ContentLength
+      default:
+        return &s3.Error{StatusCode: response.StatusCode,
+          Message: fmt.Sprintf("S3 responded %s.", response.Status)}
+      }
+
+      head.etag = strings.Trim(response.Header.Get("ETag"), "\"")
+      head.data, err = ioutil.ReadAll(io.LimitReader(response.Body,
+        int64(numBytes)))
+      return err
+    })
+  })
+  if err != nil { return head, err }
+
+  job.addBytesDownloaded(int64(len(head.data)))
+  return head, nil
+}
+
+/* Returns the page count that the linearization dictionary at the start of
+ * `head`, the first bytes of a PDF of `size` bytes, records, and true if
+ * there is one. It's only trusted if the file is still the length it
+ * records, since an update appended later may have added pages. */
+func linearizedPageCount(head []byte, size int64) (int, bool) {
+  match := PDF_OBJECT_PATTERN.FindIndex(head)
+  if match == nil { return 0, false }
+
+  parser := &pdfParser{head, match[1]}
+  value, err := parser.value(MAX_PDF_NESTING)
+  if err != nil { return 0, false }
+
+  dict, ok := value.(pdfDict)
+  if !ok || dict["Linearized"] == nil { return 0, false }
+
+  length, err := strconv.ParseInt(string(asPDFNumber(dict["L"])), 10, 64)
+  if err != nil || length != size { return 0, false }
+
+  numPages, err := strconv.Atoi(string(asPDFNumber(dict["N"])))
+  if err != nil || numPages < 1 { return 0, false }
+  return numPages, true
+}
+
+/* Counts the pages of the source described by `params` as `job`, reading
+ * as little of it as possible: if it's a linearized PDF, just its first
+ * bytes. Otherwise, or if those can't be read, it's fetched, scanned, and
+ * counted like a conversion's source. Returns the count and how it was
+ * made. */
+func countSourcePages(job *job, bucket *s3.Bucket,
+    params conversionParams) (int, string, error) {
+  // encrypted sources can only be decrypted whole
+  if params.SourceEncryption == "" {
+    head, err := fetchSourceHead(job, bucket, params, PAGE_COUNT_HEAD_BYTES)
+    if isS3NotFound(err) { return 0, "", err }
+    if err != nil {
+      job.logger().Warn("Couldn't read the start of the source; " +
+        "downloading it", errorAttr(err))
+    } else if numPages, ok := linearizedPageCount(head.data,
+        head.size); ok {
+      pageCountsTotal.add(1, PAGE_COUNT_LINEARIZED)
+      return numPages, PAGE_COUNT_LINEARIZED, nil
+    }
+  }
+
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return 0, "", err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return 0, "", err }
+
+  if format != SOURCE_PDF {
+    numPages, err := countPages(pdfPath, format)
+    return numPages, format, err
+  }
+
+  // count as getNumPages does, but note which way it went
+  numPages, err := countPDFPages(pdfPath)
+  if err == nil {
+    pageCountsTotal.add(1, PAGE_COUNT_PARSED)
+    return numPages, PAGE_COUNT_PARSED, nil
+  }
+  pageCountsTotal.add(1, PAGE_COUNT_GHOSTSCRIPT)
+  numPages, err = getNumPagesWithGhostscript(pdfPath)
+  return numPages, PAGE_COUNT_GHOSTSCRIPT, err
+}
+
+/* Handles POST /pagecount, which responds with the number of pages in the
+ * source document in `s3PDFPath` as JSON, reading only its first bytes if
+ * it's a linearized PDF, so clients can size their UIs before converting
+ * it. It takes the same bucket and source encryption keys as a conversion,
+ * and runs as a job whose ID is in the X-Job-ID header. */
+func servePageCount(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  params, err := parseInfoParams(request.Form)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+  defer cleanupScratch(jobID)
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  response := pageCountResponse{JobID: jobID}
+  if err == nil {
+    response.NumPages, response.Method, err = countSourcePages(job, bucket,
+      params)
+  }
+  job.finish(err)
+
+  if isS3NotFound(err) {
+    http.Error(writer, "There's no source at that key.\n",
+      http.StatusNotFound)
+    return
+  }
+  if errorCode(err) == ERROR_CODE_INFECTED {
+    writer.Header().Set("X-Error-Code", ERROR_CODE_INFECTED)
+    http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  writeJSON(writer, http.StatusOK, response)
+}
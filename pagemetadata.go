@@ -0,0 +1,141 @@
+package main
+
+import (
+  "bytes"
+  "encoding/xml"
+  "errors"
+  "flag"
+  "fmt"
+  "strconv"
+)
+
+var embedPageMetadata = flag.Bool("embed-page-metadata", true,
+  "record each JPEG's page, source, and render settings in its EXIF and XMP")
+
+// namespace and prefix of the XMP properties describing a page's origin
+const (
+  XMP_NAMESPACE = "https://github.com/catherinelu/evangelist/ns/page/1.0/"
+  XMP_PREFIX = "evangelist"
+)
+
+// largest payload an APP1 segment can hold after its length and identifier
+const MAX_XMP_BYTES = 65535 - 2 - len(XMP_IDENTIFIER)
+
+/* Where a rendition came from and how it was made, embedded in it so an
+ * orphaned JPEG found in a bucket can be traced to its source. */
+type pageMetadata struct {
+  PageNum int
+  Tier string
+  SourceBucket string
+  SourceKey string
+  JobID string
+  Renderer string
+  Density int
+  Quality int
+  Grayscale bool
+  Encoding string
+  PipelineVersion int
+}
+
+/* Returns the metadata of page `pageNum`, rendered by `rendererName` as
+ * `job` with `params`, or nil if -embed-page-metadata is off. Its tier and
+ * encoding are filled in by forTier. */
+func newPageMetadata(job *job, params conversionParams, rendererName string,
+    pageNum int) *pageMetadata {
+  if !*embedPageMetadata { return nil }
+
+  // an uploaded source isn't in any bucket
+  sourceBucket := params.S3Bucket
+  if sourceBucket == "" && params.UploadedPDFPath == "" {
+    sourceBucket = job.bucketName()
+  }
+
+  return &pageMetadata{
+    PageNum: pageNum,
+    SourceBucket: sourceBucket,
+    SourceKey: params.S3PDFPath,
+    JobID: job.id,
+    Renderer: rendererName,
+    Density: renderDensity(params),
+    Quality: renderQuality(params),
+    Grayscale: params.Grayscale,
+    PipelineVersion: PIPELINE_VERSION,
+  }
+}
+
+/* Returns a copy of the metadata for the rendition of size `tier`, encoded
+ * as `encoding`, or nil if `metadata` is nil. */
+func (metadata *pageMetadata) forTier(tier string,
+    encoding string) *pageMetadata {
+  if metadata == nil { return nil }
+
+  rendition := *metadata
+  rendition.Tier = tier
+  rendition.Encoding = encoding
+  return &rendition
+}
+
+/* Returns the page's source as a URL, e.g. "s3://exams/exam-42.pdf", or
+ * just its name if it was uploaded with the request. */
+func (metadata *pageMetadata) sourceURL() string {
+  if metadata.SourceBucket == "" { return metadata.SourceKey }
+  return "s3://" + metadata.SourceBucket + "/" + metadata.SourceKey
+}
+
+/* Returns the EXIF entries describing the page, sorted by tag, with the
+ * given orientation. The settings are in the Software tag, since EXIF has
+ * nowhere better for them. */
+func (metadata *pageMetadata) exifEntries(orientation uint16) []exifEntry {
+  return []exifEntry{
+    exifASCII(EXIF_TAG_DOCUMENT_NAME, metadata.sourceURL()),
+    exifASCII(EXIF_TAG_IMAGE_DESCRIPTION, fmt.Sprintf("Page %d (%s) of %s, " +
+      "job %s", metadata.PageNum, metadata.Tier, metadata.sourceURL(),
+      metadata.JobID)),
+    exifShorts(EXIF_TAG_ORIENTATION, orientation),
+    // the total is 0 since it's unknown while pages are rendered
+    exifShorts(EXIF_TAG_PAGE_NUMBER, uint16(metadata.PageNum), 0),
+    exifASCII(EXIF_TAG_SOFTWARE, fmt.Sprintf("evangelist pipeline %d; " +
+      "renderer=%s density=%d quality=%d grayscale=%t encoding=%s",
+      metadata.PipelineVersion, metadata.Renderer, metadata.Density,
+      metadata.Quality, metadata.Grayscale, metadata.Encoding)),
+  }
+}
+
+/* Returns an APP1 segment holding an XMP packet with a property in
+ * XMP_NAMESPACE for each field of the metadata. */
+func (metadata *pageMetadata) xmpSegment() ([]byte, error) {
+  properties := [][2]string{
+    {"pageNum", strconv.Itoa(metadata.PageNum)},
+    {"tier", metadata.Tier},
+    {"sourceBucket", metadata.SourceBucket},
+    {"sourceKey", metadata.SourceKey},
+    {"jobId", metadata.JobID},
+    {"renderer", metadata.Renderer},
+    {"density", strconv.Itoa(metadata.Density)},
+    {"quality", strconv.Itoa(metadata.Quality)},
+    {"grayscale", strconv.FormatBool(metadata.Grayscale)},
+    {"encoding", metadata.Encoding},
+    {"pipelineVersion", strconv.Itoa(metadata.PipelineVersion)},
+  }
+
+  var packet bytes.Buffer
+  packet.WriteString("<?xpacket begin=\"\ufeff\" " +
+    "id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+    "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+    "<rdf:RDF " +
+    "xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n" +
+    "<rdf:Description rdf:about=\"\" xmlns:" + XMP_PREFIX + "=\"" +
+    XMP_NAMESPACE + "\"")
+  for _, property := range properties {
+    packet.WriteString("\n  " + XMP_PREFIX + ":" + property[0] + "=\"")
+    xml.EscapeText(&packet, []byte(property[1]))
+    packet.WriteString("\"")
+  }
+  packet.WriteString("/>\n</rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"r\"?>")
+
+  if packet.Len() > MAX_XMP_BYTES {
+    return nil, errors.New("The page's XMP metadata is too large for a " +
+      "JPEG.\n")
+  }
+  return app1Segment(XMP_IDENTIFIER, packet.Bytes()), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// a page range expression: comma-separated pages ("9") and ranges ("1-5"),
+// where a range's end may be omitted to mean the last page ("10-")
+const PAGE_RANGE_HINT = "pages and ranges like '1-5,9' or '10-'"
+
+/* Returns the pages selected by the `pages` key of `form`, or by its
+ * `firstPage` and `lastPage` keys, as a normalized page range expression, or
+ * "" if every page should be converted. */
+func parsePageRange(form url.Values) (string, error) {
+  pages, err := optionalFormValue(form, "pages")
+  if err != nil { return "", err }
+
+  firstPage, err := optionalFormValue(form, "firstPage")
+  if err != nil { return "", err }
+
+  lastPage, err := optionalFormValue(form, "lastPage")
+  if err != nil { return "", err }
+
+  if pages != "" && (firstPage != "" || lastPage != "") {
+    return "", errors.New("Specify either 'pages' or 'firstPage' and " +
+      "'lastPage', not both.\n")
+  }
+
+  if firstPage != "" || lastPage != "" {
+    if firstPage == "" {
+      firstPage = "1"
+    }
+    pages = firstPage + "-" + lastPage
+  }
+
+  if pages == "" { return "", nil }
+
+  pageRanges, err := parsePageRangeExpression(pages)
+  if err != nil { return "", err }
+
+  return formatPageRanges(pageRanges), nil
+}
+
+/* A range of pages, from `first` to `last` inclusive. `last` is 0 if the
+ * range runs to the end of the document. */
+type pageRange struct {
+  first int
+  last int
+}
+
+/* Parses the page range expression `pages` into its ranges. */
+func parsePageRangeExpression(pages string) ([]pageRange, error) {
+  invalid := errors.New("The 'pages' key must list " + PAGE_RANGE_HINT +
+    ".\n")
+  pageRanges := []pageRange{}
+
+  for _, item := range strings.Split(pages, ",") {
+    bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+
+    first, err := strconv.Atoi(bounds[0])
+    if err != nil || first < 1 { return nil, invalid }
+
+    last := first
+    if len(bounds) == 2 {
+      last = 0
+      if bounds[1] != "" {
+        last, err = strconv.Atoi(bounds[1])
+        if err != nil || last < first { return nil, invalid }
+      }
+    }
+
+    pageRanges = append(pageRanges, pageRange{first, last})
+  }
+  return pageRanges, nil
+}
+
+/* Returns `pageRanges` as a page range expression. */
+func formatPageRanges(pageRanges []pageRange) string {
+  items := make([]string, len(pageRanges))
+  for i, pageRange := range pageRanges {
+    if pageRange.last == pageRange.first {
+      items[i] = strconv.Itoa(pageRange.first)
+    } else if pageRange.last == 0 {
+      items[i] = fmt.Sprintf("%d-", pageRange.first)
+    } else {
+      items[i] = fmt.Sprintf("%d-%d", pageRange.first, pageRange.last)
+    }
+  }
+  return strings.Join(items, ",")
+}
+
+/* Returns the numbers of the pages selected by the page range expression
+ * `pages` in a document with `numPages` pages, in ascending order, or all of
+ * them if `pages` is "". Pages past the end of the document are ignored, but
+ * it's an error if none are left. */
+func selectPages(numPages int, pages string) ([]int, error) {
+  if pages == "" { return samplePages(numPages, 0), nil }
+
+  pageRanges, err := parsePageRangeExpression(pages)
+  if err != nil { return nil, err }
+
+  selected := map[int]bool{}
+  for _, pageRange := range pageRanges {
+    last := pageRange.last
+    if last == 0 || last > numPages {
+      last = numPages
+    }
+
+    for pageNum := pageRange.first; pageNum <= last; pageNum = pageNum + 1 {
+      selected[pageNum] = true
+    }
+  }
+
+  if len(selected) == 0 {
+    return nil, errors.New(fmt.Sprintf("The 'pages' key selects none of " +
+      "the PDF's %d pages.\n", numPages))
+  }
+
+  pageNums := []int{}
+  for pageNum := range selected {
+    pageNums = append(pageNums, pageNum)
+  }
+  sort.Ints(pageNums)
+  return pageNums, nil
+}
+
+/* Returns the numbers of the pages to convert for `params` in a document
+ * with `numPages` pages: those selected by its page range, sampled if it
+ * asks for a sample. */
+func pagesToConvert(numPages int, params conversionParams) ([]int, error) {
+  selected, err := selectPages(numPages, params.Pages)
+  if err != nil { return nil, err }
+
+  pageNums := []int{}
+  for _, i := range samplePages(len(selected), params.Sample) {
+    pageNums = append(pageNums, selected[i - 1])
+  }
+  return pageNums, nil
+}
+
+/* Returns true if `params` converts only some of a document's pages. */
+func isPartialConversion(params conversionParams) bool {
+  return params.Sample > 0 || params.Pages != ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+/* Returns true if `err` is S3 reporting that a key doesn't exist. */
+func isS3NotFound(err error) bool {
+  s3Err, ok := err.(*s3.Error)
+  return ok && (s3Err.StatusCode == http.StatusNotFound ||
+    s3Err.Code == "NoSuchKey")
+}
+
+/* An error explaining that a page asked for isn't in the PDF. */
+type pageOutOfRangeError struct {
+  pageNum int
+  numPages int
+}
+
+func (err pageOutOfRangeError) Error() string {
+  return fmt.Sprintf("Page %d is out of range; the PDF has %d pages.\n",
+    err.pageNum, err.numPages)
+}
+
+/* Soft-deletes the existing renditions of page `pageNum` by copying each one
+ * to `trashPrefix` followed by its original key, so that a bad regeneration
+ * can be rolled back by hand. Renditions that don't exist are skipped. */
+func trashPageRenditions(bucket *s3.Bucket, params conversionParams,
+    pageNum int, trashPrefix string) error {
+  s3JPEGPaths := s3PathsByTier(params)
+  for format, s3Path := range s3TextPathsByFormat(params) {
+    s3JPEGPaths[format] = s3Path
+  }
+
+  for _, s3JPEGPath := range s3JPEGPaths {
+    if s3JPEGPath == "" { continue }
+    remoteJPEGPath := fmt.Sprintf(s3JPEGPath, pageNum)
+
+    data, err := bucket.Get(remoteJPEGPath)
+    if isS3NotFound(err) { continue }
+    if err != nil { return err }
+
+    err = bucket.Put(trashPrefix + remoteJPEGPath, data,
+      detectContentType(remoteJPEGPath, data), s3.Private)
+    if err != nil { return err }
+  }
+
+  return nil
+}
+
+/* Re-renders page `pageNum` of the PDF described by `params` as `job` and
+ * re-uploads its renditions over the existing ones, optionally soft-deleting
+ * the old ones under `trashPrefix` first. */
+func runPageRegeneration(job *job, bucket *s3.Bucket, params conversionParams,
+    pageNum int, trashPrefix string) error {
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return err }
+  params.SourceFormat = format
+
+  params, err = fetchWatermark(job, bucket, params)
+  if err != nil { return err }
+  params = detectPageRotations(job, params, pdfPath)
+
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    params, err = resolveContentAddressedPaths(params, sourcePath)
+    if err != nil { return err }
+  }
+
+  numPages, err := countPages(pdfPath, format)
+  if err != nil { return err }
+
+  if pageNum < 1 || pageNum > numPages {
+    return pageOutOfRangeError{pageNum, numPages}
+  }
+
+  job.setNumPages(1)
+  release := admitToScratch(job, params, pdfPath, []int{pageNum})
+  defer release()
+
+  jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath :=
+    scratchJPEGPaths(job.id, params)
+
+  var wg sync.WaitGroup
+  wg.Add(1)
+  job.setState(JOB_CONVERTING)
+  err = convertPagesToJPEGs(&wg, job, params, pdfPath, jpegPath,
+    smallJPEGPath, largeJPEGPath, darkJPEGPath, []int{pageNum})
+  if err != nil { return err }
+
+  if trashPrefix != "" {
+    err = trashPageRenditions(bucket, params, pageNum, trashPrefix)
+    if err != nil { return err }
+  }
+
+  wg.Add(1)
+  job.setState(JOB_UPLOADING)
+  err = uploadJPEGPagesToS3(&wg, job, bucket, params, jpegPath,
+    smallJPEGPath, largeJPEGPath, darkJPEGPath, []int{pageNum})
+  if err != nil { return err }
+
+  // the new renditions won't match the manifest's checksums otherwise
+  return updateManifestChecksums(bucket, params.S3ManifestPath,
+    job.uploadedChecksums())
+}
+
+/* Handles POST /pages: re-renders and re-uploads a single page of an already
+ * converted document, given the same parameters as the original conversion
+ * plus `pageNum`. If `s3TrashPrefix` is given, the page's existing renditions
+ * are copied under that prefix before being overwritten. */
+func regeneratePage(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    fmt.Fprintf(writer, "Only POST requests are supported.\n")
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+
+  var err error
+  var params conversionParams
+  startTime := time.Now()
+  defer func() {
+    job.finish(err)
+    recordInDataLake(job, params)
+    cleanupScratch(jobID)
+    auditConversion(request, jobID, 1, startTime, err)
+  }()
+
+  err = parseUploadForm(writer, request, jobID)
+  if handleError(err, writer) { return }
+
+  params, err = parseConversionParams(request)
+  if handleError(err, writer) { return }
+  params = useUploadedPDF(job, params)
+
+  pageNumStr, err := requireFormValue(request.Form, "pageNum",
+    "a page number")
+  if handleError(err, writer) { return }
+
+  pageNum, err := strconv.Atoi(pageNumStr)
+  if err != nil {
+    err = errors.New("The 'pageNum' key must be an integer.\n")
+  }
+  if handleError(err, writer) { return }
+
+  trashPrefix, err := optionalFormValue(request.Form, "s3TrashPrefix")
+  if handleError(err, writer) { return }
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  if handleError(err, writer) { return }
+
+  err = runPageRegeneration(job, bucket, params, pageNum, trashPrefix)
+  if handleError(err, writer) { return }
+
+  job.logger().Info("Regeneration finished", "page", pageNum)
+  fmt.Fprintf(writer, "Done\n")
+}
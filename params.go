@@ -0,0 +1,388 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "mime/multipart"
+  "net/http"
+  "net/url"
+  "path"
+  "strconv"
+  "strings"
+)
+
+/* Everything needed to carry out a single conversion: where the PDF lives in
+ * S3 and where its JPEGs should go. The JPEG paths contain a '%d' that is
+ * replaced by the page number. */
+type conversionParams struct {
+  S3Bucket string `json:"s3Bucket,omitempty"`
+  S3Region string `json:"s3Region,omitempty"`
+  S3PDFPath string `json:"s3PDFPath"`
+  S3JPEGPath string `json:"s3JPEGPath"`
+  S3SmallJPEGPath string `json:"s3SmallJPEGPath"`
+  S3LargeJPEGPath string `json:"s3LargeJPEGPath"`
+  S3DarkJPEGPath string `json:"s3DarkJPEGPath,omitempty"`
+  Sizes []sizeProfile `json:"sizes,omitempty"`
+  S3TextPath string `json:"s3TextPath,omitempty"`
+  S3HOCRPath string `json:"s3HOCRPath,omitempty"`
+  S3OCRPath string `json:"s3OCRPath,omitempty"`
+  S3ManifestPath string `json:"s3ManifestPath,omitempty"`
+  DualWrite bool `json:"dualWrite,omitempty"`
+  S3LegacyJPEGPath string `json:"s3LegacyJPEGPath,omitempty"`
+  S3LegacySmallJPEGPath string `json:"s3LegacySmallJPEGPath,omitempty"`
+  S3LegacyLargeJPEGPath string `json:"s3LegacyLargeJPEGPath,omitempty"`
+  S3LegacyDarkJPEGPath string `json:"s3LegacyDarkJPEGPath,omitempty"`
+  Template string `json:"template,omitempty"`
+  Labels map[string]string `json:"labels,omitempty"`
+  Layout string `json:"layout,omitempty"`
+  S3OutputPrefix string `json:"s3OutputPrefix,omitempty"`
+  Dark bool `json:"dark,omitempty"`
+  ACL string `json:"acl,omitempty"`
+  CacheControl string `json:"cacheControl,omitempty"`
+  ContentDisposition string `json:"contentDisposition,omitempty"`
+  Presign bool `json:"presign,omitempty"`
+  PresignExpiry int `json:"presignExpiry,omitempty"`
+  ObjectLockMode string `json:"objectLockMode,omitempty"`
+  ObjectLockRetainUntil string `json:"objectLockRetainUntil,omitempty"`
+  ObjectLockLegalHold bool `json:"objectLockLegalHold,omitempty"`
+  JPEGEncoding string `json:"jpegEncoding"`
+  SmallJPEGEncoding string `json:"smallJPEGEncoding"`
+  LargeJPEGEncoding string `json:"largeJPEGEncoding"`
+  DarkJPEGEncoding string `json:"darkJPEGEncoding"`
+  Sample int `json:"sample,omitempty"`
+  Pages string `json:"pages,omitempty"`
+  Incremental bool `json:"incremental,omitempty"`
+  ManifestPart bool `json:"manifestPart,omitempty"`
+  Renderer string `json:"renderer,omitempty"`
+  Strict bool `json:"strict,omitempty"`
+  GhostscriptArgs []string `json:"ghostscriptArgs,omitempty"`
+  Classify bool `json:"classify,omitempty"`
+  DetectHandwriting bool `json:"detectHandwriting,omitempty"`
+  ScoreQuality bool `json:"scoreQuality,omitempty"`
+  ExtractText bool `json:"extractText,omitempty"`
+  HOCR bool `json:"hocr,omitempty"`
+  OCRLanguages string `json:"ocrLanguages,omitempty"`
+  SpriteColumns int `json:"spriteColumns,omitempty"`
+  SpriteTileSize int `json:"spriteTileSize,omitempty"`
+  S3SpritePath string `json:"s3SpritePath,omitempty"`
+  S3SpriteIndexPath string `json:"s3SpriteIndexPath,omitempty"`
+  Density int `json:"density,omitempty"`
+  Quality int `json:"quality,omitempty"`
+  Grayscale bool `json:"grayscale,omitempty"`
+  Rotate string `json:"rotate,omitempty"`
+  WatermarkText string `json:"watermarkText,omitempty"`
+  S3WatermarkPath string `json:"s3WatermarkPath,omitempty"`
+  WatermarkPosition string `json:"watermarkPosition,omitempty"`
+  WatermarkOpacity int `json:"watermarkOpacity,omitempty"`
+  WatermarkScale int `json:"watermarkScale,omitempty"`
+  ConvertWorkers int `json:"convertWorkers,omitempty"`
+  UploadWorkers int `json:"uploadWorkers,omitempty"`
+  // only the original request is reported on, not later re-renders
+  CallbackURL string `json:"-"`
+  SourceEncryption string `json:"sourceEncryption,omitempty"`
+  OutputPublicKey string `json:"outputPublicKey,omitempty"`
+  // never persisted, so encrypted sources can't be re-rendered unattended
+  SourceKey string `json:"-"`
+  // a PDF uploaded with the request instead of `S3PDFPath`, and where it was
+  // saved for the job; likewise never persisted
+  UploadedPDF *multipart.FileHeader `json:"-"`
+  UploadedPDFPath string `json:"-"`
+  // format of the fetched source once it's been prepared for rendering,
+  // e.g. SOURCE_DJVU; detected anew each time
+  SourceFormat string `json:"-"`
+  // SHA-256 digest of the prepared source, hashed once per job for remote
+  // workers, which are only sent PDFs they don't have
+  PDFDigest string `json:"-"`
+  // where the watermark was prepared for the job, if there is one
+  WatermarkLocalPath string `json:"-"`
+  // rotation of each page of a PDF source, by page number; read anew each
+  // time
+  PageRotations map[int]pageRotation `json:"-"`
+}
+
+/* Returns the single value of `key` in `form`. `description` describes the
+ * value in error messages. */
+func requireFormValue(form url.Values, key string,
+    description string) (string, error) {
+  values, ok := form[key]
+
+  if !ok {
+    err := errors.New(fmt.Sprintf("Must specify %s in the '%s' key.\n",
+      description, key))
+    return "", err
+  }
+
+  if len(values) != 1 {
+    err := errors.New(fmt.Sprintf("Must specify exactly one value in the " +
+      "'%s' key.\n", key))
+    return "", err
+  }
+
+  return values[0], nil
+}
+
+/* Returns the single value of `key` in `form`, or "" if it's absent. */
+func optionalFormValue(form url.Values, key string) (string, error) {
+  values, ok := form[key]
+  if !ok { return "", nil }
+
+  if len(values) != 1 {
+    err := errors.New(fmt.Sprintf("Must specify at most one value in the " +
+      "'%s' key.\n", key))
+    return "", err
+  }
+
+  return values[0], nil
+}
+
+/* Returns the integer in the `key` of `form`, which must lie within [`min`,
+ * `max`], or 0 if it's absent. */
+func optionalBoundedInt(form url.Values, key string, min int,
+    max int) (int, error) {
+  value, err := optionalFormValue(form, key)
+  if err != nil || value == "" { return 0, err }
+
+  parsed, err := strconv.Atoi(value)
+  if err != nil || parsed < min || parsed > max {
+    return 0, errors.New(fmt.Sprintf("The '%s' key must be a whole number " +
+      "from %d to %d.\n", key, min, max))
+  }
+  return parsed, nil
+}
+
+/* Returns the JPEG encoding in `key` of `form`, defaulting to baseline. */
+func optionalJPEGEncoding(form url.Values, key string) (string, error) {
+  encoding, err := optionalFormValue(form, key)
+  if err != nil { return "", err }
+  if encoding == "" { return JPEG_BASELINE, nil }
+
+  err = validateJPEGEncoding(encoding, key)
+  if err != nil { return "", err }
+  return encoding, nil
+}
+
+/* Returns the single value of `key` in `form`, which must contain a '%d' to
+ * be replaced by the page number. */
+func requirePathTemplate(form url.Values, key string,
+    description string) (string, error) {
+  path, err := requireFormValue(form, key, description)
+  if err != nil { return "", err }
+
+  if !strings.Contains(path, "%d") {
+    err = errors.New(fmt.Sprintf("Must specify a JPEG path with %%d in the " +
+      "'%s' key.\n", key))
+    return "", err
+  }
+
+  return path, nil
+}
+
+/* Parses the S3 output paths of a conversion that uses caller-provided path
+ * templates into `params`: one per size, if it asks for its own sizes. */
+func parseTemplatedParams(form url.Values, params *conversionParams) error {
+  var err error
+
+  if len(params.Sizes) > 0 {
+    err = parseSizePaths(form, params)
+    if err != nil { return err }
+
+    params.S3ManifestPath, err = optionalFormValue(form, "s3ManifestPath")
+    return err
+  }
+
+  params.S3JPEGPath, err = requirePathTemplate(form, "s3JPEGPath",
+    "a JPEG path")
+  if err != nil { return err }
+
+  params.S3SmallJPEGPath, err = requirePathTemplate(form, "s3SmallJPEGPath",
+    "a small JPEG path")
+  if err != nil { return err }
+
+  params.S3LargeJPEGPath, err = requirePathTemplate(form, "s3LargeJPEGPath",
+    "a large JPEG path")
+  if err != nil { return err }
+
+  params.S3DarkJPEGPath, err = optionalFormValue(form, "s3DarkJPEGPath")
+  if err != nil { return err }
+
+  if params.S3DarkJPEGPath != "" &&
+      !strings.Contains(params.S3DarkJPEGPath, "%d") {
+    err = errors.New("Must specify a JPEG path with %d in the " +
+      "'s3DarkJPEGPath' key.\n")
+    return err
+  }
+
+  params.S3ManifestPath, err = optionalFormValue(form, "s3ManifestPath")
+  return err
+}
+
+/* Parses and validates the conversion parameters in `request`, filling in
+ * those of the named template it references, if any. Its multipart form
+ * must have been parsed with parseUploadForm. */
+func parseConversionParams(request *http.Request) (conversionParams, error) {
+  if request.MultipartForm == nil {
+    return conversionParams{}, http.ErrNotMultipart
+  }
+
+  // the PDF is either named in S3 or uploaded with the request
+  upload, err := parseUploadedPDF(request)
+  if err != nil { return conversionParams{}, err }
+
+  source, err := optionalFormValue(request.Form, "s3PDFPath")
+  if err != nil { return conversionParams{}, err }
+
+  if upload != nil && source != "" {
+    return conversionParams{}, errors.New("Must specify either a PDF in " +
+      "the 's3PDFPath' key or an uploaded 'pdf', not both.\n")
+  } else if upload != nil {
+    source = path.Base(upload.Filename)
+  } else if source == "" {
+    return conversionParams{}, errors.New("Must specify a PDF to convert " +
+      "in the 's3PDFPath' key or upload one in the 'pdf' field.\n")
+  }
+
+  template, err := applyTemplate(request.Form, source)
+  if err != nil { return conversionParams{}, err }
+
+  params, err := parseConversionForm(request.Form)
+  if err != nil { return params, err }
+
+  params.Template = template
+  params.UploadedPDF = upload
+  if upload != nil && params.SourceEncryption != "" {
+    return params, errors.New("Encrypted sources must be read from S3, " +
+      "not uploaded.\n")
+  }
+  return params, nil
+}
+
+/* Parses and validates the conversion parameters in `form`. */
+func parseConversionForm(form url.Values) (conversionParams, error) {
+  params := conversionParams{}
+
+  var err error
+  params.S3PDFPath, err = optionalFormValue(form, "s3PDFPath")
+  if err != nil { return params, err }
+
+  err = parseBucketParams(form, &params)
+  if err != nil { return params, err }
+
+  params.Sizes, err = parseSizes(form)
+  if err != nil { return params, err }
+
+  params.Layout, err = optionalFormValue(form, "layout")
+  if err != nil { return params, err }
+
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    err = parseContentAddressedParams(form, &params)
+    if err != nil { return params, err }
+  } else if params.Layout == "" {
+    err = parseTemplatedParams(form, &params)
+    if err != nil { return params, err }
+  } else {
+    err = errors.New("The 'layout' key must be 'content-addressed' if " +
+      "given.\n")
+    return params, err
+  }
+
+  err = parseDualWriteParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parseObjectLockParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parsePresignParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parseUploadOptions(form, &params)
+  if err != nil { return params, err }
+
+  err = parseSourceEncryptionParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parseOutputEncryptionParams(form, &params)
+  if err != nil { return params, err }
+
+  params.Sample, err = parseSample(form)
+  if err != nil { return params, err }
+
+  params.Pages, err = parsePageRange(form)
+  if err != nil { return params, err }
+
+  params.Renderer, err = parseRenderer(form)
+  if err != nil { return params, err }
+
+  params.Strict, err = parseStrict(form, params.Renderer)
+  if err != nil { return params, err }
+
+  params.GhostscriptArgs, err = parseGhostscriptArgs(form, params.Renderer)
+  if err != nil { return params, err }
+
+  params.Classify, err = parseClassify(form, params)
+  if err != nil { return params, err }
+
+  params.DetectHandwriting, err = parseDetectHandwriting(form)
+  if err != nil { return params, err }
+
+  params.ScoreQuality, err = parseScoreQuality(form)
+  if err != nil { return params, err }
+
+  err = parseTextParams(form, &params)
+  if err != nil { return params, err }
+
+  params.Density, err = optionalBoundedInt(form, "density",
+    MIN_DENSITY, MAX_DENSITY)
+  if err != nil { return params, err }
+
+  params.Quality, err = optionalBoundedInt(form, "quality",
+    MIN_QUALITY, MAX_QUALITY)
+  if err != nil { return params, err }
+
+  params.Grayscale, err = parseGrayscale(form)
+  if err != nil { return params, err }
+
+  params.Rotate, err = parseRotate(form)
+  if err != nil { return params, err }
+
+  err = parseWatermarkParams(form, &params)
+  if err != nil { return params, err }
+
+  params.CallbackURL, err = parseCallbackURL(form)
+  if err != nil { return params, err }
+
+  params.JPEGEncoding, err = optionalJPEGEncoding(form,
+    "jpegEncoding")
+  if err != nil { return params, err }
+
+  params.SmallJPEGEncoding, err = optionalJPEGEncoding(form,
+    "smallJPEGEncoding")
+  if err != nil { return params, err }
+
+  params.LargeJPEGEncoding, err = optionalJPEGEncoding(form,
+    "largeJPEGEncoding")
+  if err != nil { return params, err }
+
+  params.DarkJPEGEncoding, err = optionalJPEGEncoding(form,
+    "darkJPEGEncoding")
+  if err != nil { return params, err }
+
+  err = parseIncremental(form, &params)
+  if err != nil { return params, err }
+
+  err = parseSpriteParams(form, &params)
+  if err != nil { return params, err }
+
+  err = parseManifestPart(form, &params)
+  if err != nil { return params, err }
+
+  params.Labels, err = parseLabels(form)
+  if err != nil { return params, err }
+
+  err = parseWorkerCounts(form, &params)
+  if err != nil { return params, err }
+
+  err = validateSizeCombinations(params)
+  if err != nil { return params, err }
+
+  return params, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+)
+
+// A minimal Parquet encoder for flat, required columns of strings, 64-bit
+// integers, and millisecond timestamps, written as one uncompressed,
+// PLAIN-encoded row group. See https://github.com/apache/parquet-format for
+// the format, whose metadata is serialized with Thrift's compact protocol.
+
+// kinds of column we can encode
+const (
+  PARQUET_STRING = iota
+  PARQUET_INT64
+  PARQUET_TIMESTAMP_MILLIS
+)
+
+// Parquet physical types, repetition types, converted types, encodings, and
+// page types we use
+const (
+  PARQUET_TYPE_INT64 = 2
+  PARQUET_TYPE_BYTE_ARRAY = 6
+  PARQUET_REQUIRED = 0
+  PARQUET_CONVERTED_UTF8 = 0
+  PARQUET_CONVERTED_TIMESTAMP_MILLIS = 9
+  PARQUET_ENCODING_PLAIN = 0
+  PARQUET_ENCODING_RLE = 3
+  PARQUET_CODEC_UNCOMPRESSED = 0
+  PARQUET_PAGE_DATA = 0
+)
+
+// Thrift compact protocol field types
+const (
+  THRIFT_I32 = 5
+  THRIFT_I64 = 6
+  THRIFT_BINARY = 8
+  THRIFT_LIST = 9
+  THRIFT_STRUCT = 12
+)
+
+const PARQUET_MAGIC = "PAR1"
+
+/* One value of a row: column `name` of the given kind, holding `text` if
+ * it's a string and `number` otherwise. */
+type parquetField struct {
+  name string
+  kind int
+  text string
+  number int64
+}
+
+/* Writes Thrift structs with the compact protocol. */
+type thriftWriter struct {
+  buffer bytes.Buffer
+  lastFieldID int
+  enclosingFieldIDs []int
+}
+
+func (writer *thriftWriter) varint(value uint64) {
+  for value >= 0x80 {
+    writer.buffer.WriteByte(byte(value) | 0x80)
+    value >>= 7
+  }
+  writer.buffer.WriteByte(byte(value))
+}
+
+func (writer *thriftWriter) zigzag(value int64) {
+  writer.varint(uint64((value << 1) ^ (value >> 63)))
+}
+
+func (writer *thriftWriter) fieldHeader(id int, fieldType byte) {
+  delta := id - writer.lastFieldID
+  if delta > 0 && delta <= 15 {
+    writer.buffer.WriteByte(byte(delta << 4) | fieldType)
+  } else {
+    writer.buffer.WriteByte(fieldType)
+    writer.zigzag(int64(id))
+  }
+  writer.lastFieldID = id
+}
+
+func (writer *thriftWriter) i32Field(id int, value int32) {
+  writer.fieldHeader(id, THRIFT_I32)
+  writer.zigzag(int64(value))
+}
+
+func (writer *thriftWriter) i64Field(id int, value int64) {
+  writer.fieldHeader(id, THRIFT_I64)
+  writer.zigzag(value)
+}
+
+func (writer *thriftWriter) str(value string) {
+  writer.varint(uint64(len(value)))
+  writer.buffer.WriteString(value)
+}
+
+func (writer *thriftWriter) stringField(id int, value string) {
+  writer.fieldHeader(id, THRIFT_BINARY)
+  writer.str(value)
+}
+
+/* Starts a list field of `size` elements of `elementType`, which are then
+ * written without field headers. */
+func (writer *thriftWriter) listField(id int, elementType byte, size int) {
+  writer.fieldHeader(id, THRIFT_LIST)
+  if size < 15 {
+    writer.buffer.WriteByte(byte(size << 4) | elementType)
+  } else {
+    writer.buffer.WriteByte(0xf0 | elementType)
+    writer.varint(uint64(size))
+  }
+}
+
+/* Starts a struct, either as field `id` or, if `id` is 0, as a list
+ * element. It's ended by endStruct(). */
+func (writer *thriftWriter) beginStruct(id int) {
+  if id != 0 {
+    writer.fieldHeader(id, THRIFT_STRUCT)
+  }
+  writer.enclosingFieldIDs = append(writer.enclosingFieldIDs,
+    writer.lastFieldID)
+  writer.lastFieldID = 0
+}
+
+func (writer *thriftWriter) endStruct() {
+  writer.buffer.WriteByte(0)
+  last := len(writer.enclosingFieldIDs) - 1
+  writer.lastFieldID = writer.enclosingFieldIDs[last]
+  writer.enclosingFieldIDs = writer.enclosingFieldIDs[:last]
+}
+
+/* Returns the physical and converted types of columns of `kind`, or -1 if
+ * there's no converted type. */
+func parquetTypes(kind int) (int32, int32) {
+  switch kind {
+  case PARQUET_STRING:
+    return PARQUET_TYPE_BYTE_ARRAY, PARQUET_CONVERTED_UTF8
+  case PARQUET_TIMESTAMP_MILLIS:
+    return PARQUET_TYPE_INT64, PARQUET_CONVERTED_TIMESTAMP_MILLIS
+  }
+  return PARQUET_TYPE_INT64, -1
+}
+
+/* Returns the PLAIN encoding of column `column` of `rows`. */
+func encodeParquetColumn(rows [][]parquetField, column int) []byte {
+  var values bytes.Buffer
+  for _, row := range rows {
+    field := row[column]
+    if field.kind == PARQUET_STRING {
+      binary.Write(&values, binary.LittleEndian, uint32(len(field.text)))
+      values.WriteString(field.text)
+    } else {
+      binary.Write(&values, binary.LittleEndian, field.number)
+    }
+  }
+  return values.Bytes()
+}
+
+/* Returns a Parquet file holding `rows`, which must all have the same
+ * columns in the same order. */
+func encodeParquet(rows [][]parquetField) []byte {
+  var file bytes.Buffer
+  file.WriteString(PARQUET_MAGIC)
+
+  columns := rows[0]
+  offsets := make([]int64, len(columns))
+  sizes := make([]int64, len(columns))
+  totalSize := int64(0)
+
+  // each column chunk is a single data page
+  for i := range columns {
+    values := encodeParquetColumn(rows, i)
+
+    header := &thriftWriter{}
+    header.i32Field(1, PARQUET_PAGE_DATA)
+    header.i32Field(2, int32(len(values)))
+    header.i32Field(3, int32(len(values)))
+    header.beginStruct(5)
+    header.i32Field(1, int32(len(rows)))
+    header.i32Field(2, PARQUET_ENCODING_PLAIN)
+    header.i32Field(3, PARQUET_ENCODING_RLE)
+    header.i32Field(4, PARQUET_ENCODING_RLE)
+    header.endStruct()
+    header.buffer.WriteByte(0)
+
+    offsets[i] = int64(file.Len())
+    sizes[i] = int64(header.buffer.Len() + len(values))
+    totalSize += sizes[i]
+    file.Write(header.buffer.Bytes())
+    file.Write(values)
+  }
+
+  metadata := &thriftWriter{}
+  metadata.i32Field(1, 1)
+
+  metadata.listField(2, THRIFT_STRUCT, len(columns) + 1)
+  metadata.beginStruct(0)
+  metadata.stringField(4, "schema")
+  metadata.i32Field(5, int32(len(columns)))
+  metadata.endStruct()
+  for _, column := range columns {
+    physicalType, convertedType := parquetTypes(column.kind)
+    metadata.beginStruct(0)
+    metadata.i32Field(1, physicalType)
+    metadata.i32Field(3, PARQUET_REQUIRED)
+    metadata.stringField(4, column.name)
+    if convertedType >= 0 {
+      metadata.i32Field(6, convertedType)
+    }
+    metadata.endStruct()
+  }
+
+  metadata.i64Field(3, int64(len(rows)))
+
+  metadata.listField(4, THRIFT_STRUCT, 1)
+  metadata.beginStruct(0)
+  metadata.listField(1, THRIFT_STRUCT, len(columns))
+  for i, column := range columns {
+    physicalType, _ := parquetTypes(column.kind)
+    metadata.beginStruct(0)
+    metadata.i64Field(2, offsets[i])
+    metadata.beginStruct(3)
+    metadata.i32Field(1, physicalType)
+    metadata.listField(2, THRIFT_I32, 2)
+    metadata.zigzag(PARQUET_ENCODING_PLAIN)
+    metadata.zigzag(PARQUET_ENCODING_RLE)
+    metadata.listField(3, THRIFT_BINARY, 1)
+    metadata.str(column.name)
+    metadata.i32Field(4, PARQUET_CODEC_UNCOMPRESSED)
+    metadata.i64Field(5, int64(len(rows)))
+    metadata.i64Field(6, sizes[i])
+    metadata.i64Field(7, sizes[i])
+    metadata.i64Field(9, offsets[i])
+    metadata.endStruct()
+    metadata.endStruct()
+  }
+  metadata.i64Field(2, totalSize)
+  metadata.i64Field(3, int64(len(rows)))
+  metadata.endStruct()
+
+  metadata.stringField(6, "evangelist")
+  metadata.buffer.WriteByte(0)
+
+  file.Write(metadata.buffer.Bytes())
+  binary.Write(&file, binary.LittleEndian, uint32(metadata.buffer.Len()))
+  file.WriteString(PARQUET_MAGIC)
+  return file.Bytes()
+}
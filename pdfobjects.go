@@ -0,0 +1,741 @@
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "hash"
+  "io"
+  "io/ioutil"
+  "os"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// deepest nesting of arrays, dictionaries, and references followed, so
+// malicious PDFs can't exhaust the stack
+const MAX_PDF_NESTING = 64
+
+// largest decompressed object stream read
+const MAX_PDF_OBJECT_STREAM_BYTES = 64 * 1024 * 1024
+
+// largest PDF whose pages are counted by reading it into memory; larger
+// ones are left to Ghostscript
+const MAX_PAGE_COUNT_PARSE_BYTES = 256 * 1024 * 1024
+
+// how a PDF's pages were counted, as labeled in the metrics
+const (
+  PAGE_COUNT_PARSED = "parsed"
+  PAGE_COUNT_GHOSTSCRIPT = "ghostscript"
+  PAGE_COUNT_LINEARIZED = "linearized"
+)
+
+var pageCountsTotal = newCounterVec("evangelist_page_counts_total",
+  "PDFs whose pages were counted, by method (parsed, ghostscript, or " +
+  "linearized).",
+  "method")
+
+// page attributes a page inherits from its ancestors in the page tree
+var INHERITED_PAGE_KEYS = []string{"Resources", "MediaBox", "CropBox",
+  "Rotate"}
+
+// the start of an indirect object, e.g. "12 0 obj"
+var PDF_OBJECT_PATTERN = regexp.MustCompile(
+  `(\d+)[\x00\t\n\f\r ]+\d+[\x00\t\n\f\r ]+obj`)
+
+/* PDF values are nil (null), bool, pdfNumber, pdfName, pdfString, []any
+ * (arrays), pdfDict, *pdfStream, or pdfRef. */
+type pdfNumber string
+type pdfName string
+type pdfString []byte
+type pdfDict map[string]interface{}
+type pdfKeyword string
+
+type pdfRef struct {
+  num int
+}
+
+/* A stream object. `raw` holds its data as stored, still encoded. */
+type pdfStream struct {
+  dict pdfDict
+  raw []byte
+}
+
+/* An object and the offset it was found at; later definitions win, as
+ * with incremental updates. */
+type pdfObject struct {
+  value interface{}
+  offset int
+}
+
+/* A PDF read without its cross-reference table, by scanning for objects,
+ * as PDF readers do to repair damaged files. That's enough to walk the
+ * page tree, and doesn't care how the file was written. */
+type pdfDocument struct {
+  data []byte
+  objects map[int]pdfObject
+  root pdfDict
+}
+
+/* Reads objects from PDF data. */
+type pdfParser struct {
+  data []byte
+  pos int
+}
+
+func isPDFSpace(c byte) bool {
+  return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' ||
+    c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+  return bytes.IndexByte([]byte("()<>[]{}/%"), c) != -1
+}
+
+/* Skips whitespace and comments. */
+func (parser *pdfParser) skipSpace() {
+  for parser.pos < len(parser.data) {
+    c := parser.data[parser.pos]
+    if c == '%' {
+      // the end of line, if any, is skipped as whitespace
+      for parser.pos < len(parser.data) && parser.data[parser.pos] != '\n' &&
+          parser.data[parser.pos] != '\r' {
+        parser.pos = parser.pos + 1
+      }
+      continue
+    } else if !isPDFSpace(c) {
+      return
+    }
+    parser.pos = parser.pos + 1
+  }
+}
+
+/* Reads a run of regular characters, e.g. a number or keyword. */
+func (parser *pdfParser) regular() string {
+  start := parser.pos
+  for parser.pos < len(parser.data) &&
+      !isPDFSpace(parser.data[parser.pos]) &&
+      !isPDFDelimiter(parser.data[parser.pos]) {
+    parser.pos = parser.pos + 1
+  }
+  return string(parser.data[start:parser.pos])
+}
+
+/* Returns true if `token` is a non-negative integer. */
+func isPDFInteger(token string) bool {
+  if token == "" { return false }
+  for i := 0; i < len(token); i = i + 1 {
+    if token[i] < '0' || token[i] > '9' { return false }
+  }
+  return true
+}
+
+/* Reads the next value, at most `depth` levels deep. */
+func (parser *pdfParser) value(depth int) (interface{}, error) {
+  if depth <= 0 {
+    return nil, errors.New("PDF objects are nested too deeply.\n")
+  }
+
+  parser.skipSpace()
+  if parser.pos >= len(parser.data) {
+    return nil, errors.New("PDF ends in the middle of an object.\n")
+  }
+
+  data := parser.data
+  switch c := data[parser.pos]; {
+  case c == '/':
+    parser.pos = parser.pos + 1
+    return pdfName(parser.regular()), nil
+
+  case c == '(':
+    // strings are kept raw, escapes and all
+    start := parser.pos
+    nesting := 0
+    for parser.pos < len(data) {
+      switch data[parser.pos] {
+      case '\\':
+        parser.pos = parser.pos + 1
+      case '(':
+        nesting = nesting + 1
+      case ')':
+        nesting = nesting - 1
+      }
+      parser.pos = parser.pos + 1
+      if nesting == 0 { return pdfString(data[start:parser.pos]), nil }
+    }
+    return nil, errors.New("PDF string is never closed.\n")
+
+  case c == '<' && parser.pos + 1 < len(data) && data[parser.pos + 1] == '<':
+    parser.pos = parser.pos + 2
+    dict := pdfDict{}
+    for {
+      parser.skipSpace()
+      if bytes.HasPrefix(data[parser.pos:], []byte(">>")) {
+        parser.pos = parser.pos + 2
+        return dict, nil
+      }
+
+      key, err := parser.value(depth - 1)
+      if err != nil { return nil, err }
+      name, ok := key.(pdfName)
+      if !ok {
+        return nil, errors.New("PDF dictionary key isn't a name.\n")
+      }
+
+      dict[string(name)], err = parser.value(depth - 1)
+      if err != nil { return nil, err }
+    }
+
+  case c == '<':
+    end := bytes.IndexByte(data[parser.pos:], '>')
+    if end == -1 {
+      return nil, errors.New("PDF hex string is never closed.\n")
+    }
+    start := parser.pos
+    parser.pos = parser.pos + end + 1
+    return pdfString(data[start:parser.pos]), nil
+
+  case c == '[':
+    parser.pos = parser.pos + 1
+    array := []interface{}{}
+    for {
+      parser.skipSpace()
+      if parser.pos < len(data) && data[parser.pos] == ']' {
+        parser.pos = parser.pos + 1
+        return array, nil
+      }
+
+      element, err := parser.value(depth - 1)
+      if err != nil { return nil, err }
+      array = append(array, element)
+    }
+
+  case isPDFDelimiter(c):
+    return nil, errors.New(fmt.Sprintf("Unexpected '%c' in PDF.\n", c))
+  }
+
+  token := parser.regular()
+  switch token {
+  case "true", "false":
+    return token == "true", nil
+  case "null":
+    return nil, nil
+  }
+
+  if !isPDFInteger(token) {
+    if _, err := strconv.ParseFloat(token, 64); err == nil {
+      return pdfNumber(token), nil
+    }
+    return pdfKeyword(token), nil
+  }
+
+  // an integer may start a reference: "{num} {gen} R"
+  start := parser.pos
+  parser.skipSpace()
+  generation := parser.regular()
+  parser.skipSpace()
+  if isPDFInteger(generation) && parser.regular() == "R" {
+    num, err := strconv.Atoi(token)
+    if err != nil { return nil, err }
+    return pdfRef{num}, nil
+  }
+  parser.pos = start
+  return pdfNumber(token), nil
+}
+
+/* Reads the body of the indirect object whose header ends at the parser's
+ * position, along with its data if it's a stream. */
+func (parser *pdfParser) object() (interface{}, error) {
+  value, err := parser.value(MAX_PDF_NESTING)
+  if err != nil { return nil, err }
+
+  dict, ok := value.(pdfDict)
+  parser.skipSpace()
+  if !ok || !bytes.HasPrefix(parser.data[parser.pos:], []byte("stream")) {
+    return value, nil
+  }
+
+  // the data starts after the end of line following the keyword
+  parser.pos = parser.pos + len("stream")
+  if bytes.HasPrefix(parser.data[parser.pos:], []byte("\r\n")) {
+    parser.pos = parser.pos + 2
+  } else if parser.pos < len(parser.data) &&
+      (parser.data[parser.pos] == '\n' || parser.data[parser.pos] == '\r') {
+    parser.pos = parser.pos + 1
+  }
+  start := parser.pos
+
+  // trust a direct /Length that's followed by endstream; otherwise, look
+  // for endstream, since the length may be in an object not yet read
+  if length, ok := dict["Length"].(pdfNumber); ok {
+    n, err := strconv.Atoi(string(length))
+    if err == nil && n >= 0 && start + n <= len(parser.data) {
+      after := &pdfParser{parser.data, start + n}
+      after.skipSpace()
+      if bytes.HasPrefix(parser.data[after.pos:], []byte("endstream")) {
+        parser.pos = after.pos + len("endstream")
+        return &pdfStream{dict, parser.data[start:start + n]}, nil
+      }
+    }
+  }
+
+  end := bytes.Index(parser.data[start:], []byte("endstream"))
+  if end == -1 {
+    return nil, errors.New("PDF stream is never ended.\n")
+  }
+  parser.pos = start + end + len("endstream")
+  raw := bytes.TrimRight(parser.data[start:start + end], "\r\n")
+  return &pdfStream{dict, raw}, nil
+}
+
+/* Reads the PDF at `path`. */
+func openPDFDocument(path string) (*pdfDocument, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+
+  doc := &pdfDocument{data: data, objects: map[int]pdfObject{}}
+  doc.scanObjects()
+  doc.readObjectStreams()
+
+  doc.root, err = doc.findRoot()
+  if err != nil { return nil, err }
+  return doc, nil
+}
+
+/* Indexes every indirect object in the file, skipping over stream data so
+ * it isn't mistaken for objects. */
+func (doc *pdfDocument) scanObjects() {
+  position := 0
+  for position < len(doc.data) {
+    match := PDF_OBJECT_PATTERN.FindSubmatchIndex(doc.data[position:])
+    if match == nil { return }
+
+    // an object header must start a token
+    start := position + match[0]
+    end := position + match[1]
+    if start > 0 && !isPDFSpace(doc.data[start - 1]) &&
+        !isPDFDelimiter(doc.data[start - 1]) {
+      position = start + 1
+      continue
+    }
+
+    num, err := strconv.Atoi(string(doc.data[position + match[2]:
+      position + match[3]]))
+    parser := &pdfParser{doc.data, end}
+    value, parseErr := parser.object()
+    if err != nil || parseErr != nil {
+      position = end
+      continue
+    }
+
+    doc.objects[num] = pdfObject{value, start}
+    position = parser.pos
+  }
+}
+
+/* Returns the decoded data of `stream`, which must be uncompressed or
+ * compressed with FlateDecode and no predictor. */
+func decodePDFStream(stream *pdfStream, limit int64) ([]byte, error) {
+  filter := stream.dict["Filter"]
+  if filters, ok := filter.([]interface{}); ok && len(filters) == 1 {
+    filter = filters[0]
+  }
+
+  if filter == nil { return stream.raw, nil }
+  if filter != pdfName("FlateDecode") || stream.dict["DecodeParms"] != nil {
+    return nil, errors.New("PDF stream has an unsupported filter.\n")
+  }
+
+  reader, err := zlib.NewReader(bytes.NewReader(stream.raw))
+  if err != nil { return nil, err }
+  defer reader.Close()
+
+  data, err := ioutil.ReadAll(io.LimitReader(reader, limit + 1))
+  if err != nil { return nil, err }
+  if int64(len(data)) > limit {
+    return nil, errors.New("PDF stream is too large.\n")
+  }
+  return data, nil
+}
+
+/* Indexes the objects compressed in object streams. An object stream's
+ * objects replace earlier definitions, but not later ones. */
+func (doc *pdfDocument) readObjectStreams() {
+  streams := []pdfObject{}
+  for _, object := range doc.objects {
+    stream, ok := object.value.(*pdfStream)
+    if ok && stream.dict["Type"] == pdfName("ObjStm") {
+      streams = append(streams, object)
+    }
+  }
+
+  for _, object := range streams {
+    stream := object.value.(*pdfStream)
+
+    data, err := decodePDFStream(stream, MAX_PDF_OBJECT_STREAM_BYTES)
+    if err != nil { continue }
+
+    count, _ := strconv.Atoi(string(asPDFNumber(stream.dict["N"])))
+    first, err := strconv.Atoi(string(asPDFNumber(stream.dict["First"])))
+    if err != nil || first < 0 || first > len(data) { continue }
+
+    // the header pairs each object number with its offset after `First`
+    header := &pdfParser{data, 0}
+    for i := 0; i < count; i = i + 1 {
+      num, err1 := header.value(1)
+      offset, err2 := header.value(1)
+      if err1 != nil || err2 != nil { break }
+
+      n, err1 := strconv.Atoi(string(asPDFNumber(num)))
+      o, err2 := strconv.Atoi(string(asPDFNumber(offset)))
+      // compared so huge offsets can't overflow
+      if err1 != nil || err2 != nil || o < 0 || o >= len(data) - first {
+        break
+      }
+
+      if existing, ok := doc.objects[n]; ok &&
+          existing.offset > object.offset {
+        continue
+      }
+
+      value, err := (&pdfParser{data, first + o}).value(MAX_PDF_NESTING)
+      if err == nil {
+        doc.objects[n] = pdfObject{value, object.offset}
+      }
+    }
+  }
+}
+
+/* Returns `value` if it's a number, or "" otherwise. */
+func asPDFNumber(value interface{}) pdfNumber {
+  number, _ := value.(pdfNumber)
+  return number
+}
+
+/* Returns `value`, following it if it's a reference. */
+func (doc *pdfDocument) resolve(value interface{}) interface{} {
+  for i := 0; i < MAX_PDF_NESTING; i = i + 1 {
+    ref, ok := value.(pdfRef)
+    if !ok { return value }
+    value = doc.objects[ref.num].value
+  }
+  return nil
+}
+
+/* Returns `value`, resolved, if it's a dictionary or a stream's
+ * dictionary. */
+func (doc *pdfDocument) dict(value interface{}) (pdfDict, bool) {
+  switch resolved := doc.resolve(value).(type) {
+  case pdfDict:
+    return resolved, true
+  case *pdfStream:
+    return resolved.dict, true
+  }
+  return nil, false
+}
+
+/* Returns the bytes the string `text` stands for, with the escapes of a
+ * literal string or the digits of a hex string decoded. */
+func (text pdfString) decoded() []byte {
+  if len(text) < 2 { return nil }
+  body := text[1:len(text) - 1]
+
+  if text[0] == '<' {
+    digits := []byte{}
+    for _, c := range body {
+      if strings.IndexByte("0123456789abcdefABCDEF", c) != -1 {
+        digits = append(digits, c)
+      }
+    }
+    // a missing final digit is taken to be 0
+    if len(digits) % 2 == 1 { digits = append(digits, '0') }
+    decoded := make([]byte, len(digits) / 2)
+    hex.Decode(decoded, digits)
+    return decoded
+  }
+
+  decoded := []byte{}
+  for i := 0; i < len(body); i = i + 1 {
+    if body[i] != '\\' || i + 1 == len(body) {
+      decoded = append(decoded, body[i])
+      continue
+    }
+
+    i = i + 1
+    switch c := body[i]; {
+    case c >= '0' && c <= '7':
+      // up to three octal digits
+      value := 0
+      end := i + 3
+      for ; i < end && i < len(body) && body[i] >= '0' && body[i] <= '7';
+          i = i + 1 {
+        value = value * 8 + int(body[i] - '0')
+      }
+      i = i - 1
+      decoded = append(decoded, byte(value))
+    case c == 'n':
+      decoded = append(decoded, '\n')
+    case c == 'r':
+      decoded = append(decoded, '\r')
+    case c == 't':
+      decoded = append(decoded, '\t')
+    case c == 'b':
+      decoded = append(decoded, '\b')
+    case c == 'f':
+      decoded = append(decoded, '\f')
+    case c == '\r':
+      // an escaped line break continues the string on the next line
+      if i + 1 < len(body) && body[i + 1] == '\n' { i = i + 1 }
+    case c == '\n':
+    default:
+      decoded = append(decoded, c)
+    }
+  }
+  return decoded
+}
+
+/* Returns the last trailer dictionary, or else that of the last
+ * cross-reference stream, or nil if there's neither. */
+func (doc *pdfDocument) trailer() pdfDict {
+  trailerAt := bytes.LastIndex(doc.data, []byte("trailer"))
+  if trailerAt != -1 {
+    parser := &pdfParser{doc.data, trailerAt + len("trailer")}
+    trailer, err := parser.value(MAX_PDF_NESTING)
+    if dict, ok := trailer.(pdfDict); err == nil && ok { return dict }
+  }
+
+  var latest pdfDict = nil
+  latestOffset := -1
+  for _, object := range doc.objects {
+    dict, ok := doc.dict(object.value)
+    if ok && dict["Type"] == pdfName("XRef") &&
+        object.offset > latestOffset {
+      latest, latestOffset = dict, object.offset
+    }
+  }
+  return latest
+}
+
+/* Returns the document catalog, named by the last trailer or
+ * cross-reference stream, or else the last catalog in the file. */
+func (doc *pdfDocument) findRoot() (pdfDict, error) {
+  trailerAt := bytes.LastIndex(doc.data, []byte("trailer"))
+  if trailerAt != -1 {
+    parser := &pdfParser{doc.data, trailerAt + len("trailer")}
+    trailer, err := parser.value(MAX_PDF_NESTING)
+    if dict, ok := trailer.(pdfDict); err == nil && ok {
+      if root, ok := doc.dict(dict["Root"]); ok { return root, nil }
+    }
+  }
+
+  var root pdfDict = nil
+  rootOffset := -1
+  for _, object := range doc.objects {
+    dict, ok := doc.dict(object.value)
+    if !ok || object.offset < rootOffset { continue }
+
+    if dict["Type"] == pdfName("XRef") {
+      if catalog, ok := doc.dict(dict["Root"]); ok {
+        root, rootOffset = catalog, object.offset
+      }
+    } else if dict["Type"] == pdfName("Catalog") {
+      root, rootOffset = dict, object.offset
+    }
+  }
+
+  if root == nil {
+    return nil, errors.New("PDF has no document catalog.\n")
+  }
+  return root, nil
+}
+
+/* Returns the document's pages in order, each with the attributes it
+ * inherits from the page tree filled in. */
+func (doc *pdfDocument) pages() ([]pdfDict, error) {
+  tree, ok := doc.dict(doc.root["Pages"])
+  if !ok { return nil, errors.New("PDF has no page tree.\n") }
+
+  pages := []pdfDict{}
+  visited := map[pdfRef]bool{}
+
+  var walk func(node pdfDict, inherited pdfDict, depth int) error
+  walk = func(node pdfDict, inherited pdfDict, depth int) error {
+    if depth > MAX_PDF_NESTING {
+      return errors.New("PDF page tree is too deep.\n")
+    }
+
+    attributes := pdfDict{}
+    for key, value := range inherited {
+      attributes[key] = value
+    }
+    for _, key := range INHERITED_PAGE_KEYS {
+      if value, ok := node[key]; ok {
+        attributes[key] = value
+      }
+    }
+
+    kids, isTree := doc.resolve(node["Kids"]).([]interface{})
+    if !isTree || node["Type"] == pdfName("Page") {
+      page := pdfDict{}
+      for key, value := range attributes {
+        page[key] = value
+      }
+      for key, value := range node {
+        page[key] = value
+      }
+      pages = append(pages, page)
+      return nil
+    }
+
+    for _, kid := range kids {
+      // a page tree that loops would never end
+      if ref, ok := kid.(pdfRef); ok {
+        if visited[ref] {
+          return errors.New("PDF page tree has a cycle.\n")
+        }
+        visited[ref] = true
+      }
+
+      kidNode, ok := doc.dict(kid)
+      if !ok { return errors.New("PDF page tree has a bad node.\n") }
+
+      err := walk(kidNode, attributes, depth + 1)
+      if err != nil { return err }
+    }
+    return nil
+  }
+
+  err := walk(tree, pdfDict{}, 0)
+  return pages, err
+}
+
+/* Returns the number of pages in the PDF at `path`, found by walking its
+ * page tree. Returns an error, so the caller can fall back to Ghostscript,
+ * if the PDF is too large to read into memory, or if the tree's /Count
+ * disagrees with the pages found, as it does when the tree can't be fully
+ * read (e.g. in encrypted object streams). */
+func countPDFPages(path string) (int, error) {
+  fileInfo, err := os.Stat(path)
+  if err != nil { return 0, err }
+  if fileInfo.Size() > MAX_PAGE_COUNT_PARSE_BYTES {
+    return 0, errors.New("PDF is too large to parse in memory.\n")
+  }
+
+  doc, err := openPDFDocument(path)
+  if err != nil { return 0, err }
+
+  pages, err := doc.pages()
+  if err != nil { return 0, err }
+
+  tree, _ := doc.dict(doc.root["Pages"])
+  count, err := strconv.Atoi(string(asPDFNumber(doc.resolve(tree["Count"]))))
+  if err != nil || count != len(pages) || count == 0 {
+    return 0, errors.New(fmt.Sprintf("PDF page tree's /Count doesn't " +
+      "match its %d pages.\n", len(pages)))
+  }
+  return count, nil
+}
+
+/* Hashes PDF values by content, with references replaced by the hashes of
+ * what they point to, so equal content hashes equally wherever it sits in
+ * the file and whatever its object numbers. */
+type pdfHasher struct {
+  doc *pdfDocument
+  digests map[int][]byte
+  hashing map[int]bool
+}
+
+/* Writes the canonical form of `value` to `digest`. */
+func (hasher *pdfHasher) write(digest hash.Hash, value interface{},
+    depth int) {
+  if depth > MAX_PDF_NESTING {
+    digest.Write([]byte("deep;"))
+    return
+  }
+
+  switch typed := value.(type) {
+  case nil:
+    digest.Write([]byte("null;"))
+  case bool:
+    fmt.Fprintf(digest, "%t;", typed)
+  case pdfNumber:
+    fmt.Fprintf(digest, "n%s;", typed)
+  case pdfName:
+    fmt.Fprintf(digest, "/%d:%s;", len(typed), typed)
+  case pdfString:
+    fmt.Fprintf(digest, "s%d:%s;", len(typed), typed)
+  case pdfKeyword:
+    fmt.Fprintf(digest, "k%s;", typed)
+
+  case []interface{}:
+    digest.Write([]byte("["))
+    for _, element := range typed {
+      hasher.write(digest, element, depth + 1)
+    }
+    digest.Write([]byte("]"))
+
+  case pdfDict:
+    // parents change as pages are added, and lead back to every page
+    keys := []string{}
+    for key := range typed {
+      if key != "Parent" {
+        keys = append(keys, key)
+      }
+    }
+    sort.Strings(keys)
+
+    digest.Write([]byte("<<"))
+    for _, key := range keys {
+      fmt.Fprintf(digest, "/%d:%s;", len(key), key)
+      hasher.write(digest, typed[key], depth + 1)
+    }
+    digest.Write([]byte(">>"))
+
+  case *pdfStream:
+    hasher.write(digest, typed.dict, depth + 1)
+    fmt.Fprintf(digest, "stream%d:", len(typed.raw))
+    digest.Write(typed.raw)
+
+  case pdfRef:
+    digest.Write(hasher.refDigest(typed, depth))
+  }
+}
+
+/* Returns the hash of the object `ref` points to. References back into an
+ * object being hashed, e.g. an annotation's page, hash as a marker. */
+func (hasher *pdfHasher) refDigest(ref pdfRef, depth int) []byte {
+  if digest, ok := hasher.digests[ref.num]; ok { return digest }
+  if hasher.hashing[ref.num] { return []byte("cycle;") }
+
+  hasher.hashing[ref.num] = true
+  digest := sha256.New()
+  hasher.write(digest, hasher.doc.objects[ref.num].value, depth + 1)
+  delete(hasher.hashing, ref.num)
+
+  hasher.digests[ref.num] = digest.Sum(nil)
+  return hasher.digests[ref.num]
+}
+
+/* Returns the hex SHA-256 of each page of the document, covering
+ * everything it draws with: its content streams, resources, and
+ * annotations, as stored. A page hashes the same in two files exactly
+ * when it's byte-identical in both. */
+func (doc *pdfDocument) pageHashes() ([]string, error) {
+  pages, err := doc.pages()
+  if err != nil { return nil, err }
+
+  hasher := &pdfHasher{doc: doc, digests: map[int][]byte{},
+    hashing: map[int]bool{}}
+  hashes := make([]string, len(pages))
+  for i, page := range pages {
+    digest := sha256.New()
+    hasher.write(digest, page, 0)
+    hashes[i] = hex.EncodeToString(digest.Sum(nil))
+  }
+  return hashes, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+)
+
+/* Checks that no input makes the PDF parser panic, since it reads every
+ * uploaded, emailed, and watched PDF. */
+func FuzzOpenPDFDocument(f *testing.F) {
+  f.Add([]byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\n" +
+    "endobj\n2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+    "3 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\ntrailer\n" +
+    "<< /Root 1 0 R >>\n%%EOF\n"))
+  // a comment that runs to the end of the file
+  f.Add([]byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog %"))
+  // an object stream with a negative offset
+  f.Add([]byte("%PDF-1.5\n4 0 obj\n<< /Type /ObjStm /N 1 /First 10 " +
+    "/Length 6 >>\nstream\n5 -100\nendstream\nendobj\n"))
+
+  f.Fuzz(func(t *testing.T, data []byte) {
+    path := filepath.Join(t.TempDir(), "fuzz.pdf")
+    err := ioutil.WriteFile(path, data, 0600)
+    if err != nil { t.Fatal(err) }
+
+    doc, err := openPDFDocument(path)
+    if err != nil { return }
+    doc.pages()
+    doc.pageHashes()
+  })
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "strings"
+)
+
+// object numbers of the catalog and page tree, which are written last,
+// once every page is known
+const (
+  PDF_CATALOG_OBJECT = 1
+  PDF_PAGES_OBJECT = 2
+)
+
+/* An image to place on a page of a PDF being written: `data` holds its
+ * samples, encoded with `filter`, in `colorSpace` at 8 bits per component. */
+type pdfImage struct {
+  width int
+  height int
+  colorSpace string
+  filter string
+  data []byte
+}
+
+/* Writes a PDF of image pages to a file, one object at a time, so pages
+ * never have to be held in memory together. */
+type pdfWriter struct {
+  file *os.File
+  writer *bufio.Writer
+  offset int64
+  // byte offset of each object, by object number minus one
+  offsets []int64
+  pageObjects []int
+}
+
+/* Creates a PDF at `path` to write pages to. `close` must be called to
+ * finish it. */
+func createPDF(path string) (*pdfWriter, error) {
+  file, err := os.Create(path)
+  if err != nil { return nil, err }
+
+  pdf := &pdfWriter{file: file, writer: bufio.NewWriter(file),
+    offsets: []int64{0, 0}}
+  // the binary comment marks the file as binary for transfer programs
+  err = pdf.write([]byte("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n"))
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+  return pdf, nil
+}
+
+/* Appends `data` to the file. */
+func (pdf *pdfWriter) write(data []byte) error {
+  n, err := pdf.writer.Write(data)
+  pdf.offset += int64(n)
+  return err
+}
+
+/* Reserves and returns the number of a new object. */
+func (pdf *pdfWriter) newObject() int {
+  pdf.offsets = append(pdf.offsets, 0)
+  return len(pdf.offsets)
+}
+
+/* Writes object `num` with the dictionary `dict`, followed by `stream` if
+ * it isn't nil, whose /Length is added to the dictionary. */
+func (pdf *pdfWriter) writeObject(num int, dict string, stream []byte) error {
+  pdf.offsets[num - 1] = pdf.offset
+  if stream != nil {
+    dict = strings.TrimSuffix(dict, ">>") + fmt.Sprintf(" /Length %d >>",
+      len(stream))
+  }
+
+  err := pdf.write([]byte(fmt.Sprintf("%d 0 obj\n%s\n", num, dict)))
+  if err != nil { return err }
+  if stream != nil {
+    err = pdf.write([]byte("stream\n"))
+    if err != nil { return err }
+    err = pdf.write(stream)
+    if err != nil { return err }
+    err = pdf.write([]byte("\nendstream\n"))
+    if err != nil { return err }
+  }
+  return pdf.write([]byte("endobj\n"))
+}
+
+/* Adds a `width` by `height` point page showing `image`, scaled to
+ * `imageWidth` by `imageHeight` points with its lower left corner at (`x`,
+ * `y`). */
+func (pdf *pdfWriter) addImagePage(image pdfImage, width float64,
+    height float64, x float64, y float64, imageWidth float64,
+    imageHeight float64) error {
+  imageObject := pdf.newObject()
+  err := pdf.writeObject(imageObject, fmt.Sprintf("<< /Type /XObject " +
+    "/Subtype /Image /Width %d /Height %d /ColorSpace /%s " +
+    "/BitsPerComponent 8 /Filter /%s >>", image.width, image.height,
+    image.colorSpace, image.filter), image.data)
+  if err != nil { return err }
+
+  contentsObject := pdf.newObject()
+  contents := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q",
+    imageWidth, imageHeight, x, y)
+  err = pdf.writeObject(contentsObject, "<< >>", []byte(contents))
+  if err != nil { return err }
+
+  pageObject := pdf.newObject()
+  pdf.pageObjects = append(pdf.pageObjects, pageObject)
+  return pdf.writeObject(pageObject, fmt.Sprintf("<< /Type /Page " +
+    "/Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R " +
+    "/Resources << /XObject << /Im0 %d 0 R >> >> >>", PDF_PAGES_OBJECT,
+    width, height, contentsObject, imageObject), nil)
+}
+
+/* Finishes the PDF and closes its file. */
+func (pdf *pdfWriter) close() error {
+  err := pdf.writeTrailer()
+  if err == nil { err = pdf.writer.Flush() }
+
+  closeErr := pdf.file.Close()
+  if err != nil { return err }
+  return closeErr
+}
+
+/* Closes the file of a PDF that won't be finished, e.g. after a page
+ * couldn't be added. */
+func (pdf *pdfWriter) abandon() {
+  pdf.file.Close()
+}
+
+/* Writes the page tree, catalog, and cross-reference table that end the
+ * PDF. */
+func (pdf *pdfWriter) writeTrailer() error {
+  kids := []string{}
+  for _, pageObject := range pdf.pageObjects {
+    kids = append(kids, fmt.Sprintf("%d 0 R", pageObject))
+  }
+  err := pdf.writeObject(PDF_PAGES_OBJECT, fmt.Sprintf("<< /Type /Pages " +
+    "/Kids [%s] /Count %d >>", strings.Join(kids, " "),
+    len(pdf.pageObjects)), nil)
+  if err != nil { return err }
+
+  err = pdf.writeObject(PDF_CATALOG_OBJECT, fmt.Sprintf("<< /Type /Catalog " +
+    "/Pages %d 0 R >>", PDF_PAGES_OBJECT), nil)
+  if err != nil { return err }
+
+  // each cross-reference entry is exactly 20 bytes, including its EOL
+  xrefOffset := pdf.offset
+  xref := fmt.Sprintf("xref\n0 %d\n0000000000 65535 f\r\n",
+    len(pdf.offsets) + 1)
+  for _, offset := range pdf.offsets {
+    xref += fmt.Sprintf("%010d 00000 n\r\n", offset)
+  }
+  xref += fmt.Sprintf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n" +
+    "%d\n%%%%EOF\n", len(pdf.offsets) + 1, PDF_CATALOG_OBJECT, xrefOffset)
+
+  return pdf.write([]byte(xref))
+}
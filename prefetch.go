@@ -0,0 +1,185 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "io"
+  "os"
+  "sync"
+  "launchpad.net/goamz/s3"
+)
+
+var prefetchBudget = flag.Int64("prefetch-budget", 1024 * 1024 * 1024,
+  "bytes of scratch space for downloading queued jobs' PDFs ahead of time " +
+  "(0 disables prefetching)")
+
+/* A queued job's PDF, downloaded ahead of time. Until `done` is closed, it's
+ * waiting or downloading; afterwards, `err` says whether `size` bytes were
+ * saved at `path`. */
+type prefetchEntry struct {
+  job *job
+  bucket *s3.Bucket
+  params conversionParams
+  path string
+  size int64
+  err error
+  claimed bool
+  done chan struct{}
+}
+
+/* Downloads queued jobs' PDFs one at a time, in the order they were queued,
+ * while at most -prefetch-budget bytes of downloaded PDFs are waiting. */
+type prefetcher struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  pending []*prefetchEntry
+  entries map[string]*prefetchEntry
+  usedBytes int64
+}
+
+var prefetches = newPrefetcher()
+
+/* Returns a prefetcher with nothing queued. */
+func newPrefetcher() *prefetcher {
+  prefetcher := &prefetcher{entries: map[string]*prefetchEntry{}}
+  prefetcher.cond = sync.NewCond(&prefetcher.mutex)
+  return prefetcher
+}
+
+/* Queues the PDF of `job`, which was just queued to be converted with
+ * `params`, for prefetching. Encrypted sources aren't prefetched, since
+ * they're only ever decrypted in memory. */
+func (prefetcher *prefetcher) add(job *job, bucket *s3.Bucket,
+    params conversionParams) {
+  if *prefetchBudget <= 0 || params.SourceEncryption != "" ||
+      params.UploadedPDFPath != "" {
+    return
+  }
+
+  prefetcher.mutex.Lock()
+  defer prefetcher.mutex.Unlock()
+
+  entry := &prefetchEntry{job: job, bucket: bucket, params: params,
+    path: scratchPath(job.id + ".prefetch.pdf"), done: make(chan struct{})}
+  prefetcher.pending = append(prefetcher.pending, entry)
+  prefetcher.entries[job.id] = entry
+  prefetcher.cond.Signal()
+}
+
+/* Returns the next entry to download once there's budget for it, skipping
+ * those whose jobs already started. */
+func (prefetcher *prefetcher) next() *prefetchEntry {
+  prefetcher.mutex.Lock()
+  defer prefetcher.mutex.Unlock()
+
+  for {
+    for len(prefetcher.pending) == 0 ||
+        prefetcher.usedBytes >= *prefetchBudget {
+      prefetcher.cond.Wait()
+    }
+
+    entry := prefetcher.pending[0]
+    prefetcher.pending = prefetcher.pending[1:]
+    if !entry.claimed { return entry }
+  }
+}
+
+/* Downloads queued PDFs forever. */
+func (prefetcher *prefetcher) run() {
+  for {
+    entry := prefetcher.next()
+
+    prefetcher.mutex.Lock()
+    available := *prefetchBudget - prefetcher.usedBytes
+    prefetcher.mutex.Unlock()
+
+    var size int64
+    err := downloadPool.run(entry.job.tenant, func() error {
+      var err error
+      size, err = downloadWithin(entry.bucket, entry.params.S3PDFPath,
+        entry.path, available)
+      return err
+    })
+
+    prefetcher.mutex.Lock()
+    entry.size = size
+    entry.err = err
+    if err == nil {
+      prefetcher.usedBytes += size
+    } else {
+      os.Remove(entry.path)
+      entry.job.logger().Warn("Couldn't prefetch PDF",
+        "key", entry.params.S3PDFPath, errorAttr(err))
+    }
+    close(entry.done)
+    prefetcher.mutex.Unlock()
+  }
+}
+
+/* Downloads `s3Path` to the local `path`, failing if it's larger than
+ * `maxBytes`. Returns the number of bytes downloaded. */
+func downloadWithin(bucket *s3.Bucket, s3Path string, path string,
+    maxBytes int64) (int64, error) {
+  reader, err := bucket.GetReader(s3Path)
+  if err != nil { return 0, err }
+  defer reader.Close()
+
+  file, err := os.Create(path)
+  if err != nil { return 0, err }
+  defer file.Close()
+
+  numBytes, err := io.Copy(file, io.LimitReader(reader, maxBytes + 1))
+  if err != nil { return numBytes, err }
+
+  if numBytes > maxBytes {
+    return numBytes, errors.New("PDF exceeds the remaining prefetch " +
+      "budget.\n")
+  }
+  return numBytes, nil
+}
+
+/* Claims the prefetched PDF of `job`, which is starting, moving it to
+ * `pdfPath`. Waits if it's downloading. Returns the number of bytes
+ * prefetched, or false if it wasn't prefetched, in which case the caller
+ * should download it itself. */
+func (prefetcher *prefetcher) claim(job *job, pdfPath string) (int64, bool) {
+  prefetcher.mutex.Lock()
+  entry := prefetcher.entries[job.id]
+  if entry == nil {
+    prefetcher.mutex.Unlock()
+    return 0, false
+  }
+
+  // once claimed, next() skips the entry if it hasn't started downloading
+  delete(prefetcher.entries, job.id)
+  entry.claimed = true
+  pending := prefetcher.isPendingLocked(entry)
+  prefetcher.mutex.Unlock()
+
+  if pending { return 0, false }
+
+  <-entry.done
+  if entry.err != nil { return 0, false }
+
+  // the file now counts against the job's scratch, not our budget
+  prefetcher.mutex.Lock()
+  prefetcher.usedBytes -= entry.size
+  prefetcher.cond.Signal()
+  prefetcher.mutex.Unlock()
+
+  err := os.Rename(entry.path, pdfPath)
+  if err != nil {
+    os.Remove(entry.path)
+    return 0, false
+  }
+  return entry.size, true
+}
+
+/* Returns true if `entry` is still waiting to be downloaded. Expects the
+ * mutex to be held. */
+func (prefetcher *prefetcher) isPendingLocked(entry *prefetchEntry) bool {
+  for _, pending := range prefetcher.pending {
+    if pending == entry { return true }
+  }
+  return false
+}
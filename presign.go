@@ -0,0 +1,72 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "net/url"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var presignExpiry = flag.Duration("presign-expiry", time.Hour,
+  "how long presigned URLs stay valid when a request doesn't pass " +
+  "'presignExpiry'")
+
+// longest a presigned URL may stay valid, in seconds: a week, as with SigV4
+const MAX_PRESIGN_EXPIRY_SECONDS = 7 * 24 * 60 * 60
+
+/* Parses the `presign` and `presignExpiry` keys of `form` into `params`. If
+ * `presign` is "true", renditions are uploaded privately, and the response
+ * includes presigned GET URLs valid for `presignExpiry` seconds (or
+ * -presign-expiry) instead of relying on them being public. */
+func parsePresignParams(form url.Values, params *conversionParams) error {
+  presign, err := optionalFormValue(form, "presign")
+  if err != nil { return err }
+
+  if presign != "" && presign != "true" && presign != "false" {
+    return errors.New("The 'presign' key must be 'true' or 'false'.\n")
+  }
+
+  params.PresignExpiry, err = optionalBoundedInt(form, "presignExpiry", 1,
+    MAX_PRESIGN_EXPIRY_SECONDS)
+  if err != nil { return err }
+
+  if params.PresignExpiry != 0 && presign != "true" {
+    return errors.New("The 'presignExpiry' key requires 'presign'.\n")
+  }
+
+  params.Presign = presign == "true"
+  return nil
+}
+
+/* Validates -presign-expiry. */
+func validatePresignExpiry() error {
+  if *presignExpiry <= 0 ||
+      *presignExpiry > MAX_PRESIGN_EXPIRY_SECONDS * time.Second {
+    return errors.New(fmt.Sprintf("-presign-expiry must be positive and " +
+      "at most %s.\n", MAX_PRESIGN_EXPIRY_SECONDS * time.Second))
+  }
+  return nil
+}
+
+/* Returns presigned GET URLs in `bucket` for each of `keys`, keyed by size
+ * like them, and when they expire. */
+func presignKeys(bucket *s3.Bucket, params conversionParams,
+    keys map[string][]string) (map[string][]string, time.Time) {
+  expiry := *presignExpiry
+  if params.PresignExpiry != 0 {
+    expiry = time.Duration(params.PresignExpiry) * time.Second
+  }
+  expiresAt := time.Now().Add(expiry).Truncate(time.Second)
+
+  urls := map[string][]string{}
+  for tier, tierKeys := range keys {
+    tierURLs := make([]string, len(tierKeys))
+    for i, key := range tierKeys {
+      tierURLs[i] = bucket.SignedURL(key, expiresAt)
+    }
+    urls[tier] = tierURLs
+  }
+  return urls, expiresAt
+}
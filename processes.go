@@ -0,0 +1,69 @@
+package main
+
+import (
+  "flag"
+  "runtime"
+  "sync"
+)
+
+var maxProcesses = flag.Int("max-processes", runtime.NumCPU(),
+  "external tools (gs, convert, jpegtran, ...) run at once across all " +
+  "requests")
+
+/* Caps how many external processes run at once across the server, however
+ * many requests are in flight. Unlike stage slots, which pace pages, this
+ * also covers page counts, distilling, and the like. */
+type processLimiter struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  limit int
+  active int
+}
+
+// shared by everything that runs a tool; sized in main() once flags are
+// parsed
+var processSlots *processLimiter
+
+/* Returns a limiter allowing `limit` processes at once. */
+func newProcessLimiter(limit int) *processLimiter {
+  limiter := &processLimiter{limit: limit}
+  limiter.cond = sync.NewCond(&limiter.mutex)
+  return limiter
+}
+
+/* Waits for a free slot. Every call must be followed by a call to
+ * `release`. */
+func (limiter *processLimiter) acquire() {
+  limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+  for limiter.active >= limiter.limit {
+    limiter.cond.Wait()
+  }
+  limiter.active += 1
+}
+
+/* Frees the slot taken by `acquire`. */
+func (limiter *processLimiter) release() {
+  limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+  limiter.active -= 1
+  limiter.cond.Signal()
+}
+
+/* Changes the limit to `limit`. Processes already running over a lowered
+ * limit finish undisturbed. */
+func (limiter *processLimiter) setLimit(limit int) {
+  limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+  limiter.limit = limit
+  limiter.cond.Broadcast()
+}
+
+/* Calls `run`, which runs an external process, once a process slot is
+ * free. Slots are only held while a process runs, never while waiting for
+ * another slot, so callers holding stage slots can't deadlock. */
+func withProcessSlot(run func() error) error {
+  processSlots.acquire()
+  defer processSlots.release()
+  return run()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "net"
+  "net/http"
+  "strings"
+)
+
+var trustedProxiesFlag = flag.String("trusted-proxies", "",
+  "comma-separated CIDRs of reverse proxies whose X-Forwarded-For and " +
+  "X-Forwarded-Proto headers are trusted")
+
+// networks of reverse proxies we trust to report the real client
+var trustedProxies []*net.IPNet = nil
+
+/* Parses a comma-separated list of CIDRs (or bare IPs) into networks. */
+func parseTrustedProxies(cidrs string) ([]*net.IPNet, error) {
+  networks := []*net.IPNet{}
+
+  for _, cidr := range strings.Split(cidrs, ",") {
+    cidr = strings.TrimSpace(cidr)
+    if cidr == "" { continue }
+
+    // treat a bare IP as a network containing only that address
+    if !strings.Contains(cidr, "/") {
+      ip := net.ParseIP(cidr)
+      if ip == nil {
+        return nil, errors.New("Invalid trusted proxy address: " + cidr + "\n")
+      }
+
+      bits := 8 * len(ip.To16())
+      if ip.To4() != nil {
+        ip = ip.To4()
+        bits = 32
+      }
+      networks = append(networks, &net.IPNet{IP: ip,
+        Mask: net.CIDRMask(bits, bits)})
+      continue
+    }
+
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil {
+      return nil, errors.New("Invalid trusted proxy CIDR: " + cidr + "\n")
+    }
+    networks = append(networks, network)
+  }
+
+  return networks, nil
+}
+
+/* Returns true if `ip` falls within one of the trusted proxy networks. */
+func isTrustedProxy(ip net.IP) bool {
+  if ip == nil { return false }
+
+  for _, network := range trustedProxies {
+    if network.Contains(ip) { return true }
+  }
+  return false
+}
+
+/* Returns the IP address of the directly connected peer of `request`. */
+func peerIP(request *http.Request) string {
+  host, _, err := net.SplitHostPort(request.RemoteAddr)
+  if err != nil { return request.RemoteAddr }
+  return host
+}
+
+/* Returns the IP address of the client that made `request`. If the request
+ * arrived through trusted proxies, X-Forwarded-For is walked from right to
+ * left, and the first untrusted address is the client. Otherwise, headers are
+ * ignored, as anyone could have set them. */
+func clientIP(request *http.Request) string {
+  ip := peerIP(request)
+  if !isTrustedProxy(net.ParseIP(ip)) { return ip }
+
+  forwardedFor := request.Header.Values("X-Forwarded-For")
+  hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+
+  for i := len(hops) - 1; i >= 0; i = i - 1 {
+    hop := strings.TrimSpace(hops[i])
+    if hop == "" { continue }
+
+    ip = hop
+    if !isTrustedProxy(net.ParseIP(hop)) { break }
+  }
+
+  return ip
+}
+
+/* Returns the scheme ("http" or "https") the client used to make `request`,
+ * honoring X-Forwarded-Proto only when it was set by a trusted proxy. */
+func clientScheme(request *http.Request) string {
+  if isTrustedProxy(net.ParseIP(peerIP(request))) {
+    // with several proxies, the first value was set by the outermost one
+    proto := request.Header.Get("X-Forwarded-Proto")
+    proto = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+    if proto == "http" || proto == "https" { return proto }
+  }
+
+  if request.TLS != nil { return "https" }
+  return "http"
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "math"
+  "net/url"
+  "sort"
+)
+
+var qualityBlurThreshold = flag.Float64("quality-blur-threshold", 20,
+  "sharpness below which a page scored with scoreQuality=true is flagged " +
+  "as blurry")
+
+// width pages are scaled down to before they're scored, so scores don't
+// depend on the density they were rendered at
+const QUALITY_SAMPLE_WIDTH = 1000
+
+// mean luminance (0 to 255) below which a page is flagged as dark
+const QUALITY_DARK_BRIGHTNESS = 40
+
+// standard deviation of luminance below which a page is considered blank,
+// and so can't be blurry
+const QUALITY_BLANK_CONTRAST = 2
+
+// fraction of pixels whose edges are stronger than a page's sharpness: its
+// strongest edges, so a sharp page with little on it still scores as sharp
+const QUALITY_EDGE_FRACTION = 0.001
+
+// flags marking a page as likely unreadable
+const (
+  QUALITY_BLURRY = "blurry"
+  QUALITY_DARK = "dark"
+)
+
+/* How readable a rendered page looks. `Score` runs from 0 (unreadable) to
+ * 1, and is the lower of its sharpness and brightness, each relative to
+ * twice the level it's flagged below. `Sharpness` is the strength of its
+ * strongest edges, from the absolute Laplacian of its luminance (0 to
+ * 1020); `Contrast` the standard deviation and `Brightness` the mean of
+ * its luminance (0 to 255). */
+type pageQuality struct {
+  Score float64 `json:"score"`
+  Sharpness float64 `json:"sharpness"`
+  Contrast float64 `json:"contrast"`
+  Brightness float64 `json:"brightness"`
+  Flags []string `json:"flags,omitempty"`
+}
+
+/* Returns whether the `scoreQuality` key of `form` asks for each page's
+ * quality to be scored. */
+func parseScoreQuality(form url.Values) (bool, error) {
+  score, err := optionalFormValue(form, "scoreQuality")
+  if err != nil { return false, err }
+
+  if score != "" && score != "true" && score != "false" {
+    return false, errors.New("The 'scoreQuality' key must be 'true' or " +
+      "'false'.\n")
+  }
+  return score == "true", nil
+}
+
+/* Returns the luminance of each pixel of the JPEG at `jpegPath`, scaled
+ * down to at most QUALITY_SAMPLE_WIDTH pixels wide, and its width. */
+func readLuminance(jpegPath string) ([]float64, int, error) {
+  img, err := readRGBAJPEG(jpegPath)
+  if err != nil { return nil, 0, err }
+
+  width, height := img.Bounds().Dx(), img.Bounds().Dy()
+  if width > QUALITY_SAMPLE_WIDTH {
+    height = maxInt(height * QUALITY_SAMPLE_WIDTH / width, 1)
+    width = QUALITY_SAMPLE_WIDTH
+    img = scaleImage(img, width, height)
+  }
+
+  luminance := make([]float64, width * height)
+  for i := range luminance {
+    pixel := img.Pix[i * 4:i * 4 + 3]
+    luminance[i] = 0.299 * float64(pixel[0]) + 0.587 * float64(pixel[1]) +
+      0.114 * float64(pixel[2])
+  }
+  return luminance, width, nil
+}
+
+/* Scores the page whose luminance is `luminance`, `width` pixels wide. */
+func scoreLuminance(luminance []float64, width int) pageQuality {
+  quality := pageQuality{}
+  height := len(luminance) / width
+  if height == 0 { return quality }
+
+  sum, sumOfSquares := 0.0, 0.0
+  for _, value := range luminance {
+    sum += value
+    sumOfSquares += value * value
+  }
+  count := float64(len(luminance))
+  quality.Brightness = sum / count
+  quality.Contrast = math.Sqrt(math.Max(0,
+    sumOfSquares / count - quality.Brightness * quality.Brightness))
+
+  // the absolute Laplacian is at most 1020, so a histogram finds the
+  // strongest edges without sorting every pixel
+  histogram := make([]int, 1021)
+  numEdges := 0
+  for y := 1; y < height - 1; y = y + 1 {
+    for x := 1; x < width - 1; x = x + 1 {
+      i := y * width + x
+      edge := math.Abs(4 * luminance[i] - luminance[i - 1] -
+        luminance[i + 1] - luminance[i - width] - luminance[i + width])
+      histogram[int(math.Min(edge, 1020))] += 1
+      numEdges += 1
+    }
+  }
+  stronger := int(float64(numEdges) * QUALITY_EDGE_FRACTION)
+  for bin := len(histogram) - 1; bin >= 0 && numEdges > 0; bin = bin - 1 {
+    stronger -= histogram[bin]
+    if stronger < 0 {
+      quality.Sharpness = float64(bin)
+      break
+    }
+  }
+
+  sharpness := 1.0
+  if quality.Contrast >= QUALITY_BLANK_CONTRAST {
+    sharpness = math.Min(1, quality.Sharpness / (2 * *qualityBlurThreshold))
+    if quality.Sharpness < *qualityBlurThreshold {
+      quality.Flags = append(quality.Flags, QUALITY_BLURRY)
+    }
+  }
+  if quality.Brightness < QUALITY_DARK_BRIGHTNESS {
+    quality.Flags = append(quality.Flags, QUALITY_DARK)
+  }
+
+  brightness := math.Min(1, quality.Brightness /
+    (2 * QUALITY_DARK_BRIGHTNESS))
+  quality.Score = roundTo(math.Min(sharpness, brightness), 2)
+  quality.Sharpness = roundTo(quality.Sharpness, 1)
+  quality.Contrast = roundTo(quality.Contrast, 1)
+  quality.Brightness = roundTo(quality.Brightness, 1)
+  return quality
+}
+
+/* Returns `value` rounded to `places` decimal places. */
+func roundTo(value float64, places int) float64 {
+  scale := math.Pow(10, float64(places))
+  return math.Round(value * scale) / scale
+}
+
+/* Scores the quality of page `pageNum`, whose large JPEG is saved locally
+ * at `largeJPEGPath`, and records it in `job`, if `params` asks for it.
+ * Like handwriting detection, scoring is best-effort: failures are logged
+ * and leave the page unscored. */
+func scorePageQuality(job *job, params conversionParams,
+    largeJPEGPath string, pageNum int) {
+  if !params.ScoreQuality { return }
+
+  jpegPath := fmt.Sprintf(largeJPEGPath, pageNum)
+  megapixels, err := reserveDecodeBudget(jpegPath, pageNum)
+  var luminance []float64
+  var width int
+  if err == nil {
+    luminance, width, err = readLuminance(jpegPath)
+    decodeBudget.release(megapixels)
+  }
+  if err != nil {
+    job.logger().Warn("Couldn't score page quality", "page", pageNum,
+      errorAttr(err))
+    job.recordEvent("quality unscored", pageNum, err.Error())
+    return
+  }
+
+  quality := scoreLuminance(luminance, width)
+  if len(quality.Flags) > 0 {
+    job.recordEvent("likely unreadable", pageNum,
+      fmt.Sprintf("%v", quality.Flags))
+  }
+  job.setPageQuality(pageNum, quality)
+}
+
+/* Records the quality scored for page `pageNum`. */
+func (job *job) setPageQuality(pageNum int, quality pageQuality) {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+  job.pageQuality[pageNum] = quality
+}
+
+/* Returns the quality of each page that was scored, or nil if scoring
+ * didn't run. */
+func (job *job) pageQualityByPage() map[int]pageQuality {
+  job.mutex.Lock()
+  defer job.mutex.Unlock()
+
+  if len(job.pageQuality) == 0 { return nil }
+
+  quality := map[int]pageQuality{}
+  for pageNum, pageQuality := range job.pageQuality {
+    quality[pageNum] = pageQuality
+  }
+  return quality
+}
+
+/* Returns the pages in `quality` flagged as likely unreadable, in order. */
+func unreadablePages(quality map[int]pageQuality) []int {
+  pageNums := []int{}
+  for pageNum, pageQuality := range quality {
+    if len(pageQuality.Flags) > 0 {
+      pageNums = append(pageNums, pageNum)
+    }
+  }
+  if len(pageNums) == 0 { return nil }
+
+  sort.Ints(pageNums)
+  return pageNums
+}
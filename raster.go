@@ -0,0 +1,175 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/jpeg"
+  _ "image/png"
+  "os"
+)
+
+// name reported for pages rendered from TIFF, JPEG, and PNG sources
+const RENDERER_RASTER = "raster"
+
+// most pages counted in a TIFF, so a corrupt file's IFD chain can't loop
+const MAX_TIFF_PAGES = 100000
+
+// ImageMagick's names for the raster formats, to read them as, whatever
+// their scratch file is called
+var IMAGEMAGICK_FORMATS = map[string]string{SOURCE_TIFF: "tiff",
+  SOURCE_JPEG: "jpeg", SOURCE_PNG: "png"}
+
+/* Returns true if `format` is a raster image format, whose pages are
+ * already pixels, so they're never rendered by a PDF renderer. */
+func isRasterFormat(format string) bool {
+  _, ok := IMAGEMAGICK_FORMATS[format]
+  return ok
+}
+
+/* Renders pages of TIFF, JPEG, and PNG sources of `format` by re-encoding
+ * them with ImageMagick, at their own resolution, turned upright by their
+ * orientation tag and flattened onto white. Without ImageMagick, JPEG and
+ * PNG sources are re-encoded in process instead, though their orientation
+ * tags aren't read. Raster sources can only be rendered this way, and PDFs
+ * never are. */
+type rasterRenderer struct {
+  format string
+}
+
+func (renderer rasterRenderer) renderPage(imagePath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  if !hasExternalResizer() {
+    return renderer.renderPageInProcess(imagePath, pageNum, outputPath,
+      quality, gray)
+  }
+
+  // frames are numbered from 0
+  input := fmt.Sprintf("%s:%s[%d]", IMAGEMAGICK_FORMATS[renderer.format],
+    imagePath, pageNum - 1)
+  args := []string{input, "-auto-orient", "-background", "white", "-alpha",
+    "remove", "-alpha", "off"}
+  if gray { args = append(args, "-colorspace", "Gray") }
+  args = append(args, "-quality", fmt.Sprintf("%d", quality), outputPath)
+  return runTool(toolCommand("convert", args...))
+}
+
+/* Re-encodes the JPEG or PNG at `imagePath`, page `pageNum`, as a JPEG at
+ * `outputPath`, for when ImageMagick is missing. Sources are untrusted, so
+ * they're only decoded within the decode budget. */
+func (renderer rasterRenderer) renderPageInProcess(imagePath string,
+    pageNum int, outputPath string, quality int, gray bool) error {
+  if renderer.format == SOURCE_TIFF {
+    return errors.New("TIFF sources can't be rendered without " +
+      "ImageMagick.\n")
+  }
+
+  file, err := os.Open(imagePath)
+  if err != nil { return err }
+  defer file.Close()
+
+  config, _, err := image.DecodeConfig(file)
+  if err != nil { return err }
+
+  megapixels, err := reserveDecodeMegapixels(dimensions{config.Width,
+    config.Height}, pageNum)
+  if err != nil { return err }
+  defer decodeBudget.release(megapixels)
+
+  _, err = file.Seek(0, 0)
+  if err != nil { return err }
+  decoded, _, err := image.Decode(file)
+  if err != nil { return err }
+
+  output, err := os.Create(outputPath)
+  if err != nil { return err }
+
+  err = jpeg.Encode(output, flattenOntoWhite(decoded, gray),
+    &jpeg.Options{Quality: quality})
+  if err != nil {
+    output.Close()
+    return err
+  }
+  return output.Close()
+}
+
+/* Returns `decoded` drawn onto a white background, in grayscale if `gray`,
+ * since transparent pixels would otherwise be encoded as black. */
+func flattenOntoWhite(decoded image.Image, gray bool) draw.Image {
+  bounds := decoded.Bounds()
+  var flattened draw.Image = image.NewRGBA(image.Rect(0, 0, bounds.Dx(),
+    bounds.Dy()))
+  if gray {
+    flattened = image.NewGray(flattened.Bounds())
+  }
+  draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White),
+    image.Point{}, draw.Src)
+  draw.Draw(flattened, flattened.Bounds(), decoded, bounds.Min, draw.Over)
+  return flattened
+}
+
+/* Returns the number of pages in the TIFF at `tiffPath`: the length of its
+ * chain of image file directories, read without decoding any of them. Both
+ * classic TIFF and BigTIFF are supported. */
+func getTIFFNumPages(tiffPath string) (int, error) {
+  file, err := os.Open(tiffPath)
+  if err != nil { return -1, err }
+  defer file.Close()
+
+  header := make([]byte, 16)
+  _, err = file.ReadAt(header[:8], 0)
+  if err != nil { return -1, err }
+
+  var order binary.ByteOrder = binary.LittleEndian
+  if header[0] == 'M' { order = binary.BigEndian }
+
+  // BigTIFF widens counts and offsets to 8 bytes, and entries to 20
+  big := order.Uint16(header[2:4]) == 43
+  var offset uint64
+  countBytes, entryBytes, offsetBytes := 2, 12, 4
+  if big {
+    _, err = file.ReadAt(header[8:16], 8)
+    if err != nil { return -1, err }
+    offset = order.Uint64(header[8:16])
+    countBytes, entryBytes, offsetBytes = 8, 20, 8
+  } else {
+    offset = uint64(order.Uint32(header[4:8]))
+  }
+
+  readUint := func(at uint64, numBytes int) (uint64, error) {
+    buffer := make([]byte, numBytes)
+    _, err := file.ReadAt(buffer, int64(at))
+    if err != nil { return 0, err }
+
+    switch numBytes {
+    case 2: return uint64(order.Uint16(buffer)), nil
+    case 4: return uint64(order.Uint32(buffer)), nil
+    }
+    return order.Uint64(buffer), nil
+  }
+
+  numPages := 0
+  visited := map[uint64]bool{}
+  for offset != 0 {
+    if visited[offset] || numPages >= MAX_TIFF_PAGES {
+      return -1, errors.New("The TIFF's pages are corrupt.\n")
+    }
+    visited[offset] = true
+    numPages = numPages + 1
+
+    numEntries, err := readUint(offset, countBytes)
+    if err != nil { return -1, err }
+
+    next := offset + uint64(countBytes) + numEntries * uint64(entryBytes)
+    offset, err = readUint(next, offsetBytes)
+    if err != nil { return -1, err }
+  }
+
+  if numPages == 0 {
+    return -1, errors.New("The TIFF has no pages.\n")
+  }
+  return numPages, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var readThrough = flag.Bool("read-through", false,
+  "render pages on demand when /renditions/ is asked for ones that don't " +
+  "exist yet")
+
+/* A page being rendered on demand for a read-through request. `done` is
+ * closed once it's finished, with `err` set if it failed. */
+type readThroughRender struct {
+  done chan struct{}
+  err error
+}
+
+/* Renders in progress for read-through requests, keyed by the renditions
+ * they produce, so concurrent requests for a page render it only once. */
+type readThroughRenders struct {
+  mutex sync.Mutex
+  renders map[string]*readThroughRender
+}
+
+var readThroughs = readThroughRenders{
+  renders: map[string]*readThroughRender{}}
+
+/* Returns the page number and size of the rendition at `key` under
+ * `params`' path templates. Returns false if `key` isn't one of them. */
+func parseRenditionKey(params conversionParams, key string) (int, string,
+    bool) {
+  for tier, template := range s3PathsByTier(params) {
+    parts := strings.SplitN(template, "%d", 2)
+    if len(parts) != 2 || len(key) <= len(parts[0]) + len(parts[1]) ||
+        !strings.HasPrefix(key, parts[0]) ||
+        !strings.HasSuffix(key, parts[1]) {
+      continue
+    }
+
+    pageNum, err := strconv.Atoi(key[len(parts[0]):len(key) - len(parts[1])])
+    if err != nil || pageNum < 1 { continue }
+
+    // rules out e.g. leading zeros, which no page's key has
+    if fmt.Sprintf(template, pageNum) == key { return pageNum, tier, true }
+  }
+  return 0, "", false
+}
+
+/* Returns true if `key` exists in `bucket`. */
+func renditionExists(bucket *s3.Bucket, key string) (bool, error) {
+  var list *s3.ListResp
+  err := withS3Retries(logger, S3_OP_LIST, func() error {
+    var err error
+    list, err = bucket.List(key, "", "", 1)
+    return err
+  })
+  if err != nil { return false, err }
+  return len(list.Contents) > 0 && list.Contents[0].Key == key, nil
+}
+
+/* Returns true if `request` may render pages on read. Otherwise, writes an
+ * error to `writer` and returns false. Since rendering writes to S3, it's
+ * held to what other requests that change anything are: a signature, if
+ * -request-secret is set, or else a key in the X-API-Key header, if keys
+ * are configured. Browsers send Basic credentials along with cross-site
+ * images, so those aren't enough. */
+func authorizeReadThroughRender(writer http.ResponseWriter,
+    request *http.Request) bool {
+  if *requestSecret != "" {
+    err := verifyRequestSignature(request, ioutil.Discard)
+    if err != nil {
+      logger.Warn("Rejected unsigned request", "request", requestID(request),
+        "path", request.URL.Path, errorAttr(err))
+      http.Error(writer, err.Error(), http.StatusUnauthorized)
+      return false
+    }
+    return true
+  }
+
+  if len(apiKeys) > 0 && request.Header.Get("X-API-Key") == "" {
+    http.Error(writer, "Rendering on read requires an API key in the " +
+      "X-API-Key header.\n", http.StatusForbidden)
+    return false
+  }
+  return true
+}
+
+/* Renders and uploads every rendition of page `pageNum` under `params` for
+ * `request`, as a new job whose ID is returned, unless another request is
+ * already doing so, in which case this waits for it and returns "". */
+func (renders *readThroughRenders) render(request *http.Request,
+    bucket *s3.Bucket, params conversionParams, pageNum int) (string,
+    error) {
+  keys := []string{bucket.Name}
+  for _, template := range s3PathsByTier(params) {
+    keys = append(keys, fmt.Sprintf(template, pageNum))
+  }
+  sort.Strings(keys)
+  id := strings.Join(keys, "\n")
+
+  renders.mutex.Lock()
+  render, ok := renders.renders[id]
+  if ok {
+    renders.mutex.Unlock()
+    <-render.done
+    return "", render.err
+  }
+  render = &readThroughRender{done: make(chan struct{})}
+  renders.renders[id] = render
+  renders.mutex.Unlock()
+
+  jobID := newID()
+  job := newJob(jobID, tenantName(request), requestID(request))
+  startTime := time.Now()
+  render.err = runPageRegeneration(job, bucket, params, pageNum, "")
+  job.finish(render.err)
+  if render.err == nil {
+    job.logger().Info("Rendered on read", "page", pageNum)
+  }
+  recordInDataLake(job, params)
+  cleanupScratch(jobID)
+  auditConversion(request, jobID, 1, startTime, render.err)
+
+  renders.mutex.Lock()
+  delete(renders.renders, id)
+  renders.mutex.Unlock()
+  close(render.done)
+  return jobID, render.err
+}
+
+/* Handles GET /renditions/{key}, when -read-through is set. The query holds
+ * the conversion keys the document was (or would be) converted with,
+ * usually just `template` and `s3PDFPath`, and `{key}` is the key of one of
+ * its renditions. If the rendition doesn't exist yet, its page alone is
+ * rendered and uploaded, in every size, as a job whose ID is in the X-Job-ID
+ * header. Either way, the client is redirected to the rendition in S3, by a
+ * presigned URL if `presign` is "true".
+ *
+ * Rendering must be signed, or carry its key in a header, and is refused
+ * during maintenance. Concurrent requests for renditions of the same page
+ * wait for one render.
+ * Keys that don't match the conversion's path templates, pages past the end
+ * of the PDF, and missing sources are all 404s. */
+func serveReadThrough(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if !*readThrough {
+    http.NotFound(writer, request)
+    return
+  }
+
+  if request.Method != "GET" && request.Method != "HEAD" {
+    http.Error(writer, "Only GET and HEAD requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  key := strings.TrimPrefix(request.URL.Path, "/renditions/")
+  source, err := requireFormValue(request.Form, "s3PDFPath", "a PDF")
+  var params conversionParams
+  var template string
+  if err == nil {
+    template, err = applyTemplate(request.Form, source)
+  }
+  if err == nil {
+    params, err = parseConversionForm(request.Form)
+  }
+  if err == nil && params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    err = errors.New("Content-addressed renditions are served at " +
+      "/documents/.\n")
+  }
+  // keys don't belong in URLs, which end up in logs
+  if err == nil && params.SourceEncryption != "" {
+    err = errors.New("Encrypted sources can't be rendered on read.\n")
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+  params.Template = template
+
+  pageNum, tier, ok := parseRenditionKey(params, key)
+  if !ok {
+    http.NotFound(writer, request)
+    return
+  }
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  if handleError(err, writer) { return }
+
+  exists, err := renditionExists(bucket, key)
+  if handleError(err, writer) { return }
+
+  if !exists {
+    if rejectDuringMaintenance(writer) { return }
+    if !authorizeReadThroughRender(writer, request) { return }
+
+    var jobID string
+    jobID, err = readThroughs.render(request, bucket, params, pageNum)
+    if jobID != "" {
+      writer.Header().Set("X-Job-ID", jobID)
+    }
+  }
+
+  if _, ok := err.(pageOutOfRangeError); ok || isS3NotFound(err) {
+    http.Error(writer, err.Error(), http.StatusNotFound)
+    return
+  }
+  if errorCode(err) == ERROR_CODE_INFECTED {
+    http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  url := bucket.URL(key)
+  if params.Presign {
+    urls, _ := presignKeys(bucket, params, map[string][]string{tier: {key}})
+    url = urls[tier][0]
+  }
+  http.Redirect(writer, request, url, http.StatusFound)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "log/slog"
+  "net/http"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+var remoteWorkers = flag.Bool("remote-workers", false,
+  "accept render workers over WebSocket at /workers and offer them pages " +
+  "before rendering locally; enables the 'remote' renderer")
+var remoteClaimTimeout = flag.Duration("remote-claim-timeout",
+  10 * time.Second,
+  "how long a page waits for an idle remote worker to take it before it's " +
+  "rendered by the next renderer; pages don't wait when none is idle")
+var remoteRenderTimeout = flag.Duration("remote-render-timeout",
+  2 * time.Minute, "how long a remote worker has to return a page it took")
+
+// name clients select remote workers with
+const RENDERER_REMOTE = "remote"
+
+// largest message a remote worker may send, i.e. the largest page it may
+// return
+const MAX_REMOTE_MESSAGE_BYTES = 64 * 1024 * 1024
+
+// how often idle workers are pinged, so dead connections are noticed
+const REMOTE_PING_INTERVAL = 30 * time.Second
+
+var remoteTasksTotal = newCounterVec("evangelist_remote_tasks_total",
+  "Pages offered to remote workers, by outcome (rendered, failed, or " +
+  "unclaimed).", "outcome")
+
+/* A page offered to remote workers. Whichever worker takes it sends exactly
+ * one result. */
+type remoteTask struct {
+  id string
+  pdfPath string
+  pdfDigest string
+  pageNum int
+  density int
+  quality int
+  result chan remoteResult
+}
+
+/* The rendered JPEG of a remote task, or why there isn't one. */
+type remoteResult struct {
+  jpeg []byte
+  err error
+}
+
+// pages waiting for a worker; unbuffered, so a page is only handed to a
+// worker that has pulled, and is otherwise free to fall back
+var remoteTasks = make(chan *remoteTask)
+
+// number of workers that have pulled and are waiting for a page
+var idleRemoteWorkers int64
+
+/* A task as sent to a worker. If `PDFIncluded`, the PDF follows as a binary
+ * message; otherwise, it's the one the worker was last sent, which has the
+ * same SHA-256 `PDFDigest`. */
+type remoteTaskMessage struct {
+  Type string `json:"type"`
+  TaskID string `json:"taskId"`
+  PageNum int `json:"pageNum"`
+  Density int `json:"density"`
+  Quality int `json:"quality"`
+  PDFDigest string `json:"pdfDigest"`
+  PDFIncluded bool `json:"pdfIncluded"`
+}
+
+/* A message from a worker: a "pull" for its next task, or the "result" of
+ * the task it took, followed by the JPEG as a binary message unless `Error`
+ * is set. */
+type workerMessage struct {
+  Type string `json:"type"`
+  TaskID string `json:"taskId"`
+  Error string `json:"error"`
+}
+
+/* A page a remote worker reported it couldn't render. The connection is
+ * still usable, unlike after other errors. */
+type workerError struct {
+  pageNum int
+  message string
+}
+
+func (err *workerError) Error() string {
+  return fmt.Sprintf("Remote worker couldn't render page %d: %s\n",
+    err.pageNum, strings.TrimSpace(err.message))
+}
+
+/* Renders by handing pages to workers connected to /workers. Workers render
+ * in color, so grayscale pages are converted once they're back. `pdfDigest`
+ * is the digest of the PDF its pages come from, if it's known already. */
+type remoteRenderer struct {
+  pdfDigest string
+}
+
+func (renderer remoteRenderer) renderPage(pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  // without a worker to wait for, the next renderer may as well start now
+  if atomic.LoadInt64(&idleRemoteWorkers) == 0 {
+    remoteTasksTotal.add(1, "unclaimed")
+    return errors.New(fmt.Sprintf("No remote worker was idle to render " +
+      "page %d.\n", pageNum))
+  }
+
+  digest := renderer.pdfDigest
+  var err error
+  if digest == "" {
+    digest, err = hashFile(pdfPath)
+    if err != nil { return err }
+  }
+
+  task := &remoteTask{id: newID(), pdfPath: pdfPath, pdfDigest: digest,
+    pageNum: pageNum, density: density, quality: quality,
+    result: make(chan remoteResult, 1)}
+
+  select {
+  case remoteTasks <- task:
+  case <-time.After(*remoteClaimTimeout):
+    remoteTasksTotal.add(1, "unclaimed")
+    return errors.New(fmt.Sprintf("No remote worker was free to render " +
+      "page %d.\n", pageNum))
+  }
+
+  // writes to and reads from the worker have deadlines, so this can't hang
+  result := <-task.result
+  if result.err != nil {
+    remoteTasksTotal.add(1, "failed")
+    return result.err
+  }
+
+  remoteTasksTotal.add(1, "rendered")
+  err = ioutil.WriteFile(outputPath, result.jpeg, 0600)
+  if err != nil || !gray { return err }
+  return grayscaleJPEG(outputPath, quality)
+}
+
+/* Returns `params` with the digest of the PDF at `pdfPath` that remote
+ * workers are told, if they're enabled and it isn't known yet, so it's
+ * hashed once per job rather than once per page. */
+func withPDFDigest(params conversionParams, pdfPath string) (conversionParams,
+    error) {
+  if !*remoteWorkers || params.PDFDigest != "" { return params, nil }
+
+  var err error
+  params.PDFDigest, err = hashFile(pdfPath)
+  return params, err
+}
+
+/* Registers the remote renderer according to -remote-workers, putting it
+ * first in the fallback order so local renderers only handle pages no
+ * worker took or rendered. */
+func setupRemoteWorkers() error {
+  if !*remoteWorkers { return nil }
+
+  if *remoteClaimTimeout <= 0 || *remoteRenderTimeout <= 0 {
+    return errors.New("-remote-claim-timeout and -remote-render-timeout " +
+      "must be positive.\n")
+  }
+
+  renderers[RENDERER_REMOTE] = remoteRenderer{}
+  if !strings.Contains("," + *rendererFallback + ",",
+      "," + RENDERER_REMOTE + ",") {
+    *rendererFallback = RENDERER_REMOTE + "," + *rendererFallback
+  }
+
+  logger.Info("Offering pages to remote workers first")
+  return nil
+}
+
+/* Reads the next message from the worker on `socket`, which must be a text
+ * message of type `expectedType`. */
+func readWorkerMessage(socket *webSocket,
+    expectedType string) (workerMessage, error) {
+  var message workerMessage
+
+  opcode, payload, err := socket.readMessage()
+  if err != nil { return message, err }
+
+  if opcode == WS_OP_TEXT {
+    err = json.Unmarshal(payload, &message)
+  }
+  if opcode != WS_OP_TEXT || err != nil || message.Type != expectedType {
+    return message, errors.New(fmt.Sprintf("Expected a '%s' message from " +
+      "the remote worker.\n", expectedType))
+  }
+  return message, nil
+}
+
+/* Waits for a page to hand to the worker on `socket`, pinging it while
+ * idle. A worker that stops reading fails the ping once its deadline
+ * passes. */
+func claimRemoteTask(socket *webSocket) (*remoteTask, error) {
+  ticker := time.NewTicker(REMOTE_PING_INTERVAL)
+  defer ticker.Stop()
+
+  atomic.AddInt64(&idleRemoteWorkers, 1)
+  defer atomic.AddInt64(&idleRemoteWorkers, -1)
+
+  for {
+    select {
+    case task := <-remoteTasks:
+      return task, nil
+    case <-ticker.C:
+      socket.conn.SetWriteDeadline(time.Now().Add(REMOTE_PING_INTERVAL))
+      err := socket.writeMessage(WS_OP_PING, nil)
+      if err != nil { return nil, err }
+    }
+  }
+}
+
+/* Sends `task` to the worker on `socket`, along with its PDF if `sendPDF`,
+ * and returns the JPEG the worker rendered. The worker has
+ * -remote-render-timeout for all of it, so one that stops reading or
+ * answering can't hold up the page. */
+func renderOnWorker(socket *webSocket, task *remoteTask,
+    sendPDF bool) ([]byte, error) {
+  socket.conn.SetDeadline(time.Now().Add(*remoteRenderTimeout))
+  defer socket.conn.SetDeadline(time.Time{})
+
+  encoded, err := json.Marshal(remoteTaskMessage{Type: "task",
+    TaskID: task.id, PageNum: task.pageNum, Density: task.density,
+    Quality: task.quality, PDFDigest: task.pdfDigest, PDFIncluded: sendPDF})
+  if err != nil { return nil, err }
+
+  err = socket.writeMessage(WS_OP_TEXT, encoded)
+  if err != nil { return nil, err }
+
+  if sendPDF {
+    pdf, err := ioutil.ReadFile(task.pdfPath)
+    if err != nil { return nil, err }
+
+    err = socket.writeMessage(WS_OP_BINARY, pdf)
+    if err != nil { return nil, err }
+  }
+
+  reply, err := readWorkerMessage(socket, "result")
+  if err != nil { return nil, err }
+
+  if reply.TaskID != task.id {
+    return nil, errors.New("Remote worker answered for another task.\n")
+  }
+  if reply.Error != "" {
+    return nil, &workerError{task.pageNum, reply.Error}
+  }
+
+  opcode, jpeg, err := socket.readMessage()
+  if err != nil { return nil, err }
+
+  if opcode != WS_OP_BINARY {
+    return nil, errors.New("Expected a JPEG from the remote worker.\n")
+  }
+  if !bytes.HasPrefix(jpeg, []byte{0xFF, 0xD8, 0xFF}) {
+    return nil, &workerError{task.pageNum, "it returned something other " +
+      "than a JPEG"}
+  }
+  return jpeg, nil
+}
+
+/* Hands pages to the worker on `socket` each time it pulls, until it
+ * disconnects or misbehaves. */
+func serveWorker(log *slog.Logger, socket *webSocket) {
+  defer socket.close()
+
+  // digest of the PDF the worker was sent last, which it keeps
+  sentDigest := ""
+  for {
+    _, err := readWorkerMessage(socket, "pull")
+    if err != nil {
+      log.Info("Remote worker disconnected", errorAttr(err))
+      return
+    }
+
+    task, err := claimRemoteTask(socket)
+    if err != nil {
+      log.Info("Remote worker disconnected", errorAttr(err))
+      return
+    }
+
+    jpeg, err := renderOnWorker(socket, task, task.pdfDigest != sentDigest)
+    task.result <- remoteResult{jpeg, err}
+
+    if _, ok := err.(*workerError); err != nil && !ok {
+      log.Warn("Lost remote worker", "page", task.pageNum, errorAttr(err))
+      return
+    } else if err != nil {
+      log.Warn("Remote worker failed", "page", task.pageNum, errorAttr(err))
+    }
+    sentDigest = task.pdfDigest
+  }
+}
+
+/* Handles GET /workers, which render workers connect to over WebSocket to
+ * pull pages and push back JPEGs. An optional `name` query parameter
+ * identifies the worker in logs. */
+func serveWorkers(writer http.ResponseWriter, request *http.Request) {
+  if !*remoteWorkers {
+    http.Error(writer, "Remote workers aren't enabled.\n",
+      http.StatusNotFound)
+    return
+  }
+
+  // workers see every document, so without API keys only admins may be
+  // workers
+  role := ROLE_WORKER
+  if len(apiKeys) == 0 {
+    role = ROLE_ADMIN
+  }
+  if !requireRole(writer, request, role) { return }
+
+  socket, err := upgradeWebSocket(writer, request, MAX_REMOTE_MESSAGE_BYTES)
+  if err != nil { return }
+
+  name := request.URL.Query().Get("name")
+  if name == "" {
+    name = clientIP(request)
+  }
+
+  log := logger.With("worker", name, "address", clientIP(request),
+    "request", requestID(request))
+  log.Info("Remote worker connected")
+  serveWorker(log, socket)
+}
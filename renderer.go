@@ -0,0 +1,221 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/url"
+  "os/exec"
+  "sort"
+  "strings"
+)
+
+var rendererFallback = flag.String("renderer-fallback",
+  "ghostscript,poppler,mupdf",
+  "comma-separated order in which renderers are tried when one fails a page")
+
+// default and allowed resolution and JPEG quality of the large rendition,
+// which the other sizes are resized from
+const (
+  DEFAULT_DENSITY = 200
+  MIN_DENSITY = 36
+  MAX_DENSITY = 600
+  DEFAULT_QUALITY = 90
+  MIN_QUALITY = 10
+  MAX_QUALITY = 100
+)
+
+/* An engine that rasterizes PDF pages. */
+type renderer interface {
+  /* Renders page `pageNum` of the PDF at `pdfPath` as a JPEG at
+   * `outputPath`, at `density` DPI and JPEG quality `quality`, in grayscale
+   * if `gray`. */
+  renderPage(pdfPath string, pageNum int, outputPath string, density int,
+    quality int, gray bool) error
+}
+
+/* Renders with Ghostscript's jpeg device, or jpeggray for grayscale:
+ * in-process through libgs in builds with the gsapi tag, and otherwise by
+ * running gs. */
+type ghostscriptRenderer struct{}
+
+func (ghostscriptRenderer) renderPage(pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  return renderWithGhostscript(pdfPath, pageNum, outputPath, density,
+    quality, gray, nil)
+}
+
+/* Returns the Ghostscript device that writes JPEGs, in grayscale if
+ * `gray`. */
+func ghostscriptDevice(gray bool) string {
+  if gray { return "jpeggray" }
+  return "jpeg"
+}
+
+/* Returns the Ghostscript command that renders page `pageNum` of the PDF at
+ * `pdfPath` to `outputPath`. `extraArgs`, from ghostscriptArgs, come first,
+ * so they can't override the flags that follow. */
+func ghostscriptCommand(pdfPath string, pageNum int, outputPath string,
+    density int, quality int, gray bool, extraArgs []string) *exec.Cmd {
+  // convert a single page at a time with the correct output JPEG path
+  args := append([]string{}, extraArgs...)
+  args = append(args, "-dNOPAUSE", "-sDEVICE=" + ghostscriptDevice(gray),
+    fmt.Sprintf("-dFirstPage=%d", pageNum),
+    fmt.Sprintf("-dLastPage=%d", pageNum),
+    fmt.Sprintf("-sOutputFile=%s", outputPath),
+    fmt.Sprintf("-dJPEGQ=%d", quality),
+    fmt.Sprintf("-r%d", density), "-q", pdfPath, "-c", "quit")
+  return toolCommand("gs", args...)
+}
+
+/* Renders with Poppler's pdftoppm. */
+type popplerRenderer struct{}
+
+func (popplerRenderer) renderPage(pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  // pdftoppm appends the extension to the output prefix itself
+  page := fmt.Sprintf("%d", pageNum)
+  args := []string{"-jpeg", "-jpegopt", fmt.Sprintf("quality=%d", quality),
+    "-r", fmt.Sprintf("%d", density), "-f", page, "-l", page, "-singlefile"}
+  if gray { args = append(args, "-gray") }
+  args = append(args, pdfPath, strings.TrimSuffix(outputPath, ".jpg"))
+  return runTool(toolCommand("pdftoppm", args...))
+}
+
+/* Renders with MuPDF: in-process through go-fitz in builds with the fitz
+ * tag, and otherwise by running mutool. */
+type mupdfRenderer struct{}
+
+func (mupdfRenderer) renderPage(pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool) error {
+  return renderWithMuPDF(pdfPath, pageNum, outputPath, density, quality,
+    gray)
+}
+
+// available renderers, by the name clients select them with
+var renderers = map[string]renderer{
+  RENDERER_GHOSTSCRIPT: ghostscriptRenderer{},
+  "poppler": popplerRenderer{},
+  "mupdf": mupdfRenderer{},
+}
+
+/* Returns an error unless `names`, a comma-separated list, only names known
+ * renderers. `key` describes where the list came from in errors. */
+func validateRendererNames(names string, key string) error {
+  for _, name := range strings.Split(names, ",") {
+    if _, ok := renderers[strings.TrimSpace(name)]; !ok {
+      return errors.New(fmt.Sprintf("Unknown renderer '%s' in %s.\n",
+        name, key))
+    }
+  }
+  return nil
+}
+
+/* Returns the renderer preferred in the `renderer` key of `form`, or "" to
+ * just follow -renderer-fallback. */
+func parseRenderer(form url.Values) (string, error) {
+  name, err := optionalFormValue(form, "renderer")
+  if err != nil || name == "" { return "", err }
+
+  if _, ok := renderers[name]; !ok {
+    names := []string{}
+    for known := range renderers {
+      names = append(names, "'" + known + "'")
+    }
+    sort.Strings(names)
+    return "", errors.New("The 'renderer' key must be one of " +
+      strings.Join(names, ", ") + ".\n")
+  }
+  return name, nil
+}
+
+/* Returns the DPI to render at for `params`. */
+func renderDensity(params conversionParams) int {
+  if params.Density == 0 { return DEFAULT_DENSITY }
+  return params.Density
+}
+
+/* Returns the JPEG quality to render at for `params`. */
+func renderQuality(params conversionParams) int {
+  if params.Quality == 0 { return DEFAULT_QUALITY }
+  return params.Quality
+}
+
+/* Returns the names of the renderers to try, in order: `preferred` if
+ * given, then the rest of -renderer-fallback. */
+func rendererOrder(preferred string) []string {
+  order := []string{}
+  if preferred != "" {
+    order = append(order, preferred)
+  }
+
+  for _, name := range strings.Split(*rendererFallback, ",") {
+    name = strings.TrimSpace(name)
+    if name != preferred {
+      order = append(order, name)
+    }
+  }
+  return order
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath`, trying
+ * each renderer in turn until one succeeds, so one engine's bugs don't fail
+ * the page. Strict conversions and those with ghostscriptArgs only try
+ * Ghostscript, DJVU documents only ddjvu, and images only re-encoding.
+ * Returns the name of the renderer that succeeded, or the last error if none
+ * did. */
+func renderPageWithFallback(log *slog.Logger, params conversionParams,
+    pdfPath string, pageNum int, outputPath string) (string, error) {
+  var err error
+
+  // no PDF renderer can read DJVU, so it has a renderer of its own
+  if params.SourceFormat == SOURCE_DJVU {
+    err = djvuRenderer{}.renderPage(pdfPath, pageNum, outputPath,
+      renderDensity(params), renderQuality(params), params.Grayscale)
+    if err != nil { return "", err }
+    return RENDERER_DJVU, nil
+  }
+
+  // nor image, whose pages are already rasterized
+  if isRasterFormat(params.SourceFormat) {
+    err = rasterRenderer{params.SourceFormat}.renderPage(pdfPath, pageNum,
+      outputPath, renderDensity(params), renderQuality(params),
+      params.Grayscale)
+    if err != nil { return "", err }
+    return RENDERER_RASTER, nil
+  }
+
+  if params.Strict {
+    err = renderPageStrictly(log, pdfPath, pageNum, outputPath,
+      renderDensity(params), renderQuality(params), params.Grayscale,
+      params.GhostscriptArgs)
+    if err != nil { return "", err }
+    return RENDERER_GHOSTSCRIPT, nil
+  }
+
+  // no other renderer would honor the flags
+  if len(params.GhostscriptArgs) > 0 {
+    err = renderWithGhostscript(pdfPath, pageNum, outputPath,
+      renderDensity(params), renderQuality(params), params.Grayscale,
+      params.GhostscriptArgs)
+    if err != nil { return "", err }
+    return RENDERER_GHOSTSCRIPT, nil
+  }
+
+  for _, name := range rendererOrder(params.Renderer) {
+    engine := renderers[name]
+    if name == RENDERER_REMOTE {
+      engine = remoteRenderer{params.PDFDigest}
+    }
+
+    err = engine.renderPage(pdfPath, pageNum, outputPath,
+      renderDensity(params), renderQuality(params), params.Grayscale)
+    if err == nil { return name, nil }
+
+    log.Warn("Renderer failed", "renderer", name, "page", pageNum,
+      errorAttr(err))
+  }
+
+  return "", err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+/* What POST /repair did: the consistency check it ran first, and the
+ * renditions it then regenerated. */
+type repairResponse struct {
+  JobID string `json:"jobId"`
+  Check consistencyReport `json:"check"`
+  Repaired []objectProblem `json:"repaired"`
+}
+
+/* Returns the conversion parameters, pages, and digests of the document to
+ * repair, described by `request`, whose form must have been parsed: either
+ * its manifest in `s3ManifestPath`
+ * (plus `sourceKey` if its source is encrypted), or the parameters of its
+ * original conversion plus `numPages` and optionally `pages`. Documents
+ * converted from uploaded PDFs need the latter, with the PDF uploaded
+ * again. */
+func parseRepairTarget(bucket *s3.Bucket,
+    request *http.Request) (conversionParams, []int, map[string]string,
+    error) {
+  manifestPath, err := optionalFormValue(request.Form, "s3ManifestPath")
+  if err != nil { return conversionParams{}, nil, nil, err }
+
+  if manifestPath == "" {
+    params, err := parseConversionParams(request)
+    if err != nil { return params, nil, nil, err }
+
+    pageNums, err := parseCheckPages(request.Form)
+    return params, pageNums, nil, err
+  }
+
+  params, pageNums, checksums, err := parseCheckTarget(bucket,
+    url.Values{"s3ManifestPath": {manifestPath}})
+  if err != nil { return params, nil, nil, err }
+
+  if params.S3PDFPath == "" {
+    return params, nil, nil, errors.New("The document's PDF was uploaded, " +
+      "so it must be uploaded again to repair it.\n")
+  }
+
+  // we never store source keys, so encrypted sources need theirs again
+  sourceKey, err := optionalFormValue(request.Form, "sourceKey")
+  if err != nil { return params, nil, nil, err }
+
+  if params.SourceEncryption != "" || sourceKey != "" {
+    err = parseSourceEncryptionParams(url.Values{
+      "sourceEncryption": {params.SourceEncryption},
+      "sourceKey": {sourceKey},
+    }, &params)
+  }
+  return params, pageNums, checksums, err
+}
+
+/* Re-renders the pages of the PDF described by `params` that have
+ * `problems` as `job`, and re-uploads only the renditions that were
+ * missing or corrupt. */
+func runRepair(job *job, bucket *s3.Bucket, params conversionParams,
+    damagedPages []int, problems []objectProblem) error {
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return err }
+  params.SourceFormat = format
+
+  params, err = fetchWatermark(job, bucket, params)
+  if err != nil { return err }
+  params = detectPageRotations(job, params, pdfPath)
+
+  numPages, err := countPages(pdfPath, format)
+  if err != nil { return err }
+
+  for _, pageNum := range damagedPages {
+    if pageNum > numPages {
+      return errors.New(fmt.Sprintf("Page %d is out of range; the PDF has " +
+        "%d pages.\n", pageNum, numPages))
+    }
+  }
+
+  job.setPages(damagedPages, true)
+  release := admitToScratch(job, params, pdfPath, damagedPages)
+  defer release()
+
+  jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath :=
+    scratchJPEGPaths(job.id, params)
+
+  job.setState(JOB_CONVERTING)
+  err = convertPDFToJPEGs(job, params, pdfPath, jpegPath, smallJPEGPath,
+    largeJPEGPath, darkJPEGPath, damagedPages)
+  if err != nil { return err }
+
+  scratchPaths := map[string]string{TIER_NORMAL: jpegPath,
+    TIER_SMALL: smallJPEGPath, TIER_LARGE: largeJPEGPath,
+    TIER_DARK: darkJPEGPath}
+  if len(params.Sizes) > 0 {
+    scratchPaths = scratchSizePaths(job.id, params)
+  }
+  s3Paths := s3PathsByTier(params)
+
+  job.setState(JOB_UPLOADING)
+  for _, problem := range problems {
+    err = uploadJPEGToS3(job, bucket, params, scratchPaths[problem.Tier],
+      s3Paths[problem.Tier], problem.PageNum)
+    if err != nil { return err }
+  }
+
+  for _, pageNum := range damagedPages {
+    job.pageUploaded(pageNum)
+  }
+  return updateManifestChecksums(bucket, params.S3ManifestPath,
+    job.uploadedChecksums())
+}
+
+/* Records the new `checksums` of re-uploaded renditions in the manifest at
+ * `manifestPath`, so later consistency checks expect them. Does nothing if
+ * there's no manifest. */
+func updateManifestChecksums(bucket *s3.Bucket, manifestPath string,
+    checksums map[string]string) error {
+  if manifestPath == "" || len(checksums) == 0 { return nil }
+
+  manifest, err := readManifest(bucket, manifestPath)
+  if isS3NotFound(err) { return nil }
+  if err != nil { return err }
+
+  if manifest.Checksums == nil {
+    manifest.Checksums = map[string]string{}
+  }
+  for key, digest := range checksums {
+    manifest.Checksums[key] = digest
+  }
+
+  manifest.Params.S3ManifestPath = manifestPath
+  return writeManifest(bucket, manifest)
+}
+
+/* Handles POST /repair: checks a converted document's renditions like
+ * /check, then re-renders and re-uploads only those that are missing,
+ * empty, or corrupt. */
+func repairDocument(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+
+  var err error
+  var params conversionParams
+  response := repairResponse{JobID: jobID, Repaired: []objectProblem{}}
+  startTime := time.Now()
+  defer func() {
+    job.finish(err)
+    recordInDataLake(job, params)
+    cleanupScratch(jobID)
+    auditConversion(request, jobID, len(response.Check.DamagedPages),
+      startTime, err)
+  }()
+
+  err = parseUploadForm(writer, request, jobID)
+  if err == http.ErrNotMultipart {
+    err = nil
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  bucket, err := connectToRequestBucket(request.Form, bucketName, regionName)
+  if err != nil {
+    writeCheckError(writer, err)
+    return
+  }
+
+  params, pageNums, checksums, err := parseRepairTarget(bucket, request)
+  if err != nil {
+    writeCheckError(writer, err)
+    return
+  }
+
+  params = useUploadedPDF(job, params)
+
+  response.Check, err = checkRenditions(bucket, params, pageNums, checksums)
+  if handleError(err, writer) { return }
+
+  if !response.Check.Consistent {
+    err = runRepair(job, bucket, params, response.Check.DamagedPages,
+      response.Check.Problems)
+    if handleError(err, writer) { return }
+    response.Repaired = response.Check.Problems
+  }
+
+  job.logger().Info("Repair finished",
+    "renditions", len(response.Repaired))
+  writeJSON(writer, http.StatusOK, response)
+}
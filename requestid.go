@@ -0,0 +1,44 @@
+package main
+
+import (
+  "net/http"
+)
+
+// header carrying the ID that correlates a request across systems
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// longest incoming request ID we honor; longer ones are replaced
+const MAX_REQUEST_ID_LENGTH = 128
+
+/* Returns true if `id`, from a client, is fit to be logged and echoed back:
+ * non-empty, not too long, and printable ASCII without spaces. */
+func isValidRequestID(id string) bool {
+  if id == "" || len(id) > MAX_REQUEST_ID_LENGTH { return false }
+
+  for i := 0; i < len(id); i = i + 1 {
+    if id[i] <= ' ' || id[i] > '~' { return false }
+  }
+  return true
+}
+
+/* Wraps `handler` so every request has an ID in its X-Request-ID header,
+ * honoring the client's if valid and generating one otherwise. The ID is
+ * echoed in the response, so clients can quote it when reporting problems. */
+func withRequestID(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(writer http.ResponseWriter,
+      request *http.Request) {
+    id := request.Header.Get(REQUEST_ID_HEADER)
+    if !isValidRequestID(id) {
+      id = newID()
+      request.Header.Set(REQUEST_ID_HEADER, id)
+    }
+
+    writer.Header().Set(REQUEST_ID_HEADER, id)
+    handler.ServeHTTP(writer, request)
+  })
+}
+
+/* Returns the ID of `request`, as set by `withRequestID`. */
+func requestID(request *http.Request) string {
+  return request.Header.Get(REQUEST_ID_HEADER)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "net/http"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var rerenderPause = flag.Duration("rerender-pause", 5 * time.Second,
+  "pause between batch re-renders, leaving capacity for regular conversions")
+
+// most re-renders that may be waiting at once
+const MAX_QUEUED_RERENDERS = 10000
+
+// tenant name that re-render jobs are attributed to
+const TENANT_RERENDER = "rerender"
+
+// most keys to request per S3 list call
+const MAX_LIST_KEYS = 1000
+
+/* A document in `bucket` to re-render with the current pipeline, tracked as
+ * `job`. If `resize` isn't nil, only the size it names is regenerated, at
+ * its dimensions. */
+type rerenderTask struct {
+  job *job
+  bucket *s3.Bucket
+  params conversionParams
+  resize *sizeProfile
+}
+
+// re-renders waiting to be processed, one at a time
+var rerenderQueue = make(chan rerenderTask, MAX_QUEUED_RERENDERS)
+
+/* A manifest that was found under the requested prefix and queued. */
+type queuedRerender struct {
+  JobID string `json:"jobId"`
+  S3ManifestPath string `json:"s3ManifestPath"`
+}
+
+/* A manifest that couldn't be read or queued. */
+type failedRerender struct {
+  S3ManifestPath string `json:"s3ManifestPath"`
+  Error string `json:"error"`
+}
+
+/* Response of POST /admin/rerender. */
+type rerenderResponse struct {
+  Queued []queuedRerender `json:"queued"`
+  UpToDate int `json:"upToDate"`
+  Failed []failedRerender `json:"failed"`
+}
+
+/* Processes queued re-renders forever. Re-renders are batch work: they run
+ * one at a time with a pause in between, so they never crowd out regular
+ * conversions. */
+func processRerenders() {
+  for task := range rerenderQueue {
+    // once shutting down, queued re-renders are failed, not started
+    if !backgroundWork.start() {
+      task.job.finish(errShuttingDown)
+      continue
+    }
+
+    var err error
+    if task.resize != nil {
+      err = runResizeMigration(task.job, task.bucket, task.params,
+        *task.resize)
+    } else {
+      _, err = runConversion(task.job, task.bucket, task.params)
+    }
+
+    // transient failures go back on the queue after a jittered delay
+    retryTask := task
+    if scheduleRetry(task.job, err, func() { rerenderQueue <- retryTask }) {
+      // the retry will finish the job
+    } else if err != nil {
+      task.job.finish(err)
+      recordInDataLake(task.job, task.params)
+      cleanupScratch(task.job.id)
+      task.job.logger().Error("Re-render failed",
+        "key", task.params.S3PDFPath, errorAttr(err))
+    } else {
+      task.job.finish(err)
+      recordInDataLake(task.job, task.params)
+      cleanupScratch(task.job.id)
+      task.job.logger().Info("Re-render finished",
+        "key", task.params.S3PDFPath)
+    }
+    backgroundWork.end()
+
+    time.Sleep(*rerenderPause)
+  }
+}
+
+/* Handles POST /admin/rerender. Finds every manifest under the
+ * `s3ManifestPrefix` form key (in the server's bucket, or the one chosen
+ * with `s3Bucket`) that was produced by an older pipeline version and queues
+ * its document for re-rendering. Each re-render is a job that can
+ * be followed at /jobs/{id}. */
+func rerender(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireAdmin(writer, request) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  prefix, err := requireFormValue(request.Form, "s3ManifestPrefix",
+    "a manifest prefix")
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  bucket, err := connectToRequestBucket(request.Form, bucketName, regionName)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  response := rerenderResponse{Queued: []queuedRerender{},
+    Failed: []failedRerender{}}
+
+  marker := ""
+  for {
+    var list *s3.ListResp
+    err := withS3Retries(logger, S3_OP_LIST, func() error {
+      var err error
+      list, err = bucket.List(prefix, "", marker, MAX_LIST_KEYS)
+      return err
+    })
+    if handleError(err, writer) { return }
+
+    for _, key := range list.Contents {
+      if !isTopLevelManifestKey(key.Key) { continue }
+
+      manifest, err := readManifest(bucket, key.Key)
+      if err != nil {
+        response.Failed = append(response.Failed,
+          failedRerender{key.Key, err.Error()})
+        continue
+      }
+
+      // parts are re-rendered along with the manifest they were assembled
+      // into, not on their own
+      if manifest.PipelineVersion >= PIPELINE_VERSION ||
+          manifest.Params.ManifestPart {
+        response.UpToDate += 1
+        continue
+      }
+
+      // we never store source keys, so encrypted sources must be resubmitted
+      if manifest.Params.SourceEncryption != "" {
+        response.Failed = append(response.Failed, failedRerender{key.Key,
+          "Encrypted sources can't be re-rendered without their key.\n"})
+        continue
+      }
+
+      // nor uploaded PDFs, which were never in S3
+      if manifest.Params.S3PDFPath == "" {
+        response.Failed = append(response.Failed, failedRerender{key.Key,
+          "Uploaded sources can't be re-rendered; resubmit them.\n"})
+        continue
+      }
+
+      // the re-render rewrites this manifest with the current version
+      params := manifest.Params
+      params.S3ManifestPath = key.Key
+      job := newJob(newID(), TENANT_RERENDER, requestID(request))
+
+      select {
+      case rerenderQueue <- rerenderTask{job, bucket, params, nil}:
+        prefetches.add(job, bucket, params)
+        response.Queued = append(response.Queued,
+          queuedRerender{job.id, key.Key})
+      default:
+        err = errors.New("Re-render queue is full.\n")
+        job.finish(err)
+        response.Failed = append(response.Failed,
+          failedRerender{key.Key, err.Error()})
+      }
+    }
+
+    if !list.IsTruncated || len(list.Contents) == 0 { break }
+    marker = list.Contents[len(list.Contents) - 1].Key
+  }
+
+  writeJSON(writer, http.StatusOK, response)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+  "image"
+  "image/draw"
+  "image/jpeg"
+  "math"
+  "os"
+)
+
+// the ImageMagick tool that resizes and inverts renditions when present
+const EXTERNAL_RESIZER = "convert"
+
+// the health check result while ImageMagick is missing
+const RESIZER_DEGRADED = "degraded: external resizer unavailable"
+
+// quality of JPEGs written in process, matching ImageMagick's default
+const FALLBACK_JPEG_QUALITY = 92
+
+/* Returns true if ImageMagick is on the PATH. It's looked up on every call,
+ * so a fixed installation is picked up without a restart. */
+func hasExternalResizer() bool {
+  return lookTool(EXTERNAL_RESIZER) == nil
+}
+
+/* Logs a warning at startup if renditions will be resized in process. */
+func checkExternalResizer() {
+  if !hasExternalResizer() {
+    logger.Warn("ImageMagick is unavailable; resizing in process",
+      "tool", EXTERNAL_RESIZER)
+  }
+}
+
+/* Returns the image in the JPEG at `path`, converted to RGBA. */
+func readRGBAJPEG(path string) (*image.RGBA, error) {
+  file, err := os.Open(path)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  decoded, err := jpeg.Decode(file)
+  if err != nil { return nil, err }
+
+  bounds := decoded.Bounds()
+  rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(rgba, rgba.Bounds(), decoded, bounds.Min, draw.Src)
+  return rgba, nil
+}
+
+/* Saves `img` as a JPEG at `path`. */
+func writeJPEG(path string, img image.Image) error {
+  file, err := os.Create(path)
+  if err != nil { return err }
+
+  err = jpeg.Encode(file, img, &jpeg.Options{Quality: FALLBACK_JPEG_QUALITY})
+  if err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
+
+/* One source pixel's contribution to a destination pixel. */
+type resampleWeight struct {
+  index int
+  weight float64
+}
+
+/* Returns, for each of `dstSize` pixels, the source pixels among `srcSize`
+ * it covers and by how much, so each destination pixel is the area average
+ * of its footprint. */
+func resampleWeights(srcSize int, dstSize int) [][]resampleWeight {
+  scale := float64(srcSize) / float64(dstSize)
+  weights := make([][]resampleWeight, dstSize)
+
+  for i := 0; i < dstSize; i = i + 1 {
+    start := float64(i) * scale
+    end := start + scale
+
+    total := 0.0
+    for j := int(start); j < srcSize && float64(j) < end; j = j + 1 {
+      overlap := math.Min(end, float64(j + 1)) - math.Max(start, float64(j))
+      if overlap <= 0 { continue }
+      weights[i] = append(weights[i], resampleWeight{j, overlap})
+      total += overlap
+    }
+
+    for k := range weights[i] {
+      weights[i][k].weight /= total
+    }
+  }
+  return weights
+}
+
+/* Returns `src` scaled to `width` by `height` with an area-averaging
+ * filter, resampling rows and then columns. */
+func scaleImage(src *image.RGBA, width int, height int) *image.RGBA {
+  srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+  columns := resampleWeights(srcWidth, width)
+  rows := resampleWeights(srcHeight, height)
+
+  // resample each row horizontally into floats, 4 channels per pixel
+  wide := make([]float64, width * srcHeight * 4)
+  for y := 0; y < srcHeight; y = y + 1 {
+    for x, column := range columns {
+      out := wide[(y * width + x) * 4:]
+      for _, w := range column {
+        pixel := src.Pix[y * src.Stride + w.index * 4:]
+        for c := 0; c < 4; c = c + 1 {
+          out[c] += float64(pixel[c]) * w.weight
+        }
+      }
+    }
+  }
+
+  // then each column vertically
+  dst := image.NewRGBA(image.Rect(0, 0, width, height))
+  for y, row := range rows {
+    for x := 0; x < width; x = x + 1 {
+      var sum [4]float64
+      for _, w := range row {
+        pixel := wide[(w.index * width + x) * 4:]
+        for c := 0; c < 4; c = c + 1 {
+          sum[c] += pixel[c] * w.weight
+        }
+      }
+
+      out := dst.Pix[y * dst.Stride + x * 4:]
+      for c := 0; c < 4; c = c + 1 {
+        out[c] = uint8(math.Min(255, math.Max(0, math.Round(sum[c]))))
+      }
+    }
+  }
+  return dst
+}
+
+/* Returns the largest size with the aspect ratio of `width` by `height`
+ * that fits within `maxWidth` by `maxHeight`, as ImageMagick's -resize
+ * computes it. */
+func fitWithin(width int, height int, maxWidth int,
+    maxHeight int) (int, int) {
+  scale := math.Min(float64(maxWidth) / float64(width),
+    float64(maxHeight) / float64(height))
+
+  fitWidth := int(math.Round(float64(width) * scale))
+  fitHeight := int(math.Round(float64(height) * scale))
+  if fitWidth < 1 { fitWidth = 1 }
+  if fitHeight < 1 { fitHeight = 1 }
+  return fitWidth, fitHeight
+}
+
+/* Does what resizeAndSaveImage does, without ImageMagick. Like it, keeps
+ * grayscale JPEGs grayscale. */
+func resizeImageInProcess(jpegPath string, resizedJPEGPath string,
+    maxWidth int, maxHeight int) error {
+  src, err := readRGBAJPEG(jpegPath)
+  if err != nil { return err }
+
+  gray, err := isGrayscaleJPEG(jpegPath)
+  if err != nil { return err }
+
+  width, height := fitWithin(src.Bounds().Dx(), src.Bounds().Dy(), maxWidth,
+    maxHeight)
+  var resized image.Image = scaleImage(src, width, height)
+  if gray {
+    grayImage := image.NewGray(resized.Bounds())
+    draw.Draw(grayImage, grayImage.Bounds(), resized, image.Point{}, draw.Src)
+    resized = grayImage
+  }
+  return writeJPEG(resizedJPEGPath, resized)
+}
+
+/* Returns the sRGB component `value`, in [0, 1], in linear light. */
+func linearize(value float64) float64 {
+  if value <= 0.04045 { return value / 12.92 }
+  return math.Pow((value + 0.055) / 1.055, 2.4)
+}
+
+/* Returns the linear component `value` in sRGB, in [0, 1]. */
+func delinearize(value float64) float64 {
+  if value <= 0.0031308 { return value * 12.92 }
+  return 1.055 * math.Pow(value, 1 / 2.4) - 0.055
+}
+
+/* The CIE Lab companding function and its inverse. */
+func labF(t float64) float64 {
+  if t > 216.0 / 24389.0 { return math.Cbrt(t) }
+  return (24389.0 / 27.0 * t + 16) / 116
+}
+
+func labFInverse(t float64) float64 {
+  if t * t * t > 216.0 / 24389.0 { return t * t * t }
+  return (116 * t - 16) * 27.0 / 24389.0
+}
+
+/* Returns the sRGB color `r`, `g`, `b`, each in [0, 1], with its Lab
+ * lightness inverted (under D65). */
+func invertLightness(r float64, g float64, b float64) (float64, float64,
+    float64) {
+  r, g, b = linearize(r), linearize(g), linearize(b)
+
+  x := (0.4124564 * r + 0.3575761 * g + 0.1804375 * b) / 0.95047
+  y := 0.2126729 * r + 0.7151522 * g + 0.0721750 * b
+  z := (0.0193339 * r + 0.1191920 * g + 0.9503041 * b) / 1.08883
+
+  fx, fy, fz := labF(x), labF(y), labF(z)
+  lightness, a, bb := 116 * fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+
+  fy = (100 - lightness + 16) / 116
+  fx, fz = fy + a / 500, fy - bb / 200
+  x, y, z = labFInverse(fx) * 0.95047, labFInverse(fy),
+    labFInverse(fz) * 1.08883
+
+  r = 3.2404542 * x - 1.5371385 * y - 0.4985314 * z
+  g = -0.9692660 * x + 1.8760108 * y + 0.0415560 * z
+  b = 0.0556434 * x - 0.2040259 * y + 1.0572252 * z
+
+  clamp := func(value float64) float64 {
+    return math.Min(1, math.Max(0, value))
+  }
+  return delinearize(clamp(r)), delinearize(clamp(g)), delinearize(clamp(b))
+}
+
+/* Does what invertAndSaveImage does, without ImageMagick. */
+func invertImageInProcess(jpegPath string, darkJPEGPath string) error {
+  img, err := readRGBAJPEG(jpegPath)
+  if err != nil { return err }
+
+  // compress into a dark gray to light gray range, like +level 7%,90%
+  level := func(value float64) uint8 {
+    return uint8(math.Round((0.07 + value * 0.83) * 255))
+  }
+
+  for i := 0; i < len(img.Pix); i = i + 4 {
+    r, g, b := invertLightness(float64(img.Pix[i]) / 255,
+      float64(img.Pix[i + 1]) / 255, float64(img.Pix[i + 2]) / 255)
+    img.Pix[i], img.Pix[i + 1], img.Pix[i + 2] = level(r), level(g), level(b)
+  }
+  return writeJPEG(darkJPEGPath, img)
+}
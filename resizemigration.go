@@ -0,0 +1,286 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "launchpad.net/goamz/s3"
+)
+
+/* Response of POST /admin/resize. `Skipped` counts manifests without the
+ * size, or converted with another template than the one given. */
+type resizeMigrationResponse struct {
+  Size sizeProfile `json:"size"`
+  Queued []queuedRerender `json:"queued"`
+  UpToDate int `json:"upToDate"`
+  Skipped int `json:"skipped"`
+  Failed []failedRerender `json:"failed"`
+}
+
+/* Returns the size to regenerate described by `form`: the size named in
+ * `size`, at the `dimensions` given (WIDTHxHEIGHT or full), or else those
+ * the named template in `template` now gives it. Also returns the
+ * template's name, if any. The size's path is left empty, since each
+ * document keeps its own. */
+func parseResizeMigration(form url.Values) (sizeProfile, string, error) {
+  name, err := requireFormValue(form, "size", "a size name")
+  if err != nil { return sizeProfile{}, "", err }
+
+  dimensions, err := optionalFormValue(form, "dimensions")
+  if err != nil { return sizeProfile{}, "", err }
+
+  templateName, err := optionalFormValue(form, "template")
+  if err != nil { return sizeProfile{}, "", err }
+
+  if (dimensions == "") == (templateName == "") {
+    return sizeProfile{}, "", errors.New("Must specify the size's new " +
+      "dimensions in exactly one of the 'dimensions' and 'template' keys.\n")
+  }
+
+  sizes := name + ":" + dimensions
+  if templateName != "" {
+    template, ok := templates.get(templateName)
+    if !ok {
+      return sizeProfile{}, "", errors.New(fmt.Sprintf("There's no " +
+        "template named '%s'.\n", templateName))
+    }
+    sizes = template.Values["sizes"]
+  }
+
+  profiles, err := parseSizes(url.Values{"sizes": {sizes}})
+  if err != nil { return sizeProfile{}, "", err }
+
+  for _, profile := range profiles {
+    if profile.Name == name { return profile, templateName, nil }
+  }
+  return sizeProfile{}, "", errors.New(fmt.Sprintf("The template '%s' " +
+    "doesn't have a size named '%s'.\n", templateName, name))
+}
+
+/* Returns `params` with the size named like `resize` given its dimensions,
+ * and the index of that size, or -1 if `params` doesn't have it. */
+func resizedParams(params conversionParams,
+    resize sizeProfile) (conversionParams, int) {
+  for i, profile := range params.Sizes {
+    if profile.Name != resize.Name { continue }
+
+    sizes := append([]sizeProfile{}, params.Sizes...)
+    sizes[i].Width, sizes[i].Height = resize.Width, resize.Height
+    params.Sizes = sizes
+    return params, i
+  }
+  return params, -1
+}
+
+/* Regenerates only the size `resize` names of the document whose manifest
+ * is at `params.S3ManifestPath` as `job`, at `resize`'s dimensions,
+ * re-rendering each page it has and uploading over that size's renditions.
+ * Its other sizes are left untouched. The manifest then records the new
+ * dimensions and checksums. */
+func runResizeMigration(job *job, bucket *s3.Bucket, params conversionParams,
+    resize sizeProfile) error {
+  current, err := readManifest(bucket, params.S3ManifestPath)
+  if err != nil { return err }
+
+  params, index := resizedParams(params, resize)
+  if index == -1 {
+    return errors.New(fmt.Sprintf("The document no longer has a size " +
+      "named '%s'.\n", resize.Name))
+  }
+  profile := params.Sizes[index]
+
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return err }
+  params.SourceFormat = format
+
+  params, err = fetchWatermark(job, bucket, params)
+  if err != nil { return err }
+  params = detectPageRotations(job, params, pdfPath)
+
+  // the renditions of other sizes must still match the pages
+  numPages, err := countPages(pdfPath, format)
+  if err != nil { return err }
+  if numPages != current.NumPages {
+    return errors.New(fmt.Sprintf("The source now has %d pages rather " +
+      "than %d, so the document must be re-rendered whole.\n", numPages,
+      current.NumPages))
+  }
+
+  pageNums := current.RenderedPages
+  if pageNums == nil {
+    pageNums = samplePages(current.NumPages, 0)
+  }
+
+  job.setPages(pageNums, true)
+  release := admitToScratch(job, params, pdfPath, pageNums)
+  defer release()
+
+  // only the one size is rendered
+  sizeParams := params
+  sizeParams.Sizes = []sizeProfile{profile}
+  jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath :=
+    scratchJPEGPaths(job.id, sizeParams)
+
+  job.setState(JOB_CONVERTING)
+  err = convertPDFToJPEGs(job, sizeParams, pdfPath, jpegPath, smallJPEGPath,
+    largeJPEGPath, darkJPEGPath, pageNums)
+  if err != nil { return err }
+
+  job.setState(JOB_UPLOADING)
+  sizePaths := scratchSizePaths(job.id, sizeParams)
+  for _, pageNum := range pageNums {
+    err = uploadJPEGToS3(job, bucket, sizeParams, sizePaths[profile.Name],
+      profile.S3Path, pageNum)
+    if err != nil { return err }
+    job.pageUploaded(pageNum)
+  }
+
+  // re-read, so changes made while rendering aren't lost
+  updated, err := readManifest(bucket, params.S3ManifestPath)
+  if err != nil { return err }
+
+  updated.Params, index = resizedParams(updated.Params, resize)
+  if index == -1 {
+    return errors.New(fmt.Sprintf("The document's size '%s' was removed " +
+      "while it was regenerated.\n", resize.Name))
+  }
+  if updated.Checksums == nil {
+    updated.Checksums = map[string]string{}
+  }
+  for key, digest := range job.uploadedChecksums() {
+    updated.Checksums[key] = digest
+  }
+
+  updated.Params.S3ManifestPath = params.S3ManifestPath
+  return writeManifest(bucket, updated)
+}
+
+/* Handles POST /admin/resize, which regenerates one size of existing
+ * documents at new dimensions, e.g. after their template's thumbnails
+ * grew. Finds every manifest under the `s3ManifestPrefix` form key (in the
+ * server's bucket, or the one chosen with `s3Bucket`) with the size named
+ * in `size`, and queues its document for regeneration of that size alone,
+ * at the `dimensions` given or those `template` now has. With `template`,
+ * only documents converted with that template are regenerated. Each
+ * regeneration is a batch job, run one at a time with re-renders, that can
+ * be followed at /jobs/{id}. */
+func serveResizeMigration(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireAdmin(writer, request) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  prefix, err := requireFormValue(request.Form, "s3ManifestPrefix",
+    "a manifest prefix")
+  var resize sizeProfile
+  var templateName string
+  if err == nil {
+    resize, templateName, err = parseResizeMigration(request.Form)
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  bucket, err := connectToRequestBucket(request.Form, bucketName, regionName)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  response := resizeMigrationResponse{Size: resize,
+    Queued: []queuedRerender{}, Failed: []failedRerender{}}
+
+  marker := ""
+  for {
+    var list *s3.ListResp
+    err := withS3Retries(logger, S3_OP_LIST, func() error {
+      var err error
+      list, err = bucket.List(prefix, "", marker, MAX_LIST_KEYS)
+      return err
+    })
+    if handleError(err, writer) { return }
+
+    for _, key := range list.Contents {
+      if !isTopLevelManifestKey(key.Key) { continue }
+
+      manifest, err := readManifest(bucket, key.Key)
+      if err != nil {
+        response.Failed = append(response.Failed,
+          failedRerender{key.Key, err.Error()})
+        continue
+      }
+
+      // parts are regenerated along with the manifest they were assembled
+      // into, not on their own
+      _, index := resizedParams(manifest.Params, resize)
+      if index == -1 || manifest.Params.ManifestPart ||
+          (templateName != "" && manifest.Params.Template != templateName) {
+        response.Skipped += 1
+        continue
+      }
+
+      profile := manifest.Params.Sizes[index]
+      if profile.Width == resize.Width && profile.Height == resize.Height {
+        response.UpToDate += 1
+        continue
+      }
+
+      // their keys are derived from their sizes, so they can't change
+      if manifest.Params.Layout == LAYOUT_CONTENT_ADDRESSED {
+        response.Failed = append(response.Failed, failedRerender{key.Key,
+          "Content-addressed documents can't be regenerated in place; " +
+          "convert them again with the new size.\n"})
+        continue
+      }
+
+      // we never store source keys, so encrypted sources must be resubmitted
+      if manifest.Params.SourceEncryption != "" {
+        response.Failed = append(response.Failed, failedRerender{key.Key,
+          "Encrypted sources can't be regenerated without their key.\n"})
+        continue
+      }
+
+      // nor uploaded PDFs, which were never in S3
+      if manifest.Params.S3PDFPath == "" {
+        response.Failed = append(response.Failed, failedRerender{key.Key,
+          "Uploaded sources can't be regenerated; resubmit them.\n"})
+        continue
+      }
+
+      params := manifest.Params
+      params.S3ManifestPath = key.Key
+      job := newJob(newID(), TENANT_RERENDER, requestID(request))
+      task := rerenderTask{job: job, bucket: bucket, params: params,
+        resize: &resize}
+
+      select {
+      case rerenderQueue <- task:
+        prefetches.add(job, bucket, params)
+        response.Queued = append(response.Queued,
+          queuedRerender{job.id, key.Key})
+      default:
+        err = errors.New("Re-render queue is full.\n")
+        job.finish(err)
+        response.Failed = append(response.Failed,
+          failedRerender{key.Key, err.Error()})
+      }
+    }
+
+    if !list.IsTruncated || len(list.Contents) == 0 { break }
+    marker = list.Contents[len(list.Contents) - 1].Key
+  }
+
+  writeJSON(writer, http.StatusOK, response)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+  "fmt"
+  "image"
+  _ "image/jpeg"
+  "os"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// names of the sizes each page is rendered at
+const (
+  TIER_NORMAL = "normal"
+  TIER_SMALL = "small"
+  TIER_LARGE = "large"
+  TIER_DARK = "dark"
+)
+
+/* The pixel dimensions of a rendition. */
+type dimensions struct {
+  Width int `json:"width"`
+  Height int `json:"height"`
+}
+
+/* A single page: the renderer that rasterized it and the dimensions of its
+ * renditions, keyed by size. */
+type pageResult struct {
+  PageNum int `json:"pageNum"`
+  Renderer string `json:"renderer"`
+  Labels []string `json:"labels,omitempty"`
+  HandwritingRegions []handwritingRegion `json:"handwritingRegions,omitempty"`
+  Quality *pageQuality `json:"quality,omitempty"`
+  Dimensions map[string]dimensions `json:"dimensions"`
+}
+
+/* How long each stage of a conversion took. Pages are uploaded as they're
+ * converted, so `ConvertMS` includes uploads, and `UploadMS` only covers
+ * those left once every page was converted. */
+type conversionTiming struct {
+  FetchMS int64 `json:"fetchMS"`
+  ConvertMS int64 `json:"convertMS"`
+  UploadMS int64 `json:"uploadMS"`
+  TotalMS int64 `json:"totalMS"`
+}
+
+/* What a successful conversion produced, returned as JSON by `/` and
+ * included in the job's status. `Keys` lists the S3 keys written for each
+ * size and text format, and for the sprite sheet, and `URLs` presigned URLs
+ * for them if requested. If `Reused`, an identical content-addressed render,
+ * or one recorded in the ledger, already existed, so nothing was rendered
+ * and `Pages` is empty. An
+ * incremental conversion only renders (and lists) the pages after its first
+ * `UnchangedPages`. If the conversion replaced a manifest, `Diff` says how
+ * the pages changed since. */
+type conversionResult struct {
+  JobID string `json:"jobId"`
+  RequestID string `json:"requestId,omitempty"`
+  NumPages int `json:"numPages"`
+  RenderedPages []int `json:"renderedPages,omitempty"`
+  OutputPrefix string `json:"outputPrefix,omitempty"`
+  ManifestKey string `json:"manifestKey,omitempty"`
+  Reused bool `json:"reused,omitempty"`
+  UnchangedPages int `json:"unchangedPages,omitempty"`
+  Diff *manifestDiff `json:"diff,omitempty"`
+  Keys map[string][]string `json:"keys"`
+  URLs map[string][]string `json:"urls,omitempty"`
+  URLsExpireAt string `json:"urlsExpireAt,omitempty"`
+  Pages []pageResult `json:"pages"`
+  Timing conversionTiming `json:"timing"`
+}
+
+/* Returns the S3 key templates for each size produced for `params`: its
+ * own sizes, keyed by name, if it asks for them. */
+func s3PathsByTier(params conversionParams) map[string]string {
+  if len(params.Sizes) > 0 {
+    paths := map[string]string{}
+    for _, profile := range params.Sizes {
+      paths[profile.Name] = profile.S3Path
+    }
+    return paths
+  }
+
+  paths := map[string]string{
+    TIER_NORMAL: params.S3JPEGPath,
+    TIER_SMALL: params.S3SmallJPEGPath,
+    TIER_LARGE: params.S3LargeJPEGPath,
+  }
+  if params.S3DarkJPEGPath != "" {
+    paths[TIER_DARK] = params.S3DarkJPEGPath
+  }
+  return paths
+}
+
+/* Returns the dimensions of the JPEG at `path`. */
+func jpegDimensions(path string) (dimensions, error) {
+  file, err := os.Open(path)
+  if err != nil { return dimensions{}, err }
+  defer file.Close()
+
+  config, _, err := image.DecodeConfig(file)
+  if err != nil { return dimensions{}, err }
+  return dimensions{config.Width, config.Height}, nil
+}
+
+/* Returns the result of converting pages `pageNums` of a `numPages`-page
+ * PDF as `job` with `params` into `bucket`. `scratchPaths` holds the local
+ * JPEG path templates for each size, which are measured for the page
+ * dimensions; it's nil if an existing render was reused. */
+func newConversionResult(job *job, bucket *s3.Bucket,
+    params conversionParams, numPages int, pageNums []int,
+    scratchPaths map[string]string,
+    timing conversionTiming) (conversionResult, error) {
+  status := job.status()
+  result := conversionResult{
+    JobID: job.id,
+    RequestID: job.requestID,
+    NumPages: numPages,
+    RenderedPages: status.RenderedPages,
+    OutputPrefix: status.OutputPrefix,
+    ManifestKey: writtenManifestKey(params, job.id),
+    Reused: scratchPaths == nil,
+    Keys: map[string][]string{},
+    Pages: []pageResult{},
+    Timing: timing,
+  }
+
+  // extracted text is listed like another size
+  s3Paths := s3PathsByTier(params)
+  for format, s3Path := range s3TextPathsByFormat(params) {
+    s3Paths[format] = s3Path
+  }
+
+  // as are the sprite sheet and its index, each a single key
+  for name, s3Path := range s3SpritePaths(params) {
+    result.Keys[name] = []string{s3Path}
+  }
+
+  for tier, s3Path := range s3Paths {
+    keys := make([]string, len(pageNums))
+    for i, pageNum := range pageNums {
+      keys[i] = fmt.Sprintf(s3Path, pageNum)
+    }
+    result.Keys[tier] = keys
+  }
+
+  if params.Presign {
+    urls, expiresAt := presignKeys(bucket, params, result.Keys)
+    result.URLs = urls
+    result.URLsExpireAt = expiresAt.UTC().Format(time.RFC3339)
+  }
+
+  if scratchPaths == nil { return result, nil }
+
+  pageLabels := job.labelsByPage()
+  handwritingRegions := job.handwritingRegionsByPage()
+  pageQuality := job.pageQualityByPage()
+  for _, pageNum := range pageNums {
+    page := pageResult{PageNum: pageNum, Renderer: job.pageRenderer(pageNum),
+      Labels: pageLabels[pageNum],
+      HandwritingRegions: handwritingRegions[pageNum],
+      Dimensions: map[string]dimensions{}}
+    if quality, ok := pageQuality[pageNum]; ok {
+      page.Quality = &quality
+    }
+    for tier, scratchPath := range scratchPaths {
+      pageDimensions, err := jpegDimensions(fmt.Sprintf(scratchPath, pageNum))
+      if err != nil { return result, err }
+      page.Dimensions[tier] = pageDimensions
+    }
+    result.Pages = append(result.Pages, page)
+  }
+
+  return result, nil
+}
+
+/* Returns the milliseconds elapsed between `start` and `end`. */
+func millisecondsBetween(start time.Time, end time.Time) int64 {
+  return int64(end.Sub(start) / time.Millisecond)
+}
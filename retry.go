@@ -0,0 +1,110 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "io"
+  "math/rand"
+  "net"
+  "os/exec"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var jobMaxAttempts = flag.Int("job-max-attempts", 3,
+  "most times a queued job is attempted before it fails")
+var jobRetryDelay = flag.Duration("job-retry-delay", 30 * time.Second,
+  "base delay before retrying a failed job, doubled on each attempt")
+var jobRetryMaxDelay = flag.Duration("job-retry-max-delay", 10 * time.Minute,
+  "longest delay before retrying a failed job")
+var jobRetryOn = flag.String("job-retry-on", "s3,network,tool",
+  "comma-separated classes of error that cause a queued job to be retried")
+
+// classes of error a job can fail with; only some are worth retrying
+const (
+  ERROR_CLASS_S3 = "s3"
+  ERROR_CLASS_NETWORK = "network"
+  ERROR_CLASS_TOOL = "tool"
+  ERROR_CLASS_PERMANENT = "permanent"
+)
+
+/* Returns the class of `err`: a server-side S3 error, a network error, a
+ * crashed external tool (gs, convert, jpegtran), or anything else, which
+ * retrying won't fix. */
+func errorClass(err error) string {
+  if s3Err, ok := err.(*s3.Error); ok {
+    if s3Err.StatusCode >= 500 || isS3SlowDown(err) {
+      return ERROR_CLASS_S3
+    }
+    return ERROR_CLASS_PERMANENT
+  }
+
+  if _, ok := err.(net.Error); ok { return ERROR_CLASS_NETWORK }
+  if err == io.ErrUnexpectedEOF { return ERROR_CLASS_NETWORK }
+  if _, ok := err.(*exec.ExitError); ok { return ERROR_CLASS_TOOL }
+
+  return ERROR_CLASS_PERMANENT
+}
+
+/* Returns an error unless -job-retry-on lists only known error classes. */
+func validateRetryClasses() error {
+  for _, class := range strings.Split(*jobRetryOn, ",") {
+    class = strings.TrimSpace(class)
+    if class != "" && class != ERROR_CLASS_S3 &&
+        class != ERROR_CLASS_NETWORK && class != ERROR_CLASS_TOOL {
+      return errors.New("Unknown error class '" + class + "' in " +
+        "-job-retry-on.\n")
+    }
+  }
+  return nil
+}
+
+/* Returns true if a job that failed with `err` should be retried according
+ * to -job-retry-on. */
+func isRetryable(err error) bool {
+  class := errorClass(err)
+  for _, retryClass := range strings.Split(*jobRetryOn, ",") {
+    if strings.TrimSpace(retryClass) == class { return true }
+  }
+  return false
+}
+
+/* Returns how long to wait before retrying after failed attempt number
+ * `attempt`: an exponentially growing delay with full jitter, so jobs that
+ * failed together don't all retry together. */
+func retryDelay(attempt int) time.Duration {
+  delay := *jobRetryDelay
+  for i := 1; i < attempt && delay < *jobRetryMaxDelay; i = i + 1 {
+    delay *= 2
+  }
+  if delay > *jobRetryMaxDelay {
+    delay = *jobRetryMaxDelay
+  }
+  if delay <= 0 { return 0 }
+
+  return time.Duration(rand.Int63n(int64(delay)))
+}
+
+/* Decides what to do with `job` after an attempt that failed with `err`. If
+ * the error is retryable and attempts remain, schedules `requeue` to run
+ * after a jittered delay and returns true; the job stays unfinished until
+ * then. Otherwise, returns false and the caller should finish the job. */
+func scheduleRetry(job *job, err error, requeue func()) bool {
+  attempt := job.status().Attempts
+  if err == nil || attempt >= tunedInt(jobMaxAttempts) || !isRetryable(err) {
+    return false
+  }
+
+  delay := retryDelay(attempt)
+  job.retrying(err)
+  cleanupScratchForRetry(job.id)
+
+  job.logger().Warn("Attempt failed; retrying", "attempt", attempt,
+    "class", errorClass(err), "delay", delay.String(), errorAttr(err))
+  time.AfterFunc(delay, func() {
+    job.requeue()
+    requeue()
+  })
+  return true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/jpeg"
+  "net/url"
+  "os"
+)
+
+// rotations a request can force with the `rotate` key, in degrees clockwise
+var ROTATIONS = map[string]int{"0": 0, "90": 90, "180": 180, "270": 270}
+
+/* How a page of the source PDF is meant to be displayed: its /Rotate,
+ * normalized to 0, 90, 180, or 270, and its size in points once turned. */
+type pageRotation struct {
+  rotate int
+  width float64
+  height float64
+}
+
+/* Returns the rotation forced by the `rotate` key of `form`: "0", "90",
+ * "180", or "270" degrees clockwise from the page's unrotated orientation,
+ * replacing its /Rotate. Returns "" for "auto", the default, which turns
+ * each page as its /Rotate says. */
+func parseRotate(form url.Values) (string, error) {
+  rotate, err := optionalFormValue(form, "rotate")
+  if err != nil || rotate == "" || rotate == "auto" { return "", err }
+
+  if _, ok := ROTATIONS[rotate]; !ok {
+    return "", errors.New("The 'rotate' key must be 'auto', '0', '90', " +
+      "'180', or '270'.\n")
+  }
+  return rotate, nil
+}
+
+/* Returns `params` with the rotation of each page of the PDF at `pdfPath`,
+ * read from its page tree. If it can't be read, pages are left as the
+ * renderers draw them, unless the request forces a rotation. */
+func detectPageRotations(job *job, params conversionParams,
+    pdfPath string) conversionParams {
+  if params.SourceFormat != SOURCE_PDF { return params }
+
+  fileInfo, err := os.Stat(pdfPath)
+  if err == nil && fileInfo.Size() > MAX_PAGE_COUNT_PARSE_BYTES {
+    err = errors.New("PDF is too large to parse in memory.\n")
+  }
+
+  var doc *pdfDocument
+  if err == nil { doc, err = openPDFDocument(pdfPath) }
+  var pages []pdfDict
+  if err == nil { pages, err = doc.pages() }
+  if err != nil {
+    job.logger().Warn("Couldn't read page rotations", errorAttr(err))
+    return params
+  }
+
+  params.PageRotations = map[int]pageRotation{}
+  for i, page := range pages {
+    width, height, rotate, err := doc.pageSize(page)
+    if err != nil { continue }
+    params.PageRotations[i + 1] = pageRotation{rotate, width, height}
+  }
+  return params
+}
+
+/* Returns how far, in degrees clockwise, page `pageNum`, rendered at
+ * `rendered` pixels, must still be turned. Renderers apply /Rotate
+ * themselves, but one that ignored a quarter turn leaves the page sideways,
+ * which shows in its orientation; ignored half turns can't be detected. */
+func remainingRotation(params conversionParams, pageNum int,
+    rendered dimensions) int {
+  page, known := params.PageRotations[pageNum]
+  current := page.rotate
+  if (page.rotate == 90 || page.rotate == 270) &&
+      page.width != page.height && rendered.Width != rendered.Height &&
+      (page.width > page.height) != (rendered.Width > rendered.Height) {
+    current = 0
+  }
+
+  wanted := page.rotate
+  if params.Rotate != "" {
+    wanted = ROTATIONS[params.Rotate]
+  } else if !known {
+    return 0
+  }
+  return ((wanted - current) % 360 + 360) % 360
+}
+
+/* Turns page `pageNum`, rendered to the JPEG at `jpegPath`, upright: as its
+ * /Rotate says, or as the `rotate` key forces. */
+func rotateRenderedPage(params conversionParams, jpegPath string,
+    pageNum int) error {
+  if params.Rotate == "" && params.PageRotations == nil { return nil }
+
+  rendered, err := jpegDimensions(jpegPath)
+  if err != nil { return err }
+
+  degrees := remainingRotation(params, pageNum, rendered)
+  if degrees == 0 { return nil }
+
+  // turning decodes the whole page, before resizing reserves it
+  megapixels, err := reserveDecodeMegapixels(rendered, pageNum)
+  if err != nil { return err }
+  defer decodeBudget.release(megapixels)
+
+  return rotateJPEG(jpegPath, degrees, renderQuality(params))
+}
+
+/* Turns the JPEG at `jpegPath` `degrees` clockwise, a multiple of 90,
+ * re-encoding it at JPEG quality `quality`. Falls back to turning it in
+ * process if ImageMagick is missing. */
+func rotateJPEG(jpegPath string, degrees int, quality int) error {
+  if !hasExternalResizer() {
+    return rotateJPEGInProcess(jpegPath, degrees, quality)
+  }
+
+  cmd := toolCommand("convert", jpegPath, "-rotate",
+    fmt.Sprintf("%d", degrees), "-quality", fmt.Sprintf("%d", quality),
+    jpegPath)
+  return runTool(cmd)
+}
+
+/* Returns `decoded` turned and mirrored upright, as EXIF `orientation` (1
+ * to 8) says to display it. Grayscale images stay grayscale. */
+func orientImage(decoded image.Image, orientation int) draw.Image {
+  bounds := decoded.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  oriented := image.Rect(0, 0, width, height)
+  // orientations 5 to 8 swap the axes
+  if orientation >= 5 { oriented = image.Rect(0, 0, height, width) }
+
+  var upright draw.Image = image.NewRGBA(oriented)
+  if decoded.ColorModel() == color.GrayModel {
+    upright = image.NewGray(oriented)
+  }
+
+  for y := 0; y < height; y = y + 1 {
+    for x := 0; x < width; x = x + 1 {
+      pixel := decoded.At(bounds.Min.X + x, bounds.Min.Y + y)
+      switch orientation {
+      case 2:
+        upright.Set(width - 1 - x, y, pixel)
+      case 3:
+        upright.Set(width - 1 - x, height - 1 - y, pixel)
+      case 4:
+        upright.Set(x, height - 1 - y, pixel)
+      case 5:
+        upright.Set(y, x, pixel)
+      case 6:
+        upright.Set(height - 1 - y, x, pixel)
+      case 7:
+        upright.Set(height - 1 - y, width - 1 - x, pixel)
+      case 8:
+        upright.Set(y, width - 1 - x, pixel)
+      default:
+        upright.Set(x, y, pixel)
+      }
+    }
+  }
+  return upright
+}
+
+/* Does what rotateJPEG does, without ImageMagick. Grayscale JPEGs stay
+ * grayscale. */
+func rotateJPEGInProcess(jpegPath string, degrees int, quality int) error {
+  file, err := os.Open(jpegPath)
+  if err != nil { return err }
+  decoded, err := jpeg.Decode(file)
+  file.Close()
+  if err != nil { return err }
+
+  // the EXIF orientations that turn an image clockwise by each angle
+  orientations := map[int]int{90: 6, 180: 3, 270: 8}
+  rotated := orientImage(decoded, orientations[degrees])
+
+  output, err := os.Create(jpegPath)
+  if err != nil { return err }
+
+  err = jpeg.Encode(output, rotated, &jpeg.Options{Quality: quality})
+  if err != nil {
+    output.Close()
+    return err
+  }
+  return output.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "log/slog"
+  "math/rand"
+  "syscall"
+  "time"
+)
+
+var s3MaxAttempts = flag.Int("s3-max-attempts", 8,
+  "most attempts at a single S3 operation that keeps failing transiently " +
+  "(503 SlowDown, other 5xx errors, connection resets)")
+var s3RetryDelay = flag.Duration("s3-retry-delay", 200 * time.Millisecond,
+  "base delay before retrying a transient S3 failure, doubled on each " +
+  "attempt")
+var s3RetryMaxDelay = flag.Duration("s3-retry-max-delay", 10 * time.Second,
+  "longest delay before retrying a transient S3 failure")
+
+// names of the S3 operations that are retried, as reported in metrics
+const (
+  S3_OP_UPLOAD = "upload"
+  S3_OP_DOWNLOAD = "download"
+  S3_OP_READ_MANIFEST = "read_manifest"
+  S3_OP_WRITE_MANIFEST = "write_manifest"
+  S3_OP_LIST = "list"
+)
+
+var s3AttemptsTotal = newCounterVec("evangelist_s3_attempts_total",
+  "S3 operation attempts, by operation and outcome (success, retried, or " +
+  "failed).", "operation", "outcome")
+
+/* Returns true if `err` is an S3 failure that may well not happen again: a
+ * server-side error, S3 asking us to slow down, or a network problem such
+ * as a reset connection. */
+func isTransientS3Error(err error) bool {
+  class := errorClass(err)
+  return class == ERROR_CLASS_S3 || class == ERROR_CLASS_NETWORK ||
+    errors.Is(err, syscall.ECONNRESET)
+}
+
+/* Returns how long to wait before retrying an S3 operation after failed
+ * attempt number `attempt`: an exponentially growing delay with full
+ * jitter, so workers that failed together don't retry together. */
+func s3BackoffDelay(attempt int) time.Duration {
+  delay := *s3RetryDelay
+  for i := 1; i < attempt && delay < *s3RetryMaxDelay; i = i + 1 {
+    delay *= 2
+  }
+  if delay > *s3RetryMaxDelay {
+    delay = *s3RetryMaxDelay
+  }
+  return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+/* Runs `operation`, the S3 operation named `name`, retrying it with
+ * backoff while it fails transiently, up to -s3-max-attempts times in all.
+ * Every attempt is counted in the metrics, and retries are logged to `log`.
+ * Returns the last attempt's error. `operation` must be safe to repeat,
+ * e.g. by rewinding what it uploads. */
+func withS3Retries(log *slog.Logger, name string,
+    operation func() error) error {
+  for attempt := 1; ; attempt = attempt + 1 {
+    err := operation()
+    if err == nil {
+      s3AttemptsTotal.add(1, name, "success")
+      return nil
+    }
+
+    if !isTransientS3Error(err) || attempt >= tunedInt(s3MaxAttempts) {
+      s3AttemptsTotal.add(1, name, "failed")
+      return err
+    }
+
+    s3AttemptsTotal.add(1, name, "retried")
+    delay := s3BackoffDelay(attempt)
+    log.Warn("Retrying S3 operation", "operation", name, "attempt", attempt,
+      "delay", delay, errorAttr(err))
+    time.Sleep(delay)
+  }
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+  "errors"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+/* Returns the number of pages to sample in the `sample` key of `form`, or 0
+ * if every page should be converted. */
+func parseSample(form url.Values) (int, error) {
+  sample, err := optionalFormValue(form, "sample")
+  if err != nil || sample == "" { return 0, err }
+
+  numPages, err := strconv.Atoi(sample)
+  if err != nil || numPages < 1 {
+    return 0, errors.New("The 'sample' key must be a positive number of " +
+      "pages.\n")
+  }
+  return numPages, nil
+}
+
+/* Returns the numbers of the pages to convert in a document with `numPages`
+ * pages: all of them if `sample` is 0 or at least `numPages`, and otherwise
+ * `sample` evenly spaced pages, including the first and last. */
+func samplePages(numPages int, sample int) []int {
+  pageNums := []int{}
+
+  if sample == 0 || sample >= numPages {
+    for pageNum := 1; pageNum <= numPages; pageNum = pageNum + 1 {
+      pageNums = append(pageNums, pageNum)
+    }
+    return pageNums
+  }
+
+  if sample == 1 { return []int{1} }
+
+  // spacing is at least one page, so no page is picked twice
+  for i := 0; i < sample; i = i + 1 {
+    offset := (i * (numPages - 1) + (sample - 1) / 2) / (sample - 1)
+    pageNums = append(pageNums, 1 + offset)
+  }
+  return pageNums
+}
+
+/* Returns `pageNums` as a comma-separated list. */
+func formatPageList(pageNums []int) string {
+  pages := make([]string, len(pageNums))
+  for i, pageNum := range pageNums {
+    pages[i] = strconv.Itoa(pageNum)
+  }
+  return strings.Join(pages, ",")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+  "flag"
+  "math"
+  "net/http"
+  "sync"
+  "time"
+)
+
+var scalingTarget = flag.Duration("scaling-target", time.Minute,
+  "how quickly /scaling suggests the backlog of pages should be rendered")
+var scalingPageSeconds = flag.Float64("scaling-page-seconds", 2,
+  "seconds a page is assumed to take to render until one has been measured")
+
+// how much each new measurement moves the moving averages
+const SCALING_SMOOTHING = 0.1
+
+// pages a job is assumed to have until one has been counted
+const DEFAULT_PAGES_PER_JOB = 10
+
+/* Exponentially weighted moving averages of how long a page takes to render
+ * and how many pages a job has, which /scaling turns into capacity and
+ * backlog estimates. */
+type throughputTracker struct {
+  mutex sync.Mutex
+  secondsPerPage float64
+  pagesPerJob float64
+}
+
+var throughput = &throughputTracker{}
+
+/* Folds `sample` into the moving average at `average`, which starts out as
+ * the first sample. */
+func smooth(average *float64, sample float64) {
+  if *average == 0 {
+    *average = sample
+    return
+  }
+  *average += SCALING_SMOOTHING * (sample - *average)
+}
+
+/* Records that a page took `duration` to render. */
+func (tracker *throughputTracker) pageRendered(duration time.Duration) {
+  tracker.mutex.Lock()
+  defer tracker.mutex.Unlock()
+  smooth(&tracker.secondsPerPage, duration.Seconds())
+}
+
+/* Records that a job will render `numPages` pages. */
+func (tracker *throughputTracker) jobCounted(numPages int) {
+  tracker.mutex.Lock()
+  defer tracker.mutex.Unlock()
+  smooth(&tracker.pagesPerJob, float64(numPages))
+}
+
+/* Returns the current averages, or the defaults if nothing's been measured
+ * yet. */
+func (tracker *throughputTracker) averages() (float64, float64) {
+  tracker.mutex.Lock()
+  defer tracker.mutex.Unlock()
+
+  secondsPerPage := tracker.secondsPerPage
+  if secondsPerPage == 0 {
+    secondsPerPage = *scalingPageSeconds
+  }
+
+  pagesPerJob := tracker.pagesPerJob
+  if pagesPerJob == 0 {
+    pagesPerJob = DEFAULT_PAGES_PER_JOB
+  }
+  return secondsPerPage, pagesPerJob
+}
+
+/* The response to GET /scaling. `ReplicaLoad` is how many replicas' worth of
+ * render capacity this replica's backlog needs to be finished within
+ * -scaling-target; summed across replicas, it's the replica count the
+ * fleet needs. */
+type scalingResponse struct {
+  QueuedJobs int `json:"queuedJobs"`
+  RunningJobs int `json:"runningJobs"`
+  BacklogPages float64 `json:"backlogPages"`
+  SecondsPerPage float64 `json:"secondsPerPage"`
+  PagesPerSecond float64 `json:"pagesPerSecond"`
+  TargetSeconds float64 `json:"targetSeconds"`
+  ReplicaLoad float64 `json:"replicaLoad"`
+  DesiredReplicas int `json:"desiredReplicas"`
+}
+
+/* Returns scaling hints for this replica: its backlog of pages, counting
+ * unstarted jobs as the average job, and its throughput. */
+func scalingHints() scalingResponse {
+  secondsPerPage, pagesPerJob := throughput.averages()
+  response := scalingResponse{
+    SecondsPerPage: secondsPerPage,
+    PagesPerSecond: float64(tunedInt(renderSlots)) / secondsPerPage,
+    TargetSeconds: scalingTarget.Seconds(),
+  }
+
+  for _, job := range jobs.unfinished() {
+    status := job.status()
+    if status.State == JOB_QUEUED || status.State == JOB_RETRYING {
+      response.QueuedJobs += 1
+    } else {
+      response.RunningJobs += 1
+    }
+
+    // a job's pages aren't known until its PDF has been downloaded
+    if status.NumPages == 0 {
+      response.BacklogPages += pagesPerJob
+    } else {
+      response.BacklogPages += float64(status.NumPages -
+        status.PagesConverted)
+    }
+  }
+
+  response.ReplicaLoad = response.BacklogPages /
+    (response.PagesPerSecond * response.TargetSeconds)
+  response.DesiredReplicas = int(math.Max(1, math.Ceil(response.ReplicaLoad)))
+  return response
+}
+
+/* Handles GET /scaling, reporting scaling hints for autoscalers as JSON. */
+func serveScaling(writer http.ResponseWriter, request *http.Request) {
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+  writeJSON(writer, http.StatusOK, scalingHints())
+}
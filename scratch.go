@@ -0,0 +1,170 @@
+package main
+
+import (
+  "bufio"
+  "crypto/rand"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+var scratchDir = flag.String("scratch-dir", "/tmp",
+  "directory for downloaded PDFs and rendered JPEGs")
+var requireEncryptedScratch = flag.Bool("require-encrypted-scratch", false,
+  "refuse to start unless the scratch directory is on an encrypted (dm-crypt) " +
+  "or memory-backed volume")
+var shredScratch = flag.Bool("shred-scratch", false,
+  "overwrite each job's scratch files with random data before deleting them")
+var keepScratch = flag.Bool("keep-scratch", false,
+  "leave each job's scratch files behind for inspection once it finishes, " +
+  "until they're swept")
+
+/* Returns the path of a scratch file called `name`. */
+func scratchPath(name string) string {
+  return filepath.Join(*scratchDir, name)
+}
+
+/* Returns the mount point, filesystem type, and source device of the mount
+ * containing `path`, according to /proc/self/mountinfo. */
+func findMount(path string) (string, string, string, error) {
+  file, err := os.Open("/proc/self/mountinfo")
+  if err != nil { return "", "", "", err }
+  defer file.Close()
+
+  mountPoint, fsType, source := "", "", ""
+  scanner := bufio.NewScanner(file)
+
+  for scanner.Scan() {
+    // fields: id parent major:minor root mountPoint options ... - type source
+    fields := strings.Fields(scanner.Text())
+    separator := -1
+    for i, field := range fields {
+      if field == "-" {
+        separator = i
+        break
+      }
+    }
+    if len(fields) < 5 || separator < 0 || separator + 2 >= len(fields) {
+      continue
+    }
+
+    // the longest mount point that contains `path` is the one it's on
+    candidate := fields[4]
+    contains := path == candidate || candidate == "/" ||
+      strings.HasPrefix(path, candidate + "/")
+    if contains && len(candidate) >= len(mountPoint) {
+      mountPoint = candidate
+      fsType = fields[separator + 1]
+      source = fields[separator + 2]
+    }
+  }
+
+  if mountPoint == "" {
+    return "", "", "", errors.New("Couldn't find the mount containing " +
+      path + ".\n")
+  }
+  return mountPoint, fsType, source, scanner.Err()
+}
+
+/* Returns true if the block device at `source` is a dm-crypt mapping. */
+func isDMCrypt(source string) bool {
+  device, err := filepath.EvalSymlinks(source)
+  if err != nil { return false }
+
+  // dm-crypt devices have a device-mapper UUID starting with CRYPT-
+  uuid, err := ioutil.ReadFile(filepath.Join("/sys/block",
+    filepath.Base(device), "dm", "uuid"))
+  return err == nil && strings.HasPrefix(string(uuid), "CRYPT-")
+}
+
+/* Returns an error unless the scratch directory is on an encrypted or
+ * memory-backed volume, so documents never reach a disk in the clear. */
+func checkScratchEncrypted() error {
+  dir, err := filepath.Abs(*scratchDir)
+  if err != nil { return err }
+
+  dir, err = filepath.EvalSymlinks(dir)
+  if err != nil { return err }
+
+  mountPoint, fsType, source, err := findMount(dir)
+  if err != nil { return err }
+
+  if fsType == "tmpfs" || fsType == "ramfs" || isDMCrypt(source) {
+    return nil
+  }
+
+  return errors.New(fmt.Sprintf("Scratch directory %s is on %s (%s, " +
+    "mounted at %s), which is neither encrypted nor memory-backed.\n", dir,
+    source, fsType, mountPoint))
+}
+
+/* Overwrites the file at `path` with random data, syncs it to disk, and
+ * removes it. */
+func shredFile(path string) error {
+  file, err := os.OpenFile(path, os.O_WRONLY, 0)
+  if err != nil { return err }
+
+  fileInfo, err := file.Stat()
+  if err == nil {
+    _, err = io.CopyN(file, rand.Reader, fileInfo.Size())
+  }
+  if err == nil {
+    err = file.Sync()
+  }
+
+  closeErr := file.Close()
+  if err != nil { return err }
+  if closeErr != nil { return closeErr }
+
+  return os.Remove(path)
+}
+
+/* Removes the scratch files of the job with the given ID once it has
+ * finished, whether it succeeded or not, unless -keep-scratch leaves them
+ * for inspection. */
+func cleanupScratch(jobID string) {
+  if *keepScratch { return }
+  removeScratch(jobID)
+}
+
+/* Removes the scratch files a failed attempt of the job with the given ID
+ * left behind before it's retried. A PDF uploaded with the job's request is
+ * kept, since it can't be fetched again. */
+func cleanupScratchForRetry(jobID string) {
+  if *keepScratch { return }
+  removeScratchExcept(jobID, uploadedPDFPath(jobID))
+}
+
+/* Removes the scratch file at `path`, shredding it first with
+ * -shred-scratch. */
+func removeScratchFile(path string) error {
+  if *shredScratch { return shredFile(path) }
+  return os.Remove(path)
+}
+
+/* Removes the scratch files of the job with the given ID. */
+func removeScratch(jobID string) {
+  removeScratchExcept(jobID, "")
+}
+
+/* Removes the scratch files of the job with the given ID, other than the
+ * one at `keptPath`. */
+func removeScratchExcept(jobID string, keptPath string) {
+  paths, err := filepath.Glob(scratchPath(jobID + "*"))
+  if err != nil { return }
+
+  for _, path := range paths {
+    if path == keptPath { continue }
+
+    err = removeScratchFile(path)
+    if err != nil {
+      logger.Warn("Couldn't remove scratch file", "path", path,
+        errorAttr(err))
+    }
+  }
+}
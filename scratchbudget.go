@@ -0,0 +1,134 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "sync"
+)
+
+var scratchBudgetMB = flag.Int64("scratch-budget-mb", 0,
+  "megabytes of scratch space running conversions are estimated to need at " +
+  "once; conversions that would exceed it wait to start rendering (0 " +
+  "disables the budget)")
+
+// scratch space estimated for a page whose size can't be read from the PDF
+const DEFAULT_SCRATCH_BYTES_PER_PAGE = 2 * 1024 * 1024
+
+/* Bounds the scratch space running conversions are estimated to need, so
+ * that concurrent large jobs wait their turn rather than filling the volume
+ * and failing each other's writes. It's a soft quota: it admits jobs by
+ * estimate, and doesn't stop one that writes more than it reserved. */
+type diskBudget struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  inUse int64
+  running int
+  waiting int
+}
+
+var scratchBudget = newDiskBudget()
+
+var scratchBudgetBytes = newGaugeFunc("evangelist_scratch_budget_bytes",
+  "Bytes of scratch space reserved by running conversions, and the budget.",
+  "state", func() map[string]float64 {
+    reserved, _, _ := scratchBudget.usage()
+    return map[string]float64{"reserved": float64(reserved),
+      "limit": float64(*scratchBudgetMB * 1024 * 1024)}
+  })
+var scratchBudgetJobs = newGaugeFunc("evangelist_scratch_budget_jobs",
+  "Conversions holding scratch space, and those waiting for it.", "state",
+  func() map[string]float64 {
+    _, running, waiting := scratchBudget.usage()
+    return map[string]float64{"running": float64(running),
+      "waiting": float64(waiting)}
+  })
+
+/* Returns an empty budget. */
+func newDiskBudget() *diskBudget {
+  budget := &diskBudget{}
+  budget.cond = sync.NewCond(&budget.mutex)
+  return budget
+}
+
+/* Waits until `numBytes` fit within -scratch-budget-mb alongside what
+ * running conversions reserved, then reserves them, calling `onWait` first
+ * if it has to wait. A job larger than the whole budget runs once nothing
+ * else holds any. Every call must be followed by a call to `release`. */
+func (budget *diskBudget) acquire(numBytes int64, onWait func()) {
+  budget.mutex.Lock()
+  defer budget.mutex.Unlock()
+
+  limit := *scratchBudgetMB * 1024 * 1024
+  if budget.inUse > 0 && budget.inUse + numBytes > limit {
+    onWait()
+    budget.waiting += 1
+    for budget.inUse > 0 && budget.inUse + numBytes > limit {
+      budget.cond.Wait()
+    }
+    budget.waiting -= 1
+  }
+
+  budget.inUse += numBytes
+  budget.running += 1
+}
+
+/* Frees the bytes reserved by `acquire`. */
+func (budget *diskBudget) release(numBytes int64) {
+  budget.mutex.Lock()
+  defer budget.mutex.Unlock()
+
+  budget.inUse -= numBytes
+  budget.running -= 1
+  budget.cond.Broadcast()
+}
+
+/* Returns the bytes reserved, and how many jobs hold them and wait. */
+func (budget *diskBudget) usage() (int64, int, int) {
+  budget.mutex.Lock()
+  defer budget.mutex.Unlock()
+  return budget.inUse, budget.running, budget.waiting
+}
+
+/* Returns the scratch space rendering pages `pageNums` of the PDF at
+ * `pdfPath` with `params` is estimated to need: the PDF itself, and every
+ * rendition of each page, sized from the page sizes read with its
+ * rotations. */
+func estimateScratchBytes(params conversionParams, pdfPath string,
+    pageNums []int) int64 {
+  estimate := 0.0
+  if fileInfo, err := os.Stat(pdfPath); err == nil {
+    estimate += float64(fileInfo.Size())
+  }
+
+  for _, pageNum := range pageNums {
+    page, ok := params.PageRotations[pageNum]
+    if !ok {
+      estimate += DEFAULT_SCRATCH_BYTES_PER_PAGE
+      continue
+    }
+
+    renditions := estimateRenditions(page.width, page.height,
+      renderDensity(params))
+    for _, rendition := range renditions {
+      estimate += float64(rendition.Width * rendition.Height) *
+        ESTIMATED_JPEG_BYTES_PER_PIXEL
+    }
+  }
+  return int64(estimate)
+}
+
+/* Admits `job`, about to render pages `pageNums` of the PDF at `pdfPath`,
+ * once its estimated scratch space fits within -scratch-budget-mb, and
+ * returns the function that releases it once the job's done writing. */
+func admitToScratch(job *job, params conversionParams, pdfPath string,
+    pageNums []int) func() {
+  if *scratchBudgetMB <= 0 { return func() {} }
+
+  numBytes := estimateScratchBytes(params, pdfPath, pageNums)
+  scratchBudget.acquire(numBytes, func() {
+    job.recordEvent("waiting for scratch", 0, fmt.Sprintf("%d bytes",
+      numBytes))
+  })
+  return func() { scratchBudget.release(numBytes) }
+}
@@ -2,16 +2,19 @@ package main
 
 import (
   "fmt"
+  "flag"
+  "log/slog"
+  "encoding/json"
   "net/http"
   "io"
   "os"
-  "os/exec"
   "sync"
   "strconv"
   "strings"
   "math"
+  "time"
   "errors"
-  "crypto/rand"
+  "path"
   "path/filepath"
   "launchpad.net/goamz/aws"
   "launchpad.net/goamz/s3"
@@ -20,20 +23,11 @@ import (
 // allow at most 1 MB of form data to be passed to the server
 const MAX_MULTIPART_FORM_BYTES = 1024 * 1024;
 
-// number of workers to run simultaneously to convert a PDF
-const NUM_WORKERS_CONVERT = 2;
-
-// number of workers to run simultaneously to upload a PDF
-const NUM_WORKERS_UPLOAD = 10;
-
-// possible alpha numeric characters
-const ALPHA_NUMERIC = "abcdefghijklmnopqrstuvwxyz0123456789"
-
 /* If `err` is non-nil, write a 500 error to `writer. Otherwise, do nothing.
  * Returns true if there was an error or false otherwise. */
 func handleError(err error, writer http.ResponseWriter) bool {
   if err != nil {
-    fmt.Printf(err.Error())
+    logger.Error("Request failed", errorAttr(err))
     http.Error(writer, err.Error(), http.StatusInternalServerError)
     return true
   }
@@ -41,12 +35,45 @@ func handleError(err error, writer http.ResponseWriter) bool {
   return false
 }
 
-/* Returns the number of pages in the PDF specified by `pdfPath`. */
+/* Writes `value` to `writer` as a JSON response with the given status. */
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+  body, err := json.Marshal(value)
+  if handleError(err, writer) { return }
+
+  writer.Header().Set("Content-Type", "application/json")
+  writer.WriteHeader(status)
+  writer.Write(body)
+  writer.Write([]byte("\n"))
+}
+
+/* Returns the number of pages in the PDF specified by `pdfPath`, read from
+ * its page tree if possible, since that's much faster than starting
+ * Ghostscript, and counted by Ghostscript otherwise. */
 func getNumPages(pdfPath string) (int, error) {
+  numPages, err := countPDFPages(pdfPath)
+  if err == nil {
+    pageCountsTotal.add(1, PAGE_COUNT_PARSED)
+    return numPages, nil
+  }
+
+  logger.Debug("Couldn't read page tree; counting pages with Ghostscript",
+    "path", pdfPath, errorAttr(err))
+  pageCountsTotal.add(1, PAGE_COUNT_GHOSTSCRIPT)
+  return getNumPagesWithGhostscript(pdfPath)
+}
+
+/* Returns the number of pages in the PDF specified by `pdfPath`, as
+ * Ghostscript counts them. */
+func getNumPagesWithGhostscript(pdfPath string) (int, error) {
   // ghostscript can retrieve us the number of pages
-  cmd := exec.Command("gs", "-q", "-dNODISPLAY", "-c",
+  cmd := toolCommand("gs", "-q", "-dNODISPLAY", "-c",
     fmt.Sprintf("(%s) (r) file runpdfbegin pdfpagecount = quit", pdfPath))
-  numPagesBytes, err := cmd.Output()
+  var numPagesBytes []byte
+  err := withProcessSlot(func() error {
+    var err error
+    numPagesBytes, err = cmd.Output()
+    return err
+  })
 
   // convert []byte -> string -> int (painful, but necessary)
   if err != nil { return -1, err }
@@ -57,275 +84,617 @@ func getNumPages(pdfPath string) (int, error) {
   return int(numPagesInt64), nil
 }
 
-/* See the documentation for `uploadAllJPEGsToS3`. This function does the
- * same, except for a single page. */
-func uploadJPEGToS3(bucket *s3.Bucket, jpegPath string, s3JPEGPath string,
-    pageNum int) error {
-  jpegFile, err := os.Open(fmt.Sprintf(jpegPath, pageNum))
+/* Splits `pageNums` into at most `numWorkers` contiguous runs, one per
+ * worker. */
+func splitPages(pageNums []int, numWorkers int) [][]int {
+  // find number of pages per worker
+  numPagesPerWorkerFloat64 := float64(len(pageNums)) / float64(numWorkers)
+  numPagesPerWorker := int(math.Ceil(numPagesPerWorkerFloat64))
+
+  runs := [][]int{}
+  for first := 0; first < len(pageNums); first = first + numPagesPerWorker {
+    last := first + numPagesPerWorker
+    if last > len(pageNums) {
+      last = len(pageNums)
+    }
+    runs = append(runs, pageNums[first:last])
+  }
+  return runs
+}
+
+/* Waits for each of `numWorkers` workers to report to `errs`, and returns
+ * the first non-nil error among them. */
+func firstError(errs chan error, numWorkers int) error {
+  var firstErr error
+  for i := 0; i < numWorkers; i = i + 1 {
+    err := <-errs
+    if err != nil && firstErr == nil {
+      firstErr = err
+    }
+  }
+  return firstErr
+}
+
+/* Returns the extra S3 headers to set on every object uploaded for
+ * `params`, beyond the content type. */
+func uploadHeaders(params conversionParams) map[string][]string {
+  headers := map[string][]string{}
+
+  if params.CacheControl != "" {
+    headers["Cache-Control"] = []string{params.CacheControl}
+  }
+  if params.ContentDisposition != "" {
+    headers["Content-Disposition"] = []string{params.ContentDisposition}
+  }
+
+  addObjectLockHeaders(headers, params)
+  return headers
+}
+
+/* Uploads `size` bytes of `contentType` from `reader` to `remotePath` as a
+ * rendition converted with `params`, with the ACL they call for, setting the
+ * given extra `headers`. */
+func putRendition(bucket *s3.Bucket, params conversionParams,
+    remotePath string, reader io.Reader, size int64, contentType string,
+    headers map[string][]string) error {
+  err := injectS3PutFault(remotePath)
   if err != nil { return err }
 
-  jpegFileInfo, err := jpegFile.Stat()
+  if len(headers) == 0 {
+    return bucket.PutReader(remotePath, reader, size, contentType,
+      renditionACL(params))
+  }
+
+  allHeaders := map[string][]string{"Content-Type": {contentType}}
+  for name, values := range headers {
+    allHeaders[name] = values
+  }
+  return bucket.PutReaderHeader(remotePath, reader, size, allHeaders,
+    renditionACL(params))
+}
+
+/* Uploads page `pageNum` of the JPEG at `jpegPath` (note: '%d' in
+ * `jpegPath` will be replaced by the page number) to `s3JPEGPath`, likewise.
+ * Headers such as Cache-Control and Object Lock retention are set according
+ * to `params`. Uploads wait for an upload slot, are paced by the job's
+ * throttle, and are retried when they fail transiently. */
+func uploadJPEGToS3(job *job, bucket *s3.Bucket, params conversionParams,
+    jpegPath string, s3JPEGPath string, pageNum int) error {
+  return uploadFileToS3(job, bucket, params, fmt.Sprintf(jpegPath, pageNum),
+    fmt.Sprintf(s3JPEGPath, pageNum), pageNum)
+}
+
+/* Uploads the file at `localPath` to `remotePath` as uploadJPEGToS3
+ * does. `pageNum` is the page it belongs to, or 0 if it covers the whole
+ * document. */
+func uploadFileToS3(job *job, bucket *s3.Bucket, params conversionParams,
+    localPath string, remotePath string, pageNum int) error {
+  file, size, err := openUpload(params, localPath)
   if err != nil { return err }
+  defer file.Close()
 
-  remoteJPEGPath := fmt.Sprintf(s3JPEGPath, pageNum)
-  err = bucket.PutReader(remoteJPEGPath, jpegFile, jpegFileInfo.Size(),
-    "image/jpeg", s3.PublicRead)
+  // S3 reports the digest as the object's ETag, which consistency checks
+  // compare against the manifest
+  md5, err := contentMD5(file)
   if err != nil { return err }
 
+  headers := uploadHeaders(params)
+  if usesObjectLock(params) {
+    headers["Content-MD5"] = []string{md5}
+  }
+
+  contentType, err := uploadContentType(params, file, remotePath)
+  if err != nil { return err }
+
+  err = uploadPool.run(job.tenant, func() error {
+    return withS3Retries(job.logger(), S3_OP_UPLOAD, func() error {
+      job.throttle.acquire()
+      defer job.throttle.release()
+
+      _, err := file.Seek(0, 0)
+      if err != nil { return err }
+
+      err = putRendition(bucket, params, remotePath, file, size,
+        contentType, headers)
+      if isS3SlowDown(err) {
+        // back off across the whole job, not just this upload
+        job.logger().Warn("S3 asked us to slow down", "key", remotePath,
+          "page", pageNum)
+        job.throttle.slowDown()
+      }
+      return err
+    })
+  })
+  if err != nil { return err }
+
+  job.throttle.succeeded()
+  job.addBytesUploaded(size)
+  job.recordChecksum(remotePath, md5ETag(md5))
   return nil
 }
 
-/* See the documentation for `uploadAllJPEGsToS3`. This function does the
- * same, except for a limited range of pages. */
-func uploadJPEGRangeToS3(wg *sync.WaitGroup, bucket *s3.Bucket,
+/* Uploads page `pageNum`'s JPEGs at the specified `jpegPath`,
+ * `smallJPEGPath`, `largeJPEGPath`, and (if non-empty) `darkJPEGPath` to S3,
+ * along with any text extracted from it. The S3 names will be derived from
+ * the corresponding paths in `params`.
+ * Note that all paths mentioned above should have '%d' in them. This will
+ * be replaced with the page number to get the page's JPEG. If `params` asks
+ * for its own sizes, those are uploaded instead. */
+func uploadPageToS3(job *job, bucket *s3.Bucket, params conversionParams,
     jpegPath string, smallJPEGPath string, largeJPEGPath string,
-    s3JPEGPath string, s3SmallJPEGPath string, s3LargeJPEGPath string,
-    firstPage int, lastPage int) error {
-  defer wg.Done()
-
-  // upload JPEGs (normal, and large) corresponding to each page to S3
-  for pageNum := firstPage; pageNum <= lastPage; pageNum = pageNum + 1 {
-    err := uploadJPEGToS3(bucket, jpegPath, s3JPEGPath, pageNum)
+    darkJPEGPath string, pageNum int) error {
+  if len(params.Sizes) > 0 {
+    err := uploadPageSizes(job, bucket, params, pageNum)
     if err != nil { return err }
 
-    err = uploadJPEGToS3(bucket, smallJPEGPath, s3SmallJPEGPath, pageNum)
+    job.pageUploaded(pageNum)
+    return nil
+  }
+
+  err := uploadJPEGToS3(job, bucket, params, jpegPath, params.S3JPEGPath,
+    pageNum)
+  if err != nil { return err }
+
+  err = uploadJPEGToS3(job, bucket, params, smallJPEGPath,
+    params.S3SmallJPEGPath, pageNum)
+  if err != nil { return err }
+
+  err = uploadJPEGToS3(job, bucket, params, largeJPEGPath,
+    params.S3LargeJPEGPath, pageNum)
+  if err != nil { return err }
+
+  if darkJPEGPath != "" {
+    err = uploadJPEGToS3(job, bucket, params, darkJPEGPath,
+      params.S3DarkJPEGPath, pageNum)
     if err != nil { return err }
+  }
 
-    err = uploadJPEGToS3(bucket, largeJPEGPath, s3LargeJPEGPath, pageNum)
+  err = uploadPageText(job, bucket, params, jpegPath, pageNum)
+  if err != nil { return err }
+
+  // during a key layout migration, the old layout is kept up to date too
+  if isDualWriting(params) {
+    err = uploadLegacyJPEGsToS3(job, bucket, params, jpegPath,
+      smallJPEGPath, largeJPEGPath, darkJPEGPath, pageNum)
     if err != nil { return err }
   }
 
+  job.pageUploaded(pageNum)
+  classifyPage(job, bucket, params, jpegPath, pageNum)
   return nil
 }
 
-/* Uploads the JPEGs at the specified `jpegPath` and `largeJPEGPath` to S3. The
- * S3 name will be derived from the `s3JPEGPath` and `s3LargeJPEGPath` arguments
- * passed in the provided request. Note that all four paths mentioned above
- * should have '%d' in them. This will be replaced with the page number to get
- * the corresponding page's JPEG. */
-func uploadAllJPEGsToS3(bucket *s3.Bucket, request *http.Request,
-    jpegPath string, smallJPEGPath string, largeJPEGPath string,
-    numPages int) error {
-  s3JPEGPathSet, okJPEGPath := request.Form["s3JPEGPath"]
-  s3SmallJPEGPathSet, okSmallJPEGPath := request.Form["s3SmallJPEGPath"]
-  s3LargeJPEGPathSet, okLargeJPEGPath := request.Form["s3LargeJPEGPath"]
-
-  // ensure user gives us precisely one normal JPEG and one large JPEG path
-  if !okJPEGPath {
-    err := errors.New("Must specify a JPEG path in the 's3JPEGPath' key.\n")
-    return err
-  }
+/* See the documentation for `uploadPageToS3`. This function does the same,
+ * except for each of the pages `pageNums`. Calls `wg.Done()` once
+ * finished. */
+func uploadJPEGPagesToS3(wg *sync.WaitGroup, job *job, bucket *s3.Bucket,
+    params conversionParams, jpegPath string, smallJPEGPath string,
+    largeJPEGPath string, darkJPEGPath string, pageNums []int) error {
+  defer wg.Done()
 
-  if !okSmallJPEGPath {
-    err := errors.New("Must specify a small JPEG path in the " +
-      "'s3SmallJPEGPath' key.\n")
-    return err
+  for _, pageNum := range pageNums {
+    err := uploadPageToS3(job, bucket, params, jpegPath, smallJPEGPath,
+      largeJPEGPath, darkJPEGPath, pageNum)
+    if err != nil { return err }
   }
 
-  if !okLargeJPEGPath {
-    err := errors.New("Must specify a large JPEG path in the " +
-      "'s3LargeJPEGPath' key.\n")
-    return err
+  return nil
+}
+
+/* Resizes the JPEG at `jpegPath` to have a width at most `maxWidth` and
+ * a height at most `maxHeight`. Maintains aspect ratio. Saves the resized
+ * JPEG to `resizedJPEGPath`. Falls back to resizing in process if
+ * ImageMagick is missing. */
+func resizeAndSaveImage(jpegPath string, resizedJPEGPath string, maxWidth int,
+    maxHeight int) error {
+  if !hasExternalResizer() {
+    return resizeImageInProcess(jpegPath, resizedJPEGPath, maxWidth,
+      maxHeight)
   }
 
-  if len(s3JPEGPathSet) != 1 {
-    err := errors.New("Must specify exactly one JPEG path in the " +
-      "'s3JPEGPath' key.\n")
-    return err
+  dimension := fmt.Sprintf("%dx%d", maxWidth, maxHeight)
+  cmd := toolCommand("convert", "-resize", dimension, jpegPath, resizedJPEGPath)
+  return runTool(cmd)
+}
+
+/* Saves a dark mode rendition of the JPEG at `jpegPath` to `darkJPEGPath`.
+ * Only lightness is inverted (in Lab space), so colored figures and photos
+ * keep their hues rather than turning into color negatives. The result is
+ * then compressed into a dark gray to light gray range, which is easier on
+ * the eyes than pure black and white. Falls back to inverting in process if
+ * ImageMagick is missing. */
+func invertAndSaveImage(jpegPath string, darkJPEGPath string) error {
+  if !hasExternalResizer() {
+    return invertImageInProcess(jpegPath, darkJPEGPath)
   }
 
-  if len(s3SmallJPEGPathSet) != 1 {
-    err := errors.New("Must specify exactly one JPEG path in the " +
-      "'s3SmallJPEGPath' key.\n")
-    return err
+  cmd := toolCommand("convert", jpegPath, "-colorspace", "Lab", "-channel",
+    "R", "-negate", "+channel", "-colorspace", "sRGB", "+level", "7%,90%",
+    darkJPEGPath)
+  return runTool(cmd)
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to its large JPEG at
+ * `largeJPEGPath` (note: '%d' will be replaced by the page number). Returns
+ * the name of the renderer that rasterized the page. */
+func renderPageToJPEG(log *slog.Logger, params conversionParams,
+    pdfPath string, largeJPEGPath string, pageNum int) (string, error) {
+  largeJPEGPathForPage := fmt.Sprintf(largeJPEGPath, pageNum)
+
+  injectRenderDelay(pageNum)
+  rendererName, err := renderPageWithFallback(log, params, pdfPath, pageNum,
+    largeJPEGPathForPage)
+  if err != nil {
+    log.Error("Every renderer failed", "page", pageNum, errorAttr(err))
+    return "", err
   }
 
-  if len(s3LargeJPEGPathSet) != 1 {
-    err := errors.New("Must specify exactly one JPEG path in the " +
-      "'s3LargeJPEGPath' key.\n")
+  err = rotateRenderedPage(params, largeJPEGPathForPage, pageNum)
+  if err != nil { return "", err }
+
+  err = injectPageCorruption(largeJPEGPathForPage, pageNum)
+  if err != nil { return "", err }
+
+  return rendererName, nil
+}
+
+/* Derives the other renditions of page `pageNum` from its large JPEG at
+ * `largeJPEGPath`: resizes it to the normal and small sizes, inverts it
+ * into the dark rendition unless `darkJPEGPath` is empty, and encodes each
+ * as `params` asks, embedding `metadata` unless it's nil (note: '%d' in each
+ * path will be replaced by the page number). */
+func resizePageJPEGs(log *slog.Logger, params conversionParams,
+    jpegPath string, smallJPEGPath string, largeJPEGPath string,
+    darkJPEGPath string, pageNum int, metadata *pageMetadata) error {
+  jpegPathForPage := fmt.Sprintf(jpegPath, pageNum)
+  smallJPEGPathForPage := fmt.Sprintf(smallJPEGPath, pageNum)
+  largeJPEGPathForPage := fmt.Sprintf(largeJPEGPath, pageNum)
+
+  // refuse pages too large to decode before ImageMagick tries
+  megapixels, err := reserveDecodeBudget(largeJPEGPathForPage, pageNum)
+  if err != nil {
+    log.Error("Couldn't decode image", "page", pageNum, errorAttr(err))
     return err
   }
+  defer decodeBudget.release(megapixels)
 
-  s3JPEGPath := request.Form["s3JPEGPath"][0]
-  if !strings.Contains(s3JPEGPath, "%d") {
-    err := errors.New("Must specify a JPEG path with %d in the " +
-      "'s3JPEGPath' key.\n")
+  // every rendition is derived from the large one, so all get the watermark
+  err = applyWatermark(params, largeJPEGPathForPage)
+  if err != nil {
+    log.Error("Couldn't watermark image", "page", pageNum, errorAttr(err))
     return err
   }
 
-  s3SmallJPEGPath := request.Form["s3SmallJPEGPath"][0]
-  if !strings.Contains(s3SmallJPEGPath, "%d") {
-    err := errors.New("Must specify a JPEG path with %d in the " +
-      "'s3SmallJPEGPath' key.\n")
+  err = resizeAndSaveImage(largeJPEGPathForPage, jpegPathForPage,
+    NORMAL_MAX_DIMENSION, NORMAL_MAX_DIMENSION)
+  if err != nil {
+    log.Error("Couldn't resize image", "page", pageNum, errorAttr(err))
     return err
   }
 
-  s3LargeJPEGPath := request.Form["s3LargeJPEGPath"][0]
-  if !strings.Contains(s3LargeJPEGPath, "%d") {
-    err := errors.New("Must specify a JPEG path with %d in the " +
-      "'s3LargeJPEGPath' key.\n")
+  err = resizeAndSaveImage(jpegPathForPage, smallJPEGPathForPage,
+    SMALL_MAX_DIMENSION, SMALL_MAX_DIMENSION)
+  if err != nil {
+    log.Error("Couldn't resize image", "page", pageNum, errorAttr(err))
     return err
   }
 
-  // find number of pages to upload per worker
-  numPagesPerWorkerFloat64 := float64(numPages) / float64(NUM_WORKERS_UPLOAD)
-  numPagesPerWorker := int(math.Ceil(numPagesPerWorkerFloat64))
-
-  var wg sync.WaitGroup
-  for firstPage := 1; firstPage <= numPages;
-      firstPage = firstPage + numPagesPerWorker {
-    // spawn workers, keeping track of them to wait until they're finished
-    wg.Add(1)
-    lastPage := firstPage + numPagesPerWorker - 1
-    if lastPage > numPages {
-      lastPage = numPages
+  // the dark mode rendition is the same size as the normal one
+  if darkJPEGPath != "" {
+    err = invertAndSaveImage(jpegPathForPage,
+      fmt.Sprintf(darkJPEGPath, pageNum))
+    if err != nil {
+      log.Error("Couldn't invert image", "page", pageNum, errorAttr(err))
+      return err
     }
+  }
 
-    go uploadJPEGRangeToS3(&wg, bucket, jpegPath, smallJPEGPath, largeJPEGPath,
-      s3JPEGPath, s3SmallJPEGPath, s3LargeJPEGPath, firstPage, lastPage)
+  // encode each tier as requested, only once all resizing is done
+  err = finishJPEG(largeJPEGPathForPage, TIER_LARGE,
+    params.LargeJPEGEncoding, metadata)
+  if err == nil {
+    err = finishJPEG(jpegPathForPage, TIER_NORMAL, params.JPEGEncoding,
+      metadata)
+  }
+  if err == nil {
+    err = finishJPEG(smallJPEGPathForPage, TIER_SMALL,
+      params.SmallJPEGEncoding, metadata)
+  }
+  if err == nil && darkJPEGPath != "" {
+    err = finishJPEG(fmt.Sprintf(darkJPEGPath, pageNum), TIER_DARK,
+      params.DarkJPEGEncoding, metadata)
   }
 
-  wg.Wait()
-  return nil
-}
+  if err != nil {
+    log.Error("Couldn't encode image", "page", pageNum, errorAttr(err))
+    return err
+  }
 
-/* Resizes the JPEG at `jpegPath` to have a width at most `maxWidth` and
- * a height at most `maxHeight`. Maintains aspect ratio. Saves the resized
- * JPEG to `resizedJPEGPath`. */
-func resizeAndSaveImage(jpegPath string, resizedJPEGPath string, maxWidth int,
-    maxHeight int) error {
-  dimension := fmt.Sprintf("%dx%d", maxWidth, maxHeight)
-  cmd := exec.Command("convert", "-resize", dimension, jpegPath, resizedJPEGPath)
-  return cmd.Run()
+  return nil
 }
 
-/* Converts the PDF at `pdfPath` to JPEGs. Outputs the JPEGs to the provided
- * `jpegPath` (note: '%d' in `jpegPath` will be replaced by the JPEG
- * number). Converts pages within the range [`firstPage`, `lastPage`]. Calls
- * `wg.Done()` once finished. Returns an error on the given channel. */
-func convertPagesToJPEGs(wg *sync.WaitGroup, pdfPath string, jpegPath string,
-    smallJPEGPath string, largeJPEGPath string, firstPage int, lastPage int) {
-  defer wg.Done()
+/* Converts page `pageNum` of the PDF at `pdfPath` to JPEGs for `job`:
+ * renders it as renderPageToJPEG() does once `job`'s tenant gets a render
+ * slot, then derives the other renditions as resizePageJPEGs() does once it
+ * gets a resize slot, or the sizes `params` asks for as resizePageSizes()
+ * does. Extracts its text if `params` asks for it. */
+func convertPage(job *job, params conversionParams, pdfPath string,
+    jpegPath string, smallJPEGPath string, largeJPEGPath string,
+    darkJPEGPath string, pageNum int) error {
+  // tenants take turns at each stage's shared slots
+  var rendererName string
+  err := renderPool.run(job.tenant, func() error {
+    renderStartTime := time.Now()
+    var err error
+    rendererName, err = renderPageToJPEG(job.logger(), params, pdfPath,
+      largeJPEGPath, pageNum)
+    if err != nil { return err }
 
-  // use ghostscript for PDF -> JPEG conversion at 300 density
-  for pageNum := firstPage; pageNum <= lastPage; pageNum = pageNum + 1 {
-    // convert a single page at a time with the correct output JPEG path
-    firstPageOption := fmt.Sprintf("-dFirstPage=%d", pageNum)
-    lastPageOption := fmt.Sprintf("-dLastPage=%d", pageNum)
+    throughput.pageRendered(time.Since(renderStartTime))
+    return nil
+  })
+  if err != nil { return err }
 
-    // convert to two sizes: normal and large
-    jpegPathForPage := fmt.Sprintf(jpegPath, pageNum)
-    smallJPEGPathForPage := fmt.Sprintf(smallJPEGPath, pageNum)
-    largeJPEGPathForPage := fmt.Sprintf(largeJPEGPath, pageNum)
+  metadata := newPageMetadata(job, params, rendererName, pageNum)
+  sizePaths := scratchSizePaths(job.id, params)
+  err = resizePool.run(job.tenant, func() error {
+    if len(params.Sizes) > 0 {
+      return resizePageSizes(job.logger(), params, largeJPEGPath, sizePaths,
+        pageNum, metadata)
+    }
+    return resizePageJPEGs(job.logger(), params, jpegPath, smallJPEGPath,
+      largeJPEGPath, darkJPEGPath, pageNum, metadata)
+  })
+  if err != nil { return err }
 
-    outputFileOption := fmt.Sprintf("-sOutputFile=%s", largeJPEGPathForPage)
+  err = extractText(job, params, jpegPath, pageNum)
+  if err != nil { return err }
 
-    cmd := exec.Command("gs", "-dNOPAUSE", "-sDEVICE=jpeg", firstPageOption,
-      lastPageOption, outputFileOption, "-dJPEGQ=90", "-r200", "-q", pdfPath,
-      "-c", "quit")
-    err := cmd.Run()
+  // without a small rendition, the smallest size stands in for previews
+  previewPath := smallJPEGPath
+  if len(params.Sizes) > 0 {
+    previewPath = smallestSizePath(params, sizePaths)
+  }
+  job.pageConverted(pageNum, fmt.Sprintf(previewPath, pageNum),
+    rendererName)
+  detectHandwriting(job, params, largeJPEGPath, pageNum)
+  scorePageQuality(job, params, largeJPEGPath, pageNum)
+  return nil
+}
 
-    if err != nil {
-      fmt.Printf("gs command failed: %s\n", err.Error())
-      return
-    }
+/* Converts the pages `pageNums` of the PDF at `pdfPath` to JPEGs, as
+ * described in convertPage(). Calls `wg.Done()` once finished. Returns an
+ * error if any page fails. */
+func convertPagesToJPEGs(wg *sync.WaitGroup, job *job, params conversionParams,
+    pdfPath string, jpegPath string, smallJPEGPath string,
+    largeJPEGPath string, darkJPEGPath string, pageNums []int) error {
+  defer wg.Done()
 
-    resizeAndSaveImage(largeJPEGPathForPage, jpegPathForPage, 800, 800)
-    if err != nil {
-      fmt.Printf("Couldn't resize image: %s\n", err.Error())
-      return
-    }
+  params, err := withPDFDigest(params, pdfPath)
+  if err != nil { return err }
 
-    resizeAndSaveImage(jpegPathForPage, smallJPEGPathForPage, 300, 300)
-    if err != nil {
-      fmt.Printf("Couldn't resize image: %s\n", err.Error())
-      return
-    }
+  for _, pageNum := range pageNums {
+    err := convertPage(job, params, pdfPath, jpegPath, smallJPEGPath,
+      largeJPEGPath, darkJPEGPath, pageNum)
+    if err != nil { return err }
   }
+
+  return nil
 }
 
-/* Converts the PDF at `pdfPath` to JPEGs. Outputs the JPEGs to the provided
- * `jpegPath` (note: '%d' in `jpegPath` will be replaced by the JPEG
- * number). Returns the path to the JPEGs (contains a %d that should be
- * replaced with the page number) and the number of pages in the PDF. */
-func convertPDFToJPEGs(pdfPath string, jpegPath string, smallJPEGPath string,
-    largeJPEGPath string) (int, error) {
-  numPages, err := getNumPages(pdfPath)
-  if err != nil { return -1, err }
+/* Converts the pages `pageNums` of the PDF at `pdfPath` to JPEGs, split
+ * between numConvertWorkers(params) workers. Outputs the JPEGs to the
+ * provided `jpegPath` (note: '%d' in `jpegPath` will be replaced by the page
+ * number). Returns the first error any worker hit. */
+func convertPDFToJPEGs(job *job, params conversionParams, pdfPath string,
+    jpegPath string, smallJPEGPath string, largeJPEGPath string,
+    darkJPEGPath string, pageNums []int) error {
+  params, err := withPDFDigest(params, pdfPath)
+  if err != nil { return err }
 
-  // find number of pages to convert per worker
-  numPagesPerWorkerFloat64 := float64(numPages) / float64(NUM_WORKERS_CONVERT)
-  numPagesPerWorker := int(math.Ceil(numPagesPerWorkerFloat64))
+  runs := splitPages(pageNums, numConvertWorkers(params))
+  errs := make(chan error, len(runs))
 
   var wg sync.WaitGroup
-
-  for firstPage := 1; firstPage <= numPages;
-      firstPage = firstPage + numPagesPerWorker {
+  for _, workerPageNums := range runs {
     // spawn workers, keeping track of them to wait until they're finished
     wg.Add(1)
-    lastPage := firstPage + numPagesPerWorker - 1
-    if lastPage > numPages {
-      lastPage = numPages
-    }
-
-    go convertPagesToJPEGs(&wg, pdfPath, jpegPath, smallJPEGPath,
-      largeJPEGPath, firstPage, lastPage)
+    go func(workerPageNums []int) {
+      errs <- convertPagesToJPEGs(&wg, job, params, pdfPath, jpegPath,
+        smallJPEGPath, largeJPEGPath, darkJPEGPath, workerPageNums)
+    }(workerPageNums)
   }
 
   wg.Wait()
-  return numPages, err
+  return firstError(errs, len(runs))
 }
 
-/* Generates and returns a random string of the given length. */
-func generateRandomString(length int) string {
-  bytes := make([]byte, length)
-  rand.Read(bytes)
+/* Converts the pages `pageNums` of the PDF at `pdfPath` to JPEGs at the
+ * given paths, as convertPDFToJPEGs() does, and uploads each page to S3 as
+ * soon as it's converted, as uploadPageToS3() does, so rendering overlaps
+ * with uploading. numConvertWorkers(params) workers convert and
+ * numUploadWorkers(params) upload. Once any worker fails, the others stop
+ * taking on pages. Returns when the last page was converted, after which
+ * `job` is only uploading, and the first error any worker hit. */
+func convertAndUploadPages(job *job, bucket *s3.Bucket,
+    params conversionParams, pdfPath string, jpegPath string,
+    smallJPEGPath string, largeJPEGPath string, darkJPEGPath string,
+    pageNums []int) (time.Time, error) {
+  params, err := withPDFDigest(params, pdfPath)
+  if err != nil { return time.Time{}, err }
+
+  runs := splitPages(pageNums, numConvertWorkers(params))
+  numUploaders := numUploadWorkers(params)
+
+  // each worker reports once: its error, or nil once it's out of pages
+  errs := make(chan error, len(runs) + numUploaders)
+  failed := make(chan struct{})
+  var failOnce sync.Once
+  report := func(err error) {
+    if err != nil {
+      failOnce.Do(func() { close(failed) })
+    }
+    errs <- err
+  }
+  hasFailed := func() bool {
+    select {
+    case <-failed:
+      return true
+    default:
+      return false
+    }
+  }
+
+  // buffered for every page, so converters never wait on uploaders
+  converted := make(chan int, len(pageNums))
+  var converters sync.WaitGroup
+  for _, workerPageNums := range runs {
+    converters.Add(1)
+    go func(workerPageNums []int) {
+      defer converters.Done()
+      for _, pageNum := range workerPageNums {
+        if hasFailed() { break }
+
+        err := convertPage(job, params, pdfPath, jpegPath, smallJPEGPath,
+          largeJPEGPath, darkJPEGPath, pageNum)
+        if err != nil {
+          report(err)
+          return
+        }
+        converted <- pageNum
+      }
+      report(nil)
+    }(workerPageNums)
+  }
 
-  for i, randomByte := range bytes {
-    // index randomly into a list of alpha numeric characters
-    index := randomByte % byte(len(ALPHA_NUMERIC))
-    bytes[i] = ALPHA_NUMERIC[index]
+  // once every page is converted, the uploaders finish what's left
+  convertedTimes := make(chan time.Time, 1)
+  go func() {
+    converters.Wait()
+    convertedTimes <- time.Now()
+    if !hasFailed() {
+      job.setState(JOB_UPLOADING)
+    }
+    close(converted)
+  }()
+
+  for i := 0; i < numUploaders; i = i + 1 {
+    go func() {
+      for pageNum := range converted {
+        if hasFailed() { continue }
+
+        err := uploadPageToS3(job, bucket, params, jpegPath, smallJPEGPath,
+          largeJPEGPath, darkJPEGPath, pageNum)
+        if err != nil {
+          report(err)
+          return
+        }
+      }
+      report(nil)
+    }()
   }
 
-  return string(bytes)
+  err = firstError(errs, len(runs) + numUploaders)
+  return <-convertedTimes, err
 }
 
-/* Finds the PDF the user would like to convert. Downloads it to a temporary
- * file for processing. Returns the temporary file path. */
-func fetchPDF(request *http.Request, bucket *s3.Bucket) (string, error) {
-  err := request.ParseMultipartForm(MAX_MULTIPART_FORM_BYTES)
+/* Fetches the source of a conversion with `params` as downloadPDF does,
+ * and scans it for viruses before anything else touches it. Returns the
+ * temporary file path. */
+func fetchPDF(job *job, bucket *s3.Bucket, params conversionParams) (string,
+    error) {
+  sourcePath, err := downloadPDF(job, bucket, params)
   if err != nil { return "", err }
 
-  s3PDFPathSet, ok := request.Form["s3PDFPath"]
+  err = scanSource(job, sourcePath)
+  if err != nil { return "", err }
+  return sourcePath, nil
+}
 
-  // ensure user gives us precisely one PDF to convert
-  if !ok {
-    err = errors.New("Must specify a PDF to convert in the 's3PDFPath' key.\n")
-    return "", err
+/* Downloads the PDF at `s3PDFPath` to a temporary file named after `job`
+ * for processing, once `job`'s tenant gets a download slot, unless it was
+ * uploaded with the request or prefetched. Returns the temporary file
+ * path. */
+func downloadPDF(job *job, bucket *s3.Bucket, params conversionParams) (
+    string, error) {
+  // uploaded PDFs were saved to scratch along with the request
+  if params.UploadedPDFPath != "" {
+    fileInfo, err := os.Stat(params.UploadedPDFPath)
+    if err != nil { return "", err }
+
+    job.addBytesDownloaded(fileInfo.Size())
+    job.recordEvent("uploaded", 0, fmt.Sprintf("%d bytes", fileInfo.Size()))
+    return params.UploadedPDFPath, nil
   }
 
-  if len(s3PDFPathSet) != 1 {
-    err = errors.New("Must specify exactly one S3 PDF path in 's3PDFPath' key.\n")
-    return "", err
+  pdfPath := scratchPath(job.id + ".pdf")
+
+  // the PDF may have been downloaded while the job was queued
+  if params.SourceEncryption == "" {
+    numBytes, ok := prefetches.claim(job, pdfPath)
+    if ok {
+      job.addBytesDownloaded(numBytes)
+      job.recordEvent("downloaded", 0, fmt.Sprintf("%d bytes, prefetched",
+        numBytes))
+      return pdfPath, nil
+    }
   }
 
-  // find PDF in S3
-  s3PDFPath := request.Form["s3PDFPath"][0]
-  reader, err := bucket.GetReader(s3PDFPath)
+  // copy PDF from S3 into temporary file for processing
+  pdf, err := os.Create(pdfPath)
 
   if err != nil { return "", err }
-  defer reader.Close()
+  defer pdf.Close()
 
-  // copy multipart data into temporary file for processing
-  pdfPath := "/tmp/" + generateRandomString(50) + ".pdf"
-  pdf, err := os.Create(pdfPath)
+  if params.SourceEncryption == "" {
+    var numBytes int64
+    err = downloadPool.run(job.tenant, func() error {
+      return withS3Retries(job.logger(), S3_OP_DOWNLOAD, func() error {
+        // start over if an earlier attempt was cut off
+        _, err := pdf.Seek(0, 0)
+        if err != nil { return err }
+
+        err = pdf.Truncate(0)
+        if err != nil { return err }
+
+        reader, err := bucket.GetReader(params.S3PDFPath)
+        if err != nil { return err }
+        defer reader.Close()
+
+        numBytes, err = io.Copy(pdf, reader)
+        job.addBytesDownloaded(numBytes)
+        return err
+      })
+    })
+    if err != nil { return "", err }
+
+    job.recordEvent("downloaded", 0, fmt.Sprintf("%d bytes", numBytes))
+    return pdfPath, nil
+  }
 
+  // encrypted sources are decrypted in memory; only the PDF hits scratch
+  var numBytes int64
+  var plaintext []byte
+  err = downloadPool.run(job.tenant, func() error {
+    return withS3Retries(job.logger(), S3_OP_DOWNLOAD, func() error {
+      reader, err := bucket.GetReader(params.S3PDFPath)
+      if err != nil { return err }
+      defer reader.Close()
+
+      counter := &countingReader{reader: reader}
+      plaintext, err = decryptSource(counter, params)
+      job.addBytesDownloaded(counter.numBytes)
+      numBytes = counter.numBytes
+      return err
+    })
+  })
   if err != nil { return "", err }
-  defer pdf.Close()
 
-  _, err = io.Copy(pdf, reader)
+  _, err = pdf.Write(plaintext)
   if err != nil { return "", err }
 
+  job.recordEvent("downloaded", 0, fmt.Sprintf("%d bytes, decrypted to %d",
+    numBytes, len(plaintext)))
   return pdfPath, nil
 }
 
@@ -350,6 +719,174 @@ func connectToS3(bucketName string, region aws.Region) (*s3.Bucket, error) {
   return bucket, nil
 }
 
+/* Returns the local paths (each containing a '%d' for the page number) of
+ * the normal, small, large, and dark JPEGs for the job with the given ID. The
+ * dark path is empty unless `params` asks for a dark rendition. */
+func scratchJPEGPaths(jobID string, params conversionParams) (string, string,
+    string, string) {
+  // put JPEGs in the scratch folder under the job's ID
+  jpegPath := scratchPath(jobID + "-%d.jpg");
+  smallJPEGPath := scratchPath(jobID + "-%d-small.jpg");
+  largeJPEGPath := scratchPath(jobID + "-%d-large.jpg");
+
+  // the dark mode rendition is only produced on request
+  darkJPEGPath := ""
+  if params.S3DarkJPEGPath != "" {
+    darkJPEGPath = scratchPath(jobID + "-%d-dark.jpg");
+  }
+
+  return jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath
+}
+
+/* Finishes `job`, a conversion with `params` whose outputs `existing`
+ * already describes, by reporting them instead of rendering them again.
+ * `startTime` is when the job started, and `fetchedTime` when it found
+ * `existing`. Returns the number of pages in the document. */
+func reuseManifest(job *job, bucket *s3.Bucket, params conversionParams,
+    existing manifest, startTime time.Time, fetchedTime time.Time) (int,
+    error) {
+  pageNums, err := pagesToConvert(existing.NumPages, params)
+  if err != nil { return existing.NumPages, err }
+  job.setPages(pageNums, isPartialConversion(params))
+
+  timing := conversionTiming{
+    FetchMS: millisecondsBetween(startTime, fetchedTime),
+    TotalMS: millisecondsBetween(startTime, time.Now()),
+  }
+  result, err := newConversionResult(job, bucket, params, existing.NumPages,
+    pageNums, nil, timing)
+  if err != nil { return existing.NumPages, err }
+
+  job.setResult(result)
+  return existing.NumPages, nil
+}
+
+/* Carries out the conversion described by `params` as `job`: downloads the
+ * PDF, converts it to JPEGs, uploads them to S3, and writes a manifest if
+ * requested. Returns the number of pages converted. */
+func runConversion(job *job, bucket *s3.Bucket,
+    params conversionParams) (int, error) {
+  job.setConversion(bucket, params)
+  startTime := time.Now()
+
+  // another instance may have already converted this version of the source
+  sourceETag, recorded := findInLedger(job, bucket, params)
+  if recorded != nil {
+    return reuseManifest(job, bucket, params, *recorded, startTime,
+      time.Now())
+  }
+
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return 0, err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return 0, err }
+  params.SourceFormat = format
+
+  params, err = fetchWatermark(job, bucket, params)
+  if err != nil { return 0, err }
+  params = detectPageRotations(job, params, pdfPath)
+  fetchedTime := time.Now()
+
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED {
+    // distilled PDFs differ each time, so hash what was fetched
+    params, err = resolveContentAddressedPaths(params, sourcePath)
+    if err != nil { return 0, err }
+    job.setOutputPrefix(path.Dir(params.S3ManifestPath) + "/")
+
+    // if this exact render already exists, there's nothing to do
+    existing, err := readManifest(bucket, params.S3ManifestPath)
+    if err == nil && existing.PipelineVersion == PIPELINE_VERSION {
+      return reuseManifest(job, bucket, params, existing, startTime,
+        fetchedTime)
+    }
+    if err != nil && !isS3NotFound(err) { return 0, err }
+  }
+
+  jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath :=
+    scratchJPEGPaths(job.id, params)
+
+  numPages, err := countPages(pdfPath, format)
+  if err != nil { return 0, err }
+
+  pageNums, err := pagesToConvert(numPages, params)
+  if err != nil { return numPages, err }
+
+  // pages that are unchanged since the last conversion aren't rendered
+  pageHashes := hashPages(job, params, pdfPath, numPages)
+  base, err := findIncrementalBase(job, bucket, params, pageHashes)
+  if err != nil { return 0, err }
+
+  if base != nil {
+    pageNums = pageNums[len(base.PageHashes):]
+  }
+  job.setPages(pageNums, isPartialConversion(params) || base != nil)
+  throughput.jobCounted(len(pageNums))
+
+  release := admitToScratch(job, params, pdfPath, pageNums)
+  defer release()
+
+  convertStartTime := time.Now()
+  job.setState(JOB_CONVERTING)
+  uploadStartTime, err := convertAndUploadPages(job, bucket, params, pdfPath,
+    jpegPath, smallJPEGPath, largeJPEGPath, darkJPEGPath, pageNums)
+  if err != nil { return numPages, err }
+
+  err = uploadSprite(job, bucket, params, smallJPEGPath, pageNums)
+  if err != nil { return numPages, err }
+
+  var diff *manifestDiff
+  if params.ManifestPart {
+    // the manifest is assembled from its parts once they're all converted
+    err = writeManifestPart(bucket, newManifest(job, params, numPages))
+    if err != nil { return numPages, err }
+  } else if params.S3ManifestPath != "" {
+    previous := previousManifest(job, bucket, params, base)
+    manifest := newManifest(job, params, numPages)
+    manifest.PageHashes = pageHashes
+    if base != nil {
+      manifest = mergeIncrementalManifest(*base, manifest)
+    }
+
+    err = writeManifest(bucket, manifest)
+    if err != nil { return numPages, err }
+
+    if previous != nil {
+      changes := diffManifests(*previous, manifest, pageNums)
+      diff = &changes
+    }
+  }
+
+  endTime := time.Now()
+  timing := conversionTiming{
+    FetchMS: millisecondsBetween(startTime, fetchedTime),
+    ConvertMS: millisecondsBetween(convertStartTime, uploadStartTime),
+    UploadMS: millisecondsBetween(uploadStartTime, endTime),
+    TotalMS: millisecondsBetween(startTime, endTime),
+  }
+
+  scratchPaths := map[string]string{TIER_NORMAL: jpegPath,
+    TIER_SMALL: smallJPEGPath, TIER_LARGE: largeJPEGPath}
+  if darkJPEGPath != "" {
+    scratchPaths[TIER_DARK] = darkJPEGPath
+  }
+  if len(params.Sizes) > 0 {
+    scratchPaths = scratchSizePaths(job.id, params)
+  }
+
+  result, err := newConversionResult(job, bucket, params, numPages,
+    pageNums, scratchPaths, timing)
+  if err != nil { return numPages, err }
+
+  if base != nil {
+    result.UnchangedPages = len(base.PageHashes)
+  }
+  result.Diff = diff
+  job.setResult(result)
+  recordInLedger(job, bucket, params, sourceETag, numPages)
+  return numPages, nil
+}
+
 /* Converts the PDF in the given multipart request to a set of JPEGs. Uploads
  * the JPEGs to S3. */
 func convert(writer http.ResponseWriter, request *http.Request,
@@ -359,47 +896,334 @@ func convert(writer http.ResponseWriter, request *http.Request,
     return
   }
 
-  bucket, err := connectToS3(bucketName, aws.Regions[regionName])
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  // identify this conversion in scratch paths, logs, and the response
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+
+  // record the outcome of this conversion once it's finished
+  var err error
+  var params conversionParams
+  async := false
+  numPages := 0
+  startTime := time.Now()
+  defer func() {
+    // queued asynchronous conversions are finished by their worker
+    if async && err == nil { return }
+
+    job.finish(err)
+    sendCallback(params.CallbackURL, job)
+    recordInDataLake(job, params)
+    cleanupScratch(jobID)
+    auditConversion(request, jobID, numPages, startTime, err)
+  }()
+
+  err = parseUploadForm(writer, request, jobID)
   if handleError(err, writer) { return }
 
-  pdfPath, err := fetchPDF(request, bucket)
+  params, err = parseConversionParams(request)
   if handleError(err, writer) { return }
+  params = useUploadedPDF(job, params)
 
-  // put JPEGs in tmp folder under random prefix
-  jpegPrefix := generateRandomString(50);
-  jpegPath := fmt.Sprintf("/tmp/%s%%d.jpg", jpegPrefix);
-  smallJPEGPath := fmt.Sprintf("/tmp/%s%%d-small.jpg", jpegPrefix);
-  largeJPEGPath := fmt.Sprintf("/tmp/%s%%d-large.jpg", jpegPrefix);
+  async, err = parseAsync(request.Form)
+  if handleError(err, writer) { return }
 
-  numPages, err := convertPDFToJPEGs(pdfPath, jpegPath, smallJPEGPath,
-    largeJPEGPath)
+  // in maintenance mode, only conversions that can wait for it to end are
+  // accepted
+  if !async && rejectDuringMaintenance(writer) {
+    err = errMaintenance
+    return
+  }
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
   if handleError(err, writer) { return }
 
-  err = uploadAllJPEGsToS3(bucket, request, jpegPath, smallJPEGPath,
-    largeJPEGPath, numPages)
+  if async {
+    err = queueAsyncJob(asyncTask{job, bucket, params, request, startTime})
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+      return
+    }
+
+    writer.Header().Set("Location", "/jobs/" + jobID)
+    writeJSON(writer, http.StatusAccepted, job.status())
+    return
+  }
+
+  numPages, err = runConversion(job, bucket, params)
+  if errorCode(err) == ERROR_CODE_INFECTED {
+    job.logger().Warn("Conversion rejected", errorAttr(err))
+    writer.Header().Set("X-Error-Code", ERROR_CODE_INFECTED)
+    http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+    return
+  }
   if handleError(err, writer) { return }
 
-  fmt.Printf("Conversion finished\n")
-  fmt.Fprintf(writer, "Done\n")
+  // content-addressed outputs live under a prefix only known now
+  status := job.status()
+  if status.OutputPrefix != "" {
+    writer.Header().Set("X-Output-Prefix", status.OutputPrefix)
+  }
+
+  // partial conversions only render some pages; tell the client which
+  if status.RenderedPages != nil {
+    writer.Header().Set("X-Rendered-Pages",
+      formatPageList(status.RenderedPages))
+  }
+
+  job.logger().Info("Conversion finished", "pages", numPages)
+  writeJSON(writer, http.StatusOK, status.Result)
 }
 
 /* Starts up a server to handle PDF to JPEG conversions. */
 func main() {
   socket := "0.0.0.0:7000"
-  fmt.Printf("Serving on %s\n", socket)
 
-  // must have three arguments: file path, bucket name, and region name
-  if len(os.Args) != 3 {
+  // must have two positional arguments: bucket name and region name
+  flag.Parse()
+  if flag.NArg() != 2 {
     baseName := filepath.Base(os.Args[0])
-    fmt.Printf("Usage: %s [bucketName] [regionName]\n", baseName)
+    fmt.Printf("Usage: %s [flags] [bucketName] [regionName]\n", baseName)
+    flag.PrintDefaults()
     os.Exit(1)
   }
 
-  bucketName := os.Args[1]
-  regionName := os.Args[2]
+  err := setupLogging()
+  if err != nil { fatal("Invalid configuration", err) }
+  logger.Info("Serving", "address", socket)
+
+  bucketName := flag.Arg(0)
+  regionName := flag.Arg(1)
+
+  err = validateIDScheme(*idScheme)
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateRetryClasses()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupDualWrite()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validatePresignExpiry()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateRequestSigning()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateUploadURLExpiry()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateWorkerCounts()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupManifestSigning()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  if *maxProcesses < 1 {
+    fatal("Invalid configuration",
+      errors.New("-max-processes must be at least 1.\n"))
+  }
+  processSlots = newProcessLimiter(*maxProcesses)
+
+  err = setupAllowedBuckets(bucketName, regionName)
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateClassifyPayload()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupFaults()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupToolRunner()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupGhostscript()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupMuPDF()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupGhostscriptArgs()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupGPURenderer()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = setupRemoteWorkers()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = validateRendererNames(*rendererFallback, "-renderer-fallback")
+  if err != nil { fatal("Invalid configuration", err) }
+
+  if *requireEncryptedScratch {
+    err = checkScratchEncrypted()
+    if err != nil { fatal("Invalid configuration", err) }
+  }
+
+  trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag)
+  if err != nil { fatal("Invalid configuration", err) }
+
+  err = loadTemplates()
+  if err != nil { fatal("Couldn't load templates", err) }
+
+  err = loadEmailRoutes()
+  if err != nil { fatal("Couldn't load email routes", err) }
+
+  err = setupWatch()
+  if err != nil { fatal("Couldn't set up watched folders", err) }
+
+  checkExternalResizer()
+
+  if *apiKeysPath != "" {
+    apiKeys, err = loadAPIKeys(*apiKeysPath)
+    if err != nil {
+      fatal("Couldn't load API keys", err)
+    }
+  }
+
+  // tenants share each stage's slots according to their weights
+  err = setupStagePools()
+  if err != nil { fatal("Invalid configuration", err) }
+
+  for _, key := range apiKeys {
+    if key.Weight > 0 {
+      setTenantWeight(key.Name, key.Weight)
+    }
+  }
+
+  if *auditLogPath != "" {
+    // rotated audit logs are optionally shipped to the conversion bucket
+    var auditBucket *s3.Bucket = nil
+    if *auditLogS3Prefix != "" {
+      bucket, err := connectToS3(bucketName, aws.Regions[regionName])
+      if err != nil {
+        fatal("Couldn't connect to S3 for audit log", err)
+      }
+      auditBucket = bucket
+    }
+
+    log, err := openAuditLog(*auditLogPath, *auditLogMaxBytes,
+      *auditLogMaxFiles, auditBucket, *auditLogS3Prefix)
+    if err != nil {
+      fatal("Couldn't open audit log", err)
+    }
+    audit = log
+  }
+
+  go processRerenders()
+
+  // data lake records are written to the server's bucket
+  dataLakeBucket, err := connectToS3(bucketName, aws.Regions[regionName])
+  if err != nil {
+    fatal("Couldn't connect to S3", err)
+  }
+  err = setupDataLake(dataLakeBucket)
+  if err != nil { fatal("Invalid configuration", err) }
 
+  err = setupLedger(regionName)
+  if err != nil { fatal("Invalid configuration", err) }
+
+  for i := 0; i < *asyncWorkers; i = i + 1 {
+    go processAsyncJobs()
+  }
+  err = restoreSpooledJobs(bucketName, regionName)
+  if err != nil { fatal("Couldn't restore spooled conversions", err) }
+  go prefetches.run()
+  go runWatch(bucketName, regionName)
+
+  if *scratchMaxAge > 0 {
+    if *scratchSweepInterval <= 0 {
+      fatal("Invalid configuration",
+        errors.New("-scratch-sweep-interval must be positive.\n"))
+    }
+    go runScratchJanitor()
+  }
+
+  http.HandleFunc("/jobs", serveJobSearch)
+  http.HandleFunc("/jobs/", serveJobs)
+  http.HandleFunc("/metrics", serveMetrics)
+  http.HandleFunc("/manifest-signing-key", serveManifestSigningKey)
+  http.HandleFunc("/scaling", serveScaling)
+  http.HandleFunc("/healthz", serveHealthz)
+  http.HandleFunc("/readyz", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveReadyz(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/ui", serveUI)
+  http.HandleFunc("/workers", serveWorkers)
+  http.HandleFunc("/check", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveCheck(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/repair", func(writer http.ResponseWriter,
+      request *http.Request) {
+    repairDocument(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/info", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveInfo(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/pages", func(writer http.ResponseWriter,
+      request *http.Request) {
+    regeneratePage(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/split", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveSplit(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/combine", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveCombine(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/pagecount", func(writer http.ResponseWriter,
+      request *http.Request) {
+    servePageCount(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/assemble", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveAssembly(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/ledger", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveLedger(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/documents/", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveDocuments(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/renditions/", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveReadThrough(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/uploads", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveUploadURLs(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/email/ses", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveSESNotifications(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/admin/weights", serveWeights)
+  http.HandleFunc("/admin/templates", serveTemplates)
+  http.HandleFunc("/admin/config", serveConfig)
+  http.HandleFunc("/admin/maintenance", serveMaintenance)
+  http.HandleFunc("/admin/rerender", func(writer http.ResponseWriter,
+      request *http.Request) {
+    rerender(writer, request, bucketName, regionName)
+  })
+  http.HandleFunc("/admin/resize", func(writer http.ResponseWriter,
+      request *http.Request) {
+    serveResizeMigration(writer, request, bucketName, regionName)
+  })
   http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
     convert(writer, request, bucketName, regionName)
   })
-  http.ListenAndServe(socket, nil)
+  server := &http.Server{Addr: socket,
+    Handler: withRequestID(withRequestSignatures(
+      compressJSON(http.DefaultServeMux)))}
+  err = setupTLS(server)
+  if err != nil { fatal("Invalid configuration", err) }
+  serveUntilSignaled(server)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "net/http"
+  "os"
+  "os/signal"
+  "sync"
+  "syscall"
+  "time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5 * time.Minute,
+  "how long to wait for in-flight conversions to finish on SIGTERM or SIGINT")
+
+var errShuttingDown = errors.New("The server is shutting down.\n")
+
+/* Tracks the conversions being run by background workers, so shutdown can
+ * wait for them. Once stopping, no more may start. */
+type workTracker struct {
+  mutex sync.Mutex
+  stopping bool
+  running sync.WaitGroup
+}
+
+var backgroundWork = &workTracker{}
+
+/* Registers the start of a conversion. Returns false if the server is
+ * shutting down, in which case it mustn't be started. */
+func (tracker *workTracker) start() bool {
+  tracker.mutex.Lock()
+  defer tracker.mutex.Unlock()
+
+  if tracker.stopping { return false }
+  tracker.running.Add(1)
+  return true
+}
+
+/* Returns true once the server has started shutting down. */
+func (tracker *workTracker) isStopping() bool {
+  tracker.mutex.Lock()
+  defer tracker.mutex.Unlock()
+  return tracker.stopping
+}
+
+/* Registers the end of a conversion started with start(). */
+func (tracker *workTracker) end() {
+  tracker.running.Done()
+}
+
+/* Stops new conversions from starting and waits until running ones finish
+ * or `ctx` expires. Returns false if it gave up waiting. */
+func (tracker *workTracker) drain(ctx context.Context) bool {
+  tracker.mutex.Lock()
+  tracker.stopping = true
+  tracker.mutex.Unlock()
+
+  drained := make(chan struct{})
+  go func() {
+    tracker.running.Wait()
+    close(drained)
+  }()
+
+  select {
+  case <-drained:
+    return true
+  case <-ctx.Done():
+    return false
+  }
+}
+
+/* Serves with `server` until SIGTERM or SIGINT, then shuts down gracefully:
+ * stops accepting requests, waits up to -shutdown-timeout for in-flight
+ * conversions, both synchronous and background, to finish, and removes the
+ * scratch files of any that didn't. */
+func serveUntilSignaled(server *http.Server) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+  stopped := make(chan struct{})
+  go func() {
+    received := <-signals
+    logger.Info("Shutting down; waiting for conversions to finish",
+      "signal", received.String(), "timeout", shutdownTimeout.String())
+    shutDown(server)
+    close(stopped)
+  }()
+
+  var err error
+  if server.TLSConfig != nil {
+    // the certificate is already in the TLS config
+    err = server.ListenAndServeTLS("", "")
+  } else {
+    err = server.ListenAndServe()
+  }
+  if err != http.ErrServerClosed {
+    fatal("Couldn't serve", err)
+  }
+  <-stopped
+}
+
+/* Shuts `server` and the background workers down, as described in
+ * serveUntilSignaled. */
+func shutDown(server *http.Server) {
+  ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+  defer cancel()
+
+  // waits for in-flight requests, including synchronous conversions
+  err := server.Shutdown(ctx)
+  if err != nil {
+    logger.Warn("Gave up waiting for requests", errorAttr(err))
+  }
+
+  if !backgroundWork.drain(ctx) {
+    logger.Warn("Gave up waiting for background conversions")
+  }
+
+  // whatever didn't finish is abandoned, so its files won't be needed
+  for _, job := range jobs.unfinished() {
+    job.logger().Warn("Abandoning job")
+    removeScratch(job.id)
+  }
+  logger.Info("Shut down")
+}
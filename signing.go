@@ -0,0 +1,179 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "flag"
+  "hash"
+  "io"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+var requestSecret = flag.String("request-secret", "",
+  "secret requests that change anything must be signed with using " +
+  "HMAC-SHA256 (unsigned requests are accepted if empty)")
+var requestSignatureWindow = flag.Duration("request-signature-window",
+  5 * time.Minute,
+  "how far a signed request's timestamp may be from the server's clock; " +
+  "signatures are remembered this long so they can't be replayed")
+
+// headers a signed request carries, like callbacks
+const (
+  TIMESTAMP_HEADER = "X-Evangelist-Timestamp"
+  SIGNATURE_HEADER = "X-Evangelist-Signature"
+)
+
+// signatures accepted recently, and when they expire
+var seenSignatures = map[string]time.Time{}
+var seenSignaturesMutex sync.Mutex
+
+/* Checks that -request-signature-window is usable. */
+func validateRequestSigning() error {
+  if *requestSecret != "" && *requestSignatureWindow <= 0 {
+    return errors.New("-request-signature-window must be positive.\n")
+  }
+  return nil
+}
+
+/* Returns true if requests to `request`'s path with its method must be
+ * signed: those that change anything, except SNS notifications, which SNS
+ * signs itself. */
+func requiresSignature(request *http.Request) bool {
+  if *requestSecret == "" { return false }
+  if request.Method == "GET" || request.Method == "HEAD" ||
+      request.Method == "OPTIONS" {
+    return false
+  }
+  return request.URL.Path != "/email/ses"
+}
+
+/* Returns a MAC for the request signature of a request with the given
+ * timestamp, method, and request URI, to which its body must be written.
+ * The signature is the hex HMAC-SHA256 of
+ * "{timestamp}.{method}.{requestURI}.{body}" under -request-secret. */
+func newRequestMAC(timestamp string, method string,
+    requestURI string) hash.Hash {
+  mac := hmac.New(sha256.New, []byte(*requestSecret))
+  mac.Write([]byte(timestamp + "." + method + "." + requestURI + "."))
+  return mac
+}
+
+/* Returns an error unless `timestamp` is within -request-signature-window
+ * of now. */
+func checkSignatureTimestamp(timestamp string) error {
+  seconds, err := strconv.ParseInt(timestamp, 10, 64)
+  if err != nil {
+    return errors.New("The " + TIMESTAMP_HEADER + " header must be Unix " +
+      "seconds.\n")
+  }
+
+  skew := time.Since(time.Unix(seconds, 0))
+  if skew > *requestSignatureWindow || skew < -*requestSignatureWindow {
+    return errors.New("The request's timestamp is outside the signature " +
+      "window.\n")
+  }
+  return nil
+}
+
+/* Records `signature` as used, returning an error if it already was within
+ * the signature window. */
+func claimSignature(signature string) error {
+  seenSignaturesMutex.Lock()
+  defer seenSignaturesMutex.Unlock()
+
+  now := time.Now()
+  for seen, expiresAt := range seenSignatures {
+    if now.After(expiresAt) {
+      delete(seenSignatures, seen)
+    }
+  }
+
+  if _, ok := seenSignatures[signature]; ok {
+    return errors.New("The request was already made; sign it again with a " +
+      "new timestamp.\n")
+  }
+
+  // a timestamp can be up to a window in the future, so the signature stays
+  // valid for up to two windows
+  seenSignatures[signature] = now.Add(2 * *requestSignatureWindow)
+  return nil
+}
+
+/* Verifies the signature of `request`, spooling its body to `spool` along
+ * the way so it can be read again once verified. */
+func verifyRequestSignature(request *http.Request, spool io.Writer) error {
+  timestamp := request.Header.Get(TIMESTAMP_HEADER)
+  signature := strings.TrimPrefix(request.Header.Get(SIGNATURE_HEADER),
+    "sha256=")
+  if timestamp == "" || signature == "" {
+    return errors.New("Must sign the request in the " + TIMESTAMP_HEADER +
+      " and " + SIGNATURE_HEADER + " headers.\n")
+  }
+
+  err := checkSignatureTimestamp(timestamp)
+  if err != nil { return err }
+
+  mac := newRequestMAC(timestamp, request.Method, request.URL.RequestURI())
+  _, err = io.Copy(io.MultiWriter(spool, mac), request.Body)
+  if err != nil { return err }
+
+  expected := hex.EncodeToString(mac.Sum(nil))
+  if !hmac.Equal([]byte(signature), []byte(expected)) {
+    return errors.New("The request's signature is invalid.\n")
+  }
+
+  return claimSignature(expected)
+}
+
+/* Wraps `handler` so requests that change anything must be signed with
+ * -request-secret, if set, and can't be replayed. Bodies are spooled to
+ * scratch while verifying, so large uploads aren't held in memory, and are
+ * capped at MAX_UPLOAD_BYTES first, so unsigned ones can't fill scratch. */
+func withRequestSignatures(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(writer http.ResponseWriter,
+      request *http.Request) {
+    if !requiresSignature(request) {
+      handler.ServeHTTP(writer, request)
+      return
+    }
+
+    if request.ContentLength > MAX_UPLOAD_BYTES {
+      http.Error(writer, uploadError(&http.MaxBytesError{
+        Limit: MAX_UPLOAD_BYTES}).Error(), http.StatusRequestEntityTooLarge)
+      return
+    }
+    request.Body = http.MaxBytesReader(writer, request.Body, MAX_UPLOAD_BYTES)
+
+    spool, err := os.CreateTemp(*scratchDir, "request-*.body")
+    if handleError(err, writer) { return }
+    defer os.Remove(spool.Name())
+    defer spool.Close()
+
+    err = verifyRequestSignature(request, spool)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+      http.Error(writer, uploadError(err).Error(),
+        http.StatusRequestEntityTooLarge)
+      return
+    }
+    if err != nil {
+      logger.Warn("Rejected unsigned request", "request", requestID(request),
+        "path", request.URL.Path, errorAttr(err))
+      http.Error(writer, err.Error(), http.StatusUnauthorized)
+      return
+    }
+
+    _, err = spool.Seek(0, io.SeekStart)
+    if handleError(err, writer) { return }
+
+    request.Body = spool
+    handler.ServeHTTP(writer, request)
+  })
+}
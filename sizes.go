@@ -0,0 +1,259 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log/slog"
+  "net/url"
+  "regexp"
+  "strconv"
+  "strings"
+  "launchpad.net/goamz/s3"
+)
+
+// the boxes the normal and small renditions are resized to fit in, unless a
+// request asks for its own sizes
+const (
+  NORMAL_MAX_DIMENSION = 800
+  SMALL_MAX_DIMENSION = 300
+)
+
+// most size profiles a request may ask for, and largest box one may have
+const (
+  MAX_SIZE_PROFILES = 16
+  MAX_SIZE_DIMENSION = 10000
+)
+
+// a size profile that keeps the rendered page's own size
+const SIZE_FULL = "full"
+
+// what a size profile's name may look like; names appear in keys and
+// results, so they're kept short and plain
+var SIZE_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// a profile's dimensions, e.g. "1000x1000"
+var SIZE_DIMENSIONS_PATTERN = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// names results already use for other outputs
+var RESERVED_SIZE_NAMES = map[string]bool{TEXT_PLAIN: true, TEXT_HOCR: true,
+  TEXT_OCR_INFO: true, SPRITE_IMAGE: true, SPRITE_INDEX: true}
+
+/* A rendition a request asked for in place of the normal, small, and large
+ * ones: the page resized to fit within `Width` by `Height`, or left at its
+ * rendered size if both are 0, uploaded to the key template `S3Path`. */
+type sizeProfile struct {
+  Name string `json:"name"`
+  Width int `json:"width,omitempty"`
+  Height int `json:"height,omitempty"`
+  S3Path string `json:"s3Path,omitempty"`
+}
+
+/* Returns true if the profile keeps the rendered size. */
+func (profile sizeProfile) isFull() bool {
+  return profile.Width == 0 && profile.Height == 0
+}
+
+/* Returns the size profiles in the `sizes` key of `form`, a comma-separated
+ * list of name:WIDTHxHEIGHT or name:full, e.g.
+ * "thumb:200x200,web:1000x1000,print:full", or nil if it's absent. Their
+ * paths are parsed separately, once the layout is known. */
+func parseSizes(form url.Values) ([]sizeProfile, error) {
+  value, err := optionalFormValue(form, "sizes")
+  if err != nil || value == "" { return nil, err }
+
+  profiles := []sizeProfile{}
+  names := map[string]bool{}
+  for _, entry := range strings.Split(value, ",") {
+    parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+    if len(parts) != 2 {
+      return nil, errors.New(fmt.Sprintf("The size '%s' must look like " +
+        "name:WIDTHxHEIGHT or name:full.\n", entry))
+    }
+
+    profile := sizeProfile{Name: parts[0]}
+    if !SIZE_NAME_PATTERN.MatchString(profile.Name) {
+      return nil, errors.New(fmt.Sprintf("'%s' isn't a valid size name; " +
+        "names are letters, digits, '-', and '_'.\n", profile.Name))
+    }
+    if RESERVED_SIZE_NAMES[profile.Name] {
+      return nil, errors.New(fmt.Sprintf("'%s' is reserved and can't name " +
+        "a size.\n", profile.Name))
+    }
+    if names[profile.Name] {
+      return nil, errors.New(fmt.Sprintf("The size '%s' is given more " +
+        "than once.\n", profile.Name))
+    }
+    names[profile.Name] = true
+
+    if parts[1] != SIZE_FULL {
+      match := SIZE_DIMENSIONS_PATTERN.FindStringSubmatch(parts[1])
+      if match != nil {
+        profile.Width, _ = strconv.Atoi(match[1])
+        profile.Height, _ = strconv.Atoi(match[2])
+      }
+      if match == nil || profile.Width < 1 || profile.Height < 1 ||
+          profile.Width > MAX_SIZE_DIMENSION ||
+          profile.Height > MAX_SIZE_DIMENSION {
+        return nil, errors.New(fmt.Sprintf("The size '%s' must be 'full' " +
+          "or WIDTHxHEIGHT, each from 1 to %d.\n", profile.Name,
+          MAX_SIZE_DIMENSION))
+      }
+    }
+    profiles = append(profiles, profile)
+  }
+
+  if len(profiles) > MAX_SIZE_PROFILES {
+    return nil, errors.New(fmt.Sprintf("At most %d sizes may be given.\n",
+      MAX_SIZE_PROFILES))
+  }
+  return profiles, nil
+}
+
+/* Parses the S3 path template of each of the size profiles in `params`
+ * from the `s3JPEGPath.{name}` keys of `form`, which replace the normal,
+ * small, large, and dark ones. */
+func parseSizePaths(form url.Values, params *conversionParams) error {
+  for _, key := range []string{"s3JPEGPath", "s3SmallJPEGPath",
+      "s3LargeJPEGPath", "s3DarkJPEGPath"} {
+    if _, ok := form[key]; ok {
+      return errors.New(fmt.Sprintf("The '%s' key can't be combined with " +
+        "'sizes'; give each size's path in 's3JPEGPath.{name}'.\n", key))
+    }
+  }
+
+  var err error
+  for i, profile := range params.Sizes {
+    params.Sizes[i].S3Path, err = requirePathTemplate(form,
+      "s3JPEGPath." + profile.Name,
+      fmt.Sprintf("a JPEG path for the '%s' size", profile.Name))
+    if err != nil { return err }
+  }
+  return nil
+}
+
+/* Returns an error if `params` asks for sizes along with an option that
+ * needs the normal, small, or dark renditions. */
+func validateSizeCombinations(params conversionParams) error {
+  if len(params.Sizes) == 0 { return nil }
+
+  options := []string{}
+  if params.Dark || params.S3DarkJPEGPath != "" {
+    options = append(options, "dark renditions")
+  }
+  if params.ExtractText { options = append(options, "'extractText'") }
+  if params.Classify { options = append(options, "'classify'") }
+  if params.SpriteColumns != 0 {
+    options = append(options, "'spriteColumns'")
+  }
+  if params.DualWrite { options = append(options, "'dualWrite'") }
+
+  if len(options) > 0 {
+    return errors.New("The 'sizes' key can't be combined with " +
+      strings.Join(options, ", ") + ".\n")
+  }
+  return nil
+}
+
+/* Returns true if `a` and `b` ask for the same sizes at the same paths. */
+func sameSizes(a []sizeProfile, b []sizeProfile) bool {
+  if len(a) != len(b) { return false }
+  for i := range a {
+    if a[i] != b[i] { return false }
+  }
+  return true
+}
+
+/* Returns the local path template of each size profile of `params` for the
+ * job with the given ID, keyed by name. */
+func scratchSizePaths(jobID string, params conversionParams) map[string]string {
+  paths := map[string]string{}
+  for _, profile := range params.Sizes {
+    paths[profile.Name] = scratchPath(jobID + "-%d-size-" + profile.Name +
+      ".jpg")
+  }
+  return paths
+}
+
+/* Returns the local path template of the smallest size in `sizePaths`,
+ * which stands in for the small rendition in job previews. */
+func smallestSizePath(params conversionParams,
+    sizePaths map[string]string) string {
+  smallest := ""
+  smallestArea := -1
+  for _, profile := range params.Sizes {
+    area := profile.Width * profile.Height
+    if profile.isFull() { area = MAX_SIZE_DIMENSION * MAX_SIZE_DIMENSION + 1 }
+
+    if smallestArea == -1 || area < smallestArea {
+      smallest, smallestArea = sizePaths[profile.Name], area
+    }
+  }
+  return smallest
+}
+
+/* Derives each of the sizes `params` asks for of page `pageNum` from its
+ * large JPEG at `largeJPEGPath`, as resizePageJPEGs does for the normal,
+ * small, and dark renditions, saving them at `sizePaths`. Each is encoded
+ * as the `jpegEncoding` key asks. */
+func resizePageSizes(log *slog.Logger, params conversionParams,
+    largeJPEGPath string, sizePaths map[string]string, pageNum int,
+    metadata *pageMetadata) error {
+  largeJPEGPathForPage := fmt.Sprintf(largeJPEGPath, pageNum)
+
+  // refuse pages too large to decode before ImageMagick tries
+  megapixels, err := reserveDecodeBudget(largeJPEGPathForPage, pageNum)
+  if err != nil {
+    log.Error("Couldn't decode image", "page", pageNum, errorAttr(err))
+    return err
+  }
+  defer decodeBudget.release(megapixels)
+
+  err = applyWatermark(params, largeJPEGPathForPage)
+  if err != nil {
+    log.Error("Couldn't watermark image", "page", pageNum, errorAttr(err))
+    return err
+  }
+
+  for _, profile := range params.Sizes {
+    sizePathForPage := fmt.Sprintf(sizePaths[profile.Name], pageNum)
+    if profile.isFull() {
+      // a copy, since each size is encoded and tagged separately
+      var data []byte
+      data, err = ioutil.ReadFile(largeJPEGPathForPage)
+      if err == nil {
+        err = ioutil.WriteFile(sizePathForPage, data, 0600)
+      }
+    } else {
+      err = resizeAndSaveImage(largeJPEGPathForPage, sizePathForPage,
+        profile.Width, profile.Height)
+    }
+    if err != nil {
+      log.Error("Couldn't resize image", "page", pageNum,
+        "size", profile.Name, errorAttr(err))
+      return err
+    }
+
+    err = finishJPEG(sizePathForPage, profile.Name, params.JPEGEncoding,
+      metadata)
+    if err != nil {
+      log.Error("Couldn't encode image", "page", pageNum,
+        "size", profile.Name, errorAttr(err))
+      return err
+    }
+  }
+  return nil
+}
+
+/* Uploads each size of page `pageNum` that `params` asks for, as
+ * uploadPageToS3 does for the normal, small, and large renditions. */
+func uploadPageSizes(job *job, bucket *s3.Bucket, params conversionParams,
+    pageNum int) error {
+  sizePaths := scratchSizePaths(job.id, params)
+  for _, profile := range params.Sizes {
+    err := uploadJPEGToS3(job, bucket, params, sizePaths[profile.Name],
+      profile.S3Path, pageNum)
+    if err != nil { return err }
+  }
+  return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+  "crypto"
+  "crypto/rsa"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "regexp"
+  "sync"
+  "time"
+)
+
+// how long SNS may take to deliver a message before it's refused as a
+// replay; messages are also remembered this long to drop duplicates
+const SNS_MAX_MESSAGE_AGE = time.Hour
+
+// timeout for fetching SNS signing certificates and confirming
+// subscriptions
+const SNS_FETCH_TIMEOUT = 10 * time.Second
+
+// hosts SNS signing certificates and subscription URLs may live on
+var SNS_HOST_PATTERN = regexp.MustCompile(
+  `^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsClient = &http.Client{Timeout: SNS_FETCH_TIMEOUT}
+
+/* A message POSTed by SNS to an HTTP subscription. */
+type snsMessage struct {
+  Type string
+  MessageId string
+  Token string
+  TopicArn string
+  Subject string
+  Message string
+  Timestamp string
+  SignatureVersion string
+  Signature string
+  SigningCertURL string
+  SubscribeURL string
+}
+
+// public keys of SNS signing certificates, by URL
+var snsKeys = map[string]*rsa.PublicKey{}
+var snsKeysMutex sync.Mutex
+
+// IDs of messages handled recently, and when they were sent
+var seenSNSMessages = map[string]time.Time{}
+var seenSNSMessagesMutex sync.Mutex
+
+/* Returns true if `rawURL` is an HTTPS URL on an SNS host. */
+func isSNSURL(rawURL string) bool {
+  parsed, err := url.Parse(rawURL)
+  return err == nil && parsed.Scheme == "https" &&
+    SNS_HOST_PATTERN.MatchString(parsed.Host)
+}
+
+/* Returns the string SNS signed for `message`: the names and values of its
+ * signed fields, in order, each on its own line. */
+func (message snsMessage) signedString() string {
+  fields := [][]string{{"Message", message.Message},
+    {"MessageId", message.MessageId}}
+
+  if message.Type == "Notification" {
+    if message.Subject != "" {
+      fields = append(fields, []string{"Subject", message.Subject})
+    }
+    fields = append(fields, []string{"Timestamp", message.Timestamp})
+  } else {
+    fields = append(fields, []string{"SubscribeURL", message.SubscribeURL},
+      []string{"Timestamp", message.Timestamp},
+      []string{"Token", message.Token})
+  }
+  fields = append(fields, []string{"TopicArn", message.TopicArn},
+    []string{"Type", message.Type})
+
+  signed := ""
+  for _, field := range fields {
+    signed += field[0] + "\n" + field[1] + "\n"
+  }
+  return signed
+}
+
+/* Returns the public key of the SNS signing certificate at `certURL`,
+ * fetching it the first time. */
+func snsSigningKey(certURL string) (*rsa.PublicKey, error) {
+  snsKeysMutex.Lock()
+  defer snsKeysMutex.Unlock()
+
+  if key, ok := snsKeys[certURL]; ok { return key, nil }
+
+  response, err := snsClient.Get(certURL)
+  if err != nil { return nil, err }
+  defer response.Body.Close()
+
+  body, err := ioutil.ReadAll(response.Body)
+  if err != nil { return nil, err }
+
+  block, _ := pem.Decode(body)
+  if response.StatusCode != http.StatusOK || block == nil {
+    return nil, errors.New("Couldn't fetch the SNS signing certificate.\n")
+  }
+
+  certificate, err := x509.ParseCertificate(block.Bytes)
+  if err != nil { return nil, err }
+
+  key, ok := certificate.PublicKey.(*rsa.PublicKey)
+  if !ok {
+    return nil, errors.New("The SNS signing certificate isn't RSA.\n")
+  }
+
+  snsKeys[certURL] = key
+  return key, nil
+}
+
+/* Returns an error unless `message` was signed by SNS, comes from the topic
+ * `topicARN`, and hasn't been handled before. */
+func verifySNSMessage(message snsMessage, topicARN string) error {
+  if message.TopicArn != topicARN {
+    return errors.New("The SNS message is from an unexpected topic.\n")
+  }
+
+  if !isSNSURL(message.SigningCertURL) {
+    return errors.New("The SNS signing certificate isn't on an SNS host.\n")
+  }
+
+  var hash crypto.Hash
+  var digest []byte
+  switch message.SignatureVersion {
+  case "1":
+    sum := sha1.Sum([]byte(message.signedString()))
+    hash, digest = crypto.SHA1, sum[:]
+  case "2":
+    sum := sha256.Sum256([]byte(message.signedString()))
+    hash, digest = crypto.SHA256, sum[:]
+  default:
+    return errors.New(fmt.Sprintf("Unknown SNS signature version '%s'.\n",
+      message.SignatureVersion))
+  }
+
+  signature, err := base64.StdEncoding.DecodeString(message.Signature)
+  if err != nil { return err }
+
+  key, err := snsSigningKey(message.SigningCertURL)
+  if err != nil { return err }
+
+  err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+  if err != nil {
+    return errors.New("The SNS message's signature is invalid.\n")
+  }
+
+  sentAt, err := time.Parse(time.RFC3339, message.Timestamp)
+  if err != nil || time.Since(sentAt) > SNS_MAX_MESSAGE_AGE {
+    return errors.New("The SNS message is too old.\n")
+  }
+
+  // SNS delivers at least once, so the same message may arrive again
+  seenSNSMessagesMutex.Lock()
+  defer seenSNSMessagesMutex.Unlock()
+
+  for id, seenSentAt := range seenSNSMessages {
+    if time.Since(seenSentAt) > SNS_MAX_MESSAGE_AGE {
+      delete(seenSNSMessages, id)
+    }
+  }
+  if _, ok := seenSNSMessages[message.MessageId]; ok {
+    return errors.New("The SNS message was already handled.\n")
+  }
+  seenSNSMessages[message.MessageId] = sentAt
+  return nil
+}
+
+/* Confirms the subscription of an HTTP endpoint to an SNS topic, as asked by
+ * the verified `message`. */
+func confirmSNSSubscription(message snsMessage) error {
+  if !isSNSURL(message.SubscribeURL) {
+    return errors.New("The SNS subscription URL isn't on an SNS host.\n")
+  }
+
+  response, err := snsClient.Get(message.SubscribeURL)
+  if err != nil { return err }
+  response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    return errors.New(fmt.Sprintf("Confirming the SNS subscription " +
+      "failed with status %d.\n", response.StatusCode))
+  }
+  return nil
+}
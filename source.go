@@ -0,0 +1,157 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "io"
+  "os"
+  "path"
+  "strings"
+)
+
+// formats source documents may arrive in
+const (
+  SOURCE_PDF = "pdf"
+  SOURCE_POSTSCRIPT = "postscript"
+  SOURCE_EPS = "eps"
+  SOURCE_DJVU = "djvu"
+  SOURCE_TIFF = "tiff"
+  SOURCE_JPEG = "jpeg"
+  SOURCE_PNG = "png"
+)
+
+// bytes at the start of a source searched for its format's header; PDF
+// readers tolerate some junk before it
+const SOURCE_HEADER_BYTES = 1024
+
+// extensions source documents are expected to have
+var SOURCE_EXTENSIONS = []string{".pdf", ".ps", ".eps", ".djvu", ".djv",
+  ".tif", ".tiff"}
+
+// extensions of single images that may be sources too, though they aren't
+// picked out of watched folders, where they'd look like renditions
+var IMAGE_SOURCE_EXTENSIONS = []string{".jpg", ".jpeg", ".png"}
+
+// header of DOS EPS binaries, which wrap PostScript with a TIFF preview
+var DOS_EPS_MAGIC = []byte{0xC5, 0xD0, 0xD3, 0xC6}
+
+// headers of raster images: little- and big-endian TIFF and BigTIFF, JPEG,
+// and PNG
+var TIFF_MAGICS = [][]byte{[]byte("II*\x00"), []byte("MM\x00*"),
+  []byte("II+\x00"), []byte("MM\x00+")}
+var JPEG_MAGIC = []byte{0xFF, 0xD8, 0xFF}
+var PNG_MAGIC = []byte("\x89PNG\r\n\x1a\n")
+
+/* Returns true if `name` has the extension of a source document. Formats
+ * are always detected from contents; this only picks out likely sources. */
+func hasSourceExtension(name string) bool {
+  extension := strings.ToLower(path.Ext(name))
+  for _, sourceExtension := range SOURCE_EXTENSIONS {
+    if extension == sourceExtension { return true }
+  }
+  return false
+}
+
+/* Returns true if `name` has the extension of a source document or of a
+ * single image that may be converted like one. */
+func hasSourceOrImageExtension(name string) bool {
+  extension := strings.ToLower(path.Ext(name))
+  for _, imageExtension := range IMAGE_SOURCE_EXTENSIONS {
+    if extension == imageExtension { return true }
+  }
+  return hasSourceExtension(name)
+}
+
+/* Returns the format of the source document starting with `head`, or "" if
+ * it isn't one we can convert. */
+func sourceFormat(head []byte) string {
+  if bytes.HasPrefix(head, DOS_EPS_MAGIC) { return SOURCE_EPS }
+
+  // images are checked first, as their data could contain "%PDF-"
+  for _, magic := range TIFF_MAGICS {
+    if bytes.HasPrefix(head, magic) { return SOURCE_TIFF }
+  }
+  if bytes.HasPrefix(head, JPEG_MAGIC) { return SOURCE_JPEG }
+  if bytes.HasPrefix(head, PNG_MAGIC) { return SOURCE_PNG }
+
+  // single-page DJVU files are DJVU forms, and multi-page ones DJVM forms
+  if len(head) >= 16 && bytes.HasPrefix(head, []byte("AT&TFORM")) &&
+      (bytes.Equal(head[12:16], []byte("DJVU")) ||
+      bytes.Equal(head[12:16], []byte("DJVM"))) {
+    return SOURCE_DJVU
+  }
+
+  // some print drivers start PostScript jobs with a Ctrl-D
+  postScript := bytes.TrimLeft(head, "\x04\r\n\t ")
+  if bytes.HasPrefix(postScript, []byte("%!PS")) {
+    firstLine := postScript
+    if end := bytes.IndexByte(firstLine, '\n'); end != -1 {
+      firstLine = firstLine[:end]
+    }
+    if bytes.Contains(firstLine, []byte("EPSF")) { return SOURCE_EPS }
+    return SOURCE_POSTSCRIPT
+  }
+
+  if bytes.Contains(head, []byte("%PDF-")) { return SOURCE_PDF }
+  return ""
+}
+
+/* Returns the format of the source document at `path`. */
+func detectSourceFormat(path string) (string, error) {
+  file, err := os.Open(path)
+  if err != nil { return "", err }
+  defer file.Close()
+
+  head := make([]byte, SOURCE_HEADER_BYTES)
+  n, err := io.ReadFull(file, head)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return "", err
+  }
+
+  format := sourceFormat(head[:n])
+  if format == "" {
+    return "", errors.New("The source isn't a PDF, PostScript, EPS, DJVU, " +
+      "TIFF, JPEG, or PNG file.\n")
+  }
+  return format, nil
+}
+
+/* Returns the path of a renderable copy of the source document `job`
+ * fetched to `sourcePath`, and its format: SOURCE_PDF, SOURCE_DJVU, or a
+ * raster format. PDFs, DJVU documents, and images are used as they are.
+ * PostScript and EPS are distilled to PDF with Ghostscript once, so the rest
+ * of the pipeline (page counting and every renderer) treats them as PDFs. */
+func prepareSource(job *job, sourcePath string) (string, string, error) {
+  format, err := detectSourceFormat(sourcePath)
+  if err != nil { return "", "", err }
+
+  if format == SOURCE_PDF || format == SOURCE_DJVU ||
+      isRasterFormat(format) {
+    return sourcePath, format, nil
+  }
+
+  pdfPath := scratchPath(job.id + ".distilled.pdf")
+  args := []string{"-q", "-dNOPAUSE", "-dBATCH", "-dSAFER",
+    "-sDEVICE=pdfwrite", "-sOutputFile=" + pdfPath}
+
+  // EPS figures are cropped to their bounding box, not put on a full page
+  if format == SOURCE_EPS {
+    args = append(args, "-dEPSCrop")
+  }
+
+  err = runTool(toolCommand("gs", append(args, sourcePath)...))
+  if err != nil { return "", "", err }
+
+  job.recordEvent("distilled", 0, format)
+  return pdfPath, SOURCE_PDF, nil
+}
+
+/* Returns the number of pages in the document of `format` at `path`. */
+func countPages(path string, format string) (int, error) {
+  switch format {
+  case SOURCE_DJVU: return getDJVUNumPages(path)
+  case SOURCE_TIFF: return getTIFFNumPages(path)
+  case SOURCE_JPEG, SOURCE_PNG: return 1, nil
+  }
+  return getNumPages(path)
+}
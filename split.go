@@ -0,0 +1,187 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+/* One of the PDFs a source was split into: pages `FirstPage` to `LastPage`
+ * of the source, uploaded to `Key`. */
+type splitPart struct {
+  FirstPage int `json:"firstPage"`
+  LastPage int `json:"lastPage"`
+  Key string `json:"key"`
+}
+
+/* Response of POST /split. */
+type splitResponse struct {
+  JobID string `json:"jobId"`
+  NumPages int `json:"numPages"`
+  Parts []splitPart `json:"parts"`
+}
+
+/* Parses a POST to /split: the source in `s3PDFPath`, with the optional
+ * bucket, source encryption, and upload option keys a conversion takes, the
+ * output path template in `s3SplitPath`, and the page range expression in
+ * `ranges`, if any. */
+func parseSplitParams(form url.Values) (conversionParams, string, string,
+    error) {
+  params, err := parseInfoParams(form)
+  if err != nil { return params, "", "", err }
+
+  err = parseUploadOptions(form, &params)
+  if err != nil { return params, "", "", err }
+
+  splitPath, err := requireFormValue(form, "s3SplitPath", "a PDF path")
+  if err != nil { return params, "", "", err }
+  if !strings.Contains(splitPath, "%d") {
+    return params, "", "", errors.New("Must specify a PDF path with %d in " +
+      "the 's3SplitPath' key.\n")
+  }
+
+  ranges, err := optionalFormValue(form, "ranges")
+  if err != nil || ranges == "" { return params, splitPath, "", err }
+
+  _, err = parsePageRangeExpression(ranges)
+  if err != nil {
+    err = errors.New("The 'ranges' key must list " + PAGE_RANGE_HINT +
+      ".\n")
+  }
+  return params, splitPath, ranges, err
+}
+
+/* Returns the parts to split a `numPages`-page document into: one per
+ * item of the page range expression `ranges`, or one per page if it's "".
+ * Ranges are clipped to the document, and those past its end are dropped,
+ * but it's an error if none are left. */
+func splitRanges(numPages int, ranges string) ([]pageRange, error) {
+  if ranges == "" {
+    parts := []pageRange{}
+    for pageNum := 1; pageNum <= numPages; pageNum = pageNum + 1 {
+      parts = append(parts, pageRange{pageNum, pageNum})
+    }
+    return parts, nil
+  }
+
+  pageRanges, err := parsePageRangeExpression(ranges)
+  if err != nil { return nil, err }
+
+  parts := []pageRange{}
+  for _, part := range pageRanges {
+    if part.first > numPages { continue }
+    if part.last == 0 || part.last > numPages { part.last = numPages }
+    parts = append(parts, part)
+  }
+
+  if len(parts) == 0 {
+    return nil, errors.New(fmt.Sprintf("The 'ranges' key selects none of " +
+      "the PDF's %d pages.\n", numPages))
+  }
+  return parts, nil
+}
+
+/* Writes pages `first` to `last` of the PDF at `pdfPath` to a PDF of their
+ * own at `outputPath`. */
+func extractPDFPages(pdfPath string, first int, last int,
+    outputPath string) error {
+  cmd := toolCommand("gs", "-q", "-dNOPAUSE", "-dBATCH", "-dSAFER",
+    "-sDEVICE=pdfwrite", fmt.Sprintf("-dFirstPage=%d", first),
+    fmt.Sprintf("-dLastPage=%d", last), "-sOutputFile=" + outputPath,
+    pdfPath)
+  return runTool(cmd)
+}
+
+/* Fetches the source described by `params` as `job`, splits it into the
+ * parts `ranges` selects, and uploads each to `splitPath` with '%d'
+ * replaced by its first page. PostScript is distilled first; DJVU can't be
+ * split. */
+func runSplit(job *job, bucket *s3.Bucket, params conversionParams,
+    splitPath string, ranges string) (splitResponse, error) {
+  response := splitResponse{JobID: job.id, Parts: []splitPart{}}
+
+  sourcePath, err := fetchPDF(job, bucket, params)
+  if err != nil { return response, err }
+
+  pdfPath, format, err := prepareSource(job, sourcePath)
+  if err != nil { return response, err }
+  if format != SOURCE_PDF {
+    return response, errors.New("Only PDF and PostScript sources can be " +
+      "split.\n")
+  }
+
+  response.NumPages, err = getNumPages(pdfPath)
+  if err != nil { return response, err }
+
+  parts, err := splitRanges(response.NumPages, ranges)
+  if err != nil { return response, err }
+
+  job.setNumPages(len(parts))
+  for _, part := range parts {
+    localPath := scratchPath(fmt.Sprintf("%s-split-%d-%d.pdf", job.id,
+      part.first, part.last))
+    err = extractPDFPages(pdfPath, part.first, part.last, localPath)
+    if err != nil { return response, err }
+
+    key := fmt.Sprintf(splitPath, part.first)
+    err = uploadFileToS3(job, bucket, params, localPath, key, part.first)
+    if err != nil { return response, err }
+
+    response.Parts = append(response.Parts,
+      splitPart{FirstPage: part.first, LastPage: part.last, Key: key})
+  }
+  return response, nil
+}
+
+/* Handles POST /split, which splits the source document in `s3PDFPath`
+ * into a PDF per page, or per item of the `ranges` key (e.g. "1-3,4-"), and
+ * uploads each to `s3SplitPath` with its '%d' replaced by the part's first
+ * page. The source is fetched like a conversion's, as a job whose ID is in
+ * the X-Job-ID header. Responds with the key of each part. */
+func serveSplit(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  params, splitPath, ranges, err := parseSplitParams(request.Form)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  jobID := newID()
+  writer.Header().Set("X-Job-ID", jobID)
+  job := newJob(jobID, tenantName(request), requestID(request))
+  startTime := time.Now()
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  var response splitResponse
+  if err == nil {
+    response, err = runSplit(job, bucket, params, splitPath, ranges)
+  }
+  job.finish(err)
+  cleanupScratch(jobID)
+  auditConversion(request, jobID, response.NumPages, startTime, err)
+
+  if isS3NotFound(err) {
+    http.Error(writer, "There's no source at that key.\n",
+      http.StatusNotFound)
+    return
+  }
+  if handleError(err, writer) { return }
+
+  job.logger().Info("Split finished", "parts", len(response.Parts))
+  writeJSON(writer, http.StatusOK, response)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  "io/ioutil"
+  "net/url"
+  "strings"
+  "launchpad.net/goamz/s3"
+)
+
+// allowed number of thumbnails per row of a sprite sheet
+const (
+  MIN_SPRITE_COLUMNS = 1
+  MAX_SPRITE_COLUMNS = 100
+)
+
+// default and allowed edge, in pixels, of the box each thumbnail fits in;
+// thumbnails are scaled from the small rendition, so can't exceed it
+const (
+  DEFAULT_SPRITE_TILE_SIZE = 100
+  MIN_SPRITE_TILE_SIZE = 16
+  MAX_SPRITE_TILE_SIZE = 300
+)
+
+// largest width or height a JPEG can have
+const MAX_JPEG_DIMENSION = 65535
+
+// names of the sprite sheet and its index in results
+const (
+  SPRITE_IMAGE = "sprite"
+  SPRITE_INDEX = "spriteIndex"
+)
+
+/* Where each page's thumbnail lies in a sprite sheet, in pixels from its
+ * top left. */
+type spriteTile struct {
+  PageNum int `json:"pageNum"`
+  X int `json:"x"`
+  Y int `json:"y"`
+  Width int `json:"width"`
+  Height int `json:"height"`
+}
+
+/* The index uploaded beside a sprite sheet. Tiles are laid out in page
+ * order, `Columns` to a row, each centered in a `TileWidth` by
+ * `TileHeight` cell. */
+type spriteIndex struct {
+  Key string `json:"key"`
+  Width int `json:"width"`
+  Height int `json:"height"`
+  Columns int `json:"columns"`
+  TileWidth int `json:"tileWidth"`
+  TileHeight int `json:"tileHeight"`
+  Tiles []spriteTile `json:"tiles"`
+}
+
+/* Parses the `spriteColumns` key of `form` into `params`. If given, a sprite
+ * sheet of every page's thumbnail, `spriteColumns` to a row, is uploaded to
+ * `s3SpritePath` with a JSON index of where each thumbnail lies at
+ * `s3SpriteIndexPath`. Thumbnails fit within `spriteTileSize` pixels. The
+ * sheet's path defaults to the small JPEG path with "sprite" for the page
+ * number, and the index's to the sheet's with a .json extension. Must come
+ * after the layout, pages, and incremental keys are parsed. */
+func parseSpriteParams(form url.Values, params *conversionParams) error {
+  var err error
+  params.SpriteColumns, err = optionalBoundedInt(form, "spriteColumns",
+    MIN_SPRITE_COLUMNS, MAX_SPRITE_COLUMNS)
+  if err != nil { return err }
+
+  params.SpriteTileSize, err = optionalBoundedInt(form, "spriteTileSize",
+    MIN_SPRITE_TILE_SIZE, MAX_SPRITE_TILE_SIZE)
+  if err != nil { return err }
+
+  if params.SpriteColumns == 0 {
+    if params.SpriteTileSize != 0 {
+      return errors.New("The 'spriteTileSize' key requires " +
+        "'spriteColumns'.\n")
+    }
+    return nil
+  }
+  if params.SpriteTileSize == 0 {
+    params.SpriteTileSize = DEFAULT_SPRITE_TILE_SIZE
+  }
+
+  // the sheet is built from every page's thumbnail, so all must be rendered
+  if isPartialConversion(*params) || params.Incremental {
+    return errors.New("The 'spriteColumns' key can't be combined with " +
+      "'pages', 'sample', or 'incremental'.\n")
+  }
+
+  // content-addressed paths are only resolved once the source is fetched
+  if params.Layout == LAYOUT_CONTENT_ADDRESSED { return nil }
+
+  params.S3SpritePath, err = optionalFormValue(form, "s3SpritePath")
+  if err != nil { return err }
+  if params.S3SpritePath == "" {
+    params.S3SpritePath = strings.Replace(params.S3SmallJPEGPath, "%d",
+      SPRITE_IMAGE, 1)
+  }
+
+  params.S3SpriteIndexPath, err = optionalFormValue(form,
+    "s3SpriteIndexPath")
+  if err != nil { return err }
+  if params.S3SpriteIndexPath == "" {
+    params.S3SpriteIndexPath = replaceExtension(params.S3SpritePath, ".json")
+  }
+
+  if params.S3SpritePath == params.S3SpriteIndexPath {
+    return errors.New("The 's3SpritePath' and 's3SpriteIndexPath' keys " +
+      "must differ.\n")
+  }
+  return nil
+}
+
+/* Returns the S3 keys of the sprite sheet and index of `params`, or an
+ * empty map if there's no sprite sheet. */
+func s3SpritePaths(params conversionParams) map[string]string {
+  paths := map[string]string{}
+  if params.S3SpritePath != "" {
+    paths[SPRITE_IMAGE] = params.S3SpritePath
+    paths[SPRITE_INDEX] = params.S3SpriteIndexPath
+  }
+  return paths
+}
+
+/* Returns the thumbnail of the page whose small rendition is the JPEG at
+ * `smallJPEGPath`, scaled down to fit within `tileSize` pixels. */
+func spriteThumbnail(smallJPEGPath string, tileSize int) (*image.RGBA,
+    error) {
+  small, err := readRGBAJPEG(smallJPEGPath)
+  if err != nil { return nil, err }
+
+  width, height := small.Bounds().Dx(), small.Bounds().Dy()
+  if width <= tileSize && height <= tileSize { return small, nil }
+
+  width, height = fitWithin(width, height, tileSize, tileSize)
+  return scaleImage(small, width, height), nil
+}
+
+/* Composes the thumbnails of pages `pageNums`, whose small renditions are
+ * saved locally at `smallJPEGPath`, into a sprite sheet with `columns`
+ * thumbnails to a row on a white background. Returns the sheet and the
+ * index of its tiles, without its key. */
+func composeSprite(smallJPEGPath string, pageNums []int, columns int,
+    tileSize int) (*image.RGBA, spriteIndex, error) {
+  index := spriteIndex{Tiles: []spriteTile{}}
+  thumbnails := []*image.RGBA{}
+  for _, pageNum := range pageNums {
+    thumbnail, err := spriteThumbnail(fmt.Sprintf(smallJPEGPath, pageNum),
+      tileSize)
+    if err != nil { return nil, index, err }
+
+    thumbnails = append(thumbnails, thumbnail)
+    if thumbnail.Bounds().Dx() > index.TileWidth {
+      index.TileWidth = thumbnail.Bounds().Dx()
+    }
+    if thumbnail.Bounds().Dy() > index.TileHeight {
+      index.TileHeight = thumbnail.Bounds().Dy()
+    }
+  }
+
+  // a short document's sheet is only as wide as its pages
+  if len(thumbnails) < columns {
+    columns = len(thumbnails)
+  }
+  index.Columns = columns
+  rows := (len(thumbnails) + columns - 1) / columns
+  index.Width = columns * index.TileWidth
+  index.Height = rows * index.TileHeight
+  if index.Width > MAX_JPEG_DIMENSION || index.Height > MAX_JPEG_DIMENSION {
+    return nil, index, errors.New(fmt.Sprintf("A sprite sheet of %d pages " +
+      "with %d columns would be %dx%d, larger than a JPEG can be.\n",
+      len(thumbnails), index.Columns, index.Width, index.Height))
+  }
+
+  sprite := image.NewRGBA(image.Rect(0, 0, index.Width, index.Height))
+  draw.Draw(sprite, sprite.Bounds(), image.NewUniform(color.White),
+    image.Point{}, draw.Src)
+
+  for i, thumbnail := range thumbnails {
+    width, height := thumbnail.Bounds().Dx(), thumbnail.Bounds().Dy()
+    tile := spriteTile{
+      PageNum: pageNums[i],
+      X: i % columns * index.TileWidth + (index.TileWidth - width) / 2,
+      Y: i / columns * index.TileHeight + (index.TileHeight - height) / 2,
+      Width: width,
+      Height: height,
+    }
+    draw.Draw(sprite, image.Rect(tile.X, tile.Y, tile.X + width,
+      tile.Y + height), thumbnail, image.Point{}, draw.Src)
+    index.Tiles = append(index.Tiles, tile)
+  }
+  return sprite, index, nil
+}
+
+/* Builds the sprite sheet of pages `pageNums` that `params` asks for, from
+ * their small renditions saved locally at `smallJPEGPath`, and uploads it
+ * and its index. The sheet is composed in a resize slot. */
+func uploadSprite(job *job, bucket *s3.Bucket, params conversionParams,
+    smallJPEGPath string, pageNums []int) error {
+  if params.S3SpritePath == "" || len(pageNums) == 0 { return nil }
+
+  spritePath := scratchPath(job.id + "-sprite.jpg")
+  indexPath := scratchPath(job.id + "-sprite.json")
+  var index spriteIndex
+  err := resizePool.run(job.tenant, func() error {
+    sprite, composed, err := composeSprite(smallJPEGPath, pageNums,
+      params.SpriteColumns, params.SpriteTileSize)
+    if err != nil { return err }
+
+    index = composed
+    return writeJPEG(spritePath, sprite)
+  })
+  if err != nil { return err }
+
+  index.Key = params.S3SpritePath
+  encoded, err := json.Marshal(index)
+  if err != nil { return err }
+
+  err = ioutil.WriteFile(indexPath, encoded, 0600)
+  if err != nil { return err }
+
+  err = uploadFileToS3(job, bucket, params, spritePath, params.S3SpritePath,
+    0)
+  if err != nil { return err }
+
+  err = uploadFileToS3(job, bucket, params, indexPath,
+    params.S3SpriteIndexPath, 0)
+  if err != nil { return err }
+
+  job.recordEvent("sprite uploaded", 0, fmt.Sprintf("%d pages, %dx%d",
+    len(index.Tiles), index.Width, index.Height))
+  return nil
+}
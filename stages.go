@@ -0,0 +1,154 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "runtime"
+  "sync"
+  "time"
+)
+
+var downloadSlots = flag.Int("download-slots", 8,
+  "sources downloaded at once across all jobs, prefetches included")
+var renderSlots = flag.Int("render-slots", runtime.NumCPU(),
+  "pages rendered at once across all jobs, shared fairly between tenants")
+var resizeSlots = flag.Int("resize-slots", runtime.NumCPU(),
+  "pages resized, inverted, and encoded at once across all jobs")
+var uploadSlots = flag.Int("upload-slots", 32,
+  "renditions uploaded at once across all jobs")
+
+// the stages of the pipeline, each with its own pool of slots
+const (
+  STAGE_DOWNLOAD = "download"
+  STAGE_RENDER = "render"
+  STAGE_RESIZE = "resize"
+  STAGE_UPLOAD = "upload"
+)
+
+/* A pool of slots for one stage of the pipeline, handed out fairly between
+ * tenants by its own scheduler, so each stage has its own queue and can be
+ * sized to its own bottleneck. Tracks how much work is queued and running,
+ * for the metrics. */
+type stagePool struct {
+  name string
+  scheduler *fairScheduler
+  mutex sync.Mutex
+  queued int
+  active int
+}
+
+// shared by all jobs; sized in main() once flags are parsed
+var downloadPool *stagePool
+var renderPool *stagePool
+var resizePool *stagePool
+var uploadPool *stagePool
+
+// every stage pool, in pipeline order
+var stagePools = []*stagePool{}
+
+var stageItemsTotal = newCounterVec("evangelist_stage_items_total",
+  "Units of work finished by each stage: sources, pages, or renditions.",
+  "stage")
+var stageWaitSecondsTotal = newCounterVec(
+  "evangelist_stage_wait_seconds_total",
+  "Seconds spent waiting for a slot in each stage.", "stage")
+var stageBusySecondsTotal = newCounterVec(
+  "evangelist_stage_busy_seconds_total",
+  "Seconds spent holding a slot in each stage.", "stage")
+var stageQueued = newGaugeFunc("evangelist_stage_queued",
+  "Units of work waiting for a slot in each stage.", "stage",
+  func() map[string]float64 {
+    return collectStages(func(pool *stagePool) int { return pool.queued })
+  })
+var stageActive = newGaugeFunc("evangelist_stage_active",
+  "Units of work holding a slot in each stage.", "stage",
+  func() map[string]float64 {
+    return collectStages(func(pool *stagePool) int { return pool.active })
+  })
+var stageSlots = newGaugeFunc("evangelist_stage_slots",
+  "Slots in each stage.", "stage",
+  func() map[string]float64 {
+    return collectStages(func(pool *stagePool) int {
+      return pool.scheduler.numSlots()
+    })
+  })
+
+/* Returns a pool for stage `name` with `slots` slots, and registers it. */
+func newStagePool(name string, slots int) *stagePool {
+  pool := &stagePool{name: name, scheduler: newFairScheduler(slots)}
+  stagePools = append(stagePools, pool)
+  return pool
+}
+
+/* Creates the pool for each stage from its flag. */
+func setupStagePools() error {
+  flags := []*int{downloadSlots, renderSlots, resizeSlots, uploadSlots}
+  names := []string{STAGE_DOWNLOAD, STAGE_RENDER, STAGE_RESIZE, STAGE_UPLOAD}
+  for i, slots := range flags {
+    if *slots < 1 {
+      return errors.New("-" + names[i] + "-slots must be at least 1.\n")
+    }
+  }
+
+  downloadPool = newStagePool(STAGE_DOWNLOAD, *downloadSlots)
+  renderPool = newStagePool(STAGE_RENDER, *renderSlots)
+  resizePool = newStagePool(STAGE_RESIZE, *resizeSlots)
+  uploadPool = newStagePool(STAGE_UPLOAD, *uploadSlots)
+  return nil
+}
+
+/* Runs `work` for `tenant` once it gets one of the pool's slots, recording
+ * how long it waited and worked. Returns what `work` returns. */
+func (pool *stagePool) run(tenant string, work func() error) error {
+  pool.mutex.Lock()
+  pool.queued += 1
+  pool.mutex.Unlock()
+
+  waitStartTime := time.Now()
+  pool.scheduler.acquire(tenant)
+
+  pool.mutex.Lock()
+  pool.queued -= 1
+  pool.active += 1
+  pool.mutex.Unlock()
+
+  busyStartTime := time.Now()
+  err := work()
+  pool.scheduler.release()
+
+  pool.mutex.Lock()
+  pool.active -= 1
+  pool.mutex.Unlock()
+
+  stageItemsTotal.add(1, pool.name)
+  stageWaitSecondsTotal.add(busyStartTime.Sub(waitStartTime).Seconds(),
+    pool.name)
+  stageBusySecondsTotal.add(time.Since(busyStartTime).Seconds(), pool.name)
+  return err
+}
+
+/* Returns `value` of each pool, by stage. `value` is called with the
+ * pool's mutex held. */
+func collectStages(value func(pool *stagePool) int) map[string]float64 {
+  values := map[string]float64{}
+  for _, pool := range stagePools {
+    pool.mutex.Lock()
+    values[pool.name] = float64(value(pool))
+    pool.mutex.Unlock()
+  }
+  return values
+}
+
+/* Sets the weight of `tenant` in every stage. */
+func setTenantWeight(tenant string, weight float64) {
+  for _, pool := range stagePools {
+    pool.scheduler.setWeight(tenant, weight)
+  }
+}
+
+/* Resets the weight of `tenant` to the default in every stage. */
+func resetTenantWeight(tenant string) {
+  for _, pool := range stagePools {
+    pool.scheduler.resetWeight(tenant)
+  }
+}
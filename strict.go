@@ -0,0 +1,99 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/url"
+  "strings"
+)
+
+// name of the only renderer whose warnings strict mode can check
+const RENDERER_GHOSTSCRIPT = "ghostscript"
+
+// markers of Ghostscript diagnostics meaning a page was rendered degraded,
+// e.g. with a substituted font or without a broken image
+var GHOSTSCRIPT_WARNING_MARKERS = []string{
+  "****",
+  "Error:",
+  "Warning:",
+  "Substituting font",
+  "Can't find (or can't open) font",
+}
+
+/* A page that rendered, but with Ghostscript warnings, which strict mode
+ * treats as a failure. */
+type renderWarningsError struct {
+  pageNum int
+  warnings []string
+}
+
+func (err *renderWarningsError) Error() string {
+  return fmt.Sprintf("Page %d rendered with warnings in strict mode:\n  %s\n",
+    err.pageNum, strings.Join(err.warnings, "\n  "))
+}
+
+/* Returns whether the `strict` key of `form` asks to fail on any rendering
+ * warning. Strict conversions can only use Ghostscript. */
+func parseStrict(form url.Values, renderer string) (bool, error) {
+  strict, err := optionalFormValue(form, "strict")
+  if err != nil { return false, err }
+
+  if strict != "" && strict != "true" && strict != "false" {
+    return false, errors.New("The 'strict' key must be 'true' or 'false'.\n")
+  }
+
+  if strict == "true" && renderer != "" && renderer != RENDERER_GHOSTSCRIPT {
+    return false, errors.New("Strict mode requires the 'ghostscript' " +
+      "renderer.\n")
+  }
+  return strict == "true", nil
+}
+
+/* Returns the lines of Ghostscript's `output` that are warnings. */
+func ghostscriptWarnings(output []byte) []string {
+  warnings := []string{}
+
+  for _, line := range strings.Split(string(output), "\n") {
+    line = strings.TrimSpace(line)
+    for _, marker := range GHOSTSCRIPT_WARNING_MARKERS {
+      if strings.Contains(line, marker) {
+        warnings = append(warnings, line)
+        break
+      }
+    }
+  }
+  return warnings
+}
+
+/* Renders page `pageNum` of the PDF at `pdfPath` to `outputPath` with
+ * Ghostscript, failing if it prints any warnings. No other renderer is
+ * tried, since we can't tell whether their output is degraded. */
+func renderPageStrictly(log *slog.Logger, pdfPath string, pageNum int,
+    outputPath string, density int, quality int, gray bool,
+    extraArgs []string) error {
+  cmd := ghostscriptCommand(pdfPath, pageNum, outputPath, density, quality,
+    gray, extraArgs)
+  var output []byte
+  err := withProcessSlot(func() error {
+    var err error
+    output, err = cmd.CombinedOutput()
+    return err
+  })
+  log.Debug("Ran tool", "command", strings.Join(cmd.Args, " "),
+    "output", strings.TrimSpace(string(output)))
+  if err != nil {
+    warnings := ghostscriptWarnings(output)
+    if len(warnings) > 0 {
+      log.Warn("Ghostscript failed", "page", pageNum,
+        "warnings", strings.Join(warnings, "; "))
+    }
+    return err
+  }
+
+  warnings := ghostscriptWarnings(output)
+  if len(warnings) > 0 {
+    return &renderWarningsError{pageNum, warnings}
+  }
+  return nil
+}
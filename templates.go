@@ -0,0 +1,280 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+var templatesPath = flag.String("templates", "",
+  "JSON file named conversion templates are loaded from and saved to " +
+  "(kept only in memory if empty)")
+
+// what template names may look like
+var TEMPLATE_NAME_PATTERN = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+// keys a template can't set, since they identify a single conversion or are
+// secret
+var UNTEMPLATED_KEYS = []string{"template", "s3PDFPath", "sourceKey"}
+
+// stands in for the source key of each request when validating templates
+const EXAMPLE_SOURCE_KEY = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+/* A named set of conversion keys registered by an admin, so clients only
+ * send `template` and `s3PDFPath`. In `Values`, {source} is replaced by the
+ * request's s3PDFPath (or uploaded file name) without its extension, and
+ * {sourceName} by its base name without its extension. */
+type conversionTemplate struct {
+  Name string `json:"name"`
+  Values map[string]string `json:"values"`
+  UpdatedAt string `json:"updatedAt"`
+}
+
+/* The registered templates, keyed by name. */
+type templateRegistry struct {
+  mutex sync.Mutex
+  templates map[string]conversionTemplate
+}
+
+var templates = &templateRegistry{templates: map[string]conversionTemplate{}}
+
+/* Loads the templates saved at -templates, if it exists. */
+func loadTemplates() error {
+  if *templatesPath == "" { return nil }
+
+  data, err := ioutil.ReadFile(*templatesPath)
+  if os.IsNotExist(err) { return nil }
+  if err != nil { return err }
+
+  loaded := map[string]conversionTemplate{}
+  err = json.Unmarshal(data, &loaded)
+  if err != nil { return err }
+
+  for name, template := range loaded {
+    template.Name = name
+    err = validateTemplate(template)
+    if err != nil { return err }
+    loaded[name] = template
+  }
+
+  templates.mutex.Lock()
+  defer templates.mutex.Unlock()
+  templates.templates = loaded
+  return nil
+}
+
+/* Saves the templates to -templates, replacing the file atomically so a
+ * crash never leaves it half-written. Expects the mutex to be held. */
+func (registry *templateRegistry) saveLocked() error {
+  if *templatesPath == "" { return nil }
+
+  data, err := json.MarshalIndent(registry.templates, "", "  ")
+  if err != nil { return err }
+
+  temporaryPath := *templatesPath + ".tmp"
+  err = ioutil.WriteFile(temporaryPath, data, 0600)
+  if err != nil { return err }
+  return os.Rename(temporaryPath, *templatesPath)
+}
+
+/* Returns the template called `name`, or false if there isn't one. */
+func (registry *templateRegistry) get(name string) (conversionTemplate,
+    bool) {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+  template, ok := registry.templates[name]
+  return template, ok
+}
+
+/* Returns every template, sorted by name. */
+func (registry *templateRegistry) list() []conversionTemplate {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  list := []conversionTemplate{}
+  for _, template := range registry.templates {
+    list = append(list, template)
+  }
+  sort.Slice(list, func(i int, j int) bool {
+    return list[i].Name < list[j].Name
+  })
+  return list
+}
+
+/* Registers `template`, replacing any of the same name, and saves the
+ * templates. */
+func (registry *templateRegistry) put(template conversionTemplate) error {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  previous, existed := registry.templates[template.Name]
+  registry.templates[template.Name] = template
+
+  err := registry.saveLocked()
+  if err != nil {
+    // keep memory and disk in agreement
+    if existed {
+      registry.templates[template.Name] = previous
+    } else {
+      delete(registry.templates, template.Name)
+    }
+  }
+  return err
+}
+
+/* Removes the template called `name` and saves the templates. Returns false
+ * if there wasn't one. */
+func (registry *templateRegistry) remove(name string) (bool, error) {
+  registry.mutex.Lock()
+  defer registry.mutex.Unlock()
+
+  previous, existed := registry.templates[name]
+  if !existed { return false, nil }
+  delete(registry.templates, name)
+
+  err := registry.saveLocked()
+  if err != nil {
+    registry.templates[name] = previous
+  }
+  return true, err
+}
+
+/* Returns `value` from a template with its placeholders filled in for the
+ * PDF at `s3PDFPath`. */
+func expandTemplateValue(value string, s3PDFPath string) string {
+  source := strings.TrimSuffix(s3PDFPath, path.Ext(s3PDFPath))
+  value = strings.Replace(value, "{source}", source, -1)
+  return strings.Replace(value, "{sourceName}", path.Base(source), -1)
+}
+
+/* Returns an error unless `template` has a valid name and, once filled in
+ * for an example PDF, makes a valid conversion on its own. */
+func validateTemplate(template conversionTemplate) error {
+  if !TEMPLATE_NAME_PATTERN.MatchString(template.Name) {
+    return errors.New("Template names must be 1 to 64 letters, digits, " +
+      "dots, dashes, or underscores.\n")
+  }
+
+  form := url.Values{"s3PDFPath": {"example/document.pdf"}}
+  for key, value := range template.Values {
+    for _, untemplated := range UNTEMPLATED_KEYS {
+      if key == untemplated {
+        return errors.New(fmt.Sprintf("Templates can't set the '%s' key.\n",
+          key))
+      }
+    }
+    form.Set(key, expandTemplateValue(value, "example/document.pdf"))
+  }
+
+  // source keys come with each request
+  if form.Get("sourceEncryption") != "" {
+    form.Set("sourceKey", EXAMPLE_SOURCE_KEY)
+  }
+
+  _, err := parseConversionForm(form)
+  if err != nil {
+    return errors.New(fmt.Sprintf("Template '%s' is invalid: %s",
+      template.Name, err.Error()))
+  }
+  return nil
+}
+
+/* Fills in `form` with the keys of the template named in its `template`
+ * key, if any, for converting the PDF at `source` (its S3 key, or the name
+ * of the uploaded file). Returns the template's name. Templates are
+ * authoritative: a request can add keys a template doesn't set, but can't
+ * override the ones it does. */
+func applyTemplate(form url.Values, source string) (string, error) {
+  name, err := optionalFormValue(form, "template")
+  if err != nil || name == "" { return "", err }
+
+  template, ok := templates.get(name)
+  if !ok {
+    return "", errors.New(fmt.Sprintf("There's no template named '%s'.\n",
+      name))
+  }
+
+  for key, value := range template.Values {
+    if _, ok := form[key]; ok {
+      return "", errors.New(fmt.Sprintf("The '%s' key is set by template " +
+        "'%s'.\n", key, name))
+    }
+    form.Set(key, expandTemplateValue(value, source))
+  }
+  return name, nil
+}
+
+/* Handles /admin/templates. GET lists the templates. POST registers (or
+ * replaces) the template named `name`, whose keys are every other key of
+ * the form. DELETE removes the template named `name`. */
+func serveTemplates(writer http.ResponseWriter, request *http.Request) {
+  if !requireAdmin(writer, request) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  switch request.Method {
+  case "GET":
+    writeJSON(writer, http.StatusOK, templates.list())
+
+  case "POST":
+    template, err := parseTemplate(request.Form)
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    err = templates.put(template)
+    if handleError(err, writer) { return }
+    writeJSON(writer, http.StatusOK, template)
+
+  case "DELETE":
+    name, err := requireFormValue(request.Form, "name", "a template name")
+    if err != nil {
+      http.Error(writer, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    existed, err := templates.remove(name)
+    if handleError(err, writer) { return }
+    if !existed {
+      http.Error(writer, "There's no template named '" + name + "'.\n",
+        http.StatusNotFound)
+      return
+    }
+    writer.WriteHeader(http.StatusNoContent)
+
+  default:
+    http.Error(writer, "Only GET, POST, and DELETE requests are " +
+      "supported.\n", http.StatusMethodNotAllowed)
+  }
+}
+
+/* Returns the template described by `form`: its `name`, and the keys it
+ * sets as every other key. */
+func parseTemplate(form url.Values) (conversionTemplate, error) {
+  name, err := requireFormValue(form, "name", "a template name")
+  if err != nil { return conversionTemplate{}, err }
+
+  template := conversionTemplate{Name: name, Values: map[string]string{},
+    UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
+  for key := range form {
+    if key == "name" { continue }
+
+    template.Values[key], err = optionalFormValue(form, key)
+    if err != nil { return template, err }
+  }
+
+  return template, validateTemplate(template)
+}
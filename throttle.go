@@ -0,0 +1,106 @@
+package main
+
+import (
+  "math/rand"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// bounds of the pause between uploads once S3 asks us to slow down
+const MIN_UPLOAD_DELAY = 100 * time.Millisecond
+const MAX_UPLOAD_DELAY = 20 * time.Second
+
+// successful uploads in a row needed to speed back up by one step
+const UPLOADS_PER_SPEEDUP = 20
+
+/* Paces a job's uploads across all of its workers. When S3 responds with
+ * 503 SlowDown, the number of concurrent uploads is halved and a pause
+ * before each upload doubles (multiplicative decrease); as uploads succeed,
+ * both recover step by step (additive increase). */
+type uploadThrottle struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  maxLimit int
+  limit int
+  active int
+  delay time.Duration
+  successes int
+}
+
+/* Returns a throttle allowing up to `maxLimit` concurrent uploads. */
+func newUploadThrottle(maxLimit int) *uploadThrottle {
+  throttle := &uploadThrottle{maxLimit: maxLimit, limit: maxLimit}
+  throttle.cond = sync.NewCond(&throttle.mutex)
+  return throttle
+}
+
+/* Waits for a free upload slot, then for the current pause, if any. Every
+ * call must be followed by a call to `release`. */
+func (throttle *uploadThrottle) acquire() {
+  throttle.mutex.Lock()
+  for throttle.active >= throttle.limit {
+    throttle.cond.Wait()
+  }
+  throttle.active += 1
+  delay := throttle.delay
+  throttle.mutex.Unlock()
+
+  // jitter the pause so workers don't retry in lockstep
+  if delay > 0 {
+    time.Sleep(delay / 2 + time.Duration(rand.Int63n(int64(delay / 2) + 1)))
+  }
+}
+
+/* Frees the upload slot taken by `acquire`. */
+func (throttle *uploadThrottle) release() {
+  throttle.mutex.Lock()
+  defer throttle.mutex.Unlock()
+  throttle.active -= 1
+  throttle.cond.Signal()
+}
+
+/* Backs off after S3 asked us to slow down. */
+func (throttle *uploadThrottle) slowDown() {
+  throttle.mutex.Lock()
+  defer throttle.mutex.Unlock()
+
+  throttle.successes = 0
+  throttle.limit = throttle.limit / 2
+  if throttle.limit < 1 {
+    throttle.limit = 1
+  }
+
+  throttle.delay = throttle.delay * 2
+  if throttle.delay < MIN_UPLOAD_DELAY {
+    throttle.delay = MIN_UPLOAD_DELAY
+  } else if throttle.delay > MAX_UPLOAD_DELAY {
+    throttle.delay = MAX_UPLOAD_DELAY
+  }
+}
+
+/* Records a successful upload, speeding back up after enough of them. */
+func (throttle *uploadThrottle) succeeded() {
+  throttle.mutex.Lock()
+  defer throttle.mutex.Unlock()
+
+  throttle.successes += 1
+  if throttle.successes < UPLOADS_PER_SPEEDUP { return }
+  throttle.successes = 0
+
+  if throttle.limit < throttle.maxLimit {
+    throttle.limit += 1
+    throttle.cond.Signal()
+  }
+
+  throttle.delay = throttle.delay / 2
+  if throttle.delay < MIN_UPLOAD_DELAY {
+    throttle.delay = 0
+  }
+}
+
+/* Returns true if `err` is S3 asking us to reduce our request rate. */
+func isS3SlowDown(err error) bool {
+  s3Err, ok := err.(*s3.Error)
+  return ok && (s3Err.Code == "SlowDown" || s3Err.StatusCode == 503)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "flag"
+  "io/ioutil"
+  "net/http"
+)
+
+var tlsCertPath = flag.String("tls-cert", "",
+  "PEM certificate (chain) to serve HTTPS with; requires -tls-key " +
+  "(plain HTTP if empty)")
+var tlsKeyPath = flag.String("tls-key", "",
+  "PEM private key of -tls-cert")
+var tlsClientCAPath = flag.String("tls-client-ca", "",
+  "PEM bundle of CAs whose client certificates are accepted; requires " +
+  "-tls-cert (client certificates aren't checked if empty)")
+var tlsClientAuth = flag.String("tls-client-auth", TLS_CLIENT_AUTH_REQUIRE,
+  "with -tls-client-ca, whether clients must present a certificate: " +
+  "require or optional (verified only if presented)")
+
+// ways client certificates can be checked
+const (
+  TLS_CLIENT_AUTH_REQUIRE = "require"
+  TLS_CLIENT_AUTH_OPTIONAL = "optional"
+)
+
+/* Configures `server` to serve HTTPS according to -tls-cert and -tls-key,
+ * verifying client certificates against -tls-client-ca if given. Leaves it
+ * serving plain HTTP if no certificate is given. */
+func setupTLS(server *http.Server) error {
+  if *tlsCertPath == "" && *tlsKeyPath == "" {
+    if *tlsClientCAPath != "" {
+      return errors.New("-tls-client-ca requires -tls-cert and -tls-key.\n")
+    }
+    return nil
+  }
+
+  if *tlsCertPath == "" || *tlsKeyPath == "" {
+    return errors.New("-tls-cert and -tls-key must be given together.\n")
+  }
+
+  // loaded now, so a bad certificate stops the server from starting
+  certificate, err := tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath)
+  if err != nil { return err }
+
+  config := &tls.Config{MinVersion: tls.VersionTLS12,
+    Certificates: []tls.Certificate{certificate}}
+
+  if *tlsClientCAPath != "" {
+    bundle, err := ioutil.ReadFile(*tlsClientCAPath)
+    if err != nil { return err }
+
+    config.ClientCAs = x509.NewCertPool()
+    if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+      return errors.New("-tls-client-ca holds no PEM certificates.\n")
+    }
+
+    switch *tlsClientAuth {
+    case TLS_CLIENT_AUTH_REQUIRE:
+      config.ClientAuth = tls.RequireAndVerifyClientCert
+    case TLS_CLIENT_AUTH_OPTIONAL:
+      config.ClientAuth = tls.VerifyClientCertIfGiven
+    default:
+      return errors.New("-tls-client-auth must be require or optional.\n")
+    }
+  }
+
+  server.TLSConfig = config
+  logger.Info("Serving HTTPS", "clientCA", *tlsClientCAPath)
+  return nil
+}
+
+/* Returns the common name of the verified client certificate `request`
+ * was made with, or "" if there isn't one. */
+func clientCertificateName(request *http.Request) string {
+  if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+    return ""
+  }
+  return request.TLS.VerifiedChains[0][0].Subject.CommonName
+}
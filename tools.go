@@ -0,0 +1,129 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "os/exec"
+  "strings"
+)
+
+var toolExecPrefix = flag.String("tool-exec-prefix", "",
+  "command line external tools are run through, e.g. 'podman exec -i " +
+  "evangelist-tools' or 'kubectl exec -i evangelist-0 -c tools --', for " +
+  "deployments where they live in a sidecar container (run locally if empty)")
+var containerTools = flag.String("container-tools", "",
+  "comma-separated tools (gs, convert, ...) run through -tool-exec-prefix; " +
+  "all of them if empty")
+
+/* Runs the external tools conversions depend on: gs, convert, jpegtran,
+ * and the like. */
+type toolRunner interface {
+  /* Returns the command that runs tool `name` with `args`, killed if `ctx`
+   * is done before it exits. */
+  command(ctx context.Context, name string, args ...string) *exec.Cmd
+
+  /* Returns an error if tool `name` can't be run. */
+  lookPath(name string) error
+}
+
+/* Runs tools from this machine's PATH. */
+type localToolRunner struct{}
+
+func (localToolRunner) command(ctx context.Context, name string,
+    args ...string) *exec.Cmd {
+  return exec.CommandContext(ctx, name, args...)
+}
+
+func (localToolRunner) lookPath(name string) error {
+  _, err := exec.LookPath(name)
+  return err
+}
+
+/* Runs tools in another container by prefixing their command lines with
+ * `prefix`, like "podman exec -i evangelist-tools", so the server's own
+ * image can be distroless. Only the tools in `tools` are run this way, or
+ * every tool if it's empty; the rest run locally. Paths are passed as is,
+ * so the container must see the scratch directory at the same path. */
+type containerToolRunner struct {
+  prefix []string
+  tools map[string]bool
+  local localToolRunner
+}
+
+/* Returns true if tool `name` runs in the container. */
+func (runner containerToolRunner) runsInContainer(name string) bool {
+  return len(runner.tools) == 0 || runner.tools[name]
+}
+
+/* Cancelling `ctx` kills the exec client, such as podman, which is
+ * expected to stop the tool with it. */
+func (runner containerToolRunner) command(ctx context.Context, name string,
+    args ...string) *exec.Cmd {
+  if !runner.runsInContainer(name) {
+    return runner.local.command(ctx, name, args...)
+  }
+
+  prefixed := append([]string{}, runner.prefix[1:]...)
+  prefixed = append(prefixed, name)
+  prefixed = append(prefixed, args...)
+  return exec.CommandContext(ctx, runner.prefix[0], prefixed...)
+}
+
+/* A tool in the container is assumed to be there as long as the exec
+ * client is; looking inside would cost a process on every check. */
+func (runner containerToolRunner) lookPath(name string) error {
+  if !runner.runsInContainer(name) { return runner.local.lookPath(name) }
+  return runner.local.lookPath(runner.prefix[0])
+}
+
+// runs every external tool; replaced in main() if -tool-exec-prefix is set
+var tools toolRunner = localToolRunner{}
+
+/* Sets up the tool runner according to -tool-exec-prefix and
+ * -container-tools, failing if the exec client isn't on the PATH. */
+func setupToolRunner() error {
+  prefix := strings.Fields(*toolExecPrefix)
+  if len(prefix) == 0 {
+    if *containerTools != "" {
+      return errors.New("-container-tools requires -tool-exec-prefix.\n")
+    }
+    return nil
+  }
+
+  runner := containerToolRunner{prefix: prefix, tools: map[string]bool{}}
+  for _, name := range strings.Split(*containerTools, ",") {
+    name = strings.TrimSpace(name)
+    if name != "" { runner.tools[name] = true }
+  }
+
+  err := runner.local.lookPath(prefix[0])
+  if err != nil {
+    return errors.New(fmt.Sprintf("The -tool-exec-prefix command '%s' " +
+      "isn't on the PATH.\n", prefix[0]))
+  }
+
+  tools = runner
+  logger.Info("Running tools through exec prefix", "prefix",
+    *toolExecPrefix, "tools", *containerTools)
+  return nil
+}
+
+/* Returns the command that runs tool `name` with `args`, through the tool
+ * runner. */
+func toolCommand(name string, args ...string) *exec.Cmd {
+  return tools.command(context.Background(), name, args...)
+}
+
+/* Does what toolCommand does, killing the tool if `ctx` is done before it
+ * exits. */
+func toolCommandContext(ctx context.Context, name string,
+    args ...string) *exec.Cmd {
+  return tools.command(ctx, name, args...)
+}
+
+/* Returns an error if tool `name` can't be run. */
+func lookTool(name string) error {
+  return tools.lookPath(name)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+  _ "embed"
+  "net/http"
+)
+
+// the page served at /ui
+//go:embed ui.html
+var uiPage []byte
+
+/* Handles GET /ui: a page for support staff to start conversions and follow
+ * jobs from a browser. It calls the same endpoints as other clients, so it
+ * needs the convert role; browsers prompt for the API key and send it as the
+ * Basic password. */
+func serveUI(writer http.ResponseWriter, request *http.Request) {
+  if request.Method != "GET" {
+    http.Error(writer, "Only GET requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+  writer.Header().Set("Cache-Control", "no-store")
+  writer.Write(uiPage)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "mime"
+  "mime/multipart"
+  "net/http"
+  "os"
+  "path"
+  "regexp"
+)
+
+// multipart field a PDF can be uploaded in, instead of naming one in S3
+const UPLOAD_FIELD = "pdf"
+
+// largest multipart request body accepted, uploaded PDF and all
+const MAX_UPLOAD_BYTES = 512 * 1024 * 1024
+
+// characters kept in the names of documents clients send; others become '_'
+var UNSAFE_FILENAME_CHARS = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+/* Parses the multipart form of `request`, for the job with ID `jobID`,
+ * streaming the PDF uploaded in its `pdf` field, if any, straight to
+ * scratch. Unlike ParseMultipartForm, this never spills to the system's
+ * temporary directory, so uploads get the same treatment as the rest of
+ * scratch, and the whole body is capped at MAX_UPLOAD_BYTES. Its other
+ * fields are added to the request's form, and the upload is recorded in its
+ * multipart form for parseUploadedPDF. Does nothing if the form was already
+ * parsed, and returns http.ErrNotMultipart, with the query parsed, if the
+ * request isn't multipart. */
+func parseUploadForm(writer http.ResponseWriter, request *http.Request,
+    jobID string) error {
+  err := request.ParseForm()
+  if err != nil { return err }
+  if request.MultipartForm != nil { return nil }
+
+  mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+  if mediaType != "multipart/form-data" { return http.ErrNotMultipart }
+
+  request.Body = http.MaxBytesReader(writer, request.Body, MAX_UPLOAD_BYTES)
+  reader, err := request.MultipartReader()
+  if err != nil { return err }
+
+  if request.PostForm == nil {
+    request.PostForm = map[string][]string{}
+  }
+  form := &multipart.Form{Value: map[string][]string{},
+    File: map[string][]*multipart.FileHeader{}}
+  valueBytes := 0
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF { break }
+    if err != nil { return uploadError(err) }
+
+    name := part.FormName()
+    if part.FileName() == "" {
+      value, err := ioutil.ReadAll(io.LimitReader(part,
+        int64(MAX_MULTIPART_FORM_BYTES - valueBytes + 1)))
+      if err != nil { return uploadError(err) }
+
+      valueBytes = valueBytes + len(value)
+      if valueBytes > MAX_MULTIPART_FORM_BYTES {
+        return errors.New(fmt.Sprintf("The form's fields must be at most " +
+          "%d bytes in all.\n", MAX_MULTIPART_FORM_BYTES))
+      }
+      form.Value[name] = append(form.Value[name], string(value))
+      request.Form[name] = append(request.Form[name], string(value))
+      request.PostForm[name] = append(request.PostForm[name], string(value))
+      continue
+    }
+
+    // files in other fields are ignored, as they always were
+    if name != UPLOAD_FIELD { continue }
+    if len(form.File[UPLOAD_FIELD]) > 0 {
+      return errors.New("Must upload at most one PDF in the 'pdf' " +
+        "field.\n")
+    }
+
+    size, err := saveUploadedPart(part, uploadedPDFPath(jobID))
+    if err != nil { return uploadError(err) }
+    form.File[UPLOAD_FIELD] = []*multipart.FileHeader{{
+      Filename: part.FileName(), Header: part.Header, Size: size}}
+  }
+
+  request.MultipartForm = form
+  return nil
+}
+
+/* Returns `err`, from reading an upload, explained if it's because the
+ * request was too large. */
+func uploadError(err error) error {
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    return errors.New(fmt.Sprintf("Uploads must be at most %d bytes.\n",
+      MAX_UPLOAD_BYTES))
+  }
+  return err
+}
+
+/* Saves the uploaded file `part` to `path`, after checking that it's a
+ * format we convert. Returns its size. */
+func saveUploadedPart(part io.Reader, path string) (int64, error) {
+  head := make([]byte, SOURCE_HEADER_BYTES)
+  n, err := io.ReadFull(part, head)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return 0, err
+  }
+  if sourceFormat(head[:n]) == "" {
+    return 0, errors.New("The uploaded 'pdf' isn't a PDF, PostScript, EPS, " +
+      "DJVU, TIFF, JPEG, or PNG file.\n")
+  }
+
+  file, err := os.Create(path)
+  if err != nil { return 0, err }
+  defer file.Close()
+
+  return io.Copy(file, io.MultiReader(bytes.NewReader(head[:n]), part))
+}
+
+/* Returns the PDF uploaded in the `pdf` field of `request`, which must have
+ * had its multipart form parsed, or nil if there isn't one. */
+func parseUploadedPDF(request *http.Request) (*multipart.FileHeader, error) {
+  if request.MultipartForm == nil { return nil, nil }
+
+  files := request.MultipartForm.File[UPLOAD_FIELD]
+  if len(files) == 0 { return nil, nil }
+
+  if len(files) > 1 {
+    return nil, errors.New("Must upload at most one PDF in the 'pdf' " +
+      "field.\n")
+  }
+  return files[0], nil
+}
+
+/* Returns the base name of `filename`, from a client, with characters that
+ * aren't safe in S3 keys replaced, or "document" if nothing's left. */
+func sanitizeFilename(filename string) string {
+  filename = UNSAFE_FILENAME_CHARS.ReplaceAllString(path.Base(filename), "_")
+  if filename == "" || filename == "." || filename == "_" ||
+      filename == ".." {
+    return "document"
+  }
+  return filename
+}
+
+/* Returns the scratch path of the PDF uploaded for the job with the given
+ * ID. */
+func uploadedPDFPath(jobID string) string {
+  return scratchPath(jobID + ".upload.pdf")
+}
+
+/* Returns `params` pointing at the PDF uploaded with the request they were
+ * parsed from, if any, which parseUploadForm saved to scratch for `job`. */
+func useUploadedPDF(job *job, params conversionParams) conversionParams {
+  if params.UploadedPDF != nil {
+    params.UploadedPDFPath = uploadedPDFPath(job.id)
+  }
+  return params
+}
+
+/* Returns where the PDF of `request` came from, for the audit log: its S3
+ * key, or "upload:" and the name of the uploaded file. */
+func requestSource(request *http.Request) string {
+  upload, _ := parseUploadedPDF(request)
+  if upload != nil {
+    return "upload:" + upload.Filename
+  }
+  return request.Form.Get("s3PDFPath")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/url"
+  "strings"
+  "launchpad.net/goamz/s3"
+)
+
+// longest Cache-Control or Content-Disposition a request may set
+const MAX_UPLOAD_HEADER_LENGTH = 1024
+
+// ACLs renditions may be uploaded with, by the name clients select them with
+var RENDITION_ACLS = map[string]s3.ACL{
+  "private": s3.Private,
+  "public-read": s3.PublicRead,
+  "bucket-owner": s3.BucketOwnerFull,
+}
+
+/* Returns the value of the header in `key` of `form`, or "" if it's absent.
+ * It must fit on one line in an HTTP header. */
+func optionalHeaderValue(form url.Values, key string) (string, error) {
+  value, err := optionalFormValue(form, key)
+  if err != nil || value == "" { return value, err }
+
+  if len(value) > MAX_UPLOAD_HEADER_LENGTH ||
+      strings.ContainsAny(value, "\r\n\x00") {
+    return "", errors.New(fmt.Sprintf("The '%s' key must be a single line " +
+      "of at most %d characters.\n", key, MAX_UPLOAD_HEADER_LENGTH))
+  }
+  return value, nil
+}
+
+/* Parses the optional `acl`, `cacheControl`, and `contentDisposition` keys
+ * of `form` into `params`. They're applied to every rendition uploaded. */
+func parseUploadOptions(form url.Values, params *conversionParams) error {
+  acl, err := optionalFormValue(form, "acl")
+  if err != nil { return err }
+
+  if _, ok := RENDITION_ACLS[acl]; acl != "" && !ok {
+    return errors.New("The 'acl' key must be 'private', 'public-read', or " +
+      "'bucket-owner'.\n")
+  }
+  params.ACL = acl
+
+  params.CacheControl, err = optionalHeaderValue(form, "cacheControl")
+  if err != nil { return err }
+
+  params.ContentDisposition, err = optionalHeaderValue(form,
+    "contentDisposition")
+  if err != nil { return err }
+
+  disposition := strings.ToLower(params.ContentDisposition)
+  if disposition != "" && !strings.HasPrefix(disposition, "inline") &&
+      !strings.HasPrefix(disposition, "attachment") {
+    return errors.New("The 'contentDisposition' key must start with " +
+      "'inline' or 'attachment'.\n")
+  }
+  return nil
+}
+
+/* Returns the ACL renditions converted with `params` are uploaded with: the
+ * requested one, or public unless presigned URLs were requested. */
+func renditionACL(params conversionParams) s3.ACL {
+  if params.ACL != "" { return RENDITION_ACLS[params.ACL] }
+  if params.Presign { return s3.Private }
+  return s3.PublicRead
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/sha1"
+  "encoding/base64"
+  "errors"
+  "flag"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var uploadURLPrefix = flag.String("upload-url-prefix", "",
+  "S3 prefix under which /uploads mints presigned PUT URLs for source " +
+  "documents, one subdirectory per tenant (disabled if empty)")
+var uploadURLExpiry = flag.Duration("upload-url-expiry", 15 * time.Minute,
+  "how long presigned upload URLs stay valid")
+
+// content types sources may be uploaded with, as checked by the signature
+var UPLOAD_CONTENT_TYPES = map[string]bool{
+  "application/pdf": true,
+  "application/postscript": true,
+  "image/vnd.djvu": true,
+  "image/tiff": true,
+  "image/jpeg": true,
+  "image/png": true,
+}
+
+/* A presigned URL a client can PUT a source document to, and how to
+ * convert it once uploaded. */
+type uploadURLResponse struct {
+  URL string `json:"url"`
+  Method string `json:"method"`
+  Headers map[string]string `json:"headers"`
+  S3PDFPath string `json:"s3PDFPath"`
+  ExpiresAt string `json:"expiresAt"`
+}
+
+/* Validates -upload-url-expiry. */
+func validateUploadURLExpiry() error {
+  if *uploadURLExpiry <= 0 ||
+      *uploadURLExpiry > MAX_PRESIGN_EXPIRY_SECONDS * time.Second {
+    return errors.New(fmt.Sprintf("-upload-url-expiry must be positive " +
+      "and at most %s.\n", MAX_PRESIGN_EXPIRY_SECONDS * time.Second))
+  }
+  return nil
+}
+
+/* Returns a URL anyone may PUT an object with `contentType` to at `key` in
+ * `bucket` until `expiresAt`, signed with S3's query string
+ * authentication, as goamz only presigns GETs. */
+func presignPut(bucket *s3.Bucket, key string, contentType string,
+    expiresAt time.Time) string {
+  expires := strconv.FormatInt(expiresAt.Unix(), 10)
+  stringToSign := "PUT\n\n" + contentType + "\n" + expires + "\n/" +
+    bucket.Name + "/" + key
+
+  mac := hmac.New(sha1.New, []byte(bucket.SecretKey))
+  mac.Write([]byte(stringToSign))
+
+  query := url.Values{
+    "AWSAccessKeyId": {bucket.AccessKey},
+    "Expires": {expires},
+    "Signature": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+  }
+  return bucket.URL(key) + "?" + query.Encode()
+}
+
+/* Handles POST /uploads, which mints a presigned URL for a client, e.g. a
+ * browser, to upload a source document straight to S3, keeping large
+ * uploads off the server. The document is named by `filename` and uploaded
+ * with `contentType` (application/pdf by default) under the tenant's own
+ * prefix, in the bucket chosen by `s3Bucket` and `s3Region` if given. The
+ * response gives the key to convert it with as `s3PDFPath`. */
+func serveUploadURLs(writer http.ResponseWriter, request *http.Request,
+    bucketName string, regionName string) {
+  if *uploadURLPrefix == "" {
+    http.Error(writer, "Upload URLs aren't enabled.\n", http.StatusNotFound)
+    return
+  }
+
+  if request.Method != "POST" {
+    http.Error(writer, "Only POST requests are supported.\n",
+      http.StatusMethodNotAllowed)
+    return
+  }
+
+  if !requireRole(writer, request, ROLE_CONVERT) { return }
+
+  err := request.ParseForm()
+  if handleError(err, writer) { return }
+
+  filename, err := requireFormValue(request.Form, "filename",
+    "the name of the document")
+  if err == nil {
+    filename = sanitizeFilename(filename)
+    if !hasSourceOrImageExtension(filename) {
+      err = errors.New("The 'filename' key must name a PDF, PostScript, " +
+        "EPS, DJVU, TIFF, JPEG, or PNG file.\n")
+    }
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  contentType, err := optionalFormValue(request.Form, "contentType")
+  if err == nil && contentType == "" {
+    contentType = "application/pdf"
+  } else if err == nil && !UPLOAD_CONTENT_TYPES[contentType] {
+    err = errors.New(fmt.Sprintf("Sources can't be uploaded as '%s'.\n",
+      contentType))
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  bucket, err := connectToRequestBucket(request.Form, bucketName, regionName)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  // each tenant uploads under its own prefix, and each upload gets its own
+  // directory so names never collide
+  key := fmt.Sprintf("%s%s/%s/%s", *uploadURLPrefix,
+    sanitizeFilename(tenantName(request)), newID(), filename)
+  expiresAt := time.Now().Add(*uploadURLExpiry).Truncate(time.Second)
+
+  logger.Info("Minted upload URL", "request", requestID(request),
+    "tenant", tenantName(request), "key", key)
+  writeJSON(writer, http.StatusOK, uploadURLResponse{
+    URL: presignPut(bucket, key, contentType, expiresAt),
+    Method: "PUT",
+    Headers: map[string]string{"Content-Type": contentType},
+    S3PDFPath: key,
+    ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+  })
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+  "bufio"
+  "encoding/binary"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "strings"
+  "time"
+)
+
+var clamdAddress = flag.String("clamd-address", "",
+  "clamd socket every source is scanned with before it's processed: a " +
+  "path for a Unix socket, or host:port for TCP (no scanning if empty)")
+var clamdTimeout = flag.Duration("clamd-timeout", 2 * time.Minute,
+  "longest a clamd scan of one source may take")
+
+// size of the chunks a source is streamed to clamd in
+const CLAMD_CHUNK_BYTES = 64 * 1024
+
+// the error code of a job whose source was rejected as infected
+const ERROR_CODE_INFECTED = "infected"
+
+/* The error a conversion fails with when clamd finds `signature` in its
+ * source. Retrying won't help, so it's a permanent error. */
+type infectedSourceError struct {
+  signature string
+}
+
+func (err infectedSourceError) Error() string {
+  return fmt.Sprintf("The source is infected with %s.\n", err.signature)
+}
+
+/* Returns the code clients can tell `err` apart by, or "" if it has none. */
+func errorCode(err error) string {
+  if _, ok := err.(infectedSourceError); ok { return ERROR_CODE_INFECTED }
+  return ""
+}
+
+/* Opens a connection to clamd that times out after -clamd-timeout. */
+func dialClamd() (net.Conn, error) {
+  network := "tcp"
+  if strings.HasPrefix(*clamdAddress, "/") {
+    network = "unix"
+  }
+
+  conn, err := net.DialTimeout(network, *clamdAddress, *clamdTimeout)
+  if err != nil { return nil, err }
+
+  err = conn.SetDeadline(time.Now().Add(*clamdTimeout))
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  return conn, nil
+}
+
+/* Returns the null-terminated reply clamd sends on `conn`. */
+func clamdReply(conn net.Conn) (string, error) {
+  reply, err := bufio.NewReader(conn).ReadString(0)
+  if err != nil { return "", err }
+  return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+/* Returns nil if clamd answers a PING. */
+func pingClamd() error {
+  conn, err := dialClamd()
+  if err != nil { return err }
+  defer conn.Close()
+
+  _, err = conn.Write([]byte("zPING\x00"))
+  if err != nil { return err }
+
+  reply, err := clamdReply(conn)
+  if err != nil { return err }
+  if reply != "PONG" {
+    return errors.New(fmt.Sprintf("clamd answered PING with '%s'.\n", reply))
+  }
+  return nil
+}
+
+/* Streams the file at `path` to clamd with INSTREAM, and returns the name
+ * of the signature it matched, or "" if it's clean. */
+func clamdScan(path string) (string, error) {
+  file, err := os.Open(path)
+  if err != nil { return "", err }
+  defer file.Close()
+
+  conn, err := dialClamd()
+  if err != nil { return "", err }
+  defer conn.Close()
+
+  _, err = conn.Write([]byte("zINSTREAM\x00"))
+  if err != nil { return "", err }
+
+  // each chunk is preceded by its length; an empty one ends the stream
+  chunk := make([]byte, 4 + CLAMD_CHUNK_BYTES)
+  for {
+    numBytes, err := io.ReadFull(file, chunk[4:])
+    if err == io.EOF { break }
+    if err != nil && err != io.ErrUnexpectedEOF { return "", err }
+
+    binary.BigEndian.PutUint32(chunk, uint32(numBytes))
+    _, err = conn.Write(chunk[:4 + numBytes])
+    if err != nil { return "", err }
+  }
+
+  _, err = conn.Write([]byte{0, 0, 0, 0})
+  if err != nil { return "", err }
+
+  reply, err := clamdReply(conn)
+  if err != nil { return "", err }
+
+  // replies are "stream: OK", "stream: <signature> FOUND", or an error
+  result := strings.TrimPrefix(reply, "stream: ")
+  if result == "OK" { return "", nil }
+  if strings.HasSuffix(result, " FOUND") {
+    return strings.TrimSuffix(result, " FOUND"), nil
+  }
+  return "", errors.New(fmt.Sprintf("clamd couldn't scan the source: %s\n",
+    result))
+}
+
+/* Scans the source at `path` with clamd, if -clamd-address is given, before
+ * any external tool reads it. Returns an infectedSourceError if it's
+ * infected. If clamd can't be reached, the conversion fails rather than
+ * process an unscanned source. */
+func scanSource(job *job, path string) error {
+  if *clamdAddress == "" { return nil }
+
+  startTime := time.Now()
+  signature, err := clamdScan(path)
+  if err != nil { return err }
+
+  if signature != "" {
+    job.logger().Warn("Rejected infected source", "signature", signature)
+    job.recordEvent("scanned", 0, "infected with " + signature)
+    return infectedSourceError{signature}
+  }
+
+  job.recordEvent("scanned", 0, fmt.Sprintf("clean in %dms",
+    millisecondsBetween(startTime, time.Now())))
+  return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+var watchS3Prefix = flag.String("watch-s3-prefix", "",
+  "S3 prefix polled for new documents, which are converted with " +
+  "-watch-template (disabled if empty)")
+var watchDir = flag.String("watch-dir", "",
+  "local directory polled for new documents, which are converted with " +
+  "-watch-template (disabled if empty)")
+var watchTemplate = flag.String("watch-template", "",
+  "template watched documents are converted with")
+var watchInterval = flag.Duration("watch-interval", time.Minute,
+  "how often watched folders are polled")
+var watchStatePath = flag.String("watch-state", "",
+  "JSON file recording which watched documents were processed (kept only " +
+  "in memory if empty)")
+
+// tenant conversions of watched documents are attributed to
+const TENANT_WATCH = "watch"
+
+// how long a local file must go unmodified before it's converted, so files
+// still being copied in aren't picked up
+const WATCH_SETTLE_TIME = 10 * time.Second
+
+/* A document in a watched folder, identified by "s3:{key}" or
+ * "file:{path}". Its `fingerprint` changes whenever its contents do: the
+ * ETag of an object, or the size and modification time of a file. */
+type watchedDocument struct {
+  id string
+  fingerprint string
+  s3Key string
+  localPath string
+}
+
+/* A processed document: the fingerprint it had, and how its conversion
+ * went. */
+type processedDocument struct {
+  Fingerprint string `json:"fingerprint"`
+  JobID string `json:"jobId"`
+  State string `json:"state"`
+  Error string `json:"error,omitempty"`
+  ProcessedAt string `json:"processedAt"`
+}
+
+/* The documents processed from watched folders, by ID, and those being
+ * converted. */
+type watchState struct {
+  mutex sync.Mutex
+  processed map[string]processedDocument
+  converting map[string]bool
+}
+
+var watched = &watchState{processed: map[string]processedDocument{},
+  converting: map[string]bool{}}
+
+/* Checks the watch flags, which must come after templates are loaded, and
+ * loads the processed documents saved at -watch-state, if it exists. */
+func setupWatch() error {
+  if *watchS3Prefix == "" && *watchDir == "" { return nil }
+
+  if *watchTemplate == "" {
+    return errors.New("-watch-s3-prefix and -watch-dir require " +
+      "-watch-template.\n")
+  }
+  if _, ok := templates.get(*watchTemplate); !ok {
+    return errors.New(fmt.Sprintf("There's no template named '%s' for " +
+      "-watch-template.\n", *watchTemplate))
+  }
+  if *watchInterval <= 0 {
+    return errors.New("-watch-interval must be positive.\n")
+  }
+
+  if *watchDir != "" {
+    info, err := os.Stat(*watchDir)
+    if err != nil { return err }
+    if !info.IsDir() {
+      return errors.New("-watch-dir must be a directory.\n")
+    }
+  }
+
+  if *watchStatePath == "" { return nil }
+
+  data, err := ioutil.ReadFile(*watchStatePath)
+  if os.IsNotExist(err) { return nil }
+  if err != nil { return err }
+  return json.Unmarshal(data, &watched.processed)
+}
+
+/* Saves the processed documents to -watch-state, if given. Must be called
+ * with the mutex held. */
+func (state *watchState) saveLocked() error {
+  if *watchStatePath == "" { return nil }
+
+  data, err := json.MarshalIndent(state.processed, "", "  ")
+  if err != nil { return err }
+
+  temporaryPath := *watchStatePath + ".tmp"
+  err = ioutil.WriteFile(temporaryPath, data, 0600)
+  if err != nil { return err }
+  return os.Rename(temporaryPath, *watchStatePath)
+}
+
+/* Marks `document` as being converted, returning false if it already is or
+ * was processed with the same contents. */
+func (state *watchState) claim(document watchedDocument) bool {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+
+  if state.converting[document.id] { return false }
+  if state.processed[document.id].Fingerprint == document.fingerprint {
+    return false
+  }
+
+  state.converting[document.id] = true
+  return true
+}
+
+/* Records that `document` was processed as `job`, or releases it to be
+ * tried again on the next poll if `job` is nil. */
+func (state *watchState) finish(document watchedDocument, job *job) {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+
+  delete(state.converting, document.id)
+  if job == nil { return }
+
+  status := job.status()
+  state.processed[document.id] = processedDocument{
+    Fingerprint: document.fingerprint,
+    JobID: job.id,
+    State: status.State,
+    Error: status.Error,
+    ProcessedAt: time.Now().UTC().Format(time.RFC3339),
+  }
+
+  err := state.saveLocked()
+  if err != nil {
+    logger.Error("Couldn't save watch state", errorAttr(err))
+  }
+}
+
+/* Returns the conversion parameters for the watched document whose S3 key
+ * (if `inS3`) or path within -watch-dir is `source`, according to
+ * -watch-template, and the form they were parsed from. */
+func parseWatchParams(source string, inS3 bool) (conversionParams,
+    url.Values, error) {
+  form := url.Values{"template": {*watchTemplate}}
+  if inS3 {
+    form.Set("s3PDFPath", source)
+  }
+
+  template, err := applyTemplate(form, source)
+  if err != nil { return conversionParams{}, form, err }
+
+  params, err := parseConversionForm(form)
+  if err != nil { return params, form, err }
+
+  params.Template = template
+  return params, form, nil
+}
+
+/* Returns the documents under -watch-s3-prefix, in the bucket
+ * -watch-template converts in. */
+func listWatchedObjects(bucketName string,
+    regionName string) ([]watchedDocument, error) {
+  // the template may choose another bucket, which is the one to watch
+  params, _, err := parseWatchParams(*watchS3Prefix + "example.pdf", true)
+  if err != nil { return nil, err }
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  if err != nil { return nil, err }
+
+  documents := []watchedDocument{}
+  marker := ""
+  for {
+    var list *s3.ListResp
+    err = withS3Retries(logger, S3_OP_LIST, func() error {
+      var err error
+      list, err = bucket.List(*watchS3Prefix, "", marker, MAX_LIST_KEYS)
+      return err
+    })
+    if err != nil { return nil, err }
+
+    for _, key := range list.Contents {
+      if !hasSourceExtension(key.Key) { continue }
+      documents = append(documents, watchedDocument{id: "s3:" + key.Key,
+        fingerprint: key.ETag, s3Key: key.Key})
+    }
+
+    if !list.IsTruncated || len(list.Contents) == 0 { break }
+    marker = list.Contents[len(list.Contents) - 1].Key
+  }
+  return documents, nil
+}
+
+/* Returns the documents in -watch-dir and its subdirectories that have
+ * settled. */
+func listWatchedFiles() ([]watchedDocument, error) {
+  documents := []watchedDocument{}
+  err := filepath.Walk(*watchDir, func(filePath string, info os.FileInfo,
+      err error) error {
+    if err != nil { return err }
+    if !info.Mode().IsRegular() || !hasSourceExtension(filePath) ||
+        time.Since(info.ModTime()) < WATCH_SETTLE_TIME {
+      return nil
+    }
+
+    documents = append(documents, watchedDocument{id: "file:" + filePath,
+      fingerprint: fmt.Sprintf("%d:%d", info.Size(),
+        info.ModTime().UnixNano()),
+      localPath: filePath})
+    return nil
+  })
+  return documents, err
+}
+
+/* Copies the watched file at `filePath` to scratch for `job`, as if it had
+ * been uploaded. */
+func copyWatchedFile(job *job, filePath string) (string, error) {
+  source, err := os.Open(filePath)
+  if err != nil { return "", err }
+  defer source.Close()
+
+  scratchPath := uploadedPDFPath(job.id)
+  destination, err := os.Create(scratchPath)
+  if err != nil { return "", err }
+  defer destination.Close()
+
+  _, err = io.Copy(destination, source)
+  return scratchPath, err
+}
+
+/* Queues the conversion of `document` with -watch-template, returning the
+ * job converting it. */
+func queueWatchedConversion(document watchedDocument, bucketName string,
+    regionName string) (*job, error) {
+  // files are named by their path within the directory, so documents with
+  // the same name in different subdirectories get different outputs
+  source := document.s3Key
+  if document.localPath != "" {
+    relativePath, err := filepath.Rel(*watchDir, document.localPath)
+    if err != nil { return nil, err }
+    source = filepath.ToSlash(relativePath)
+  }
+
+  params, form, err := parseWatchParams(source, document.s3Key != "")
+  if err != nil { return nil, err }
+
+  bucket, err := connectToParamsBucket(params, bucketName, regionName)
+  if err != nil { return nil, err }
+
+  id := newID()
+  job := newJob(newID(), TENANT_WATCH, id)
+
+  if document.localPath != "" {
+    params.UploadedPDFPath, err = copyWatchedFile(job, document.localPath)
+    if err != nil {
+      job.finish(err)
+      cleanupScratch(job.id)
+      return nil, err
+    }
+
+    // the audit log names the file the document came from
+    form.Set("s3PDFPath", "file:" + document.localPath)
+  }
+
+  // watched conversions have no request, so the audit log gets one that
+  // carries their form and request ID
+  auditRequest := &http.Request{Header: http.Header{REQUEST_ID_HEADER: {id}},
+    Form: form}
+
+  err = queueAsyncJob(asyncTask{job, bucket, params, auditRequest,
+    time.Now()})
+  if err != nil {
+    job.finish(err)
+    cleanupScratch(job.id)
+    return nil, err
+  }
+  return job, nil
+}
+
+/* Queues every new or changed document in the watched folders, recording
+ * each once its conversion finishes. */
+func pollWatchedFolders(bucketName string, regionName string) {
+  documents := []watchedDocument{}
+
+  if *watchS3Prefix != "" {
+    objects, err := listWatchedObjects(bucketName, regionName)
+    if err != nil {
+      logger.Error("Couldn't list watched prefix", "prefix", *watchS3Prefix,
+        errorAttr(err))
+    }
+    documents = append(documents, objects...)
+  }
+
+  if *watchDir != "" {
+    files, err := listWatchedFiles()
+    if err != nil {
+      logger.Error("Couldn't list watched directory", "dir", *watchDir,
+        errorAttr(err))
+    }
+    documents = append(documents, files...)
+  }
+
+  for _, document := range documents {
+    if !watched.claim(document) { continue }
+
+    job, err := queueWatchedConversion(document, bucketName, regionName)
+    if err != nil {
+      // left unprocessed, so it's tried again on the next poll
+      logger.Warn("Couldn't convert watched document", "document",
+        document.id, errorAttr(err))
+      watched.finish(document, nil)
+      continue
+    }
+
+    job.logger().Info("Converting watched document", "document",
+      document.id)
+    go func(document watchedDocument) {
+      <-job.done
+      watched.finish(document, job)
+    }(document)
+  }
+}
+
+/* Polls the watched folders every -watch-interval, if any are configured. */
+func runWatch(bucketName string, regionName string) {
+  if *watchS3Prefix == "" && *watchDir == "" { return }
+
+  logger.Info("Watching for documents", "prefix", *watchS3Prefix,
+    "dir", *watchDir, "template", *watchTemplate)
+  for {
+    pollWatchedFolders(bucketName, regionName)
+    time.Sleep(*watchInterval)
+  }
+}
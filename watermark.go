@@ -0,0 +1,274 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/draw"
+  _ "image/png"
+  "io"
+  "net/url"
+  "os"
+  "regexp"
+  "launchpad.net/goamz/s3"
+)
+
+// what watermark text may contain: enough for labels and IDs, but none of
+// the characters ImageMagick treats specially, like '%' and '@'
+var WATERMARK_TEXT_PATTERN = regexp.MustCompile(
+  `^[\p{L}\p{N} .,:;!?'"()#&+_/-]{1,100}$`)
+
+// where a watermark may go on the page, and the ImageMagick gravity for each
+var WATERMARK_POSITIONS = map[string]string{
+  "center": "Center",
+  "top": "North",
+  "bottom": "South",
+  "left": "West",
+  "right": "East",
+  "top-left": "NorthWest",
+  "top-right": "NorthEast",
+  "bottom-left": "SouthWest",
+  "bottom-right": "SouthEast",
+}
+
+// default and allowed opacity and width of a watermark, in percent
+const (
+  DEFAULT_WATERMARK_OPACITY = 30
+  DEFAULT_WATERMARK_SCALE = 50
+  MIN_WATERMARK_PERCENT = 1
+  MAX_WATERMARK_PERCENT = 100
+)
+
+// largest watermark image accepted, in megapixels
+const MAX_WATERMARK_MEGAPIXELS = 16
+
+// distance of an off-center watermark from the page's edges, in percent of
+// the page's width
+const WATERMARK_MARGIN_PERCENT = 3
+
+// point size text watermarks are drawn at before they're scaled to the page
+const WATERMARK_POINT_SIZE = 144
+
+/* Parses the watermark keys of `form` into `params`. A watermark is either
+ * the text in `watermarkText` or the PNG or JPEG at `s3WatermarkPath` in the
+ * conversion's bucket, composited onto every page before it's resized.
+ * `watermarkPosition` places it (center by default), `watermarkOpacity`
+ * sets its opacity in percent (30 by default), and `watermarkScale` its
+ * width in percent of the page's (50 by default). */
+func parseWatermarkParams(form url.Values, params *conversionParams) error {
+  var err error
+  params.WatermarkText, err = optionalFormValue(form, "watermarkText")
+  if err != nil { return err }
+
+  params.S3WatermarkPath, err = optionalFormValue(form, "s3WatermarkPath")
+  if err != nil { return err }
+
+  params.WatermarkPosition, err = optionalFormValue(form,
+    "watermarkPosition")
+  if err != nil { return err }
+
+  params.WatermarkOpacity, err = optionalBoundedInt(form, "watermarkOpacity",
+    MIN_WATERMARK_PERCENT, MAX_WATERMARK_PERCENT)
+  if err != nil { return err }
+
+  params.WatermarkScale, err = optionalBoundedInt(form, "watermarkScale",
+    MIN_WATERMARK_PERCENT, MAX_WATERMARK_PERCENT)
+  if err != nil { return err }
+
+  if params.WatermarkText == "" && params.S3WatermarkPath == "" {
+    if params.WatermarkPosition != "" || params.WatermarkOpacity != 0 ||
+        params.WatermarkScale != 0 {
+      return errors.New("The watermark keys require 'watermarkText' or " +
+        "'s3WatermarkPath'.\n")
+    }
+    return nil
+  }
+
+  if params.WatermarkText != "" && params.S3WatermarkPath != "" {
+    return errors.New("Must specify at most one of 'watermarkText' and " +
+      "'s3WatermarkPath'.\n")
+  }
+
+  if params.WatermarkText != "" &&
+      !WATERMARK_TEXT_PATTERN.MatchString(params.WatermarkText) {
+    return errors.New("The 'watermarkText' key must be 1 to 100 letters, " +
+      "digits, spaces, and the punctuation .,:;!?'\"()#&+_/-.\n")
+  }
+
+  if params.WatermarkPosition == "" { params.WatermarkPosition = "center" }
+  if _, ok := WATERMARK_POSITIONS[params.WatermarkPosition]; !ok {
+    return errors.New("The 'watermarkPosition' key must be 'center', " +
+      "'top', 'bottom', 'left', 'right', 'top-left', 'top-right', " +
+      "'bottom-left', or 'bottom-right'.\n")
+  }
+
+  if params.WatermarkOpacity == 0 {
+    params.WatermarkOpacity = DEFAULT_WATERMARK_OPACITY
+  }
+  if params.WatermarkScale == 0 {
+    params.WatermarkScale = DEFAULT_WATERMARK_SCALE
+  }
+  return nil
+}
+
+/* Returns true if `params` asks for a watermark. */
+func hasWatermark(params conversionParams) bool {
+  return params.WatermarkText != "" || params.S3WatermarkPath != ""
+}
+
+/* Prepares the watermark `params` asks for, if any, as an image in `job`'s
+ * scratch space, and returns `params` with its path. Text is drawn by
+ * ImageMagick, so text watermarks need it; images are downloaded from
+ * `bucket`, once `job`'s tenant gets a download slot. */
+func fetchWatermark(job *job, bucket *s3.Bucket,
+    params conversionParams) (conversionParams, error) {
+  if !hasWatermark(params) { return params, nil }
+
+  watermarkPath := scratchPath(job.id + "-watermark.png")
+  if params.WatermarkText != "" {
+    if !hasExternalResizer() {
+      return params, errors.New("Text watermarks can't be drawn while " +
+        "ImageMagick is unavailable.\n")
+    }
+
+    cmd := toolCommand("convert", "-background", "none", "-fill", "black",
+      "-pointsize", fmt.Sprintf("%d", WATERMARK_POINT_SIZE),
+      "label:" + params.WatermarkText, watermarkPath)
+    err := runTool(cmd)
+    if err != nil { return params, err }
+
+    params.WatermarkLocalPath = watermarkPath
+    return params, nil
+  }
+
+  err := downloadPool.run(job.tenant, func() error {
+    return withS3Retries(job.logger(), S3_OP_DOWNLOAD, func() error {
+      reader, err := bucket.GetReader(params.S3WatermarkPath)
+      if err != nil { return err }
+      defer reader.Close()
+
+      file, err := os.Create(watermarkPath)
+      if err != nil { return err }
+
+      _, err = io.Copy(file, reader)
+      closeErr := file.Close()
+      if err != nil { return err }
+      return closeErr
+    })
+  })
+  if err != nil { return params, err }
+
+  err = validateWatermarkImage(watermarkPath)
+  if err != nil { return params, err }
+
+  params.WatermarkLocalPath = watermarkPath
+  return params, nil
+}
+
+/* Returns an error unless the file at `path` is a PNG or JPEG of at most
+ * MAX_WATERMARK_MEGAPIXELS megapixels. */
+func validateWatermarkImage(path string) error {
+  file, err := os.Open(path)
+  if err != nil { return err }
+  defer file.Close()
+
+  config, format, err := image.DecodeConfig(file)
+  if err != nil || (format != "png" && format != "jpeg") {
+    return errors.New("The watermark at 's3WatermarkPath' must be a PNG or " +
+      "JPEG.\n")
+  }
+
+  if config.Width * config.Height > MAX_WATERMARK_MEGAPIXELS * 1000000 {
+    return errors.New(fmt.Sprintf("The watermark at 's3WatermarkPath' may " +
+      "be at most %d megapixels.\n", MAX_WATERMARK_MEGAPIXELS))
+  }
+  return nil
+}
+
+/* Composites the watermark `params` asks for onto the JPEG at `jpegPath`,
+ * if there is one, re-encoding it at the page's quality. Falls back to
+ * compositing in process if ImageMagick is missing. */
+func applyWatermark(params conversionParams, jpegPath string) error {
+  if params.WatermarkLocalPath == "" { return nil }
+
+  page, err := jpegDimensions(jpegPath)
+  if err != nil { return err }
+
+  width := maxInt(page.Width * params.WatermarkScale / 100, 1)
+  margin := page.Width * WATERMARK_MARGIN_PERCENT / 100
+  if params.WatermarkPosition == "center" { margin = 0 }
+
+  if !hasExternalResizer() {
+    return applyWatermarkInProcess(params, jpegPath, width, margin)
+  }
+
+  args := []string{jpegPath, "(", params.WatermarkLocalPath, "-resize",
+    fmt.Sprintf("%dx", width), ")",
+    "-gravity", WATERMARK_POSITIONS[params.WatermarkPosition],
+    "-geometry", fmt.Sprintf("+%d+%d", margin, margin),
+    "-compose", "dissolve",
+    "-define", fmt.Sprintf("compose:args=%d", params.WatermarkOpacity),
+    "-composite"}
+  if params.Grayscale {
+    args = append(args, "-colorspace", "Gray")
+  }
+  args = append(args, "-quality", fmt.Sprintf("%d", renderQuality(params)),
+    jpegPath)
+  return runTool(toolCommand("convert", args...))
+}
+
+/* Does what applyWatermark does, without ImageMagick, drawing the watermark
+ * `width` pixels wide, `margin` pixels from the page's edges. */
+func applyWatermarkInProcess(params conversionParams, jpegPath string,
+    width int, margin int) error {
+  page, err := readRGBAJPEG(jpegPath)
+  if err != nil { return err }
+
+  file, err := os.Open(params.WatermarkLocalPath)
+  if err != nil { return err }
+  decoded, _, err := image.Decode(file)
+  file.Close()
+  if err != nil { return err }
+
+  bounds := decoded.Bounds()
+  watermark := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(watermark, watermark.Bounds(), decoded, bounds.Min, draw.Src)
+  height := maxInt(bounds.Dy() * width / bounds.Dx(), 1)
+  scaled := scaleImage(watermark, width, height)
+
+  // place it like ImageMagick's gravity would
+  pageWidth, pageHeight := page.Bounds().Dx(), page.Bounds().Dy()
+  x, y := (pageWidth - width) / 2, (pageHeight - height) / 2
+  switch WATERMARK_POSITIONS[params.WatermarkPosition] {
+  case "North", "NorthWest", "NorthEast":
+    y = margin
+  case "South", "SouthWest", "SouthEast":
+    y = pageHeight - height - margin
+  }
+  switch WATERMARK_POSITIONS[params.WatermarkPosition] {
+  case "West", "NorthWest", "SouthWest":
+    x = margin
+  case "East", "NorthEast", "SouthEast":
+    x = pageWidth - width - margin
+  }
+
+  opacity := image.NewUniform(color.Alpha{
+    uint8(params.WatermarkOpacity * 255 / 100)})
+  draw.DrawMask(page, image.Rect(x, y, x + width, y + height), scaled,
+    image.Point{}, opacity, image.Point{}, draw.Over)
+
+  var output image.Image = page
+  if params.Grayscale {
+    gray := image.NewGray(page.Bounds())
+    draw.Draw(gray, gray.Bounds(), page, image.Point{}, draw.Src)
+    output = gray
+  }
+  return writeJPEG(jpegPath, output)
+}
+
+/* Returns the larger of `a` and `b`. */
+func maxInt(a int, b int) int {
+  if a > b { return a }
+  return b
+}
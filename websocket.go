@@ -0,0 +1,219 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "strings"
+  "sync"
+)
+
+// appended to a client's key to prove the server speaks WebSocket (RFC 6455)
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+  WS_OP_CONTINUATION = 0x0
+  WS_OP_TEXT = 0x1
+  WS_OP_BINARY = 0x2
+  WS_OP_CLOSE = 0x8
+  WS_OP_PING = 0x9
+  WS_OP_PONG = 0xA
+)
+
+// largest payload of a control frame
+const MAX_WS_CONTROL_BYTES = 125
+
+/* The server end of a WebSocket connection. Only one goroutine may read
+ * messages at a time, but any may write them. */
+type webSocket struct {
+  conn net.Conn
+  reader *bufio.Reader
+  writeMutex sync.Mutex
+  maxMessageBytes int64
+}
+
+/* Returns true if the comma-separated header `value` contains `token`,
+ * ignoring case. */
+func headerHasToken(value string, token string) bool {
+  for _, part := range strings.Split(value, ",") {
+    if strings.EqualFold(strings.TrimSpace(part), token) { return true }
+  }
+  return false
+}
+
+/* Upgrades `request` to a WebSocket connection, whose messages may be at
+ * most `maxMessageBytes` long. If it isn't a valid WebSocket handshake,
+ * responds with 400 and returns an error. */
+func upgradeWebSocket(writer http.ResponseWriter, request *http.Request,
+    maxMessageBytes int64) (*webSocket, error) {
+  key := request.Header.Get("Sec-WebSocket-Key")
+  decodedKey, err := base64.StdEncoding.DecodeString(key)
+
+  if request.Method != "GET" ||
+      !headerHasToken(request.Header.Get("Connection"), "upgrade") ||
+      !headerHasToken(request.Header.Get("Upgrade"), "websocket") ||
+      request.Header.Get("Sec-WebSocket-Version") != "13" ||
+      err != nil || len(decodedKey) != 16 {
+    err = errors.New("Must connect with a WebSocket (version 13) " +
+      "handshake.\n")
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return nil, err
+  }
+
+  conn, buffered, err := http.NewResponseController(writer).Hijack()
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusInternalServerError)
+    return nil, err
+  }
+
+  digest := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+  _, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n" +
+    "Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+    "Sec-WebSocket-Accept: %s\r\n%s: %s\r\n\r\n",
+    base64.StdEncoding.EncodeToString(digest[:]), REQUEST_ID_HEADER,
+    requestID(request))
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  return &webSocket{conn: conn, reader: buffered.Reader,
+    maxMessageBytes: maxMessageBytes}, nil
+}
+
+/* Reads the next frame from the client, returning whether it's the last of
+ * its message, its opcode, and its unmasked payload. At most `limit` bytes
+ * of payload are accepted. */
+func (socket *webSocket) readFrame(limit int64) (bool, int, []byte,
+    error) {
+  header := make([]byte, 2)
+  _, err := io.ReadFull(socket.reader, header)
+  if err != nil { return false, 0, nil, err }
+
+  final := header[0] & 0x80 != 0
+  opcode := int(header[0] & 0x0F)
+  if header[0] & 0x70 != 0 {
+    return false, 0, nil, errors.New("WebSocket frame uses reserved bits.\n")
+  }
+
+  // clients must mask every frame they send
+  if header[1] & 0x80 == 0 {
+    return false, 0, nil, errors.New("WebSocket frame isn't masked.\n")
+  }
+
+  length := int64(header[1] & 0x7F)
+  if length == 126 {
+    extended := make([]byte, 2)
+    _, err = io.ReadFull(socket.reader, extended)
+    if err != nil { return false, 0, nil, err }
+    length = int64(binary.BigEndian.Uint16(extended))
+  } else if length == 127 {
+    extended := make([]byte, 8)
+    _, err = io.ReadFull(socket.reader, extended)
+    if err != nil { return false, 0, nil, err }
+    length = int64(binary.BigEndian.Uint64(extended) & (1 << 63 - 1))
+  }
+
+  if length > limit {
+    return false, 0, nil, errors.New(fmt.Sprintf("WebSocket message is " +
+      "longer than %d bytes.\n", limit))
+  }
+
+  mask := make([]byte, 4)
+  _, err = io.ReadFull(socket.reader, mask)
+  if err != nil { return false, 0, nil, err }
+
+  payload := make([]byte, length)
+  _, err = io.ReadFull(socket.reader, payload)
+  if err != nil { return false, 0, nil, err }
+
+  for i := range payload {
+    payload[i] ^= mask[i % 4]
+  }
+  return final, opcode, payload, nil
+}
+
+/* Reads the next text or binary message from the client, returning its
+ * opcode and payload. Pings are answered along the way. Returns io.EOF once
+ * the client closes the connection. */
+func (socket *webSocket) readMessage() (int, []byte, error) {
+  opcode := -1
+  message := []byte{}
+
+  for {
+    final, frameOpcode, payload, err := socket.readFrame(
+      socket.maxMessageBytes - int64(len(message)))
+    if err != nil { return 0, nil, err }
+
+    switch frameOpcode {
+    case WS_OP_PING, WS_OP_PONG, WS_OP_CLOSE:
+      if !final || len(payload) > MAX_WS_CONTROL_BYTES {
+        return 0, nil, errors.New("WebSocket control frame is invalid.\n")
+      }
+
+      if frameOpcode == WS_OP_PING {
+        err = socket.writeMessage(WS_OP_PONG, payload)
+        if err != nil { return 0, nil, err }
+      } else if frameOpcode == WS_OP_CLOSE {
+        socket.writeMessage(WS_OP_CLOSE, payload)
+        return 0, nil, io.EOF
+      }
+      continue
+
+    case WS_OP_TEXT, WS_OP_BINARY:
+      if opcode != -1 {
+        return 0, nil, errors.New("WebSocket message was interrupted.\n")
+      }
+      opcode = frameOpcode
+
+    case WS_OP_CONTINUATION:
+      if opcode == -1 {
+        return 0, nil, errors.New("WebSocket message has no start.\n")
+      }
+
+    default:
+      return 0, nil, errors.New(fmt.Sprintf("Unknown WebSocket opcode " +
+        "%d.\n", frameOpcode))
+    }
+
+    message = append(message, payload...)
+    if final { return opcode, message, nil }
+  }
+}
+
+/* Sends `payload` to the client as a single, unmasked frame with the given
+ * opcode. */
+func (socket *webSocket) writeMessage(opcode int, payload []byte) error {
+  header := []byte{0x80 | byte(opcode)}
+  length := len(payload)
+
+  if length < 126 {
+    header = append(header, byte(length))
+  } else if length <= 0xFFFF {
+    header = append(header, 126)
+    header = binary.BigEndian.AppendUint16(header, uint16(length))
+  } else {
+    header = append(header, 127)
+    header = binary.BigEndian.AppendUint64(header, uint64(length))
+  }
+
+  socket.writeMutex.Lock()
+  defer socket.writeMutex.Unlock()
+
+  _, err := socket.conn.Write(append(header, payload...))
+  return err
+}
+
+/* Says goodbye to the client and closes the connection. */
+func (socket *webSocket) close() {
+  // status 1000: normal closure
+  socket.writeMessage(WS_OP_CLOSE, []byte{0x03, 0xE8})
+  socket.conn.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "net/url"
+  "runtime"
+)
+
+var convertWorkers = flag.Int("convert-workers", runtime.NumCPU(),
+  "workers converting each PDF's pages, and the most a request may ask for")
+var uploadWorkers = flag.Int("upload-workers", 10,
+  "workers uploading each PDF's JPEGs, and the most a request may ask for")
+
+/* Validates -convert-workers and -upload-workers. */
+func validateWorkerCounts() error {
+  if *convertWorkers < 1 {
+    return errors.New("-convert-workers must be at least 1.\n")
+  }
+  if *uploadWorkers < 1 {
+    return errors.New("-upload-workers must be at least 1.\n")
+  }
+  return nil
+}
+
+/* Parses the `convertWorkers` and `uploadWorkers` keys of `form` into
+ * `params`. Each may lower its count for the request, down to 1, but not
+ * raise it past the server's. */
+func parseWorkerCounts(form url.Values, params *conversionParams) error {
+  var err error
+  params.ConvertWorkers, err = optionalBoundedInt(form, "convertWorkers", 1,
+    tunedInt(convertWorkers))
+  if err != nil { return err }
+
+  params.UploadWorkers, err = optionalBoundedInt(form, "uploadWorkers", 1,
+    tunedInt(uploadWorkers))
+  return err
+}
+
+/* Returns the number of workers to convert with under `params`. Counts
+ * from older manifests may exceed the server's, so they're capped anew. */
+func numConvertWorkers(params conversionParams) int {
+  workers := tunedInt(convertWorkers)
+  if params.ConvertWorkers > 0 && params.ConvertWorkers < workers {
+    return params.ConvertWorkers
+  }
+  return workers
+}
+
+/* Returns the number of workers to upload with under `params`, capped like
+ * numConvertWorkers. */
+func numUploadWorkers(params conversionParams) int {
+  workers := tunedInt(uploadWorkers)
+  if params.UploadWorkers > 0 && params.UploadWorkers < workers {
+    return params.UploadWorkers
+  }
+  return workers
+}